@@ -0,0 +1,453 @@
+package mandodb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chenjiandongx/logger"
+
+	"github.com/chenjiandongx/mandodb/pkg/promql"
+)
+
+// Prometheus HTTP API 的兼容实现 可以直接作为 Grafana 的 Prometheus 数据源使用
+// 接口定义参见 https://prometheus.io/docs/prometheus/latest/querying/api/
+
+const (
+	apiStatusSuccess = "success"
+	apiStatusError   = "error"
+
+	apiErrorBadData   = "bad_data"
+	apiErrorExecution = "execution"
+	apiErrorTimeout   = "timeout"
+	apiErrorCanceled  = "canceled"
+)
+
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type apiError struct {
+	typ string
+	err error
+}
+
+func (e *apiError) code() int {
+	switch e.typ {
+	case apiErrorBadData:
+		return http.StatusBadRequest
+	case apiErrorTimeout, apiErrorCanceled:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusUnprocessableEntity
+}
+
+type apiFunc func(r *http.Request) (interface{}, *apiError)
+
+// APIHandler 返回兼容 Prometheus HTTP API 的 http.Handler
+// * /api/v1/query: PromQL 即时查询
+// * /api/v1/query_range: PromQL 区间查询
+// * /api/v1/series: 查询满足 match[] 的 series
+// * /api/v1/labels: 查询 label 名称
+// * /api/v1/label/<name>/values: 查询 label 值
+// * /api/v1/status/disk: 磁盘空间使用情况
+// * /api/v1/write、/api/v1/read: Prometheus remote_write/remote_read
+// * /write: InfluxDB line protocol 写入
+// * /api/put: OpenTSDB HTTP 写入
+func (tsdb *TSDB) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/query", tsdb.apiWrap(tsdb.apiQuery))
+	mux.Handle("/api/v1/query_range", tsdb.apiWrap(tsdb.apiQueryRange))
+	mux.Handle("/api/v1/series", tsdb.apiWrap(tsdb.apiSeries))
+	mux.Handle("/api/v1/labels", tsdb.apiWrap(tsdb.apiLabelNames))
+	mux.Handle("/api/v1/label/", tsdb.apiWrap(tsdb.apiLabelValues))
+	mux.Handle("/api/v1/status/disk", tsdb.apiWrap(tsdb.apiDiskUsage))
+	mux.Handle("/api/v1/write", tsdb.RemoteWriteHandler())
+	mux.Handle("/api/v1/read", tsdb.RemoteReadHandler())
+	mux.Handle("/write", tsdb.InfluxWriteHandler())
+	mux.Handle("/api/put", tsdb.OpenTSDBPutHandler())
+	return mux
+}
+
+func (tsdb *TSDB) apiWrap(f apiFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// POST 表单的请求体同样受 maxRequestBodySize 限制
+		if limit := tsdb.opts.maxRequestBodySize; limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+
+		code := http.StatusOK
+		resp := &apiResponse{Status: apiStatusSuccess}
+
+		if data, apiErr := callAPI(f, r); apiErr != nil {
+			code = apiErr.code()
+			resp = &apiResponse{Status: apiStatusError, ErrorType: apiErr.typ, Error: apiErr.err.Error()}
+		} else {
+			resp.Data = data
+		}
+
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logger.Errorf("failed to write api response: %v", err)
+		}
+	})
+}
+
+// callAPI 解析请求参数并调用 f 指定了 timeout 参数时会为请求的 context 设置超时时间
+func callAPI(f apiFunc, r *http.Request) (interface{}, *apiError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, badData(err)
+	}
+
+	timeout, err := parseTimeout(r.FormValue("timeout"))
+	if err != nil {
+		return nil, badData(err)
+	}
+
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	return f(r)
+}
+
+// parseTimeout 解析查询的 timeout 参数 未指定时返回 0
+func parseTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	d, err := parseStep(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+
+	return d, nil
+}
+
+// queryError 解析错误以及参数错误归类为 bad_data 超时以及取消归类为 timeout/canceled 其余为 execution
+// 超出资源限制(QueryLimitErr)属于 execution
+func queryError(err error) *apiError {
+	var parseErr *promql.ParseError
+	switch {
+	case errors.As(err, &parseErr) || errors.Is(err, ErrInvalidStep) || errors.Is(err, ErrTooManySteps) || errors.Is(err, ErrInvalidMatcher):
+		return &apiError{typ: apiErrorBadData, err: err}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &apiError{typ: apiErrorTimeout, err: err}
+	case errors.Is(err, context.Canceled):
+		return &apiError{typ: apiErrorCanceled, err: err}
+	}
+	return &apiError{typ: apiErrorExecution, err: err}
+}
+
+func badData(err error) *apiError {
+	return &apiError{typ: apiErrorBadData, err: err}
+}
+
+// parseTime 支持 unix 时间戳(秒 可以带小数)以及 RFC3339 两种格式 返回当前精度下的时间戳
+func (tsdb *TSDB) parseTime(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return tsdb.opts.precision.Timestamp(time.Unix(int64(sec), int64(frac*float64(time.Second)))), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return tsdb.opts.precision.Timestamp(t), nil
+	}
+
+	return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseStep 支持秒数(可以带小数)以及 PromQL duration 两种格式
+func parseStep(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+		}
+		return time.Duration(f * float64(time.Second)), nil
+	}
+
+	if d, err := promql.ParseDuration(s); err == nil {
+		return d, nil
+	}
+
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+// apiTimestamp 返回值中的时间戳统一为 unix 秒
+func (tsdb *TSDB) apiTimestamp(ts int64) float64 {
+	return float64(tsdb.opts.precision.ToMilliseconds(ts)) / 1000
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+type apiQueryData struct {
+	ResultType ValueType   `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+type apiSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value,omitempty"`
+	Values [][]interface{}   `json:"values,omitempty"`
+}
+
+func (tsdb *TSDB) apiPoint(p Point) []interface{} {
+	return []interface{}{tsdb.apiTimestamp(p.Ts), formatValue(p.Value)}
+}
+
+func (tsdb *TSDB) apiMatrix(m Matrix) []apiSeries {
+	ret := make([]apiSeries, 0, len(m))
+	for _, s := range m {
+		values := make([][]interface{}, 0, len(s.Points))
+		for _, p := range s.Points {
+			values = append(values, tsdb.apiPoint(p))
+		}
+		ret = append(ret, apiSeries{Metric: s.Labels.Map(), Values: values})
+	}
+
+	return ret
+}
+
+func (tsdb *TSDB) apiQuery(r *http.Request) (interface{}, *apiError) {
+	ts, err := tsdb.parseTime(r.FormValue("time"), tsdb.opts.precision.Timestamp(time.Now()))
+	if err != nil {
+		return nil, badData(err)
+	}
+
+	v, err := tsdb.QueryContext(r.Context(), r.FormValue("query"), ts)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	data := &apiQueryData{ResultType: v.Type()}
+	switch v := v.(type) {
+	case Scalar:
+		data.Result = tsdb.apiPoint(Point{Ts: v.T, Value: v.V})
+	case Vector:
+		result := make([]apiSeries, 0, len(v))
+		for _, s := range v {
+			result = append(result, apiSeries{Metric: s.Labels.Map(), Value: tsdb.apiPoint(s.Point)})
+		}
+		data.Result = result
+	case Matrix:
+		data.Result = tsdb.apiMatrix(v)
+	}
+
+	return data, nil
+}
+
+// apiQueryRange 与 Prometheus 一致 start、end 以及 step 都是必填参数
+func (tsdb *TSDB) apiQueryRange(r *http.Request) (interface{}, *apiError) {
+	for _, param := range []string{"start", "end"} {
+		if r.FormValue(param) == "" {
+			return nil, badData(fmt.Errorf("missing %s parameter", param))
+		}
+	}
+
+	start, err := tsdb.parseTime(r.FormValue("start"), 0)
+	if err != nil {
+		return nil, badData(err)
+	}
+
+	end, err := tsdb.parseTime(r.FormValue("end"), 0)
+	if err != nil {
+		return nil, badData(err)
+	}
+
+	step, err := parseStep(r.FormValue("step"))
+	if err != nil {
+		return nil, badData(err)
+	}
+
+	m, err := tsdb.QueryRangeExprContext(r.Context(), r.FormValue("query"), start, end, step)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	return &apiQueryData{ResultType: ValueTypeMatrix, Result: tsdb.apiMatrix(m)}, nil
+}
+
+// parseTimeRange 未指定 start/end 时查询全部数据
+func (tsdb *TSDB) parseTimeRange(r *http.Request) (int64, int64, *apiError) {
+	start, err := tsdb.parseTime(r.FormValue("start"), math.MinInt64)
+	if err != nil {
+		return 0, 0, badData(err)
+	}
+
+	end, err := tsdb.parseTime(r.FormValue("end"), math.MaxInt64)
+	if err != nil {
+		return 0, 0, badData(err)
+	}
+
+	return start, end, nil
+}
+
+// parseSelector 将 match[] 参数解析成 LabelMatcherSet
+func parseSelector(s string) (LabelMatcherSet, error) {
+	expr, err := promql.ParseExpr(s)
+	if err != nil {
+		return nil, err
+	}
+
+	vs, ok := expr.(*promql.VectorSelector)
+	if !ok {
+		return nil, fmt.Errorf("invalid series selector %q", s)
+	}
+
+	lms := make(LabelMatcherSet, 0, len(vs.Matchers))
+	for _, m := range vs.Matchers {
+		lms = append(lms, LabelMatcher{Name: m.Name, Value: m.Value, Type: promqlMatchTypes[m.Type]})
+	}
+
+	return lms.filter(), nil
+}
+
+func (tsdb *TSDB) apiSeries(r *http.Request) (interface{}, *apiError) {
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		return nil, badData(errors.New("no match[] parameter provided"))
+	}
+
+	start, end, apiErr := tsdb.parseTimeRange(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	series := make(map[string]map[string]string)
+	for _, s := range selectors {
+		lms, err := parseSelector(s)
+		if err != nil {
+			return nil, badData(err)
+		}
+
+		ret, err := tsdb.QuerySeriesContext(r.Context(), lms, start, end)
+		if err != nil {
+			return nil, queryError(err)
+		}
+
+		for _, labels := range ret {
+			series[fmt.Sprint(labels)] = labels
+		}
+	}
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	data := make([]map[string]string, 0, len(keys))
+	for _, k := range keys {
+		data = append(data, series[k])
+	}
+
+	return data, nil
+}
+
+// parseMatchers 解析所有 match[] 参数 没有指定时返回 nil
+func parseMatchers(r *http.Request) ([]LabelMatcherSet, *apiError) {
+	var ret []LabelMatcherSet
+	for _, s := range r.Form["match[]"] {
+		lms, err := parseSelector(s)
+		if err != nil {
+			return nil, badData(err)
+		}
+		ret = append(ret, lms)
+	}
+
+	return ret, nil
+}
+
+// unionLabels 对每组 matcher 分别查询并合并结果 没有 matcher 时查询全部数据
+func unionLabels(matchers []LabelMatcherSet, f func(lms LabelMatcherSet) ([]string, error)) ([]string, *apiError) {
+	if len(matchers) == 0 {
+		matchers = []LabelMatcherSet{nil}
+	}
+
+	set := make(map[string]struct{})
+	for _, lms := range matchers {
+		values, err := f(lms)
+		if err != nil {
+			return nil, queryError(err)
+		}
+
+		for _, v := range values {
+			set[v] = struct{}{}
+		}
+	}
+
+	data := make([]string, 0, len(set))
+	for v := range set {
+		data = append(data, v)
+	}
+	sort.Strings(data)
+
+	return data, nil
+}
+
+func (tsdb *TSDB) apiLabelNames(r *http.Request) (interface{}, *apiError) {
+	start, end, apiErr := tsdb.parseTimeRange(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	matchers, apiErr := parseMatchers(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	return unionLabels(matchers, func(lms LabelMatcherSet) ([]string, error) {
+		return tsdb.QueryLabelNamesContext(r.Context(), lms, start, end)
+	})
+}
+
+func (tsdb *TSDB) apiLabelValues(r *http.Request) (interface{}, *apiError) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+	name := strings.TrimSuffix(path, "/values")
+	if name == path || name == "" || strings.Contains(name, "/") {
+		return nil, badData(fmt.Errorf("invalid label values path %q", r.URL.Path))
+	}
+
+	start, end, apiErr := tsdb.parseTimeRange(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	matchers, apiErr := parseMatchers(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	return unionLabels(matchers, func(lms LabelMatcherSet) ([]string, error) {
+		return tsdb.QueryLabelValuesContext(r.Context(), name, start, end, lms...)
+	})
+}
+
+func (tsdb *TSDB) apiDiskUsage(_ *http.Request) (interface{}, *apiError) {
+	return tsdb.DiskUsage(), nil
+}
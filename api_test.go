@@ -0,0 +1,168 @@
+package mandodb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getAPI(h http.Handler, path string, params url.Values) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodGet, path+"?"+params.Encode(), nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	resp := make(map[string]interface{})
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp
+}
+
+func TestAPIHandler(t *testing.T) {
+	tmpdir := "/tmp/tsdb-api"
+	defer os.RemoveAll(tmpdir)
+
+	store := genEngineStore(tmpdir)
+	defer store.Close()
+	h := store.APIHandler()
+
+	code, resp := getAPI(h, "/api/v1/query_range", url.Values{
+		"query": {`sum by (job) (http_requests)`},
+		"start": {"1600000600"},
+		"end":   {"1600000660"},
+		"step":  {"30s"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "success", resp["status"])
+
+	data := resp["data"].(map[string]interface{})
+	assert.Equal(t, "matrix", data["resultType"])
+	result := data["result"].([]interface{})
+	assert.Equal(t, 2, len(result))
+
+	series := result[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"job": "api"}, series["metric"])
+	assert.Equal(t, []interface{}{
+		[]interface{}{1600000600.0, "120"},
+		[]interface{}{1600000630.0, "126"},
+		[]interface{}{1600000660.0, "132"},
+	}, series["values"])
+
+	code, resp = getAPI(h, "/api/v1/query", url.Values{
+		"query": {`http_requests{instance="c"}`},
+		"time":  {"2020-09-13T12:36:40Z"}, // 1600000600
+	})
+	assert.Equal(t, http.StatusOK, code)
+	data = resp["data"].(map[string]interface{})
+	assert.Equal(t, "vector", data["resultType"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"metric": map[string]interface{}{"__name__": "http_requests", "instance": "c", "job": "web"},
+			"value":  []interface{}{1600000600.0, "120"},
+		},
+	}, data["result"])
+
+	code, resp = getAPI(h, "/api/v1/series", url.Values{"match[]": {`http_requests{job="api"}`, `{instance="c"}`}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, len(resp["data"].([]interface{})))
+
+	code, resp = getAPI(h, "/api/v1/labels", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"__name__", "instance", "job"}, resp["data"])
+
+	code, resp = getAPI(h, "/api/v1/label/instance/values", url.Values{"start": {"1600000000"}, "end": {"1600000100"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"a", "b", "c"}, resp["data"])
+
+	code, resp = getAPI(h, "/api/v1/label/instance/values", url.Values{"match[]": {`{job="web"}`, `{instance="a"}`}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"a", "c"}, resp["data"])
+
+	code, resp = getAPI(h, "/api/v1/labels", url.Values{"match[]": {`http_requests{job="web"}`}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"__name__", "instance", "job"}, resp["data"])
+
+	code, resp = getAPI(h, "/api/v1/status/disk", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, resp["data"], "segmentBytes")
+}
+
+func TestAPIHandler_BadRequest(t *testing.T) {
+	tmpdir := "/tmp/tsdb-api-bad"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+	defer store.Close()
+	h := store.APIHandler()
+
+	cases := []struct {
+		path   string
+		params url.Values
+	}{
+		{path: "/api/v1/query", params: url.Values{"query": {"sum("}}},
+		{path: "/api/v1/query", params: url.Values{"query": {"up"}, "time": {"yesterday"}}},
+		{path: "/api/v1/query_range", params: url.Values{"query": {"up"}, "start": {"1"}, "end": {"2"}, "step": {"0"}}},
+		{path: "/api/v1/query_range", params: url.Values{"query": {"up"}, "start": {"1"}, "end": {"2"}, "step": {"x"}}},
+		{path: "/api/v1/query_range", params: url.Values{"query": {"up"}, "end": {"2"}, "step": {"1s"}}},
+		{path: "/api/v1/query_range", params: url.Values{"query": {"up"}, "start": {"1"}, "step": {"1s"}}},
+		{path: "/api/v1/series", params: url.Values{"match[]": {`up{job=~"("}`}}},
+		{path: "/api/v1/series", params: nil},
+		{path: "/api/v1/series", params: url.Values{"match[]": {"rate(up[5m])"}}},
+		{path: "/api/v1/label/job", params: nil},
+		{path: "/api/v1/labels", params: url.Values{"timeout": {"-1s"}}},
+		{path: "/api/v1/labels", params: url.Values{"match[]": {"sum(up)"}}},
+	}
+
+	for _, c := range cases {
+		code, resp := getAPI(h, c.path, c.params)
+		assert.Equal(t, http.StatusBadRequest, code, "%s %v", c.path, c.params)
+		assert.Equal(t, "error", resp["status"])
+		assert.Equal(t, "bad_data", resp["errorType"])
+	}
+
+	// POST 表单超过 maxRequestBodySize
+	store.opts.maxRequestBodySize = 16
+	form := url.Values{"query": {strings.Repeat("up", 16)}}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestAPIHandler_QueryErrors(t *testing.T) {
+	tmpdir := "/tmp/tsdb-api-errors"
+	defer os.RemoveAll(tmpdir)
+
+	store := genEngineStore(tmpdir, WithMaxQuerySeries(2))
+	defer store.Close()
+	h := store.APIHandler()
+
+	code, resp := getAPI(h, "/api/v1/query", url.Values{"query": {"http_requests"}, "time": {"1600000600"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Equal(t, "execution", resp["errorType"])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=1600000600", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"errorType":"canceled"`)
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/query_range?query=up&start=1600000000&end=1600000600&step=15", nil).WithContext(ctx)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"errorType":"timeout"`)
+}
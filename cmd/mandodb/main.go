@@ -0,0 +1,258 @@
+// mandodb 服务端 提供兼容 Prometheus 的 HTTP API 可以作为 Grafana 的 Prometheus 数据源使用
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/chenjiandongx/logger"
+
+	"github.com/chenjiandongx/mandodb"
+	"github.com/chenjiandongx/mandodb/pkg/graphite"
+	"github.com/chenjiandongx/mandodb/pkg/influx"
+)
+
+var (
+	listenAddr         = flag.String("listen-addr", ":9090", "HTTP API 监听地址")
+	influxUDPAddr      = flag.String("influx-udp-addr", "", "InfluxDB line protocol UDP 监听地址 为空时不开启")
+	influxUDPPrecision = flag.String("influx-udp-precision", "ns", "InfluxDB line protocol UDP 写入的时间戳精度 可选 ns、u、ms、s、m、h")
+	graphiteAddr       = flag.String("graphite-addr", "", "Graphite plaintext TCP 监听地址 为空时不开启")
+	graphiteTemplates  = flag.String("graphite-templates", "", "Graphite 模板规则 以分号分隔 如 \"servers.* .host.metric*;*.app env.metric* dc=bj\"")
+	opentsdbAddr       = flag.String("opentsdb-addr", "", "OpenTSDB telnet TCP 监听地址 为空时不开启")
+	scrapeConfig       = flag.String("scrape-config", "", "Prometheus 格式的 YAML 抓取配置文件 为空时不开启抓取")
+	dataPath           = flag.String("data-path", ".", "Segment 持久化存储文件夹")
+	retention          = flag.Duration("retention", 7*24*time.Hour, "Segment 持久化数据保存时长")
+	precision          = flag.String("precision", "s", "时间戳精度 可选 s、ms、ns")
+	onlyMemoryMode     = flag.Bool("only-memory-mode", false, "是否只存储在内存中")
+	enableOutdated     = flag.Bool("enable-outdated", true, "是否支持乱序写入")
+	outOfOrderWindow   = flag.Duration("out-of-order-window", 0, "乱序写入的时间窗口 0 表示不限制")
+	duplicatePolicy    = flag.String("duplicate-policy", "last", "时间戳重复的数据点的处理策略 可选 last、first、reject")
+	enableWAL          = flag.Bool("enable-wal", true, "是否开启 WAL")
+	maxRowsPerSegment  = flag.Int64("max-rows-per-segment", 19960412, "单 Segment 最大允许存储的点数")
+	compactionLevels   = flag.String("compaction-levels", "12h,48h", "Segment 合并的时间跨度 以逗号分隔 为空时关闭 compaction")
+	maxDiskBytes       = flag.Int64("max-disk-bytes", 0, "持久化数据最多允许占用的磁盘空间 0 表示不限制")
+	maxQuerySeries     = flag.Int64("max-query-series", 0, "单次查询最多允许涉及的 series 数量 0 表示不限制")
+	maxQuerySamples    = flag.Int64("max-query-samples", 0, "单次查询最多允许读取的数据点数量 0 表示不限制")
+	maxRequestBodySize = flag.Int64("max-request-body-size", 32*1024*1024, "HTTP 请求体(解压后)允许的最大字节数 0 表示不限制")
+	maxLineSize        = flag.Int64("max-line-size", 64*1024, "Graphite/OpenTSDB TCP 监听器单行数据允许的最大字节数 0 表示不限制")
+	compressor         = flag.String("compressor", "noop", "字节数据的压缩算法 可选 noop、zstd、snappy")
+	writeTimeout       = flag.Duration("write-timeout", 30*time.Second, "写入超时阈值")
+	logLevel           = flag.String("log-level", "info", "日志级别 可选 debug、info、warn、error")
+)
+
+var precisions = map[string]mandodb.TimestampPrecision{
+	"s":  mandodb.PrecisionSecond,
+	"ms": mandodb.PrecisionMillisecond,
+	"ns": mandodb.PrecisionNanosecond,
+}
+
+var compressors = map[string]mandodb.BytesCompressorType{
+	"noop":   mandodb.NoopBytesCompressor,
+	"zstd":   mandodb.ZstdBytesCompressor,
+	"snappy": mandodb.SnappyBytesCompressor,
+}
+
+var duplicatePolicies = map[string]mandodb.DuplicatePolicy{
+	"last":   mandodb.DuplicateLastWriteWins,
+	"first":  mandodb.DuplicateFirstWriteWins,
+	"reject": mandodb.DuplicateReject,
+}
+
+var logLevels = map[string]logger.Level{
+	"debug": logger.DebugLevel,
+	"info":  logger.InfoLevel,
+	"warn":  logger.WarnLevel,
+	"error": logger.ErrorLevel,
+}
+
+// buildOptions 将命令行参数转换成 mandodb.Option
+func buildOptions() ([]mandodb.Option, error) {
+	p, ok := precisions[*precision]
+	if !ok {
+		return nil, fmt.Errorf("unknown precision %q", *precision)
+	}
+
+	c, ok := compressors[*compressor]
+	if !ok {
+		return nil, fmt.Errorf("unknown compressor %q", *compressor)
+	}
+
+	dp, ok := duplicatePolicies[*duplicatePolicy]
+	if !ok {
+		return nil, fmt.Errorf("unknown duplicate policy %q", *duplicatePolicy)
+	}
+
+	level, ok := logLevels[*logLevel]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %q", *logLevel)
+	}
+
+	levels := make([]time.Duration, 0)
+	for _, s := range strings.Split(*compactionLevels, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compaction level %q: %v", s, err)
+		}
+		levels = append(levels, d)
+	}
+
+	return []mandodb.Option{
+		mandodb.WithDataPath(*dataPath),
+		mandodb.WithRetention(*retention),
+		mandodb.WithTimestampPrecision(p),
+		mandodb.WithOnlyMemoryMode(*onlyMemoryMode),
+		mandodb.WithEnabledOutdated(*enableOutdated),
+		mandodb.WithOutOfOrderWindow(*outOfOrderWindow),
+		mandodb.WithDuplicatePolicy(dp),
+		mandodb.WithEnabledWAL(*enableWAL),
+		mandodb.WithMaxRowsPerSegment(*maxRowsPerSegment),
+		mandodb.WithCompactionLevels(levels...),
+		mandodb.WithMaxDiskBytes(*maxDiskBytes),
+		mandodb.WithMaxQuerySeries(*maxQuerySeries),
+		mandodb.WithMaxQuerySamples(*maxQuerySamples),
+		mandodb.WithMaxRequestBodySize(*maxRequestBodySize),
+		mandodb.WithMaxLineSize(*maxLineSize),
+		mandodb.WithMetaBytesCompressorType(c),
+		mandodb.WithWriteTimeout(*writeTimeout),
+		mandodb.WithLoggerConfig(&logger.Options{
+			Stdout:      true,
+			ConsoleMode: true,
+			Level:       level,
+		}),
+	}, nil
+}
+
+func main() {
+	flag.Parse()
+
+	opts, err := buildOptions()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	unit, err := influx.ParsePrecision(*influxUDPPrecision)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	templates := make([]string, 0)
+	for _, s := range strings.Split(*graphiteTemplates, ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			templates = append(templates, s)
+		}
+	}
+
+	parser, err := graphite.NewParser(templates)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var scrapeCfg *mandodb.ScrapeConfig
+	if *scrapeConfig != "" {
+		scrapeCfg, err = mandodb.LoadScrapeConfigFile(*scrapeConfig)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	store := mandodb.OpenTSDB(opts...)
+	server := &http.Server{Addr: *listenAddr, Handler: store.APIHandler()}
+
+	// closers 退出时需要关闭的 listener
+	closers := make([]io.Closer, 0)
+	if *influxUDPAddr != "" {
+		conn, err := net.ListenPacket("udp", *influxUDPAddr)
+		if err != nil {
+			logger.Fatalf("failed to listen influx udp: %v", err)
+		}
+		closers = append(closers, conn)
+
+		go func() {
+			logger.Infof("influx udp is listening on %s", *influxUDPAddr)
+			if err := store.ServeInfluxUDP(conn, unit); err != nil {
+				logger.Errorf("failed to serve influx udp: %v", err)
+			}
+		}()
+	}
+
+	if *graphiteAddr != "" {
+		ln, err := net.Listen("tcp", *graphiteAddr)
+		if err != nil {
+			logger.Fatalf("failed to listen graphite: %v", err)
+		}
+		closers = append(closers, ln)
+
+		go func() {
+			logger.Infof("graphite is listening on %s", *graphiteAddr)
+			if err := store.ServeGraphite(ln, parser); err != nil {
+				logger.Errorf("failed to serve graphite: %v", err)
+			}
+		}()
+	}
+
+	if *opentsdbAddr != "" {
+		ln, err := net.Listen("tcp", *opentsdbAddr)
+		if err != nil {
+			logger.Fatalf("failed to listen opentsdb: %v", err)
+		}
+		closers = append(closers, ln)
+
+		go func() {
+			logger.Infof("opentsdb is listening on %s", *opentsdbAddr)
+			if err := store.ServeOpenTSDB(ln); err != nil {
+				logger.Errorf("failed to serve opentsdb: %v", err)
+			}
+		}()
+	}
+
+	scrapeCtx, scrapeCancel := context.WithCancel(context.Background())
+	scrapeDone := make(chan struct{})
+	go func() {
+		defer close(scrapeDone)
+		if scrapeCfg != nil {
+			logger.Infof("scraping %d jobs from %s", len(scrapeCfg.ScrapeConfigs), *scrapeConfig)
+			store.NewScrapeManager(scrapeCfg).Run(scrapeCtx)
+		}
+	}()
+
+	go func() {
+		logger.Infof("mandodb is listening on %s", *listenAddr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("failed to start http server: %v", err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Errorf("failed to shutdown http server: %v", err)
+	}
+	for _, closer := range closers {
+		closer.Close()
+	}
+	scrapeCancel()
+	<-scrapeDone
+	store.Close()
+}
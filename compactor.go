@@ -0,0 +1,352 @@
+package mandodb
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/chenjiandongx/logger"
+
+	"github.com/chenjiandongx/mandodb/pkg/chunkenc"
+	"github.com/chenjiandongx/mandodb/pkg/mmap"
+)
+
+// Compaction 负责将相邻的 diskSegment 逐级合并成时间跨度更大的 Segment
+// 以 2h -> 12h -> 48h 为例 同一个 12h 时间窗口内的 2h Segment 会被合并成一个 12h Segment
+// 同理 同一个 48h 时间窗口内的 12h Segment 又会被合并成一个 48h Segment
+// 合并后的 Segment 会原子地替换掉原来的 Segment 正在进行的查询不受影响
+// 存在 tombstones 的 Segment 即使不需要合并也会被重写 被删除的数据在重写时才会被真正清理
+
+const compactInterval = 5 * time.Minute
+
+func (tsdb *TSDB) compactLoop() {
+	if tsdb.opts.onlyMemoryMode {
+		return
+	}
+
+	tick := time.Tick(compactInterval)
+	for {
+		select {
+		case <-tsdb.ctx.Done():
+			return
+		case <-tick:
+			if err := tsdb.compact(); err != nil {
+				logger.Errorf("failed to compact segments: %v", err)
+			}
+		}
+	}
+}
+
+// compact 不断执行合并直到没有可以合并的 Segment 然后重写剩余存在 tombstones 的 Segment
+func (tsdb *TSDB) compact() error {
+	tsdb.compactMut.Lock()
+	defer tsdb.compactMut.Unlock()
+
+	for {
+		plan := tsdb.planCompaction()
+		if len(plan) == 0 {
+			break
+		}
+
+		if err := tsdb.compactSegments(plan); err != nil {
+			return err
+		}
+	}
+
+	for _, segment := range tsdb.segs.All() {
+		ds, ok := segment.(*diskSegment)
+		if !ok || !ds.hasTombstones() {
+			continue
+		}
+
+		if err := tsdb.compactSegments([]*diskSegment{ds}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planCompaction 挑选出最早的一组可以合并的 Segment
+// 同一层级时间窗口内的 Segment 数量大于 1 且该窗口的数据已经全部持久化才会被合并
+func (tsdb *TSDB) planCompaction() []*diskSegment {
+	tsdb.mut.Lock()
+	boundary := tsdb.segs.head.MinTs()
+	tsdb.mut.Unlock()
+
+	// ooo 持久化后会与其时间区间内的 segment 重叠 这部分窗口需要等待 ooo 持久化后再合并
+	if ooo := tsdb.segs.PendingOutOfOrder(); ooo != nil && ooo.MinTs() < boundary {
+		boundary = ooo.MinTs()
+	}
+
+	disks := make([]*diskSegment, 0)
+	for _, segment := range tsdb.segs.All() {
+		ds, ok := segment.(*diskSegment)
+		if !ok {
+			// 仍在持久化中的 memorySegment
+			if segment.MinTs() < boundary {
+				boundary = segment.MinTs()
+			}
+			continue
+		}
+		disks = append(disks, ds)
+	}
+
+	for _, level := range tsdb.opts.compactionLevels {
+		width := tsdb.opts.precision.Duration(level)
+		if width <= 0 {
+			continue
+		}
+
+		var group []*diskSegment
+		var window int64
+		for _, ds := range disks {
+			w := floorDiv(ds.MinTs(), width)
+			if len(group) > 0 && w != window {
+				if len(group) > 1 && (window+1)*width <= boundary {
+					return group
+				}
+				group = nil
+			}
+
+			window = w
+			group = append(group, ds)
+		}
+
+		if len(group) > 1 && (window+1)*width <= boundary {
+			return group
+		}
+	}
+
+	return nil
+}
+
+func floorDiv(a, b int64) int64 {
+	if a < 0 && a%b != 0 {
+		return a/b - 1
+	}
+	return a / b
+}
+
+// compactSegments 将 segs 中的数据合并写入新的 Segment 并替换掉原来的 Segment
+// 按 LabelSet 顺序归并 segs 中的 series 每个 series 合并完成后立即写入磁盘 内存占用不随合并窗口的大小增长
+func (tsdb *TSDB) compactSegments(segs []*diskSegment) error {
+	t0 := time.Now()
+
+	// segs 之间的时间区间可能重叠 按照写入顺序合并 时间戳相同的数据点以较新的为准
+	sorted := make([]*diskSegment, len(segs))
+	copy(sorted, segs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].seq < sorted[j].seq
+	})
+
+	desc := &Desc{MinTs: math.MaxInt64, MaxTs: math.MinInt64}
+	sets := make([]SeriesSet, 0, len(sorted))
+	pres := make([]Segment, 0, len(sorted))
+	for _, ds := range sorted {
+		if _, err := ds.Load(); err != nil {
+			return err
+		}
+		if err := ds.verifyIndex(); err != nil {
+			return err
+		}
+
+		if ds.walSeq > desc.WalSeq {
+			desc.WalSeq = ds.walSeq
+		}
+		if ds.seq > desc.Seq {
+			desc.Seq = ds.seq
+		}
+		desc.Parents = append(desc.Parents, path.Base(ds.dir))
+
+		sets = append(sets, ds.allSeries())
+		pres = append(pres, ds)
+	}
+
+	w, err := newSegmentWriter(tsdb.opts)
+	if err != nil {
+		return err
+	}
+	defer w.Abort()
+
+	ss := newMergedSeriesSet(sets...)
+	for ss.Next() {
+		series := ss.At()
+		if err := w.Append(series.Labels(), series.Iterator(), desc); err != nil {
+			return err
+		}
+	}
+	if err := ss.Err(); err != nil {
+		return err
+	}
+
+	// 所有 Segment 都没有数据 直接删除即可
+	if desc.DataPointsCount == 0 {
+		for _, pre := range pres {
+			if err := tsdb.segs.Remove(pre); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dn, err := w.Commit(desc)
+	if err != nil {
+		return err
+	}
+
+	mf, err := mmap.OpenMmapFile(path.Join(dn, "data"))
+	if err != nil {
+		return err
+	}
+
+	nxt := newDiskSegment(mf, dn, desc.MinTs, desc.MaxTs, tsdb.opts)
+	nxt.(*diskSegment).walSeq = desc.WalSeq
+	nxt.(*diskSegment).seq = desc.Seq
+
+	if err := tsdb.segs.Swap(pres, nxt); err != nil {
+		return err
+	}
+
+	logger.Infof("compact %d segments into %s, take: %v", len(pres), dn, time.Since(t0))
+	return nil
+}
+
+// segmentWriter 将 series 逐条写入临时文件夹中的 data 文件 文件格式与 memorySegment.Marshal 一致
+// 只有 index 需要的 LabelSet 以及 chunk 偏移会保留在内存中
+type segmentWriter struct {
+	opts *tsdbOptions
+	tmp  string
+	fd   *os.File
+	bw   *bufio.Writer
+
+	shift  int64  // TOC 在文件中的偏移
+	offset uint64 // 下一个 chunk 相对于 data 区域的偏移
+	series []indexSeries
+	done   bool
+}
+
+// newSegmentWriter 在 dataPath 下创建临时文件夹 写入 header 以及 TOC 占位符
+// 临时文件夹以 seg- 开头 .tmp 结尾 进程崩溃后残留的文件夹会在启动时被清理
+func newSegmentWriter(opts *tsdbOptions) (*segmentWriter, error) {
+	tmp, err := ioutil.TempDir(opts.dataPath, "seg-compact-*"+tmpSegmentSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.OpenFile(path.Join(tmp, "data"), os.O_CREATE|os.O_WRONLY|os.O_EXCL, os.ModePerm)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	header := segmentHeader{
+		version:         segmentFormatV4,
+		bytesCompressor: opts.bytesCompressorType,
+		metaSerializer:  opts.metaSerializerType,
+	}.Marshal()
+
+	w := &segmentWriter{opts: opts, tmp: tmp, fd: fd, bw: bufio.NewWriter(fd), shift: int64(len(header))}
+	if _, err := w.bw.Write(append(header, make([]byte, segmentTOCSize)...)); err != nil {
+		w.Abort()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Append 将 it 中的数据点编码成一个 chunk 写入 没有数据点的 series 会被忽略 desc 中的统计信息会同步更新
+func (w *segmentWriter) Append(labels LabelSet, it SeriesIterator, desc *Desc) error {
+	chunk := chunkenc.NewXORChunk()
+	for it.Next() {
+		p := it.At()
+		chunk.Append(p.Ts, p.Value)
+
+		if p.Ts < desc.MinTs {
+			desc.MinTs = p.Ts
+		}
+		if p.Ts > desc.MaxTs {
+			desc.MaxTs = p.Ts
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	if chunk.NumSamples() == 0 {
+		return nil
+	}
+
+	encf := newEncbuf()
+	encf.MarshalUint32(uint32(chunk.NumSamples()))
+	dataBytes := w.opts.bytesCompressor.Compress(append(encf.Bytes(), chunk.Bytes()...))
+
+	if _, err := w.bw.Write(appendChecksum(dataBytes, dataBytes)); err != nil {
+		return err
+	}
+
+	end := w.offset + uint64(len(dataBytes))
+	w.series = append(w.series, indexSeries{labels: labels, start: w.offset, end: end})
+	w.offset = end + checksumSize
+
+	desc.SeriesCount++
+	desc.DataPointsCount += int64(chunk.NumSamples())
+	return nil
+}
+
+// Commit 写入 index、TOC 以及 meta.json 并将临时文件夹 rename 成最终的 Segment 文件夹
+func (w *segmentWriter) Commit(desc *Desc) (string, error) {
+	indexBytes := marshalIndex(w.series, segmentFormatV4)
+	indexLen := len(indexBytes)
+
+	if _, err := w.bw.Write(appendChecksum(indexBytes, indexBytes[indexLen-indexTOCSize:])); err != nil {
+		return "", err
+	}
+	if err := w.bw.Flush(); err != nil {
+		return "", err
+	}
+
+	encf := newEncbuf()
+	encf.MarshalUint64(w.offset, uint64(indexLen))
+	if _, err := w.fd.WriteAt(encf.Bytes(), w.shift); err != nil {
+		return "", err
+	}
+
+	if err := w.fd.Sync(); err != nil {
+		return "", err
+	}
+	if err := w.fd.Close(); err != nil {
+		return "", err
+	}
+
+	descBytes, _ := json.MarshalIndent(desc, "", "    ")
+	if err := writeFileSync(path.Join(w.tmp, "meta.json"), descBytes); err != nil {
+		return "", err
+	}
+
+	dn := segmentDirname(w.opts.dataPath, desc.MinTs, desc.MaxTs)
+	if err := commitSegmentDir(w.tmp, dn); err != nil {
+		return "", err
+	}
+
+	w.done = true
+	return dn, nil
+}
+
+// Abort 删除临时文件夹 Commit 成功后调用不会有任何影响
+func (w *segmentWriter) Abort() {
+	if w.done {
+		return
+	}
+
+	w.fd.Close()
+	if err := os.RemoveAll(w.tmp); err != nil {
+		logger.Errorf("failed to remove dir %s: %v", w.tmp, err)
+	}
+	w.done = true
+}
@@ -0,0 +1,121 @@
+package mandodb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTSDB_Compact(t *testing.T) {
+	tmpdir := "/tmp/tsdb-compact"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+
+	var start int64 = 1600000000
+	var now = start
+	for i := 0; i < 2880; i++ { // 48h
+		_ = store.InsertRows(genPoints(now, 0, 0))
+		now += 60
+	}
+	time.Sleep(time.Millisecond * 100)
+	store.wg.Wait()
+
+	before := len(store.segs.All())
+	assert.NoError(t, store.compact())
+	after := len(store.segs.All())
+	assert.True(t, after < before, "segments: %d -> %d", before, after)
+
+	ret, err := store.QueryRange("cpu.busy", nil, start, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, 2880, len(ret[0].Points))
+	for i := 1; i < len(ret[0].Points); i++ {
+		assert.Equal(t, ret[0].Points[i-1].Ts+60, ret[0].Points[i].Ts)
+	}
+
+	store.Close()
+
+	store = OpenTSDB(WithDataPath(tmpdir))
+	defer store.Close()
+
+	ret, err = store.QueryRange("cpu.busy", nil, start, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, 2880, len(ret[0].Points))
+}
+
+func TestTSDB_CompactSegments_Merge(t *testing.T) {
+	tmpdir := "/tmp/tsdb-compact-merge"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir), WithCompactionLevels())
+	defer store.Close()
+
+	persist := func(seq int64, rows []*Row) *diskSegment {
+		ms := newMemorySegment(store.opts).(*memorySegment)
+		ms.seq = seq
+		ms.InsertRows(rows)
+
+		dn, err := writeToDisk(ms)
+		assert.NoError(t, err)
+		ds, _, err := openDiskSegment(dn, store.opts)
+		assert.NoError(t, err)
+		store.segs.Add(ds)
+		return ds
+	}
+
+	row := func(node string, ts int64, v float64) *Row {
+		return &Row{Metric: "cpu", Labels: LabelSet{{Name: "node", Value: node}}, Point: Point{Ts: ts, Value: v}}
+	}
+
+	older := persist(1, []*Row{row("vm2", 10, 1), row("vm2", 20, 1), row("vm2", 30, 1), row("vm1", 10, 1)})
+	newer := persist(2, []*Row{row("vm2", 20, 2), row("vm3", 40, 2)})
+
+	// 传入顺序与写入顺序无关 时间戳相同的数据点以 seq 大的为准
+	assert.NoError(t, store.compactSegments([]*diskSegment{newer, older}))
+
+	segs := store.segs.All()
+	assert.Equal(t, 1, len(segs))
+	ds := segs[0].(*diskSegment)
+	assert.Equal(t, int64(10), ds.MinTs())
+	assert.Equal(t, int64(40), ds.MaxTs())
+	assert.Equal(t, int64(2), ds.seq)
+
+	expected := map[string][]Point{
+		"vm1": {{Ts: 10, Value: 1}},
+		"vm2": {{Ts: 10, Value: 1}, {Ts: 20, Value: 2}, {Ts: 30, Value: 1}},
+		"vm3": {{Ts: 40, Value: 2}},
+	}
+	for node, points := range expected {
+		ret, err := store.QueryRange("cpu", LabelMatcherSet{{Name: "node", Value: node}}, 0, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(ret))
+		assert.Equal(t, points, ret[0].Points, node)
+	}
+
+	// 临时文件夹已经被 rename 或者清理
+	entries, err := ioutil.ReadDir(tmpdir)
+	assert.NoError(t, err)
+	var dirs []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "seg-") {
+			dirs = append(dirs, e.Name())
+		}
+	}
+	assert.Equal(t, []string{path.Base(ds.dir)}, dirs)
+
+	b, err := ioutil.ReadFile(path.Join(ds.dir, "meta.json"))
+	assert.NoError(t, err)
+	desc := Desc{}
+	assert.NoError(t, json.Unmarshal(b, &desc))
+	assert.Equal(t, int64(3), desc.SeriesCount)
+	assert.Equal(t, int64(5), desc.DataPointsCount)
+	assert.Equal(t, []string{path.Base(older.dir), path.Base(newer.dir)}, desc.Parents)
+}
@@ -1,6 +1,8 @@
 package mandodb
 
 import (
+	"fmt"
+
 	"github.com/golang/snappy"
 	"github.com/klauspost/compress/zstd"
 )
@@ -25,14 +27,18 @@ type BytesCompressor interface {
 	Decompress(src []byte) ([]byte, error)
 }
 
-// ByteCompress 数据压缩
-func ByteCompress(src []byte) []byte {
-	return globalOpts.bytesCompressor.Compress(src)
-}
-
-// ByteDecompress 数据解压缩
-func ByteDecompress(src []byte) ([]byte, error) {
-	return globalOpts.bytesCompressor.Decompress(src)
+// newBytesCompressor 根据类型创建对应的压缩器
+func newBytesCompressor(t BytesCompressorType) (BytesCompressor, error) {
+	switch t {
+	case NoopBytesCompressor:
+		return newNoopBytesCompressor(), nil
+	case ZstdBytesCompressor:
+		return newZstdBytesCompressor(), nil
+	case SnappyBytesCompressor:
+		return newSnappyBytesCompressor(), nil
+	}
+
+	return nil, fmt.Errorf("unknown bytes compressor type: %d", t)
 }
 
 type noopBytesCompressor struct{}
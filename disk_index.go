@@ -0,0 +1,610 @@
+package mandodb
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// version 3 的 Segment 使用可以直接从 mmap 中读取的索引替换了 Metadata
+// 索引不做压缩 所有偏移量都相对于索引的起始位置
+//
+// ┌──────────────────────────────── Symbols ─────────────────────────────────┐
+// │ count(uint32) │ offset(uint32) x count │ len │ bytes │ ...                 │
+// ├───────────────────────────── Label Pairs ────────────────────────────────┤
+// │ count(uint32) │ name(uint32) │ value(uint32) │ postings(uint32) │ ...      │
+// ├─────────────────────────────── Postings ─────────────────────────────────┤
+// │ count │ sid x count │ ...                                                 │
+// ├──────────────────────────────── Series ──────────────────────────────────┤
+// │ count(uint32) │ start(uint64) │ end(uint64) │ labels(uint32) │ ...         │
+// │ count │ pair x count │ ...                                                │
+// ├─────────────────────────────── Index TOC ────────────────────────────────┤
+// │ symbols(uint64) │ pairs(uint64) │ postings(uint64) │ series(uint64) │ crc32 │
+// └──────────────────────────────────────────────────────────────────────────┘
+//
+// * Symbols: 所有 label 名称和值去重后升序排列 symbol id 即为下标 所以 id 的大小关系与字符串一致
+// * Label Pairs: 按 (name, value) 排序 同一个 label 名称的所有值是连续的 可以直接二分查找
+// * Series: 按 sid 顺序排列的定长记录 labels 指向该 series 引用的 label pair 下标列表
+// * Index TOC: 定长 segment 文件末尾的 crc32 校验的就是这部分数据 加载时只需读取并校验 Index TOC
+//   Index TOC 中的 crc32 校验 TOC 之前的整个索引 只在 compaction 读取整个 segment 之前校验
+//   其余情况下索引损坏会在读取到对应位置时以错误的形式返回
+//
+// 没有标注长度的字段在 version 3 中为 uint32
+// version 4 中为 uvarint 并且 postings 中的 sid 以及 series 引用的 pair 下标都只记录与前一个值的差值
+
+const (
+	indexTOCSize        = uint64Size*4 + checksumSize
+	indexPairSize       = uint32Size * 3
+	indexSeriesSize     = uint64Size*2 + uint32Size
+	indexSymbolOffsetSz = uint32Size
+)
+
+// indexSeries 写入索引的 series 信息
+type indexSeries struct {
+	labels     LabelSet
+	start, end uint64
+}
+
+// indexWriter 根据版本写入长度以及 uint32 列表
+type indexWriter struct {
+	version uint8
+}
+
+func (w indexWriter) marshalLen(encf *encbuf, n int) {
+	if w.version < segmentFormatV4 {
+		encf.MarshalUint32(uint32(n))
+		return
+	}
+	encf.MarshalUvarint(uint64(n))
+}
+
+// marshalList 写入升序排列的 list
+func (w indexWriter) marshalList(encf *encbuf, list []uint32) {
+	w.marshalLen(encf, len(list))
+	if w.version < segmentFormatV4 {
+		encf.MarshalUint32(list...)
+		return
+	}
+
+	var prev uint32
+	for _, n := range list {
+		encf.MarshalUvarint(uint64(n - prev))
+		prev = n
+	}
+}
+
+// marshalIndex 生成指定版本格式的索引 series 的下标即为 sid
+func marshalIndex(series []indexSeries, version uint8) []byte {
+	w := indexWriter{version: version}
+
+	symbolSet := make(map[string]struct{})
+	pairSids := make(map[Label][]uint32)
+	for sid, s := range series {
+		for _, label := range s.labels {
+			symbolSet[label.Name] = struct{}{}
+			symbolSet[label.Value] = struct{}{}
+			pairSids[label] = append(pairSids[label], uint32(sid))
+		}
+	}
+
+	symbols := make([]string, 0, len(symbolSet))
+	for s := range symbolSet {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+
+	symbolIds := make(map[string]uint32, len(symbols))
+	for i, s := range symbols {
+		symbolIds[s] = uint32(i)
+	}
+
+	pairs := make([]Label, 0, len(pairSids))
+	for label := range pairSids {
+		pairs = append(pairs, label)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Name != pairs[j].Name {
+			return pairs[i].Name < pairs[j].Name
+		}
+		return pairs[i].Value < pairs[j].Value
+	})
+
+	pairIds := make(map[Label]uint32, len(pairs))
+	for i, label := range pairs {
+		pairIds[label] = uint32(i)
+	}
+
+	encf := newEncbuf()
+
+	// 变长的数据先写入单独的 buffer 得到各自的偏移量后再与定长的部分合并
+	// symbols
+	symbolsOff := encf.Len()
+	body := newEncbuf()
+	encf.MarshalUint32(uint32(len(symbols)))
+	for _, s := range symbols {
+		encf.MarshalUint32(uint32(body.Len()))
+		w.marshalLen(body, len(s))
+		body.MarshalString(s)
+	}
+	encf.MarshalBytes(body.Bytes())
+
+	// postings
+	body = newEncbuf()
+	postingsOffs := make([]uint32, len(pairs))
+	for i, label := range pairs {
+		postingsOffs[i] = uint32(body.Len())
+		w.marshalList(body, pairSids[label])
+	}
+
+	// label pairs
+	pairsOff := encf.Len()
+	postingsOff := pairsOff + uint32Size + len(pairs)*indexPairSize
+	encf.MarshalUint32(uint32(len(pairs)))
+	for i, label := range pairs {
+		encf.MarshalUint32(symbolIds[label.Name], symbolIds[label.Value], uint32(postingsOff)+postingsOffs[i])
+	}
+	encf.MarshalBytes(body.Bytes())
+
+	// series
+	seriesOff := encf.Len()
+	labelsOff := uint32(seriesOff + uint32Size + len(series)*indexSeriesSize)
+	body = newEncbuf()
+	encf.MarshalUint32(uint32(len(series)))
+	for _, s := range series {
+		lids := make([]uint32, 0, len(s.labels))
+		for _, label := range s.labels {
+			lids = append(lids, pairIds[label])
+		}
+		sort.Slice(lids, func(i, j int) bool {
+			return lids[i] < lids[j]
+		})
+
+		encf.MarshalUint64(s.start, s.end)
+		encf.MarshalUint32(labelsOff + uint32(body.Len()))
+		w.marshalList(body, lids)
+	}
+	encf.MarshalBytes(body.Bytes())
+
+	// TOC
+	checksum := crc32.Checksum(encf.Bytes(), castagnoliTable)
+	encf.MarshalUint64(uint64(symbolsOff), uint64(pairsOff), uint64(postingsOff), uint64(seriesOff))
+	encf.MarshalUint32(checksum)
+
+	return encf.Bytes()
+}
+
+// mmapIndex 直接从 mmap 中读取 version 3/4 格式的索引 打开时只会读取 Index TOC 以及各区域的数量
+// 所有的读取都会检查边界 越界说明索引已经损坏 返回的错误由 diskSegment 包装成 CorruptionErr
+// 返回的字符串都是复制出来的 segment 被关闭后仍然可以使用
+type mmapIndex struct {
+	b        []byte
+	decf     *decbuf
+	version  uint8
+	checksum uint32
+
+	symbols    int
+	numSymbols int
+
+	pairs    int
+	numPairs int
+
+	series    int
+	numSeries int
+}
+
+func newMmapIndex(b []byte, version uint8) (*mmapIndex, error) {
+	if len(b) < indexTOCSize {
+		return nil, ErrInvalidSize
+	}
+
+	idx := &mmapIndex{b: b, decf: newDecbuf(), version: version}
+	toc := b[len(b)-indexTOCSize:]
+	offs := make([]int, 4)
+	for i := range offs {
+		offs[i] = int(idx.decf.UnmarshalUint64(toc[i*uint64Size:]))
+	}
+	idx.checksum = idx.decf.UnmarshalUint32(toc[len(offs)*uint64Size:])
+
+	// 各区域按顺序排列且都在 TOC 之前
+	limit := len(b) - indexTOCSize
+	for i := range offs {
+		if offs[i] < 0 || offs[i] > limit || (i > 0 && offs[i] < offs[i-1]) {
+			return nil, fmt.Errorf("invalid index toc: %v", offs)
+		}
+	}
+
+	idx.symbols, idx.pairs, idx.series = offs[0], offs[1], offs[3]
+
+	var err error
+	if idx.numSymbols, err = idx.count(idx.symbols, indexSymbolOffsetSz, limit); err != nil {
+		return nil, err
+	}
+	if idx.numPairs, err = idx.count(idx.pairs, indexPairSize, limit); err != nil {
+		return nil, err
+	}
+	if idx.numSeries, err = idx.count(idx.series, indexSeriesSize, limit); err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// count 读取 off 处区域的记录数量 并检查定长记录部分没有超出 limit
+func (idx *mmapIndex) count(off, size, limit int) (int, error) {
+	n, err := idx.u32(off)
+	if err != nil {
+		return 0, err
+	}
+
+	if off+uint32Size+int(n)*size > limit {
+		return 0, ErrInvalidSize
+	}
+	return int(n), nil
+}
+
+// verify 校验 Index TOC 之前的整个索引 耗时与索引大小成正比
+func (idx *mmapIndex) verify() error {
+	if crc32.Checksum(idx.b[:len(idx.b)-indexTOCSize], castagnoliTable) != idx.checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// outOfRange 返回读取越界的错误
+func (idx *mmapIndex) outOfRange(off int) error {
+	return fmt.Errorf("%w: index offset %d out of range %d", ErrInvalidSize, off, len(idx.b))
+}
+
+// u32 读取 off 处的 uint32
+func (idx *mmapIndex) u32(off int) (uint32, error) {
+	if off < 0 || off+uint32Size > len(idx.b) {
+		return 0, idx.outOfRange(off)
+	}
+	return idx.decf.UnmarshalUint32(idx.b[off:]), nil
+}
+
+func (idx *mmapIndex) u64(off int) (uint64, error) {
+	if off < 0 || off+uint64Size > len(idx.b) {
+		return 0, idx.outOfRange(off)
+	}
+	return idx.decf.UnmarshalUint64(idx.b[off:]), nil
+}
+
+// readLen 读取 off 处的长度 返回长度以及其占用的字节数
+func (idx *mmapIndex) readLen(off int) (int, int, error) {
+	if off < 0 || off >= len(idx.b) {
+		return 0, 0, idx.outOfRange(off)
+	}
+
+	if idx.version < segmentFormatV4 {
+		n, err := idx.u32(off)
+		if err != nil {
+			return 0, 0, err
+		}
+		return int(n), uint32Size, nil
+	}
+
+	n, size := idx.decf.UnmarshalUvarint(idx.b[off:])
+	if size <= 0 || n > uint64(len(idx.b)) {
+		return 0, 0, fmt.Errorf("%w: invalid length at index offset %d", ErrInvalidSize, off)
+	}
+	return int(n), size, nil
+}
+
+// list 读取 off 处的 uint32 列表 列表中的值都需要小于 max
+func (idx *mmapIndex) list(off, max int) ([]uint32, error) {
+	n, size, err := idx.readLen(off)
+	if err != nil {
+		return nil, err
+	}
+	off += size
+
+	var ret []uint32
+	if idx.version < segmentFormatV4 {
+		if off+uint32Size*n > len(idx.b) {
+			return nil, idx.outOfRange(off + uint32Size*n)
+		}
+
+		ret = make([]uint32, n)
+		for j := range ret {
+			ret[j] = idx.decf.UnmarshalUint32(idx.b[off+uint32Size*j:])
+		}
+	} else {
+		// 每个差值至少占用一个字节
+		if off+n > len(idx.b) {
+			return nil, idx.outOfRange(off + n)
+		}
+
+		ret = make([]uint32, n)
+		var prev uint32
+		for j := range ret {
+			delta, size := idx.decf.UnmarshalUvarint(idx.b[off:])
+			if size <= 0 {
+				return nil, fmt.Errorf("%w: invalid list item at index offset %d", ErrInvalidSize, off)
+			}
+			off += size
+			prev += uint32(delta)
+			ret[j] = prev
+		}
+	}
+
+	for _, v := range ret {
+		if int(v) >= max {
+			return nil, fmt.Errorf("%w: index list item %d out of range %d", ErrInvalidSize, v, max)
+		}
+	}
+	return ret, nil
+}
+
+// symbolBytes 返回 id 对应的字符串 不做复制
+func (idx *mmapIndex) symbolBytes(id uint32) ([]byte, error) {
+	if int(id) >= idx.numSymbols {
+		return nil, fmt.Errorf("%w: index symbol %d out of range %d", ErrInvalidSize, id, idx.numSymbols)
+	}
+
+	base := idx.symbols + uint32Size + idx.numSymbols*indexSymbolOffsetSz
+	rel, err := idx.u32(idx.symbols + uint32Size + int(id)*indexSymbolOffsetSz)
+	if err != nil {
+		return nil, err
+	}
+
+	off := base + int(rel)
+	n, size, err := idx.readLen(off)
+	if err != nil {
+		return nil, err
+	}
+	if off+size+n > len(idx.b) {
+		return nil, idx.outOfRange(off + size + n)
+	}
+
+	return idx.b[off+size : off+size+n], nil
+}
+
+func (idx *mmapIndex) symbol(id uint32) (string, error) {
+	b, err := idx.symbolBytes(id)
+	return string(b), err
+}
+
+// lookupSymbol 二分查找字符串对应的 symbol id
+func (idx *mmapIndex) lookupSymbol(s string) (uint32, bool, error) {
+	var err error
+	i := sort.Search(idx.numSymbols, func(i int) bool {
+		b, e := idx.symbolBytes(uint32(i))
+		if e != nil && err == nil {
+			err = e
+		}
+		return bytes.Compare(b, []byte(s)) >= 0
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	if i < idx.numSymbols {
+		b, err := idx.symbolBytes(uint32(i))
+		if err != nil {
+			return 0, false, err
+		}
+		if string(b) == s {
+			return uint32(i), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// pair 返回第 i 个 label pair 的 name/value symbol id 以及 postings 偏移量
+func (idx *mmapIndex) pair(i int) (uint32, uint32, int, error) {
+	if i < 0 || i >= idx.numPairs {
+		return 0, 0, 0, fmt.Errorf("%w: index label pair %d out of range %d", ErrInvalidSize, i, idx.numPairs)
+	}
+
+	off := idx.pairs + uint32Size + i*indexPairSize
+	name, err := idx.u32(off)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	value, err := idx.u32(off + uint32Size)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	postings, err := idx.u32(off + uint32Size*2)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return name, value, int(postings), nil
+}
+
+// pairRange 返回 label 名称为 name 的 label pair 下标范围 [lo, hi)
+func (idx *mmapIndex) pairRange(name uint32) (int, int, error) {
+	var err error
+	nameAt := func(i int) uint32 {
+		n, _, _, e := idx.pair(i)
+		if e != nil && err == nil {
+			err = e
+		}
+		return n
+	}
+
+	lo := sort.Search(idx.numPairs, func(i int) bool {
+		return nameAt(i) >= name
+	})
+	hi := sort.Search(idx.numPairs, func(i int) bool {
+		return nameAt(i) > name
+	})
+
+	return lo, hi, err
+}
+
+func (idx *mmapIndex) LabelNames() ([]string, error) {
+	ret := make([]string, 0)
+	for i := 0; i < idx.numPairs; {
+		name, _, _, err := idx.pair(i)
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := idx.symbol(name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+
+		_, hi, err := idx.pairRange(name)
+		if err != nil {
+			return nil, err
+		}
+		if hi <= i {
+			return nil, fmt.Errorf("index label pairs are not sorted at %d", i)
+		}
+		i = hi
+	}
+
+	return ret, nil
+}
+
+func (idx *mmapIndex) LabelValues(name string) ([]string, error) {
+	ret := make([]string, 0)
+	id, ok, err := idx.lookupSymbol(name)
+	if err != nil || !ok {
+		return ret, err
+	}
+
+	lo, hi, err := idx.pairRange(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := lo; i < hi; i++ {
+		_, value, _, err := idx.pair(i)
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := idx.symbol(value)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+
+	return ret, nil
+}
+
+func (idx *mmapIndex) Postings(name, value string) (*roaring.Bitmap, error) {
+	ret := roaring.New()
+
+	nid, ok, err := idx.lookupSymbol(name)
+	if err != nil || !ok {
+		return ret, err
+	}
+
+	vid, ok, err := idx.lookupSymbol(value)
+	if err != nil || !ok {
+		return ret, err
+	}
+
+	lo, hi, err := idx.pairRange(nid)
+	if err != nil {
+		return nil, err
+	}
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		_, v, _, e := idx.pair(lo + i)
+		if e != nil && err == nil {
+			err = e
+		}
+		return v >= vid
+	})
+	if err != nil {
+		return nil, err
+	}
+	if i >= hi {
+		return ret, nil
+	}
+
+	_, v, off, err := idx.pair(i)
+	if err != nil || v != vid {
+		return ret, err
+	}
+
+	sids, err := idx.list(off, idx.numSeries)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.AddMany(sids)
+	return ret, nil
+}
+
+func (idx *mmapIndex) NumSeries() int {
+	return idx.numSeries
+}
+
+// seriesOffset 返回 sid 对应的定长 series 记录的偏移量
+func (idx *mmapIndex) seriesOffset(sid uint32) (int, error) {
+	if int(sid) >= idx.numSeries {
+		return 0, fmt.Errorf("%w: index series %d out of range %d", ErrInvalidSize, sid, idx.numSeries)
+	}
+	return idx.series + uint32Size + int(sid)*indexSeriesSize, nil
+}
+
+func (idx *mmapIndex) SeriesLabels(sid uint32) (LabelSet, error) {
+	off, err := idx.seriesOffset(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := idx.u32(off + uint64Size*2)
+	if err != nil {
+		return nil, err
+	}
+
+	lids, err := idx.list(int(labels), idx.numPairs)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(LabelSet, 0, len(lids))
+	for _, lid := range lids {
+		name, value, _, err := idx.pair(int(lid))
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := idx.symbol(name)
+		if err != nil {
+			return nil, err
+		}
+		v, err := idx.symbol(value)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Label{Name: n, Value: v})
+	}
+
+	return ret, nil
+}
+
+func (idx *mmapIndex) SeriesChunk(sid uint32) (uint64, uint64, error) {
+	off, err := idx.seriesOffset(sid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start, err := idx.u64(off)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := idx.u64(off + uint64Size)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start > end {
+		return 0, 0, fmt.Errorf("%w: index series %d has an invalid chunk range [%d, %d)", ErrInvalidSize, sid, start, end)
+	}
+	return start, end, nil
+}
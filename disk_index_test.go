@@ -0,0 +1,120 @@
+package mandodb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMmapIndex(t *testing.T) {
+	labels := func(node, dc string) LabelSet {
+		ls := LabelSet{{Name: "node", Value: node}, {Name: "dc", Value: dc}}.AddMetricName("cpu.busy")
+		ls.Sorted()
+		return ls
+	}
+
+	series := []indexSeries{
+		{labels: labels("vm1", "sh"), start: 0, end: 10},
+		{labels: labels("vm0", "bj"), start: 14, end: 30},
+		{labels: labels("vm2", "sh"), start: 34, end: 40},
+	}
+
+	for _, version := range []uint8{segmentFormatV3, segmentFormatV4} {
+		testMmapIndex(t, labels, marshalIndex(series, version), version)
+	}
+
+	assert.True(t, len(marshalIndex(series, segmentFormatV4)) < len(marshalIndex(series, segmentFormatV3)))
+}
+
+func testMmapIndex(t *testing.T, labels func(node, dc string) LabelSet, b []byte, version uint8) {
+	idx, err := newMmapIndex(b, version)
+	assert.NoError(t, err)
+	assert.NoError(t, idx.verify())
+
+	values := func(vs []string, err error) []string {
+		assert.NoError(t, err)
+		return vs
+	}
+	postings := func(name, value string) []uint32 {
+		bm, err := idx.Postings(name, value)
+		assert.NoError(t, err)
+		return bm.ToArray()
+	}
+	match := func(lms LabelMatcherSet) []uint32 {
+		sids, err := matchDiskSids(idx, lms)
+		assert.NoError(t, err)
+		return sids
+	}
+
+	assert.Equal(t, 3, idx.NumSeries())
+	assert.Equal(t, []string{"__name__", "dc", "node"}, values(idx.LabelNames()))
+	assert.Equal(t, []string{"vm0", "vm1", "vm2"}, values(idx.LabelValues("node")))
+	assert.Equal(t, []string{}, values(idx.LabelValues("unknown")))
+
+	assert.Equal(t, []uint32{0, 2}, postings("dc", "sh"))
+	assert.Empty(t, postings("dc", "gz"))
+	assert.Empty(t, postings("unknown", "sh"))
+
+	ls, err := idx.SeriesLabels(1)
+	assert.NoError(t, err)
+	assert.Equal(t, labels("vm0", "bj"), ls)
+	start, end, err := idx.SeriesChunk(2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(34), start)
+	assert.Equal(t, uint64(40), end)
+
+	_, err = idx.SeriesLabels(3)
+	assert.True(t, errors.Is(err, ErrInvalidSize))
+	_, _, err = idx.SeriesChunk(3)
+	assert.True(t, errors.Is(err, ErrInvalidSize))
+
+	assert.Equal(t, []uint32{0, 1}, match(LabelMatcherSet{{Name: "node", Value: "vm[01]", Type: MatchRegexp}}))
+	assert.Equal(t, []uint32{2}, match(LabelMatcherSet{
+		{Name: "dc", Value: "sh"},
+		{Name: "node", Value: "vm1", Type: MatchNotEqual},
+	}))
+	assert.Equal(t, []uint32{0, 1, 2}, match(LabelMatcherSet{{Name: "zone", Value: ""}}))
+	assert.Empty(t, match(LabelMatcherSet{{Name: "node", Value: "vm3"}}))
+
+	// Index TOC 中的偏移量超出范围
+	broken := append([]byte(nil), b...)
+	broken[len(broken)-checksumSize-1] = 0xff
+	_, err = newMmapIndex(broken, version)
+	assert.Error(t, err)
+
+	_, err = newMmapIndex(b[:indexTOCSize-1], version)
+	assert.Equal(t, ErrInvalidSize, err)
+
+	// 打开时不会读取 series 记录 越界的 label 列表偏移量在读取时才返回错误 完整校验可以发现损坏
+	broken = append([]byte(nil), b...)
+	copy(broken[idx.series+uint32Size+uint64Size*2:], []byte{0xff, 0xff, 0xff, 0xff})
+	bidx, err := newMmapIndex(broken, version)
+	assert.NoError(t, err)
+	_, err = bidx.SeriesLabels(0)
+	assert.True(t, errors.Is(err, ErrInvalidSize))
+	assert.Equal(t, ErrChecksumMismatch, bidx.verify())
+
+	// 任意一个字节损坏都不能导致 panic
+	for i := range b {
+		broken = append(broken[:0], b...)
+		broken[i] ^= 0xff
+		idx, err := newMmapIndex(broken, version)
+		if err != nil {
+			continue
+		}
+
+		names, _ := idx.LabelNames()
+		for _, name := range names {
+			vs, _ := idx.LabelValues(name)
+			for _, value := range vs {
+				_, _ = idx.Postings(name, value)
+			}
+		}
+		for sid := 0; sid < idx.NumSeries(); sid++ {
+			_, _ = idx.SeriesLabels(uint32(sid))
+			_, _, _ = idx.SeriesChunk(uint32(sid))
+		}
+		_, _ = matchDiskSids(idx, LabelMatcherSet{{Name: "node", Value: "vm.*", Type: MatchRegexp}})
+	}
+}
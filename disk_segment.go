@@ -2,74 +2,196 @@ package mandodb
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/chenjiandongx/logger"
 	"github.com/dgryski/go-tsz"
 
+	"github.com/chenjiandongx/mandodb/pkg/chunkenc"
 	"github.com/chenjiandongx/mandodb/pkg/mmap"
 )
 
+// data 文件布局
+//
+// ┌───────────────────────────────────── Header ─────────────────────────────────────┐
+// │ magic(uint32) │ version(uint8) │ bytesCompressor(uint8) │ metaSerializer(uint8) │ reserved(uint8) │
+// ├──────────────────────────────────── TOC ─────────────────────────────────────────┤
+// │ dataSize(uint64) │ metaSize(uint64) │
+// ├──────────────────────────────────── Data ────────────────────────────────────────┤
+// │ series chunk 1 │ crc32 │ series chunk 2 │ crc32 │ ... │
+// ├──────────────────────────────────── Meta ────────────────────────────────────────┤
+// │ meta block │ crc32 │
+// └──────────────────────────────────────────────────────────────────────────────────┘
+//
+// version 0 的文件没有 Header 以及 crc32 校验
+// version 0/1 的 series chunk 使用 go-tsz 编码 时间戳只支持 uint32
+// version 2 的 series chunk 格式为 数据点数量(uint32) | XOR 数据流 时间戳为 int64
+// version 3 的 Meta 区域替换为不压缩的索引(见 disk_index.go) crc32 只校验索引末尾的 Index TOC
+// version 4 的索引使用 uvarint 以及差值编码 体积更小
+
+const (
+	segmentMagic      uint32 = 0x4d414e44 // MAND
+	segmentHeaderSize        = 8
+	segmentTOCSize           = uint64Size * 2
+	checksumSize             = uint32Size
+
+	segmentFormatV0 uint8 = 0
+	segmentFormatV1 uint8 = 1
+	segmentFormatV2 uint8 = 2
+	segmentFormatV3 uint8 = 3
+	segmentFormatV4 uint8 = 4
+)
+
+// ErrChecksumMismatch 数据校验失败
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// CorruptionErr 表示 Segment 数据文件已经损坏
+type CorruptionErr struct {
+	Dir string
+	Err error
+}
+
+func (e *CorruptionErr) Error() string {
+	return fmt.Sprintf("segment %s is corrupted: %v", e.Dir, e.Err)
+}
+
+func (e *CorruptionErr) Unwrap() error {
+	return e.Err
+}
+
+// segmentHeader 记录了 data 文件的格式版本以及写入时使用的压缩算法和序列化方式
+type segmentHeader struct {
+	version         uint8
+	bytesCompressor BytesCompressorType
+	metaSerializer  MetaSerializerType
+}
+
+func (h segmentHeader) Marshal() []byte {
+	encf := newEncbuf()
+	encf.MarshalUint32(segmentMagic)
+	encf.MarshalUint8(h.version)
+	encf.MarshalUint8(uint8(h.bytesCompressor))
+	encf.MarshalUint8(uint8(h.metaSerializer))
+	encf.MarshalUint8(0) // reserved
+
+	return encf.Bytes()
+}
+
+// readSegmentHeader 读取文件头 没有 magic 的文件视为 version 0
+func readSegmentHeader(b []byte) segmentHeader {
+	decf := newDecbuf()
+	if len(b) < segmentHeaderSize || decf.UnmarshalUint32(b[:uint32Size]) != segmentMagic {
+		return segmentHeader{version: segmentFormatV0}
+	}
+
+	return segmentHeader{
+		version:         b[4],
+		bytesCompressor: BytesCompressorType(b[5]),
+		metaSerializer:  MetaSerializerType(b[6]),
+	}
+}
+
+// Size 返回文件头长度
+func (h segmentHeader) Size() int64 {
+	if h.version == segmentFormatV0 {
+		return 0
+	}
+	return segmentHeaderSize
+}
+
+// ChecksumSize 返回每个数据块的校验和长度
+func (h segmentHeader) ChecksumSize() int64 {
+	if h.version == segmentFormatV0 {
+		return 0
+	}
+	return checksumSize
+}
+
 // diskSegment 持久化 segment 磁盘数据使用 mmap 的方式按需加载
 type diskSegment struct {
 	dataFd       *mmap.MmapFile
 	dataFilename string
 	dir          string
+	header       segmentHeader
 	load         bool
+	mut          sync.Mutex
 
-	wg       sync.WaitGroup
-	labelVs  *labelValueSet
-	indexMap *diskIndexMap
-	series   []metaSeries
+	opts *tsdbOptions
+
+	// 写入该 segment 时所使用的压缩器和序列化器
+	bytesCompressor BytesCompressor
+	metaSerializer  MetaSerializer
+
+	wg    sync.WaitGroup
+	index diskIndex
 
 	minTs int64
 	maxTs int64
 
 	seriesCount     int64
 	dataPointsCount int64
+
+	// walSeq 该 segment 数据所对应的最后一个 WAL 文件序号
+	walSeq int
+
+	// seq 写入顺序 见 Desc.Seq
+	seq int64
+
+	// size segment 文件夹占用的磁盘空间
+	size int64
+
+	// tombstones 记录被删除的数据区间 deleted 为数据已经被全部删除的 sid
+	tombMut    sync.RWMutex
+	tombstones map[uint32]intervals
+	deleted    *roaring.Bitmap
 }
 
 type tocReader struct {
 	reader *bytes.Reader
+	offset int64
 }
 
 func (t *tocReader) Read() (int64, int64, error) {
 	// 读取 dataBytes 长度
 	dst := make([]byte, uint64Size)
-	_, err := t.reader.ReadAt(dst, 0)
+	_, err := t.reader.ReadAt(dst, t.offset)
 	if err != nil {
 		return 0, 0, err
 	}
 
 	decf := newDecbuf()
-	decf.UnmarshalUint64(dst)
 	dataSize := decf.UnmarshalUint64(dst)
 
 	// 读取 metaBytes 长度
 	dst = make([]byte, uint64Size)
-	_, err = t.reader.ReadAt(dst, uint64Size)
+	_, err = t.reader.ReadAt(dst, t.offset+uint64Size)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	decf = newDecbuf()
-	decf.UnmarshalUint64(dst)
 	metaSize := decf.UnmarshalUint64(dst)
 
 	return int64(dataSize), int64(metaSize), nil
 }
 
-func newDiskSegment(mf *mmap.MmapFile, dir string, minTs, maxTs int64) Segment {
+func newDiskSegment(mf *mmap.MmapFile, dir string, minTs, maxTs int64, opts *tsdbOptions) Segment {
 	return &diskSegment{
+		opts:         opts,
 		dataFd:       mf,
 		dir:          dir,
-		dataFilename: path.Join(dir, "meta.json"),
+		dataFilename: path.Join(dir, "data"),
+		header:       readSegmentHeader(mf.Bytes()),
 		minTs:        minTs,
 		maxTs:        maxTs,
-		labelVs:      newLabelValueSet(),
+		size:         dirSize(dir),
 	}
 }
 
@@ -81,6 +203,10 @@ func (ds *diskSegment) MaxTs() int64 {
 	return ds.maxTs
 }
 
+func (ds *diskSegment) Seq() int64 {
+	return ds.seq
+}
+
 func (ds *diskSegment) Frozen() bool {
 	return true
 }
@@ -89,6 +215,11 @@ func (ds *diskSegment) Type() SegmentType {
 	return DiskSegmentType
 }
 
+// Size 返回 segment 文件夹占用的磁盘空间
+func (ds *diskSegment) Size() int64 {
+	return atomic.LoadInt64(&ds.size)
+}
+
 func (ds *diskSegment) Close() error {
 	ds.wg.Wait() // 确保没有进程在使用 fd
 	return ds.dataFd.Close()
@@ -98,116 +229,506 @@ func (ds *diskSegment) Cleanup() error {
 	return os.RemoveAll(ds.dir)
 }
 
-func (ds *diskSegment) shift() uint64 {
-	return uint64Size * 2
+func (ds *diskSegment) shift() int64 {
+	return ds.header.Size() + segmentTOCSize
 }
 
-func (ds *diskSegment) Load() Segment {
-	// 仅加载一次即可
-	if ds.load {
-		return ds
+func (ds *diskSegment) corruption(err error) error {
+	return &CorruptionErr{Dir: ds.dir, Err: err}
+}
+
+// readTOC 读取 TOC 并校验文件长度是否与 TOC 描述一致
+func (ds *diskSegment) readTOC() (int64, int64, error) {
+	tocRr := &tocReader{reader: bytes.NewReader(ds.dataFd.Bytes()), offset: ds.header.Size()}
+	dataSize, metaSize, err := tocRr.Read()
+	if err != nil {
+		return 0, 0, ds.corruption(err)
+	}
+
+	if ds.shift()+dataSize+metaSize+ds.header.ChecksumSize() != int64(len(ds.dataFd.Bytes())) {
+		return 0, 0, ds.corruption(ErrInvalidSize)
+	}
+
+	return dataSize, metaSize, nil
+}
+
+// readBlock 读取 [start, end) 的数据块并校验紧随其后的 crc32
+func (ds *diskSegment) readBlock(start, end int64) ([]byte, error) {
+	if start < 0 || end < start {
+		return nil, ds.corruption(ErrInvalidSize)
 	}
 
-	t0 := time.Now()
 	reader := bytes.NewReader(ds.dataFd.Bytes())
+	block := make([]byte, end-start)
+	if _, err := reader.ReadAt(block, start); err != nil {
+		return nil, ds.corruption(err)
+	}
 
-	tocRr := &tocReader{reader: reader}
-	dataSize, metaSize, err := tocRr.Read()
+	if ds.header.version == segmentFormatV0 {
+		return block, nil
+	}
+
+	checksum := make([]byte, checksumSize)
+	if _, err := reader.ReadAt(checksum, end); err != nil {
+		return nil, ds.corruption(err)
+	}
+
+	if newDecbuf().UnmarshalUint32(checksum) != crc32.Checksum(block, castagnoliTable) {
+		return nil, ds.corruption(ErrChecksumMismatch)
+	}
+
+	return block, nil
+}
+
+// resolveCodec 根据文件头选择解码使用的压缩器和序列化器
+// version 0 的文件没有记录相关信息 只能使用当前的配置
+func (ds *diskSegment) resolveCodec() error {
+	if ds.header.version == segmentFormatV0 {
+		ds.bytesCompressor = ds.opts.bytesCompressor
+		ds.metaSerializer = ds.opts.metaSerializer
+		return nil
+	}
+
+	compressor, err := newBytesCompressor(ds.header.bytesCompressor)
 	if err != nil {
-		logger.Errorf("failed to read %s toc: %v", ds.dataFilename, err)
-		return ds
+		return ds.corruption(err)
 	}
 
-	metaBytes := make([]byte, metaSize)
-	_, err = reader.ReadAt(metaBytes, uint64Size*2+int64(dataSize))
+	serializer, err := newMetaSerializer(ds.header.metaSerializer)
 	if err != nil {
-		logger.Errorf("failed to read %s meta-bytes: %v", ds.dataFilename, err)
-		return ds
+		return ds.corruption(err)
 	}
 
-	var meta Metadata
-	if err := UnmarshalMeta(metaBytes, &meta); err != nil {
-		logger.Errorf("failed to unmarshal meta: %v", err)
-		return ds
+	ds.bytesCompressor = compressor
+	ds.metaSerializer = serializer
+	return nil
+}
+
+func (ds *diskSegment) Load() (Segment, error) {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+
+	// 仅加载一次即可
+	if ds.load {
+		return ds, nil
 	}
 
-	for _, label := range meta.Labels {
-		k, v := unmarshalLabelName(label.Name)
-		if k != "" && v != "" {
-			ds.labelVs.Set(k, v)
-		}
+	if ds.header.version > segmentFormatV4 {
+		return nil, fmt.Errorf("unsupported segment format version %d of %s", ds.header.version, ds.dataFilename)
+	}
+
+	if err := ds.resolveCodec(); err != nil {
+		return nil, err
 	}
 
-	ds.indexMap = newDiskIndexMap(meta.Labels)
-	ds.series = meta.Series
+	t0 := time.Now()
+	dataSize, metaSize, err := ds.readTOC()
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := ds.loadIndex(ds.shift()+dataSize, metaSize)
+	if err != nil {
+		return nil, err
+	}
+
+	tombstones, err := readTombstones(ds.dir)
+	if err != nil {
+		return nil, ds.corruption(err)
+	}
+
+	ds.index = index
+	ds.setTombstones(tombstones)
 	ds.load = true
 
 	logger.Infof("load disk segment %s, take: %v", ds.dataFilename, time.Since(t0))
-	return ds
+	return ds, nil
 }
 
-func (ds *diskSegment) InsertRows(_ []*Row) {
+// loadIndex 加载 [start, start+size) 区域的索引
+// version 3 之前需要解码整个 Metadata 并构建内存索引 version 3 开始只需读取并校验 Index TOC
+func (ds *diskSegment) loadIndex(start, size int64) (diskIndex, error) {
+	if ds.header.version < segmentFormatV3 {
+		metaBytes, err := ds.readBlock(start, start+size)
+		if err != nil {
+			return nil, err
+		}
+
+		var meta Metadata
+		if err := UnmarshalMeta(ds.metaSerializer, ds.bytesCompressor, metaBytes, &meta); err != nil {
+			return nil, ds.corruption(err)
+		}
+
+		return newDiskIndexMap(meta), nil
+	}
+
+	if size < indexTOCSize {
+		return nil, ds.corruption(ErrInvalidSize)
+	}
+
+	b := ds.dataFd.Bytes()
+	end := start + size
+	if newDecbuf().UnmarshalUint32(b[end:]) != crc32.Checksum(b[end-indexTOCSize:end], castagnoliTable) {
+		return nil, ds.corruption(ErrChecksumMismatch)
+	}
+
+	index, err := newMmapIndex(b[start:end], ds.header.version)
+	if err != nil {
+		return nil, ds.corruption(err)
+	}
+
+	return index, nil
+}
+
+// verifyIndex 校验整个索引 加载时只校验了 Index TOC 读取整个 segment 之前调用
+// version 3 之前的 Metadata 在加载时就已经完整校验过了
+func (ds *diskSegment) verifyIndex() error {
+	idx, ok := ds.index.(*mmapIndex)
+	if !ok {
+		return nil
+	}
+
+	if err := idx.verify(); err != nil {
+		return ds.corruption(err)
+	}
+	return nil
+}
+
+func (ds *diskSegment) InsertRows(_ []*Row) InsertResult {
 	panic("BUG: disk segments are not mutable")
 }
 
-func (ds *diskSegment) QueryLabelValues(label string) []string {
-	return ds.labelVs.Get(label)
+// setTombstones 更新 tombstones 并重新计算数据已经被全部删除的 sid
+func (ds *diskSegment) setTombstones(tombstones map[uint32]intervals) {
+	deleted := roaring.New()
+	for sid, ivs := range tombstones {
+		if ivs.covers(ds.minTs, ds.maxTs) {
+			deleted.Add(sid)
+		}
+	}
+
+	ds.tombMut.Lock()
+	ds.tombstones = tombstones
+	ds.deleted = deleted
+	ds.tombMut.Unlock()
 }
 
-func (ds *diskSegment) QuerySeries(lms LabelMatcherSet) ([]LabelSet, error) {
-	sids := ds.indexMap.MatchSids(ds.labelVs, lms)
-	ret := make([]LabelSet, 0)
+// hasTombstones 判断 segment 是否存在 tombstones 不需要加载 segment
+func (ds *diskSegment) hasTombstones() bool {
+	return isFileExist(path.Join(ds.dir, tombstonesFilename))
+}
 
+// matchSids 返回满足 lms 且没有被全部删除的 sid
+func (ds *diskSegment) matchSids(lms LabelMatcherSet) ([]uint32, error) {
+	sids, err := matchDiskSids(ds.index, lms)
+	if err != nil {
+		return nil, ds.corruption(err)
+	}
+
+	ds.tombMut.RLock()
+	defer ds.tombMut.RUnlock()
+
+	if ds.deleted.IsEmpty() {
+		return sids, nil
+	}
+
+	ret := sids[:0]
 	for _, sid := range sids {
-		ret = append(ret, ds.indexMap.MatchLabels(ds.series[sid].Labels...))
+		if !ds.deleted.Contains(sid) {
+			ret = append(ret, sid)
+		}
 	}
 
 	return ret, nil
 }
 
-func (ds *diskSegment) QueryRange(lms LabelMatcherSet, start, end int64) ([]MetricRet, error) {
-	ds.wg.Add(1)
-	defer ds.wg.Done()
+// seriesLabels 返回 sid 对应的 LabelSet 索引损坏时返回 CorruptionErr
+func (ds *diskSegment) seriesLabels(sid uint32) (LabelSet, error) {
+	labels, err := ds.index.SeriesLabels(sid)
+	if err != nil {
+		return nil, ds.corruption(err)
+	}
+	return labels, nil
+}
 
-	sids := ds.indexMap.MatchSids(ds.labelVs, lms)
+// QueryLabelNames 没有指定 lms 时直接从 label 索引中获取 否则从满足 lms 的 series 中收集
+func (ds *diskSegment) QueryLabelNames(lms LabelMatcherSet) ([]string, error) {
+	if len(lms) > 0 {
+		sids, err := ds.matchSids(lms)
+		if err != nil {
+			return nil, err
+		}
 
-	ret := make([]MetricRet, 0)
-	for _, sid := range sids {
-		startOffset := ds.series[sid].StartOffset + ds.shift()
-		endOffset := ds.series[sid].EndOffset + ds.shift()
+		ret := make([]string, 0)
+		for _, sid := range sids {
+			labels, err := ds.seriesLabels(sid)
+			if err != nil {
+				return nil, err
+			}
+			for _, label := range labels {
+				ret = append(ret, label.Name)
+			}
+		}
+		return ret, nil
+	}
+
+	ds.tombMut.RLock()
+	defer ds.tombMut.RUnlock()
+
+	names, err := ds.index.LabelNames()
+	if err != nil {
+		return nil, ds.corruption(err)
+	}
 
-		reader := bytes.NewReader(ds.dataFd.Bytes())
-		dataBytes := make([]byte, endOffset-startOffset)
-		_, err := reader.ReadAt(dataBytes, int64(startOffset))
+	if ds.deleted.IsEmpty() {
+		return names, nil
+	}
+
+	// 过滤掉只存在于已删除 series 中的 label 名称
+	ret := make([]string, 0)
+	for _, name := range names {
+		values, err := liveLabelValues(ds.index, name, ds.deleted)
+		if err != nil {
+			return nil, ds.corruption(err)
+		}
+		if len(values) > 0 {
+			ret = append(ret, name)
+		}
+	}
+
+	return ret, nil
+}
+
+// QueryLabelValues 没有指定 lms 时直接从 label 索引中获取 否则从满足 lms 的 series 中收集
+func (ds *diskSegment) QueryLabelValues(label string, lms LabelMatcherSet) ([]string, error) {
+	if len(lms) > 0 {
+		sids, err := ds.matchSids(lms)
 		if err != nil {
 			return nil, err
 		}
 
-		dataBytes, err = ByteDecompress(dataBytes)
+		ret := make([]string, 0)
+		for _, sid := range sids {
+			labels, err := ds.seriesLabels(sid)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range labels {
+				if l.Name == label {
+					ret = append(ret, l.Value)
+				}
+			}
+		}
+		return ret, nil
+	}
+
+	ds.tombMut.RLock()
+	defer ds.tombMut.RUnlock()
+
+	var values []string
+	var err error
+	if ds.deleted.IsEmpty() {
+		values, err = ds.index.LabelValues(label)
+	} else {
+		// 过滤掉只存在于已删除 series 中的 label 值
+		values, err = liveLabelValues(ds.index, label, ds.deleted)
+	}
+	if err != nil {
+		return nil, ds.corruption(err)
+	}
+
+	return values, nil
+}
+
+// DeleteSeries 记录满足 lms 的 series 在 [start, end] 区间内的 tombstones
+// 数据点被全部删除的 series 对应的区间会扩展成整个 segment 的时间范围
+func (ds *diskSegment) DeleteSeries(lms LabelMatcherSet, start, end int64) error {
+	sids, err := ds.matchSids(lms)
+	if err != nil {
+		return err
+	}
+	if len(sids) == 0 {
+		return nil
+	}
+
+	ds.tombMut.RLock()
+	tombstones := make(map[uint32]intervals, len(ds.tombstones)+len(sids))
+	for sid, ivs := range ds.tombstones {
+		tombstones[sid] = ivs
+	}
+	ds.tombMut.RUnlock()
+
+	for _, sid := range sids {
+		ivs := tombstones[sid].add(interval{Start: start, End: end})
+
+		points, err := ds.readRawPoints(sid, ds.minTs, ds.maxTs)
+		if err != nil {
+			return err
+		}
+
+		if len(ivs.filter(points)) == 0 {
+			ivs = ivs.add(interval{Start: ds.minTs, End: ds.maxTs})
+		}
+		tombstones[sid] = ivs
+	}
+
+	if err := writeTombstones(ds.dir, tombstones); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&ds.size, dirSize(ds.dir))
+
+	ds.setTombstones(tombstones)
+	return nil
+}
+
+func (ds *diskSegment) QuerySeries(lms LabelMatcherSet) ([]LabelSet, error) {
+	sids, err := ds.matchSids(lms)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]LabelSet, 0)
+	for _, sid := range sids {
+		labels, err := ds.seriesLabels(sid)
 		if err != nil {
 			return nil, err
 		}
+		ret = append(ret, labels)
+	}
+
+	return ret, nil
+}
+
+// readPoints 返回 sid 在 [start, end] 范围内且没有被删除的数据点
+func (ds *diskSegment) readPoints(sid uint32, start, end int64) ([]Point, error) {
+	return collectPoints(ds.seriesIterator(sid, start, end))
+}
+
+// readRawPoints 返回 sid 在 [start, end] 范围内的数据点 包括已经被删除的数据点
+func (ds *diskSegment) readRawPoints(sid uint32, start, end int64) ([]Point, error) {
+	return collectPoints(ds.rawIterator(sid, start, end))
+}
+
+// seriesIterator 返回 sid 在 [start, end] 范围内且没有被删除的数据点迭代器
+func (ds *diskSegment) seriesIterator(sid uint32, start, end int64) SeriesIterator {
+	it := ds.rawIterator(sid, start, end)
+
+	ds.tombMut.RLock()
+	ivs := ds.tombstones[sid]
+	ds.tombMut.RUnlock()
 
+	if len(ivs) == 0 {
+		return it
+	}
+	return &tombstoneIterator{SeriesIterator: it, ivs: ivs}
+}
+
+// rawIterator 读取并解压 sid 对应的 series chunk 数据点在迭代时才解码
+func (ds *diskSegment) rawIterator(sid uint32, start, end int64) SeriesIterator {
+	chunkStart, chunkEnd, err := ds.index.SeriesChunk(sid)
+	if err != nil {
+		return errSeriesIterator{err: ds.corruption(err)}
+	}
+	startOffset := int64(chunkStart) + ds.shift()
+	endOffset := int64(chunkEnd) + ds.shift()
+
+	dataBytes, err := ds.readBlock(startOffset, endOffset)
+	if err != nil {
+		return errSeriesIterator{err: err}
+	}
+
+	dataBytes, err = ds.bytesCompressor.Decompress(dataBytes)
+	if err != nil {
+		return errSeriesIterator{err: ds.corruption(err)}
+	}
+
+	if ds.header.version < segmentFormatV2 {
 		iter, err := tsz.NewIterator(dataBytes)
 		if err != nil {
-			return nil, err
+			return errSeriesIterator{err: ds.corruption(err)}
+		}
+		return &tszSeriesIterator{it: iter, start: start, end: end}
+	}
+
+	if len(dataBytes) < uint32Size {
+		return errSeriesIterator{err: ds.corruption(ErrInvalidSize)}
+	}
+
+	n := newDecbuf().UnmarshalUint32(dataBytes[:uint32Size])
+	return &xorSeriesIterator{
+		it:    chunkenc.NewIterator(dataBytes[uint32Size:], int(n)),
+		start: start,
+		end:   end,
+		wrap:  ds.corruption,
+	}
+}
+
+// diskSeries diskSegment 中的 series 数据点在调用 Iterator 时才会读取
+type diskSeries struct {
+	ds         *diskSegment
+	sid        uint32
+	labels     LabelSet
+	start, end int64
+}
+
+func (s *diskSeries) Labels() LabelSet {
+	return s.labels
+}
+
+func (s *diskSeries) Iterator() SeriesIterator {
+	return s.ds.seriesIterator(s.sid, s.start, s.end)
+}
+
+func (ds *diskSegment) Select(lms LabelMatcherSet, start, end int64) SeriesSet {
+	sids, err := ds.matchSids(lms)
+	if err != nil {
+		return errSeriesSet{err: err}
+	}
+
+	ret := make([]Series, 0, len(sids))
+	for _, sid := range sids {
+		labels, err := ds.seriesLabels(sid)
+		if err != nil {
+			return errSeriesSet{err: err}
 		}
 
-		points := make([]Point, 0)
-		for iter.Next() {
-			ts, val := iter.Values()
-			if ts > uint32(end) {
-				break
-			}
+		ret = append(ret, &diskSeries{
+			ds:     ds,
+			sid:    sid,
+			labels: labels,
+			start:  start,
+			end:    end,
+		})
+	}
 
-			if ts >= uint32(start) && ts <= uint32(end) {
-				points = append(points, Point{Ts: int64(ts), Value: val})
-			}
+	return newListSeriesSet(ret)
+}
+
+// allSeries 返回所有没有被全部删除的 series 按 LabelSet 升序排列 数据点在迭代时才会读取 已经被删除的数据点会被忽略
+func (ds *diskSegment) allSeries() SeriesSet {
+	ret := make([]Series, 0, ds.index.NumSeries())
+	for sid := 0; sid < ds.index.NumSeries(); sid++ {
+		ds.tombMut.RLock()
+		deleted := ds.deleted.Contains(uint32(sid))
+		ds.tombMut.RUnlock()
+
+		if deleted {
+			continue
 		}
 
-		lbs := ds.indexMap.MatchLabels(ds.series[sid].Labels...)
-		ret = append(ret, MetricRet{Points: points, Labels: lbs})
+		labels, err := ds.seriesLabels(uint32(sid))
+		if err != nil {
+			return errSeriesSet{err: err}
+		}
+
+		ret = append(ret, &diskSeries{
+			ds:     ds,
+			sid:    uint32(sid),
+			labels: labels,
+			start:  ds.minTs,
+			end:    ds.maxTs,
+		})
 	}
 
-	return ret, nil
+	return newListSeriesSet(ret)
 }
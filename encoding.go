@@ -46,6 +46,13 @@ func (e *encbuf) MarshalUint64(u ...uint64) {
 	}
 }
 
+func (e *encbuf) MarshalUvarint(u ...uint64) {
+	for _, num := range u {
+		n := binary.PutUvarint(e.C[:], num)
+		e.B = append(e.B, e.C[:n]...)
+	}
+}
+
 func (e *encbuf) MarshalBytes(b []byte) {
 	e.B = append(e.B, b...)
 }
@@ -90,6 +97,16 @@ func (d *decbuf) UnmarshalUint64(b []byte) uint64 {
 	return binary.LittleEndian.Uint64(b)
 }
 
+// UnmarshalUvarint 返回解码的数值以及占用的字节数
+func (d *decbuf) UnmarshalUvarint(b []byte) (uint64, int) {
+	num, n := binary.Uvarint(b)
+	if n <= 0 {
+		d.err = ErrInvalidSize
+		return 0, 0
+	}
+	return num, n
+}
+
 func (d *decbuf) UnmarshalString(b []byte) string {
 	return yoloString(b)
 }
@@ -0,0 +1,624 @@
+package mandodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/chenjiandongx/mandodb/pkg/promql"
+)
+
+// PromQL 查询引擎 表达式的解析由 pkg/promql 负责 这里负责求值
+// 求值前会先把表达式中所有 selector 对应的数据一次性查询出来 然后在每个时间点上对语法树求值
+
+// ValueType 查询结果类型
+type ValueType = promql.ValueType
+
+const (
+	ValueTypeScalar = promql.ValueTypeScalar
+	ValueTypeVector = promql.ValueTypeVector
+	ValueTypeMatrix = promql.ValueTypeMatrix
+)
+
+// Value 查询结果 可能是 Scalar、Vector 或者 Matrix
+type Value interface {
+	Type() ValueType
+}
+
+// Scalar 表示某个时间点上的一个数值
+type Scalar struct {
+	T int64
+	V float64
+}
+
+func (s Scalar) Type() ValueType { return ValueTypeScalar }
+
+// Sample 表示某个 series 在某个时间点上的数据点
+type Sample struct {
+	Labels LabelSet
+	Point  Point
+}
+
+// Vector 即时向量 同一个时间点上多个 series 的数据点
+type Vector []Sample
+
+func (v Vector) Type() ValueType { return ValueTypeVector }
+
+// Matrix 区间向量 多个 series 在一段时间内的数据点
+type Matrix []MetricRet
+
+func (m Matrix) Type() ValueType { return ValueTypeMatrix }
+
+const (
+	// defaultLookbackDelta 即时向量向前查找数据点的最大时间跨度
+	defaultLookbackDelta = 5 * time.Minute
+
+	// maxQuerySteps 单次区间查询允许的最大步数
+	maxQuerySteps = 11000
+)
+
+var (
+	ErrInvalidStep  = errors.New("zero or negative query resolution step widths are not accepted")
+	ErrTooManySteps = fmt.Errorf("exceeded maximum resolution of %d points per timeseries", maxQuerySteps)
+)
+
+// Query 在 ts 时刻对 PromQL 表达式求值
+func (tsdb *TSDB) Query(expr string, ts int64) (Value, error) {
+	return tsdb.QueryContext(context.Background(), expr, ts)
+}
+
+// QueryContext 与 Query 相同 ctx 被取消时查询会提前返回 ctx.Err()
+func (tsdb *TSDB) QueryContext(ctx context.Context, expr string, ts int64) (Value, error) {
+	e, err := promql.ParseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	ev, err := tsdb.newEvaluator(ctx, e, ts, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	return ev.eval(e, ts)
+}
+
+// QueryRangeExpr 在 [start, end] 区间内每隔 step 对 PromQL 表达式求值
+// 表达式的结果必须是 Scalar 或者 Vector
+func (tsdb *TSDB) QueryRangeExpr(expr string, start, end int64, step time.Duration) (Matrix, error) {
+	return tsdb.QueryRangeExprContext(context.Background(), expr, start, end, step)
+}
+
+// QueryRangeExprContext 与 QueryRangeExpr 相同 每一步求值前都会检查 ctx 是否已经被取消
+func (tsdb *TSDB) QueryRangeExprContext(ctx context.Context, expr string, start, end int64, step time.Duration) (Matrix, error) {
+	e, err := promql.ParseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Type() != ValueTypeScalar && e.Type() != ValueTypeVector {
+		return nil, fmt.Errorf("invalid expression type %q for range query, must be scalar or instant vector", e.Type())
+	}
+
+	interval := tsdb.opts.precision.Duration(step)
+	if interval <= 0 {
+		return nil, ErrInvalidStep
+	}
+
+	if end < start {
+		return nil, errors.New("end timestamp must not be before start time")
+	}
+
+	if (end-start)/interval >= maxQuerySteps {
+		return nil, ErrTooManySteps
+	}
+
+	ev, err := tsdb.newEvaluator(ctx, e, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(map[uint64]*MetricRet)
+	for ts := start; ts <= end; ts += interval {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		v, err := ev.eval(e, ts)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := v.(type) {
+		case Scalar:
+			v.T = ts
+			appendSample(series, Sample{Labels: LabelSet{}, Point: Point{Ts: v.T, Value: v.V}})
+		case Vector:
+			for _, sample := range v {
+				sample.Point.Ts = ts
+				appendSample(series, sample)
+			}
+		}
+	}
+
+	ret := make(Matrix, 0, len(series))
+	for _, s := range series {
+		ret = append(ret, *s)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Labels.String() < ret[j].Labels.String()
+	})
+
+	return ret, nil
+}
+
+func appendSample(series map[uint64]*MetricRet, sample Sample) {
+	h := sample.Labels.Hash()
+	s, ok := series[h]
+	if !ok {
+		s = &MetricRet{Labels: sample.Labels}
+		series[h] = s
+	}
+
+	s.Points = append(s.Points, sample.Point)
+}
+
+var promqlMatchTypes = map[promql.MatchType]MatchType{
+	promql.MatchEqual:     MatchEqual,
+	promql.MatchNotEqual:  MatchNotEqual,
+	promql.MatchRegexp:    MatchRegexp,
+	promql.MatchNotRegexp: MatchNotRegexp,
+}
+
+type evaluator struct {
+	tsdb     *TSDB
+	lookback int64
+
+	// series 每个 selector 在整个查询区间内的数据
+	series map[*promql.VectorSelector][]MetricRet
+}
+
+// newEvaluator 预先查询出表达式中所有 selector 在 [start, end] 区间求值所需要的数据
+func (tsdb *TSDB) newEvaluator(ctx context.Context, expr promql.Expr, start, end int64) (*evaluator, error) {
+	ev := &evaluator{
+		tsdb:     tsdb,
+		lookback: tsdb.opts.precision.Duration(defaultLookbackDelta),
+		series:   make(map[*promql.VectorSelector][]MetricRet),
+	}
+
+	fetch := func(vs *promql.VectorSelector, lookback int64) error {
+		if _, ok := ev.series[vs]; ok {
+			return nil
+		}
+
+		lms := make(LabelMatcherSet, 0, len(vs.Matchers))
+		for _, m := range vs.Matchers {
+			lms = append(lms, LabelMatcher{Name: m.Name, Value: m.Value, Type: promqlMatchTypes[m.Type]})
+		}
+
+		ret, err := tsdb.queryRange(ctx, lms.filter(), start-lookback, end)
+		if err != nil {
+			return err
+		}
+
+		ev.series[vs] = ret
+		return nil
+	}
+
+	var err error
+	promql.Inspect(expr, func(node promql.Expr) {
+		if err != nil {
+			return
+		}
+
+		switch n := node.(type) {
+		case *promql.MatrixSelector:
+			err = fetch(n.VectorSelector, tsdb.opts.precision.Duration(n.Range))
+		case *promql.VectorSelector:
+			err = fetch(n, ev.lookback)
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// seconds 将时间跨度转换成秒
+func (ev *evaluator) seconds(d int64) float64 {
+	return float64(d) / float64(ev.tsdb.opts.precision.Duration(time.Second))
+}
+
+// pointsBetween 返回 (start, end] 区间内的数据点
+func pointsBetween(points []Point, start, end int64) []Point {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Ts > start })
+	j := sort.Search(len(points), func(i int) bool { return points[i].Ts > end })
+	return points[i:j]
+}
+
+func (ev *evaluator) eval(expr promql.Expr, ts int64) (Value, error) {
+	switch e := expr.(type) {
+	case *promql.NumberLiteral:
+		return Scalar{T: ts, V: e.Val}, nil
+
+	case *promql.ParenExpr:
+		return ev.eval(e.Expr, ts)
+
+	case *promql.UnaryExpr:
+		v, err := ev.eval(e.Expr, ts)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := v.(type) {
+		case Scalar:
+			return Scalar{T: v.T, V: -v.V}, nil
+		case Vector:
+			ret := make(Vector, 0, len(v))
+			for _, sample := range v {
+				ret = append(ret, Sample{Labels: sample.Labels.dropMetricName(), Point: Point{Ts: ts, Value: -sample.Point.Value}})
+			}
+			return ret, nil
+		}
+
+	case *promql.VectorSelector:
+		ret := make(Vector, 0)
+		for _, s := range ev.series[e] {
+			points := pointsBetween(s.Points, ts-ev.lookback, ts)
+			if len(points) == 0 {
+				continue
+			}
+
+			ret = append(ret, Sample{Labels: s.Labels, Point: Point{Ts: ts, Value: points[len(points)-1].Value}})
+		}
+		return ret, nil
+
+	case *promql.MatrixSelector:
+		ret := make(Matrix, 0)
+		rng := ev.tsdb.opts.precision.Duration(e.Range)
+		for _, s := range ev.series[e.VectorSelector] {
+			points := pointsBetween(s.Points, ts-rng, ts)
+			if len(points) == 0 {
+				continue
+			}
+
+			ret = append(ret, MetricRet{Labels: s.Labels, Points: points})
+		}
+		return ret, nil
+
+	case *promql.Call:
+		return ev.evalCall(e, ts)
+
+	case *promql.AggregateExpr:
+		return ev.evalAggregate(e, ts)
+
+	case *promql.BinaryExpr:
+		return ev.evalBinary(e, ts)
+	}
+
+	return nil, fmt.Errorf("unsupported expression %s", expr)
+}
+
+func (ev *evaluator) evalCall(e *promql.Call, ts int64) (Value, error) {
+	arg, err := ev.eval(e.Args[0], ts)
+	if err != nil {
+		return nil, err
+	}
+
+	// rate((foo[5m])) 中的括号不影响语义
+	inner := e.Args[0]
+	for {
+		paren, ok := inner.(*promql.ParenExpr)
+		if !ok {
+			break
+		}
+		inner = paren.Expr
+	}
+
+	ms, ok := inner.(*promql.MatrixSelector)
+	if !ok {
+		return nil, fmt.Errorf("expected range vector selector in %s, got %s", e.Func, e.Args[0])
+	}
+	rng := ev.tsdb.opts.precision.Duration(ms.Range)
+
+	ret := make(Vector, 0)
+	for _, s := range arg.(Matrix) {
+		var v float64
+		var ok bool
+
+		switch e.Func {
+		case "rate":
+			v, ok = ev.extrapolatedRate(s.Points, ts-rng, ts, true)
+		case "increase":
+			v, ok = ev.extrapolatedRate(s.Points, ts-rng, ts, false)
+		case "irate":
+			v, ok = ev.instantRate(s.Points)
+		default:
+			return nil, fmt.Errorf("unsupported function %q", e.Func)
+		}
+
+		if ok {
+			ret = append(ret, Sample{Labels: s.Labels.dropMetricName(), Point: Point{Ts: ts, Value: v}})
+		}
+	}
+
+	return ret, nil
+}
+
+// extrapolatedRate 计算 counter 在 (rangeStart, rangeEnd] 内的增量 算法与 Prometheus 保持一致
+// 会处理 counter 重置 并将首尾数据点的增量外推到区间边界
+func (ev *evaluator) extrapolatedRate(points []Point, rangeStart, rangeEnd int64, isRate bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	first, last := points[0], points[len(points)-1]
+	result := last.Value - first.Value
+
+	prev := first.Value
+	for _, p := range points[1:] {
+		if p.Value < prev {
+			result += prev
+		}
+		prev = p.Value
+	}
+
+	durationToStart := ev.seconds(first.Ts - rangeStart)
+	durationToEnd := ev.seconds(rangeEnd - last.Ts)
+	sampledInterval := ev.seconds(last.Ts - first.Ts)
+	averageDurationBetweenSamples := sampledInterval / float64(len(points)-1)
+
+	// counter 不会小于 0 外推不应该超过 counter 为 0 的时刻
+	if result > 0 && first.Value >= 0 {
+		durationToZero := sampledInterval * (first.Value / result)
+		if durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	extrapolationThreshold := averageDurationBetweenSamples * 1.1
+	extrapolateToInterval := sampledInterval
+
+	if durationToStart < extrapolationThreshold {
+		extrapolateToInterval += durationToStart
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+
+	if durationToEnd < extrapolationThreshold {
+		extrapolateToInterval += durationToEnd
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+
+	result = result * (extrapolateToInterval / sampledInterval)
+	if isRate {
+		result = result / ev.seconds(rangeEnd-rangeStart)
+	}
+
+	return result, true
+}
+
+// instantRate 使用最后两个数据点计算每秒增长率
+func (ev *evaluator) instantRate(points []Point) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	last, prev := points[len(points)-1], points[len(points)-2]
+	interval := ev.seconds(last.Ts - prev.Ts)
+	if interval <= 0 {
+		return 0, false
+	}
+
+	result := last.Value - prev.Value
+	if last.Value < prev.Value { // counter 重置
+		result = last.Value
+	}
+
+	return result / interval, true
+}
+
+type aggGroup struct {
+	labels  LabelSet
+	value   float64
+	count   int
+	samples Vector
+}
+
+func (ev *evaluator) evalAggregate(e *promql.AggregateExpr, ts int64) (Value, error) {
+	v, err := ev.eval(e.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	vec := v.(Vector)
+
+	var k int
+	if e.Op == "topk" {
+		param, err := ev.eval(e.Param, ts)
+		if err != nil {
+			return nil, err
+		}
+		k = int(param.(Scalar).V)
+		if k < 1 {
+			return Vector{}, nil
+		}
+	}
+
+	grouping := make(map[string]struct{}, len(e.Grouping))
+	for _, name := range e.Grouping {
+		grouping[name] = struct{}{}
+	}
+
+	groups := make(map[uint64]*aggGroup)
+	order := make([]uint64, 0)
+	for _, sample := range vec {
+		labels := make(LabelSet, 0, len(sample.Labels))
+		for _, label := range sample.Labels {
+			_, ok := grouping[label.Name]
+			if e.Without && !ok && label.Name != metricName || !e.Without && ok {
+				labels = append(labels, label)
+			}
+		}
+
+		h := labels.Hash()
+		g, ok := groups[h]
+		if !ok {
+			g = &aggGroup{labels: labels, value: sample.Point.Value}
+			groups[h] = g
+			order = append(order, h)
+		}
+
+		val := sample.Point.Value
+		switch e.Op {
+		case "sum", "avg":
+			if ok {
+				g.value += val
+			}
+		case "min":
+			if val < g.value || math.IsNaN(g.value) {
+				g.value = val
+			}
+		case "max":
+			if val > g.value || math.IsNaN(g.value) {
+				g.value = val
+			}
+		case "topk":
+			g.samples = append(g.samples, sample)
+		}
+		g.count++
+	}
+
+	ret := make(Vector, 0, len(groups))
+	for _, h := range order {
+		g := groups[h]
+		switch e.Op {
+		case "avg":
+			g.value = g.value / float64(g.count)
+		case "count":
+			g.value = float64(g.count)
+		case "topk":
+			sort.SliceStable(g.samples, func(i, j int) bool {
+				return g.samples[i].Point.Value > g.samples[j].Point.Value
+			})
+			if len(g.samples) > k {
+				g.samples = g.samples[:k]
+			}
+			ret = append(ret, g.samples...)
+			continue
+		}
+
+		ret = append(ret, Sample{Labels: g.labels, Point: Point{Ts: ts, Value: g.value}})
+	}
+
+	return ret, nil
+}
+
+func binaryOp(op string, lhs, rhs float64) (float64, error) {
+	switch op {
+	case "+":
+		return lhs + rhs, nil
+	case "-":
+		return lhs - rhs, nil
+	case "*":
+		return lhs * rhs, nil
+	case "/":
+		return lhs / rhs, nil
+	case "%":
+		return math.Mod(lhs, rhs), nil
+	case "^":
+		return math.Pow(lhs, rhs), nil
+	}
+
+	return 0, fmt.Errorf("unsupported binary operator %q", op)
+}
+
+// evalBinary 计算四则运算 向量之间按照去掉 __name__ 后的 label 一一匹配 结果中不包含 __name__
+func (ev *evaluator) evalBinary(e *promql.BinaryExpr, ts int64) (Value, error) {
+	lhs, err := ev.eval(e.LHS, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	rhs, err := ev.eval(e.RHS, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			v, err := binaryOp(e.Op, l.V, r.V)
+			if err != nil {
+				return nil, err
+			}
+			return Scalar{T: ts, V: v}, nil
+
+		case Vector:
+			ret := make(Vector, 0, len(r))
+			for _, sample := range r {
+				v, err := binaryOp(e.Op, l.V, sample.Point.Value)
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, Sample{Labels: sample.Labels.dropMetricName(), Point: Point{Ts: ts, Value: v}})
+			}
+			return ret, nil
+		}
+
+	case Vector:
+		switch r := rhs.(type) {
+		case Scalar:
+			ret := make(Vector, 0, len(l))
+			for _, sample := range l {
+				v, err := binaryOp(e.Op, sample.Point.Value, r.V)
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, Sample{Labels: sample.Labels.dropMetricName(), Point: Point{Ts: ts, Value: v}})
+			}
+			return ret, nil
+
+		case Vector:
+			rights := make(map[uint64]Sample, len(r))
+			for _, sample := range r {
+				labels := sample.Labels.dropMetricName()
+				h := labels.Hash()
+				if _, ok := rights[h]; ok {
+					return nil, fmt.Errorf("found duplicate series for the match group %s on the right hand-side of the operation", labels)
+				}
+				rights[h] = sample
+			}
+
+			ret := make(Vector, 0, len(l))
+			matched := make(map[uint64]struct{}, len(l))
+			for _, sample := range l {
+				labels := sample.Labels.dropMetricName()
+				h := labels.Hash()
+				rs, ok := rights[h]
+				if !ok {
+					continue
+				}
+
+				if _, ok := matched[h]; ok {
+					return nil, fmt.Errorf("found duplicate series for the match group %s on the left hand-side of the operation", labels)
+				}
+				matched[h] = struct{}{}
+
+				v, err := binaryOp(e.Op, sample.Point.Value, rs.Point.Value)
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, Sample{Labels: labels, Point: Point{Ts: ts, Value: v}})
+			}
+			return ret, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid operand types for binary expression %s", e)
+}
@@ -0,0 +1,193 @@
+package mandodb
+
+import (
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// genEngineStore 写入 http_requests 计数器 每 15s 一个点
+// instance a/b/c 每个点分别增长 1/2/3
+func genEngineStore(tmpdir string, opts ...Option) *TSDB {
+	store := OpenTSDB(append([]Option{WithDataPath(tmpdir)}, opts...)...)
+
+	series := []LabelSet{
+		{{Name: "instance", Value: "a"}, {Name: "job", Value: "api"}},
+		{{Name: "instance", Value: "b"}, {Name: "job", Value: "api"}},
+		{{Name: "instance", Value: "c"}, {Name: "job", Value: "web"}},
+	}
+
+	var start int64 = 1600000000
+	for i := 0; i < 300; i++ {
+		rows := make([]*Row, 0)
+		for n, labels := range series {
+			rows = append(rows, &Row{
+				Metric: "http_requests",
+				Labels: append(LabelSet{}, labels...),
+				Point:  Point{Ts: start + int64(i*15), Value: float64(i * (n + 1))},
+			})
+		}
+		_ = store.InsertRows(rows)
+	}
+	time.Sleep(time.Millisecond * 20)
+	return store
+}
+
+func vectorByLabels(v Value) map[string]float64 {
+	ret := make(map[string]float64)
+	for _, sample := range v.(Vector) {
+		labels := append(LabelSet{}, sample.Labels...)
+		labels.Sorted()
+		ret[labels.String()] = sample.Point.Value
+	}
+	return ret
+}
+
+func TestTSDB_Query(t *testing.T) {
+	tmpdir := "/tmp/tsdb-engine"
+	defer os.RemoveAll(tmpdir)
+
+	store := genEngineStore(tmpdir)
+	defer store.Close()
+
+	var ts int64 = 1600000000 + 600 // 第 40 个点
+
+	cases := []struct {
+		expr   string
+		expect map[string]float64
+	}{
+		{
+			expr:   `http_requests{instance="a"}`,
+			expect: map[string]float64{`{__name__="http_requests", instance="a", job="api"}`: 40},
+		},
+		{
+			expr: `rate(http_requests[1m])`,
+			expect: map[string]float64{
+				`{instance="a", job="api"}`: 4.0 / 60,
+				`{instance="b", job="api"}`: 8.0 / 60,
+				`{instance="c", job="web"}`: 12.0 / 60,
+			},
+		},
+		{
+			expr:   `rate((http_requests{instance="a"}[1m]))`,
+			expect: map[string]float64{`{instance="a", job="api"}`: 4.0 / 60},
+		},
+		{
+			expr:   `increase(http_requests{job="web"}[1m])`,
+			expect: map[string]float64{`{instance="c", job="web"}`: 12},
+		},
+		{
+			expr:   `irate(http_requests{instance="b"}[1m])`,
+			expect: map[string]float64{`{instance="b", job="api"}`: 2.0 / 15},
+		},
+		{
+			expr:   `sum by (job) (rate(http_requests[1m]))`,
+			expect: map[string]float64{`{job="api"}`: 0.2, `{job="web"}`: 0.2},
+		},
+		{
+			expr:   `count without (instance) (http_requests)`,
+			expect: map[string]float64{`{job="api"}`: 2, `{job="web"}`: 1},
+		},
+		{
+			expr:   `avg(http_requests)`,
+			expect: map[string]float64{`{}`: 80},
+		},
+		{
+			expr:   `max by (job) (http_requests)`,
+			expect: map[string]float64{`{job="api"}`: 80, `{job="web"}`: 120},
+		},
+		{
+			expr:   `topk(1, http_requests)`,
+			expect: map[string]float64{`{__name__="http_requests", instance="c", job="web"}`: 120},
+		},
+		{
+			expr:   `http_requests{instance="a"} * 2 + 1`,
+			expect: map[string]float64{`{instance="a", job="api"}`: 81},
+		},
+		{
+			expr: `http_requests{job="api"} / http_requests`,
+			expect: map[string]float64{
+				`{instance="a", job="api"}`: 1,
+				`{instance="b", job="api"}`: 1,
+			},
+		},
+		{
+			expr:   `-http_requests{instance="a"}`,
+			expect: map[string]float64{`{instance="a", job="api"}`: -40},
+		},
+	}
+
+	for _, c := range cases {
+		v, err := store.Query(c.expr, ts)
+		assert.NoError(t, err, c.expr)
+
+		ret := vectorByLabels(v)
+		assert.Equal(t, len(c.expect), len(ret), c.expr)
+		for k, expect := range c.expect {
+			assert.InDelta(t, expect, ret[k], 1e-9, "%s: %s", c.expr, k)
+		}
+	}
+
+	v, err := store.Query("1 + 2 * 3", ts)
+	assert.NoError(t, err)
+	assert.Equal(t, Scalar{T: ts, V: 7}, v)
+
+	v, err = store.Query("http_requests[1m]", ts)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(v.(Matrix)))
+	assert.Equal(t, 4, len(v.(Matrix)[0].Points))
+
+	// 超过 lookback 之后不再返回数据
+	last := int64(1600000000 + 299*15)
+	v, err = store.Query("http_requests", last+299)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(v.(Vector)))
+
+	v, err = store.Query("http_requests", last+301)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(v.(Vector)))
+
+	_, err = store.Query("rate(http_requests)", ts)
+	assert.Error(t, err)
+}
+
+func TestTSDB_QueryRangeExpr(t *testing.T) {
+	tmpdir := "/tmp/tsdb-engine-range"
+	defer os.RemoveAll(tmpdir)
+
+	store := genEngineStore(tmpdir)
+	defer store.Close()
+
+	var start int64 = 1600000000 + 600
+
+	ret, err := store.QueryRangeExpr("sum(http_requests)", start, start+60, 30*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, LabelSet{}, ret[0].Labels)
+	assert.Equal(t, []Point{
+		{Ts: start, Value: 240},
+		{Ts: start + 30, Value: 252},
+		{Ts: start + 60, Value: 264},
+	}, ret[0].Points)
+
+	ret, err = store.QueryRangeExpr("http_requests / 10", start, start+150, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(ret))
+
+	instances := make([]string, 0)
+	for _, r := range ret {
+		assert.Equal(t, 3, len(r.Points))
+		instances = append(instances, r.Labels.Map()["instance"])
+	}
+	sort.Strings(instances)
+	assert.Equal(t, []string{"a", "b", "c"}, instances)
+
+	_, err = store.QueryRangeExpr("http_requests[1m]", start, start+60, time.Minute)
+	assert.Error(t, err)
+
+	_, err = store.QueryRangeExpr("http_requests", start, start+60, 0)
+	assert.Equal(t, ErrInvalidStep, err)
+}
@@ -13,5 +13,5 @@ require (
 	github.com/stretchr/testify v1.7.0
 	go.uber.org/atomic v1.8.0 // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,42 @@
+package mandodb
+
+import (
+	"net"
+	"time"
+
+	"github.com/chenjiandongx/logger"
+
+	"github.com/chenjiandongx/mandodb/pkg/graphite"
+)
+
+// ServeGraphite 接受 ln 上的 Graphite plaintext 连接并写入 parser 负责将点分路径转换为指标名称和标签
+// 时间戳单位为秒 缺失或者为 -1 时使用当前时间 无法解析的行只记录日志 ln 被关闭后返回
+func (tsdb *TSDB) ServeGraphite(ln net.Listener, parser *graphite.Parser) error {
+	return tsdb.serveLines(ln, "graphite", func(line string) ([]*Row, string) {
+		metric, err := parser.Parse(line)
+		if err != nil {
+			logger.Warnf("failed to parse graphite line: %v", err)
+			return nil, ""
+		}
+
+		return []*Row{tsdb.graphiteMetricToRow(metric, time.Now())}, ""
+	})
+}
+
+func (tsdb *TSDB) graphiteMetricToRow(metric graphite.Metric, now time.Time) *Row {
+	ts := tsdb.opts.precision.Timestamp(now)
+	if metric.HasTimestamp {
+		ts = tsdb.opts.precision.Timestamp(time.Unix(metric.Timestamp, 0))
+	}
+
+	labels := make(LabelSet, 0, len(metric.Tags))
+	for _, tag := range metric.Tags {
+		labels = append(labels, Label{Name: tag.Key, Value: tag.Value})
+	}
+
+	return &Row{
+		Metric: metric.Name,
+		Labels: labels,
+		Point:  Point{Ts: ts, Value: metric.Value},
+	}
+}
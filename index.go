@@ -1,6 +1,7 @@
 package mandodb
 
 import (
+	"fmt"
 	"strings"
 	"sync"
 
@@ -9,141 +10,140 @@ import (
 
 // Memory Index 负责管理内存索引的存储和搜索
 
-type memorySidSet struct {
-	set map[string]struct{}
-	mut sync.Mutex
-}
-
-func newMemorySidSet() *memorySidSet {
-	return &memorySidSet{set: make(map[string]struct{})}
-}
-
-func (mss *memorySidSet) Add(a string) {
-	mss.mut.Lock()
-	defer mss.mut.Unlock()
-
-	mss.set[a] = struct{}{}
-}
-
-func (mss *memorySidSet) Size() int {
-	mss.mut.Lock()
-	defer mss.mut.Unlock()
-
-	return len(mss.set)
-}
-
-func (mss *memorySidSet) Copy() *memorySidSet {
-	mss.mut.Lock()
-	defer mss.mut.Unlock()
-
-	newset := newMemorySidSet()
-	for k := range mss.set {
-		newset.set[k] = struct{}{}
-	}
-
-	return newset
-}
-
-func (mss *memorySidSet) Intersection(other *memorySidSet) {
-	mss.mut.Lock()
-	defer mss.mut.Unlock()
-
-	for k := range mss.set {
-		_, ok := other.set[k]
-		if !ok {
-			delete(mss.set, k)
-		}
-	}
-}
-
-func (mss *memorySidSet) Union(other *memorySidSet) {
-	mss.mut.Lock()
-	defer mss.mut.Unlock()
-
-	for k := range other.set {
-		mss.set[k] = struct{}{}
-	}
-}
-
-func (mss *memorySidSet) List() []string {
-	mss.mut.Lock()
-	defer mss.mut.Unlock()
-
-	keys := make([]string, 0, len(mss.set))
-	for k := range mss.set {
-		keys = append(keys, k)
-	}
-
-	return keys
-}
-
+// memoryIndexMap label 到 series ref 的倒排索引
 type memoryIndexMap struct {
-	idx map[string]*memorySidSet
+	idx map[string]*roaring.Bitmap
 	mut sync.Mutex
 }
 
 func newMemoryIndexMap() *memoryIndexMap {
-	return &memoryIndexMap{idx: make(map[string]*memorySidSet)}
+	return &memoryIndexMap{idx: make(map[string]*roaring.Bitmap)}
 }
 
-func (mim *memoryIndexMap) Range(f func(k string, v *memorySidSet)) {
+func (mim *memoryIndexMap) UpdateIndex(ref uint32, labels LabelSet) {
 	mim.mut.Lock()
 	defer mim.mut.Unlock()
 
-	for k, sids := range mim.idx {
-		f(k, sids)
+	for _, label := range labels {
+		key := label.MarshalName()
+		if _, ok := mim.idx[key]; !ok {
+			mim.idx[key] = roaring.New()
+		}
+		mim.idx[key].Add(ref)
 	}
 }
 
-func (mim *memoryIndexMap) UpdateIndex(sid string, labels LabelSet) {
+// RemoveIndex 从索引中移除 ref 返回移除后不再关联任何 series 的 label
+func (mim *memoryIndexMap) RemoveIndex(ref uint32, labels LabelSet) []Label {
 	mim.mut.Lock()
 	defer mim.mut.Unlock()
 
+	ret := make([]Label, 0)
 	for _, label := range labels {
 		key := label.MarshalName()
-		if _, ok := mim.idx[key]; !ok {
-			mim.idx[key] = newMemorySidSet()
+		refs, ok := mim.idx[key]
+		if !ok {
+			continue
+		}
+
+		refs.Remove(ref)
+		if refs.IsEmpty() {
+			delete(mim.idx, key)
+			ret = append(ret, label)
 		}
-		mim.idx[key].Add(sid)
 	}
+
+	return ret
 }
 
-func (mim *memoryIndexMap) MatchSids(lvs *labelValueSet, lms LabelMatcherSet) []string {
+// MatchSids 返回满足所有匹配器的 series ref
+// 不能匹配空值的匹配器取对应 label 值的并集后求交集
+// 能够匹配空值的匹配器（如 !=、!~）则从结果中减去 label 值不满足条件的 series 这样不存在该 label 的 series 也会被保留
+func (mim *memoryIndexMap) MatchSids(lvs *labelValueSet, lms LabelMatcherSet) []uint32 {
 	mim.mut.Lock()
 	defer mim.mut.Unlock()
 
-	sids := newMemorySidSet()
-	var got bool
-	for i := len(lms) - 1; i >= 0; i-- {
-		tmp := newMemorySidSet()
-		vs := lvs.Match(lms[i])
+	// 返回的是新的 bitmap 可以直接修改
+	union := func(name string, vs []string) *roaring.Bitmap {
+		tmp := roaring.New()
 		for _, v := range vs {
-			midx := mim.idx[joinSeparator(lms[i].Name, v)]
-			if midx == nil || midx.Size() <= 0 {
+			midx := mim.idx[joinSeparator(name, v)]
+			if midx == nil {
 				continue
 			}
 
-			tmp.Union(midx.Copy())
+			tmp.Or(midx)
 		}
+		return tmp
+	}
 
-		if tmp == nil || tmp.Size() <= 0 {
+	var sids *roaring.Bitmap
+	excludes := make([]*roaring.Bitmap, 0)
+	for i := len(lms) - 1; i >= 0; i-- {
+		matches := lms[i].compile()
+		if matches("") {
+			excludes = append(excludes, union(lms[i].Name, lvs.Filter(lms[i].Name, func(v string) bool {
+				return !matches(v)
+			})))
+			continue
+		}
+
+		vs := []string{lms[i].Value}
+		if lms[i].Type != MatchEqual {
+			vs = lvs.Filter(lms[i].Name, matches)
+		}
+
+		tmp := union(lms[i].Name, vs)
+		if tmp.IsEmpty() {
 			return nil
 		}
 
-		if !got {
+		if sids == nil {
 			sids = tmp
-			got = true
 			continue
 		}
 
-		sids.Intersection(tmp.Copy())
+		sids.And(tmp)
+	}
+
+	// 所有的匹配器都能匹配空值 每个 series 都有 metricName 以此作为全集
+	if sids == nil {
+		sids = union(metricName, lvs.Get(metricName))
+	}
+
+	for _, exclude := range excludes {
+		sids.AndNot(exclude)
 	}
 
-	return sids.List()
+	return sids.ToArray()
 }
 
 // Disk Index 负责管理磁盘的索引存储和搜索
 
+// diskIndex diskSegment 的索引
+// version 3 之前的 segment 需要在加载时将 Metadata 构建成内存索引(diskIndexMap)
+// version 3 开始索引直接从 mmap 中读取(mmapIndex) 加载时不需要构建任何内存结构
+// 索引数据损坏时各方法返回错误 由 diskSegment 包装成 CorruptionErr
+type diskIndex interface {
+	// LabelNames 返回所有 label 名称
+	LabelNames() ([]string, error)
+
+	// LabelValues 返回 label 的所有值
+	LabelValues(name string) ([]string, error)
+
+	// Postings 返回 name=value 关联的 sid 不存在时返回空集合
+	Postings(name, value string) (*roaring.Bitmap, error)
+
+	// NumSeries 返回 series 数量 sid 的取值范围为 [0, NumSeries)
+	NumSeries() int
+
+	// SeriesLabels 返回 sid 对应的 LabelSet 按 Name 排序
+	SeriesLabels(sid uint32) (LabelSet, error)
+
+	// SeriesChunk 返回 sid 对应的 series chunk 在 Data 区域中的偏移量
+	SeriesChunk(sid uint32) (uint64, uint64, error)
+}
+
 type diskSidSet struct {
 	set *roaring.Bitmap
 	mut sync.Mutex
@@ -160,33 +160,82 @@ func (dss *diskSidSet) Add(a uint32) {
 	dss.set.Add(a)
 }
 
+// diskIndexMap 由 Metadata 构建的内存索引
 type diskIndexMap struct {
 	label2sids   map[string]*diskSidSet
 	labelOrdered map[int]string
+	labelVs      *labelValueSet
+	series       []metaSeries
 
 	mut sync.Mutex
 }
 
-func newDiskIndexMap(swl []seriesWithLabel) *diskIndexMap {
+func newDiskIndexMap(meta Metadata) *diskIndexMap {
 	dim := &diskIndexMap{
 		label2sids:   make(map[string]*diskSidSet),
 		labelOrdered: make(map[int]string),
+		labelVs:      newLabelValueSet(),
+		series:       meta.Series,
 	}
 
-	for i := range swl {
-		row := swl[i]
+	for i := range meta.Labels {
+		row := meta.Labels[i]
 		dim.label2sids[row.Name] = newDiskSidSet()
-		for _, sid := range swl[i].Sids {
+		for _, sid := range row.Sids {
 			dim.label2sids[row.Name].Add(sid)
 		}
 		dim.labelOrdered[i] = row.Name
+
+		k, v := unmarshalLabelName(row.Name)
+		if k != "" && v != "" {
+			dim.labelVs.Set(k, v)
+		}
 	}
 
 	return dim
 }
 
-func (dim *diskIndexMap) MatchLabels(lids ...uint32) []Label {
-	ret := make([]Label, 0, len(lids))
+func (dim *diskIndexMap) LabelNames() ([]string, error) {
+	return dim.labelVs.Names(), nil
+}
+
+func (dim *diskIndexMap) LabelValues(name string) ([]string, error) {
+	return dim.labelVs.Get(name), nil
+}
+
+func (dim *diskIndexMap) Postings(name, value string) (*roaring.Bitmap, error) {
+	dim.mut.Lock()
+	defer dim.mut.Unlock()
+
+	didx := dim.label2sids[joinSeparator(name, value)]
+	if didx == nil {
+		return roaring.New(), nil
+	}
+
+	return didx.set, nil
+}
+
+func (dim *diskIndexMap) NumSeries() int {
+	return len(dim.series)
+}
+
+func (dim *diskIndexMap) SeriesLabels(sid uint32) (LabelSet, error) {
+	if int(sid) >= len(dim.series) {
+		return nil, fmt.Errorf("%w: series %d out of range %d", ErrInvalidSize, sid, len(dim.series))
+	}
+	return dim.MatchLabels(dim.series[sid].Labels...), nil
+}
+
+func (dim *diskIndexMap) SeriesChunk(sid uint32) (uint64, uint64, error) {
+	if int(sid) >= len(dim.series) {
+		return 0, 0, fmt.Errorf("%w: series %d out of range %d", ErrInvalidSize, sid, len(dim.series))
+	}
+	return dim.series[sid].StartOffset, dim.series[sid].EndOffset, nil
+}
+
+// MatchLabels 返回 lids 对应的 LabelSet 与内存中的 series 保持一致 按 Name 排序
+func (dim *diskIndexMap) MatchLabels(lids ...uint32) LabelSet {
+	ret := make(LabelSet, 0, len(lids))
 	for _, lid := range lids {
 		labelPair := dim.labelOrdered[int(lid)]
 		kv := strings.SplitN(labelPair, separator, 2)
@@ -200,34 +249,124 @@ func (dim *diskIndexMap) MatchLabels(lids ...uint32) []Label {
 		})
 	}
 
+	ret.Sorted()
 	return ret
 }
 
-func (dim *diskIndexMap) MatchSids(lvs *labelValueSet, lms LabelMatcherSet) []uint32 {
-	dim.mut.Lock()
-	defer dim.mut.Unlock()
+// liveLabelValues 返回 label 下关联了 excluded 之外的 sid 的值
+func liveLabelValues(idx diskIndex, name string, excluded *roaring.Bitmap) ([]string, error) {
+	vs, err := idx.LabelValues(name)
+	if err != nil {
+		return nil, err
+	}
 
-	lst := make([]*roaring.Bitmap, 0)
-	for i := len(lms) - 1; i >= 0; i-- {
-		tmp := make([]*roaring.Bitmap, 0)
-		vs := lvs.Match(lms[i])
+	ret := make([]string, 0)
+	for _, v := range vs {
+		postings, err := idx.Postings(name, v)
+		if err != nil {
+			return nil, err
+		}
+
+		if roaring.AndNot(postings, excluded).GetCardinality() > 0 {
+			ret = append(ret, v)
+		}
+	}
+
+	return ret, nil
+}
+
+// filterLabelValues 返回 label 下所有满足 f 的值
+func filterLabelValues(idx diskIndex, name string, f func(string) bool) ([]string, error) {
+	vs, err := idx.LabelValues(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0)
+	for _, v := range vs {
+		if f(v) {
+			ret = append(ret, v)
+		}
+	}
+
+	return ret, nil
+}
 
+// matchDiskSids 返回满足所有匹配器的 sid 匹配规则与 memoryIndexMap.MatchSids 一致
+func matchDiskSids(idx diskIndex, lms LabelMatcherSet) ([]uint32, error) {
+	union := func(name string, vs []string) (*roaring.Bitmap, error) {
+		tmp := make([]*roaring.Bitmap, 0)
 		for _, v := range vs {
-			didx := dim.label2sids[joinSeparator(lms[i].Name, v)]
-			if didx == nil || didx.set.IsEmpty() {
+			postings, err := idx.Postings(name, v)
+			if err != nil {
+				return nil, err
+			}
+			if postings.IsEmpty() {
 				continue
 			}
 
-			tmp = append(tmp, didx.set)
+			tmp = append(tmp, postings)
 		}
+		return roaring.ParOr(4, tmp...), nil
+	}
 
-		union := roaring.ParOr(4, tmp...)
-		if union.IsEmpty() {
-			return nil
+	lst := make([]*roaring.Bitmap, 0)
+	excludes := make([]*roaring.Bitmap, 0)
+	for i := len(lms) - 1; i >= 0; i-- {
+		matches := lms[i].compile()
+		if matches("") {
+			vs, err := filterLabelValues(idx, lms[i].Name, func(v string) bool {
+				return !matches(v)
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			exclude, err := union(lms[i].Name, vs)
+			if err != nil {
+				return nil, err
+			}
+			excludes = append(excludes, exclude)
+			continue
+		}
+
+		vs := []string{lms[i].Value}
+		if lms[i].Type != MatchEqual {
+			var err error
+			if vs, err = filterLabelValues(idx, lms[i].Name, matches); err != nil {
+				return nil, err
+			}
+		}
+
+		u, err := union(lms[i].Name, vs)
+		if err != nil {
+			return nil, err
+		}
+		if u.IsEmpty() {
+			return nil, nil
 		}
 
-		lst = append(lst, union)
+		lst = append(lst, u)
+	}
+
+	// 所有的匹配器都能匹配空值 每个 series 都有 metricName 以此作为全集
+	if len(lst) == 0 {
+		vs, err := idx.LabelValues(metricName)
+		if err != nil {
+			return nil, err
+		}
+
+		all, err := union(metricName, vs)
+		if err != nil {
+			return nil, err
+		}
+		lst = append(lst, all)
+	}
+
+	sids := roaring.ParAnd(4, lst...)
+	for _, exclude := range excludes {
+		sids.AndNot(exclude)
 	}
 
-	return roaring.ParAnd(4, lst...).ToArray()
+	return sids.ToArray(), nil
 }
@@ -0,0 +1,185 @@
+package mandodb
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/chenjiandongx/logger"
+
+	"github.com/chenjiandongx/mandodb/pkg/influx"
+)
+
+// influxMaxDatagramSize UDP 数据报的最大长度
+const influxMaxDatagramSize = 64 * 1024
+
+type influxLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type influxWriteResponse struct {
+	Error  string            `json:"error"`
+	Errors []influxLineError `json:"errors,omitempty"`
+}
+
+// InfluxWriteHandler 返回接收 InfluxDB line protocol 写入请求的 http.Handler 兼容 InfluxDB 1.x 的 /write 接口
+// precision 参数指定时间戳精度 可选 ns(默认)、u、ms、s、m、h 请求体支持 gzip 压缩
+// * 204: 写入成功
+// * 400: 请求无法解析或者存在无法解析的行 其余的行仍然会被写入 响应体中包含每一行的错误
+// * 413: 请求体超过 WithMaxRequestBodySize 设置的上限
+// * 503: 写入队列已满 客户端应该稍后重试
+func (tsdb *TSDB) InfluxWriteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unit, err := influx.ParsePrecision(r.URL.Query().Get("precision"))
+		if err != nil {
+			influxError(w, http.StatusBadRequest, &influxWriteResponse{Error: err.Error()})
+			return
+		}
+
+		body, err := tsdb.readGzipBody(r)
+		if err != nil {
+			influxError(w, badRequestCode(err), &influxWriteResponse{Error: err.Error()})
+			return
+		}
+
+		points, parseErrs := influx.Parse(body)
+		rows, convErrs := tsdb.influxPointsToRows(points, unit, time.Now())
+		parseErrs = append(parseErrs, convErrs...)
+		sort.Slice(parseErrs, func(i, j int) bool {
+			return parseErrs[i].Line < parseErrs[j].Line
+		})
+
+		if len(rows) > 0 {
+			if err := tsdb.InsertRows(rows); err != nil {
+				code := http.StatusInternalServerError
+				if errors.Is(err, ErrWriteOverloaded) {
+					code = http.StatusServiceUnavailable
+				}
+				influxError(w, code, &influxWriteResponse{Error: err.Error()})
+				return
+			}
+		}
+
+		if len(parseErrs) > 0 {
+			lineErrs := make([]influxLineError, 0, len(parseErrs))
+			for _, e := range parseErrs {
+				lineErrs = append(lineErrs, influxLineError{Line: e.Line, Error: e.Err})
+			}
+
+			influxError(w, http.StatusBadRequest, &influxWriteResponse{
+				Error:  fmt.Sprintf("partial write: %d lines dropped", len(parseErrs)),
+				Errors: lineErrs,
+			})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// readGzipBody 读取请求体 Content-Encoding 为 gzip 时先解压 解压前后的长度都受 maxRequestBodySize 限制
+func (tsdb *TSDB) readGzipBody(r *http.Request) ([]byte, error) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return tsdb.readRequestBody(r)
+	}
+
+	limit := tsdb.opts.maxRequestBodySize
+	gr, err := gzip.NewReader(limitReader(r.Body, limit))
+	if err != nil {
+		if errors.Is(err, ErrRequestTooLarge) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to decode gzip payload: %v", err)
+	}
+	defer gr.Close()
+
+	return ioutil.ReadAll(limitReader(gr, limit))
+}
+
+func influxError(w http.ResponseWriter, code int, resp *influxWriteResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Errorf("failed to write influx response: %v", err)
+	}
+}
+
+// influxMetricName 将 measurement 和 field 拼接成指标名称 如 cpu + usage_idle => cpu_usage_idle
+// 名为 value 的 field 直接使用 measurement 作为指标名称
+func influxMetricName(measurement, field string) string {
+	if field == "value" {
+		return measurement
+	}
+	return measurement + "_" + field
+}
+
+// influxPointsToRows 将 influx.Point 转换为 Row 每个 field 对应一个 Row tags 对应 Labels
+// 时间戳会从 unit 转换为当前配置的精度 没有时间戳的数据点使用 now 时间戳溢出的数据点会被丢弃并返回对应行的错误
+func (tsdb *TSDB) influxPointsToRows(points []influx.Point, unit time.Duration, now time.Time) ([]*Row, []*influx.ParseError) {
+	rows := make([]*Row, 0)
+	var errs []*influx.ParseError
+	for _, point := range points {
+		ts := tsdb.opts.precision.Timestamp(now)
+		if point.HasTimestamp {
+			ns, err := point.UnixNano(unit)
+			if err != nil {
+				errs = append(errs, &influx.ParseError{Line: point.Line, Err: err.Error()})
+				continue
+			}
+			ts = tsdb.opts.precision.Timestamp(time.Unix(0, ns))
+		}
+
+		labels := make(LabelSet, 0, len(point.Tags))
+		for _, tag := range point.Tags {
+			labels = append(labels, Label{Name: tag.Key, Value: tag.Value})
+		}
+
+		// 每行数据在写入的时候都会追加 metricName 这里限制容量避免共享底层数组
+		labels = labels[:len(labels):len(labels)]
+		for _, field := range point.Fields {
+			rows = append(rows, &Row{
+				Metric: influxMetricName(point.Measurement, field.Key),
+				Labels: labels,
+				Point:  Point{Ts: ts, Value: field.Value},
+			})
+		}
+	}
+
+	return rows, errs
+}
+
+// ServeInfluxUDP 从 conn 读取 InfluxDB line protocol 数据报并写入 unit 为时间戳精度
+// UDP 无法响应客户端 无法解析的行以及写入失败只会记录日志 conn 被关闭后返回
+func (tsdb *TSDB) ServeInfluxUDP(conn net.PacketConn, unit time.Duration) error {
+	buf := make([]byte, influxMaxDatagramSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		points, parseErrs := influx.Parse(buf[:n])
+		rows, convErrs := tsdb.influxPointsToRows(points, unit, time.Now())
+		for _, e := range append(parseErrs, convErrs...) {
+			logger.Warnf("failed to parse influx udp datagram: %v", e)
+		}
+
+		if len(rows) == 0 {
+			continue
+		}
+
+		if err := tsdb.InsertRows(rows); err != nil {
+			logger.Errorf("failed to insert influx udp rows: %v", err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package mandodb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfluxWriteHandler(t *testing.T) {
+	tmpdir := "/tmp/tsdb-influx-write"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir), WithTimestampPrecision(PrecisionMillisecond))
+	defer store.Close()
+
+	var start int64 = 1600000000
+	lines := []string{
+		"cpu,host=vm1 usage_idle=90,usage_user=10i 1600000000",
+		"cpu,host=vm1 usage_idle=80,usage_user=20i 1600000015",
+		"cpu,host=vm1 usage_idle=bad 1600000030",
+		"cpu,host=vm1 usage_idle=70 99999999999999999",
+		"temperature,room=a value=21.5 1600000000",
+		"",
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/write?db=telegraf&precision=s", strings.NewReader(strings.Join(lines, "\n")))
+	w := httptest.NewRecorder()
+	store.APIHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp influxWriteResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, 2, len(resp.Errors))
+	assert.Equal(t, 3, resp.Errors[0].Line)
+	assert.Equal(t, 4, resp.Errors[1].Line)
+	time.Sleep(time.Millisecond * 20)
+
+	ret, err := store.QueryRange("cpu_usage_idle", LabelMatcherSet{{Name: "host", Value: "vm1"}}, start*1000, (start+60)*1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, []Point{{Ts: start * 1000, Value: 90}, {Ts: (start + 15) * 1000, Value: 80}}, ret[0].Points)
+
+	ret, err = store.QueryRange("temperature", nil, start*1000, (start+60)*1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, LabelSet{{Name: "__name__", Value: "temperature"}, {Name: "room", Value: "a"}}, ret[0].Labels)
+
+	// gzip 压缩的请求体 默认精度为 ns
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, _ = gw.Write([]byte("cpu,host=vm2 usage_user=5i 1600000000000000000\n"))
+	assert.NoError(t, gw.Close())
+
+	r = httptest.NewRequest(http.MethodPost, "/write", &buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	store.APIHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	time.Sleep(time.Millisecond * 20)
+
+	ret, err = store.QueryRange("cpu_usage_user", nil, start*1000, (start+60)*1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(ret))
+
+	r = httptest.NewRequest(http.MethodPost, "/write?precision=d", strings.NewReader("cpu value=1"))
+	w = httptest.NewRecorder()
+	store.APIHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestInfluxWriteHandler_TooLarge(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true), WithMaxRequestBodySize(1024))
+	defer store.Close()
+
+	line := "cpu,host=vm1 usage_idle=90 1600000000\n"
+	r := httptest.NewRequest(http.MethodPost, "/write?precision=s", strings.NewReader(strings.Repeat(line, 100)))
+	w := httptest.NewRecorder()
+	store.InfluxWriteHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// 压缩后未超过上限 但解压后超过上限
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, _ = gw.Write([]byte(strings.Repeat(line, 100)))
+	assert.NoError(t, gw.Close())
+	assert.Less(t, buf.Len(), 1024)
+
+	r = httptest.NewRequest(http.MethodPost, "/write?precision=s", &buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	store.InfluxWriteHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/write?precision=s", strings.NewReader(line))
+	w = httptest.NewRecorder()
+	store.InfluxWriteHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestServeInfluxUDP(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true))
+	defer store.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- store.ServeInfluxUDP(conn, time.Second)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("load,host=vm1 load1=0.5,load5=0.25 1600000000\nbroken\n"))
+	assert.NoError(t, err)
+
+	var ret []MetricRet
+	for i := 0; i < 50 && len(ret) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+		ret, err = store.QueryRange("load_load5", nil, 1600000000, 1600000060)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, []Point{{Ts: 1600000000, Value: 0.25}}, ret[0].Points)
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, <-done)
+}
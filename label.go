@@ -2,6 +2,8 @@ package mandodb
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"regexp"
 	"regexp/syntax"
 	"sort"
@@ -59,6 +61,21 @@ func (lvs *labelValueSet) Set(label, value string) {
 	lvs.values[label][value] = struct{}{}
 }
 
+func (lvs *labelValueSet) Remove(label, value string) {
+	lvs.mut.Lock()
+	defer lvs.mut.Unlock()
+
+	vs, ok := lvs.values[label]
+	if !ok {
+		return
+	}
+
+	delete(vs, value)
+	if len(vs) == 0 {
+		delete(lvs.values, label)
+	}
+}
+
 func (lvs *labelValueSet) Get(label string) []string {
 	lvs.mut.Lock()
 	defer lvs.mut.Unlock()
@@ -76,6 +93,19 @@ func (lvs *labelValueSet) Get(label string) []string {
 	return ret
 }
 
+// Names 返回所有 label 名称
+func (lvs *labelValueSet) Names() []string {
+	lvs.mut.Lock()
+	defer lvs.mut.Unlock()
+
+	ret := make([]string, 0, len(lvs.values))
+	for k := range lvs.values {
+		ret = append(ret, k)
+	}
+
+	return ret
+}
+
 // fastRegexMatcher 是一种优化的正则匹配器 算法来自 Prometheus
 type fastRegexMatcher struct {
 	re       *regexp.Regexp
@@ -162,25 +192,16 @@ func (m *fastRegexMatcher) MatchString(s string) bool {
 	return m.re.MatchString(s)
 }
 
-// Match 主要用于匹配 Labels 组合 支持正则匹配
-func (lvs *labelValueSet) Match(matcher LabelMatcher) []string {
+// Filter 返回 label 下所有满足 f 的值
+func (lvs *labelValueSet) Filter(label string, f func(string) bool) []string {
 	ret := make([]string, 0)
-	if matcher.IsRegx {
-		pattern, err := newFastRegexMatcher(matcher.Value)
-		if err != nil {
-			return []string{matcher.Value}
-		}
-
-		for _, v := range lvs.Get(matcher.Name) {
-			if pattern.MatchString(v) {
-				ret = append(ret, v)
-			}
+	for _, v := range lvs.Get(label) {
+		if f(v) {
+			ret = append(ret, v)
 		}
-
-		return ret
 	}
 
-	return []string{matcher.Value}
+	return ret
 }
 
 // LabelSet 表示 Label 组合
@@ -261,6 +282,39 @@ func (ls LabelSet) Has(name string) bool {
 	return false
 }
 
+// dropMetricName 返回去掉 metricName 后的 LabelSet 不修改原 LabelSet
+func (ls LabelSet) dropMetricName() LabelSet {
+	ret := make(LabelSet, 0, len(ls))
+	for _, label := range ls {
+		if label.Name != metricName {
+			ret = append(ret, label)
+		}
+	}
+
+	return ret
+}
+
+// compareLabels 按 Label 逐个比较两个已排序的 LabelSet
+func compareLabels(a, b LabelSet) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			if a[i].Name < b[i].Name {
+				return -1
+			}
+			return 1
+		}
+
+		if a[i].Value != b[i].Value {
+			if a[i].Value < b[i].Value {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return len(a) - len(b)
+}
+
 // String 用户格式化输出
 func (ls LabelSet) String() string {
 	var b bytes.Buffer
@@ -279,11 +333,77 @@ func (ls LabelSet) String() string {
 	return b.String()
 }
 
-// LabelMatcher Label 匹配器 支持正则
+// MatchType 匹配器类型
+type MatchType int8
+
+const (
+	MatchEqual     MatchType = iota // =
+	MatchNotEqual                   // !=
+	MatchRegexp                     // =~
+	MatchNotRegexp                  // !~
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return "="
+}
+
+// LabelMatcher Label 匹配器 支持 =, !=, =~, !~ 四种匹配方式
+// 与 Prometheus 语义一致 不存在该 label 的 series 视为 label 值为空字符串
 type LabelMatcher struct {
-	Name   string
-	Value  string
-	IsRegx bool
+	Name  string
+	Value string
+	Type  MatchType
+}
+
+func (lm LabelMatcher) String() string {
+	return lm.Name + lm.Type.String() + strconv.Quote(lm.Value)
+}
+
+// compile 返回判断 label 值是否满足匹配条件的函数 不存在该 label 的 series 使用空字符串判断
+// 调用方需要先通过 LabelMatcherSet.validate 校验正则表达式 非法的正则表达式不匹配任何值
+func (lm LabelMatcher) compile() func(string) bool {
+	switch lm.Type {
+	case MatchNotEqual:
+		return func(v string) bool { return v != lm.Value }
+	case MatchRegexp, MatchNotRegexp:
+		pattern, err := newFastRegexMatcher(lm.Value)
+		if err != nil {
+			return func(string) bool { return false }
+		}
+
+		negative := lm.Type == MatchNotRegexp
+		return func(v string) bool {
+			return pattern.MatchString(v) != negative
+		}
+	}
+
+	return func(v string) bool { return v == lm.Value }
+}
+
+// ErrInvalidMatcher 匹配器的正则表达式无法编译
+var ErrInvalidMatcher = errors.New("invalid label matcher")
+
+// validate 校验所有正则匹配器 查询以及删除数据前调用
+func (lms LabelMatcherSet) validate() error {
+	for _, lm := range lms {
+		if lm.Type != MatchRegexp && lm.Type != MatchNotRegexp {
+			continue
+		}
+
+		if _, err := newFastRegexMatcher(lm.Value); err != nil {
+			return fmt.Errorf("%w %s: %v", ErrInvalidMatcher, lm, err)
+		}
+	}
+
+	return nil
 }
 
 // LabelMatcherSet 表示 LabelMatcher 组合
@@ -302,17 +422,18 @@ func (lms LabelMatcherSet) AddMetricName(metric string) LabelMatcherSet {
 	return labels
 }
 
-// filter 过滤空 kv 和重复数据
+// filter 过滤空 label 名称和重复的匹配器
+// 值为空的匹配器是有意义的 例如 label="" 表示不存在该 label
 func (lms LabelMatcherSet) filter() LabelMatcherSet {
-	mark := make(map[string]struct{})
+	mark := make(map[LabelMatcher]struct{})
 	var size int
 	for _, v := range lms {
-		_, ok := mark[v.Name]
-		if v.Name != "" && v.Value != "" && !ok {
+		_, ok := mark[v]
+		if v.Name != "" && !ok {
 			lms[size] = v // 复用原来的 slice
 			size++
 		}
-		mark[v.Name] = struct{}{}
+		mark[v] = struct{}{}
 	}
 
 	return lms[:size]
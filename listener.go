@@ -0,0 +1,165 @@
+package mandodb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/chenjiandongx/logger"
+)
+
+// listenerBatchSize 单个连接每批写入的最大行数
+const listenerBatchSize = 1000
+
+// errLineTooLong 单行数据超过 WithMaxLineSize 设置的上限
+var errLineTooLong = errors.New("line too long")
+
+// lineHandler 处理一行数据 返回解析出的 rows 以及需要回复给客户端的内容(为空时不回复)
+type lineHandler func(line string) ([]*Row, string)
+
+// lineServer 按行读取 TCP 连接上的数据并批量写入
+type lineServer struct {
+	tsdb   *TSDB
+	name   string
+	handle lineHandler
+
+	mut   sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// serveLines 接受 ln 上的连接 ln 被关闭后会关闭所有连接并在连接处理完成后返回
+func (tsdb *TSDB) serveLines(ln net.Listener, name string, handle lineHandler) error {
+	s := &lineServer{tsdb: tsdb, name: name, handle: handle, conns: make(map[net.Conn]struct{})}
+	defer s.closeAll()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		s.mut.Lock()
+		s.conns[conn] = struct{}{}
+		s.mut.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *lineServer) closeAll() {
+	s.mut.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mut.Unlock()
+
+	s.wg.Wait()
+}
+
+// serveConn 批次写满或者连接上暂时没有更多数据时写入
+// 写入队列满载时会一直阻塞直到写入成功 期间不再读取连接上的数据 客户端能够通过 TCP 感知到背压
+// TSDB 关闭等原因导致写入失败或者单行数据过长时会将错误回复给客户端并关闭连接
+func (s *lineServer) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+
+		s.mut.Lock()
+		delete(s.conns, conn)
+		s.mut.Unlock()
+
+		s.wg.Done()
+	}()
+
+	reader := bufio.NewReader(conn)
+	batch := make([]*Row, 0, listenerBatchSize)
+	for {
+		line, err := readLine(reader, s.tsdb.opts.maxLineSize)
+		if errors.Is(err, errLineTooLong) {
+			// 已经解析的数据仍然写入
+			if len(batch) > 0 {
+				if err := s.tsdb.insertRowsBlocking(batch); err != nil {
+					logger.Errorf("failed to insert %s rows from %s: %v", s.name, conn.RemoteAddr(), err)
+				}
+			}
+			s.replyError(conn, err)
+			return
+		}
+
+		if line = strings.TrimSpace(line); line != "" {
+			rows, reply := s.handle(line)
+			batch = append(batch, rows...)
+
+			if reply != "" {
+				if _, err := conn.Write([]byte(reply + "\n")); err != nil {
+					logger.Warnf("failed to reply %s client %s: %v", s.name, conn.RemoteAddr(), err)
+				}
+			}
+		}
+
+		if len(batch) > 0 && (len(batch) >= listenerBatchSize || reader.Buffered() == 0 || err != nil) {
+			if err := s.tsdb.insertRowsBlocking(batch); err != nil {
+				logger.Errorf("failed to insert %s rows from %s: %v", s.name, conn.RemoteAddr(), err)
+				s.replyError(conn, fmt.Errorf("failed to insert rows: %v", err))
+				return
+			}
+
+			// InsertRows 会直接使用 batch 不能复用
+			batch = make([]*Row, 0, listenerBatchSize)
+		}
+
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				logger.Warnf("failed to read from %s client %s: %v", s.name, conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+func (s *lineServer) replyError(conn net.Conn, err error) {
+	if _, err := conn.Write([]byte(fmt.Sprintf("error: %v\n", err))); err != nil {
+		logger.Warnf("failed to reply %s client %s: %v", s.name, conn.RemoteAddr(), err)
+	}
+}
+
+// readLine 读取一行数据 超过 limit 字节时返回 errLineTooLong limit <= 0 表示不限制
+func readLine(reader *bufio.Reader, limit int64) (string, error) {
+	var line []byte
+	for {
+		frag, err := reader.ReadSlice('\n')
+		line = append(line, frag...)
+		if limit > 0 && int64(len(line)) > limit {
+			return "", errLineTooLong
+		}
+
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// insertRowsBlocking 写入队列满载时一直重试 TSDB 关闭后返回 ErrClosed 其余错误直接返回
+func (tsdb *TSDB) insertRowsBlocking(rows []*Row) error {
+	for {
+		err := tsdb.InsertRows(rows)
+		if !errors.Is(err, ErrWriteOverloaded) {
+			return err
+		}
+
+		logger.Warnf("failed to insert rows, retrying: %v", err)
+		select {
+		case <-tsdb.ctx.Done():
+			return ErrClosed
+		default:
+		}
+	}
+}
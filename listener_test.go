@@ -0,0 +1,234 @@
+package mandodb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/chenjiandongx/mandodb/pkg/graphite"
+)
+
+func queryUntil(t *testing.T, store *TSDB, metric string, start, end int64) []MetricRet {
+	var ret []MetricRet
+	var err error
+	for i := 0; i < 50 && len(ret) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+		ret, err = store.QueryRange(metric, nil, start, end)
+		assert.NoError(t, err)
+	}
+	return ret
+}
+
+func TestServeGraphite(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true))
+	defer store.Close()
+
+	parser, err := graphite.NewParser([]string{"servers.* .host.metric*"})
+	assert.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- store.ServeGraphite(ln, parser)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("servers.vm1.cpu.busy 12.5 1600000000\nbroken\nservers.vm1.cpu.busy 13 1600000015\n"))
+	assert.NoError(t, err)
+
+	ret := queryUntil(t, store, "cpu.busy", 1600000000, 1600000060)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, LabelSet{{Name: "__name__", Value: "cpu.busy"}, {Name: "host", Value: "vm1"}}, ret[0].Labels)
+	assert.Equal(t, []Point{{Ts: 1600000000, Value: 12.5}, {Ts: 1600000015, Value: 13}}, ret[0].Points)
+
+	assert.NoError(t, ln.Close())
+	assert.NoError(t, <-done)
+}
+
+func TestServeOpenTSDB(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true))
+	defer store.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- store.ServeOpenTSDB(ln)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	reader := bufio.NewReader(client)
+	_, err = client.Write([]byte("put sys.cpu.user 1600000000 42.5 host=web01\nput sys.cpu.user abc 1\n"))
+	assert.NoError(t, err)
+
+	reply, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(reply, "put: illegal argument:"), reply)
+
+	_, err = client.Write([]byte("version\n"))
+	assert.NoError(t, err)
+	reply, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "mandodb\n", reply)
+
+	ret := queryUntil(t, store, "sys.cpu.user", 1600000000, 1600000060)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, []Point{{Ts: 1600000000, Value: 42.5}}, ret[0].Points)
+
+	assert.NoError(t, ln.Close())
+	assert.NoError(t, <-done)
+}
+
+func TestOpenTSDBPutHandler(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true), WithTimestampPrecision(PrecisionMillisecond))
+	defer store.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/put", strings.NewReader(`{"metric": "sys.cpu.nice", "timestamp": 1600000000, "value": 18, "tags": {"host": "web01"}}`))
+	w := httptest.NewRecorder()
+	store.APIHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	body := `[{"metric": "sys.cpu.nice", "timestamp": 1600000015000, "value": "9", "tags": {"host": "web01"}}, {"metric": "", "timestamp": 1600000030, "value": 1}]`
+	r = httptest.NewRequest(http.MethodPost, "/api/put", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	store.APIHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp openTSDBPutResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, 1, resp.Success)
+	assert.Equal(t, 1, resp.Failed)
+
+	ret := queryUntil(t, store, "sys.cpu.nice", 1600000000000, 1600000060000)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, []Point{{Ts: 1600000000000, Value: 18}, {Ts: 1600000015000, Value: 9}}, ret[0].Points)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/put", strings.NewReader(`not json`))
+	w = httptest.NewRecorder()
+	store.APIHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServeOpenTSDB_LineTooLong(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true), WithMaxLineSize(64))
+	defer store.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- store.ServeOpenTSDB(ln)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// 过长的行之前已经解析的数据仍然会被写入 随后连接被关闭
+	long := "put sys.cpu.user 1600000015 1 host=" + strings.Repeat("x", 64) + "\n"
+	_, err = client.Write([]byte("put sys.cpu.user 1600000000 42.5 host=web01\n" + long))
+	assert.NoError(t, err)
+
+	reader := bufio.NewReader(client)
+	reply, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "error: line too long\n", reply)
+
+	_, err = reader.ReadString('\n')
+	assert.Error(t, err)
+
+	ret := queryUntil(t, store, "sys.cpu.user", 1600000000, 1600000060)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, []Point{{Ts: 1600000000, Value: 42.5}}, ret[0].Points)
+
+	assert.NoError(t, ln.Close())
+	assert.NoError(t, <-done)
+}
+
+func TestOpenTSDBPutHandler_TooLarge(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true), WithMaxRequestBodySize(64))
+	defer store.Close()
+
+	body := `{"metric": "sys.cpu.nice", "timestamp": 1600000000, "value": 18, "tags": {"host": "web01"}}`
+	r := httptest.NewRequest(http.MethodPost, "/api/put", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	store.OpenTSDBPutHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestTSDB_InsertRowsBlocking(t *testing.T) {
+	opts := newDefaultOptions()
+	opts.writeTimeout = time.Millisecond
+
+	// 没有消费者的写入队列会一直处于满载状态
+	tsdb := &TSDB{opts: opts, q: make(chan *writeBatch)}
+	tsdb.ctx, tsdb.cancel = context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tsdb.insertRowsBlocking([]*Row{{Metric: "cpu", Point: Point{Ts: 1, Value: 1}}})
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("insertRowsBlocking returned while queue was full")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	tsdb.cancel()
+	assert.Equal(t, ErrClosed, <-done)
+
+	// TSDB 关闭后不再重试
+	tsdb.closed = true
+	assert.Equal(t, ErrClosed, tsdb.insertRowsBlocking([]*Row{{Metric: "cpu", Point: Point{Ts: 1, Value: 1}}}))
+}
+
+func TestServeOpenTSDB_Closed(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- store.ServeOpenTSDB(ln)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// TSDB 关闭后的写入失败会回复给客户端 随后连接被关闭
+	store.Close()
+	_, err = client.Write([]byte("put sys.cpu.user 1600000000 42.5 host=web01\n"))
+	assert.NoError(t, err)
+
+	reader := bufio.NewReader(client)
+	reply, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "error: failed to insert rows: "+ErrClosed.Error()+"\n", reply)
+
+	_, err = reader.ReadString('\n')
+	assert.Error(t, err)
+
+	assert.NoError(t, ln.Close())
+	assert.NoError(t, <-done)
+}
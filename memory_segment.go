@@ -3,6 +3,7 @@ package mandodb
 import (
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"math"
 	"os"
 	"path"
@@ -14,42 +15,139 @@ import (
 )
 
 type memorySegment struct {
+	opts     *tsdbOptions
 	once     sync.Once
-	segment  sync.Map
 	indexMap *memoryIndexMap
 	labelVs  *labelValueSet
 
-	outdated    map[string]sortedlist.List
+	// series 以自增的 ref 作为标识 hashes 用于通过 LabelSet 的哈希值查找 series
+	// 不同的 LabelSet 可能存在哈希冲突 所以同一个哈希值下可能有多个 series
+	seriesMut sync.RWMutex
+	series    map[uint32]*memorySeries
+	hashes    map[uint64][]*memorySeries
+	nextRef   uint32
+
+	outdated    map[uint32]sortedlist.List
 	outdatedMut sync.Mutex
 
+	// deleteMut 写入时持有读锁 DeleteSeries 持有写锁 避免删除 series 的同时有数据点写入
+	deleteMut sync.RWMutex
+
 	minTs int64
 	maxTs int64
 
 	seriesCount     int64
 	dataPointsCount int64
+
+	// walSeq 该 segment 数据所对应的最后一个 WAL 文件序号
+	walSeq int
+
+	// seq 写入顺序 在 segment 停止写入时分配 见 Desc.Seq
+	seq int64
+
+	// parents 由 compaction 生成的 segment 会记录被合并的 segment
+	parents []string
 }
 
-func newMemorySegment() Segment {
+func newMemorySegment(opts *tsdbOptions) Segment {
 	return &memorySegment{
+		opts:     opts,
 		indexMap: newMemoryIndexMap(),
 		labelVs:  newLabelValueSet(),
-		outdated: make(map[string]sortedlist.List),
+		series:   make(map[uint32]*memorySeries),
+		hashes:   make(map[uint64][]*memorySeries),
+		outdated: make(map[uint32]sortedlist.List),
 		minTs:    math.MaxInt64,
 		maxTs:    math.MinInt64,
 	}
 }
 
-func (ms *memorySegment) getOrCreateSeries(row *Row) *memorySeries {
-	v, ok := ms.segment.Load(row.ID())
-	if ok {
-		return v.(*memorySeries)
+// lookupSeries 在哈希值为 hash 的 series 中查找 LabelSet 完全一致的 series
+func (ms *memorySegment) lookupSeries(hash uint64, labels LabelSet) *memorySeries {
+	for _, series := range ms.hashes[hash] {
+		if compareLabels(series.labels, labels) == 0 {
+			return series
+		}
 	}
 
+	return nil
+}
+
+// getOrCreateSeries 返回 row 对应的 series 新建 series 时会分配 ref 并更新索引
+func (ms *memorySegment) getOrCreateSeries(row *Row, hash uint64) *memorySeries {
+	ms.seriesMut.RLock()
+	series := ms.lookupSeries(hash, row.Labels)
+	ms.seriesMut.RUnlock()
+
+	if series != nil {
+		return series
+	}
+
+	ms.seriesMut.Lock()
+	defer ms.seriesMut.Unlock()
+
+	if series = ms.lookupSeries(hash, row.Labels); series != nil {
+		return series
+	}
+
+	series = newSeries(row, ms.nextRef, hash)
+	ms.nextRef++
+	ms.series[series.ref] = series
+	ms.hashes[hash] = append(ms.hashes[hash], series)
+	ms.indexMap.UpdateIndex(series.ref, series.labels)
 	atomic.AddInt64(&ms.seriesCount, 1)
-	newSeries := newSeries(row)
-	ms.segment.Store(row.ID(), newSeries)
 
-	return newSeries
+	return series
+}
+
+func (ms *memorySegment) getSeries(ref uint32) *memorySeries {
+	ms.seriesMut.RLock()
+	defer ms.seriesMut.RUnlock()
+
+	return ms.series[ref]
+}
+
+// removeSeries 移除 series 并返回移除后不再关联任何 series 的 label
+func (ms *memorySegment) removeSeries(series *memorySeries) []Label {
+	ms.seriesMut.Lock()
+	defer ms.seriesMut.Unlock()
+
+	if _, ok := ms.series[series.ref]; !ok {
+		return nil
+	}
+
+	delete(ms.series, series.ref)
+	hashed := ms.hashes[series.hash]
+	for i := range hashed {
+		if hashed[i] == series {
+			hashed = append(hashed[:i], hashed[i+1:]...)
+			break
+		}
+	}
+
+	if len(hashed) == 0 {
+		delete(ms.hashes, series.hash)
+	} else {
+		ms.hashes[series.hash] = hashed
+	}
+
+	atomic.AddInt64(&ms.seriesCount, -1)
+	return ms.indexMap.RemoveIndex(series.ref, series.labels)
+}
+
+// allSeries 返回按 ref 排序的所有 series
+func (ms *memorySegment) allSeries() []*memorySeries {
+	ms.seriesMut.RLock()
+	ret := make([]*memorySeries, 0, len(ms.series))
+	for _, series := range ms.series {
+		ret = append(ret, series)
+	}
+	ms.seriesMut.RUnlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ref < ret[j].ref
+	})
+	return ret
 }
 
 func (ms *memorySegment) MinTs() int64 {
@@ -60,12 +158,16 @@ func (ms *memorySegment) MaxTs() int64 {
 	return atomic.LoadInt64(&ms.maxTs)
 }
 
+func (ms *memorySegment) Seq() int64 {
+	return ms.seq
+}
+
 func (ms *memorySegment) Frozen() bool {
-	if globalOpts.onlyMemoryMode {
+	if ms.opts.onlyMemoryMode {
 		return false
 	}
 
-	return ms.MaxTs()-ms.MinTs() > int64(globalOpts.segmentDuration.Seconds())
+	return ms.MaxTs()-ms.MinTs() > ms.opts.precision.Duration(ms.opts.segmentDuration)
 }
 
 func (ms *memorySegment) Type() SegmentType {
@@ -73,23 +175,37 @@ func (ms *memorySegment) Type() SegmentType {
 }
 
 func (ms *memorySegment) Close() error {
-	if ms.dataPointsCount == 0 || globalOpts.onlyMemoryMode {
+	if atomic.LoadInt64(&ms.dataPointsCount) == 0 || ms.opts.onlyMemoryMode {
 		return nil
 	}
 
-	return writeToDisk(ms)
+	_, err := writeToDisk(ms)
+	return err
 }
 
 func (ms *memorySegment) Cleanup() error {
 	return nil
 }
 
-func (ms *memorySegment) Load() Segment {
-	return ms
+func (ms *memorySegment) Load() (Segment, error) {
+	return ms, nil
 }
 
-func (ms *memorySegment) InsertRows(rows []*Row) {
-	for _, row := range rows {
+// InsertRows 写入 rows 并返回写入结果
+// 时间戳重复的数据点按照 DuplicatePolicy 处理 没有开启乱序写入时 时间戳小于 series 最新时间戳的数据点会被拒绝
+// 乱序以及 DuplicateLastWriteWins 下重复的数据点都记录在 outdated 中 合并时 outdated 中的数据点优先
+func (ms *memorySegment) InsertRows(rows []*Row) InsertResult {
+	ms.deleteMut.RLock()
+	defer ms.deleteMut.RUnlock()
+
+	var rejected []RejectedRow
+	var ignored int
+	for i, row := range rows {
+		if row.Metric == "" {
+			rejected = append(rejected, RejectedRow{Index: i, Row: row, Reason: RejectEmptyMetric})
+			continue
+		}
+
 		ms.labelVs.Set(metricName, row.Metric)
 		for _, label := range row.Labels {
 			ms.labelVs.Set(label.Name, label.Value)
@@ -97,16 +213,36 @@ func (ms *memorySegment) InsertRows(rows []*Row) {
 
 		row.Labels = row.Labels.AddMetricName(row.Metric)
 		row.Labels.Sorted()
-		series := ms.getOrCreateSeries(row)
+		series := ms.getOrCreateSeries(row, row.Labels.Hash())
 
 		dp := series.Append(&row.Point)
 
+		if dp != nil && (ms.opts.duplicatePolicy != DuplicateLastWriteWins || !ms.opts.enableOutdated) {
+			var reason RejectReason
+			dup := ms.containsSample(series, dp.Ts)
+			switch {
+			case dup && ms.opts.duplicatePolicy == DuplicateFirstWriteWins:
+				ignored++
+				continue
+			case dup && ms.opts.duplicatePolicy == DuplicateReject:
+				reason = RejectDuplicate
+			case !dup && !ms.opts.enableOutdated:
+				reason = RejectOutOfOrder
+			}
+
+			if reason != "" {
+				row.Labels = row.Labels.dropMetricName()
+				rejected = append(rejected, RejectedRow{Index: i, Row: row, Reason: reason})
+				continue
+			}
+		}
+
 		if dp != nil {
 			ms.outdatedMut.Lock()
-			if _, ok := ms.outdated[row.ID()]; !ok {
-				ms.outdated[row.ID()] = sortedlist.NewTree()
+			if _, ok := ms.outdated[series.ref]; !ok {
+				ms.outdated[series.ref] = sortedlist.NewTree()
 			}
-			ms.outdated[row.ID()].Add(row.Point.Ts, row.Point)
+			ms.outdated[series.ref].Add(row.Point.Ts, row.Point)
 			ms.outdatedMut.Unlock()
 		}
 
@@ -117,20 +253,84 @@ func (ms *memorySegment) InsertRows(rows []*Row) {
 			atomic.StoreInt64(&ms.maxTs, row.Point.Ts)
 		}
 		atomic.AddInt64(&ms.dataPointsCount, 1)
-		ms.indexMap.UpdateIndex(row.ID(), row.Labels)
 	}
+
+	return InsertResult{Inserted: len(rows) - len(rejected) - ignored, Ignored: ignored, Rejected: rejected}
+}
+
+// containsSample 判断 series 中是否已经存在时间戳为 ts 的数据点 需要遍历 chunk 只在乱序写入时调用
+func (ms *memorySegment) containsSample(series *memorySeries, ts int64) bool {
+	if series.MaxTs() == ts {
+		return true
+	}
+
+	ms.outdatedMut.Lock()
+	lst, ok := ms.outdated[series.ref]
+	found := ok && lst.Range(ts, ts).Next()
+	ms.outdatedMut.Unlock()
+	if found {
+		return true
+	}
+
+	return series.Iterator(ts, ts).Next()
+}
+
+// QueryLabelNames 没有指定 lms 时直接从 labelValueSet 中获取 否则从满足 lms 的 series 中收集
+func (ms *memorySegment) QueryLabelNames(lms LabelMatcherSet) ([]string, error) {
+	if len(lms) == 0 {
+		return ms.labelVs.Names(), nil
+	}
+
+	ret := make([]string, 0)
+	for _, labels := range ms.matchLabels(lms) {
+		for _, label := range labels {
+			ret = append(ret, label.Name)
+		}
+	}
+
+	return ret, nil
+}
+
+// QueryLabelValues 没有指定 lms 时直接从 labelValueSet 中获取 否则从满足 lms 的 series 中收集
+func (ms *memorySegment) QueryLabelValues(label string, lms LabelMatcherSet) ([]string, error) {
+	if len(lms) == 0 {
+		return ms.labelVs.Get(label), nil
+	}
+
+	ret := make([]string, 0)
+	for _, labels := range ms.matchLabels(lms) {
+		for _, l := range labels {
+			if l.Name == label {
+				ret = append(ret, l.Value)
+			}
+		}
+	}
+
+	return ret, nil
 }
 
-func (ms *memorySegment) QueryLabelValues(label string) []string {
-	return ms.labelVs.Get(label)
+func (ms *memorySegment) matchLabels(lms LabelMatcherSet) []LabelSet {
+	matchSids := ms.indexMap.MatchSids(ms.labelVs, lms)
+	ret := make([]LabelSet, 0, len(matchSids))
+	for _, sid := range matchSids {
+		series := ms.getSeries(sid)
+		if series == nil {
+			continue
+		}
+		ret = append(ret, series.labels)
+	}
+
+	return ret
 }
 
 func (ms *memorySegment) QuerySeries(lms LabelMatcherSet) ([]LabelSet, error) {
 	matchSids := ms.indexMap.MatchSids(ms.labelVs, lms)
 	ret := make([]LabelSet, 0)
 	for _, sid := range matchSids {
-		b, _ := ms.segment.Load(sid)
-		series := b.(*memorySeries)
+		series := ms.getSeries(sid)
+		if series == nil {
+			continue
+		}
 
 		ret = append(ret, series.labels)
 	}
@@ -138,129 +338,173 @@ func (ms *memorySegment) QuerySeries(lms LabelMatcherSet) ([]LabelSet, error) {
 	return ret, nil
 }
 
-func (ms *memorySegment) QueryRange(lms LabelMatcherSet, start, end int64) ([]MetricRet, error) {
+// memSeries head 中的 series 乱序写入的数据点在 Select 时复制 其余数据点在迭代时才解码
+type memSeries struct {
+	series     *memorySeries
+	outdated   []Point
+	start, end int64
+}
+
+func (s *memSeries) Labels() LabelSet {
+	return s.series.labels
+}
+
+func (s *memSeries) Iterator() SeriesIterator {
+	it := s.series.Iterator(s.start, s.end)
+	if len(s.outdated) == 0 {
+		return it
+	}
+	return newMergedIterator(it, newListSeriesIterator(s.outdated))
+}
+
+func (ms *memorySegment) Select(lms LabelMatcherSet, start, end int64) SeriesSet {
 	matchSids := ms.indexMap.MatchSids(ms.labelVs, lms)
-	ret := make([]MetricRet, 0, len(matchSids))
+	ret := make([]Series, 0, len(matchSids))
 	for _, sid := range matchSids {
-		b, _ := ms.segment.Load(sid)
-		series := b.(*memorySeries)
+		s := ms.getSeries(sid)
+		if s == nil {
+			continue
+		}
 
-		points := series.Get(start, end)
+		series := &memSeries{series: s, start: start, end: end}
 
 		ms.outdatedMut.Lock()
 		v, ok := ms.outdated[sid]
 		if ok {
 			iter := v.Range(start, end)
 			for iter.Next() {
-				points = append(points, iter.Value().(Point))
+				series.outdated = append(series.outdated, iter.Value().(Point))
 			}
 		}
 		ms.outdatedMut.Unlock()
 
-		ret = append(ret, MetricRet{
-			Labels: series.labels,
-			Points: points,
-		})
+		ret = append(ret, series)
 	}
 
-	return ret, nil
+	return newListSeriesSet(ret)
 }
 
-func (ms *memorySegment) Marshal() ([]byte, []byte, error) {
-	sids := make(map[string]uint32)
+// DeleteSeries 直接删除满足 lms 的 series 在 [start, end] 区间内的数据点
+// 数据点被全部删除的 series 会从索引中移除 删除期间会阻塞写入
+func (ms *memorySegment) DeleteSeries(lms LabelMatcherSet, start, end int64) error {
+	ms.deleteMut.Lock()
+	defer ms.deleteMut.Unlock()
 
-	startOffset := 0
-	size := 0
+	for _, sid := range ms.indexMap.MatchSids(ms.labelVs, lms) {
+		series := ms.getSeries(sid)
+		if series == nil {
+			continue
+		}
+
+		removed := series.Delete(start, end)
+
+		ms.outdatedMut.Lock()
+		v, ok := ms.outdated[sid]
+		if ok {
+			keys := make([]int64, 0)
+			iter := v.Range(start, end)
+			for iter.Next() {
+				keys = append(keys, iter.Value().(Point).Ts)
+			}
+
+			for _, key := range keys {
+				v.Remove(key)
+			}
+			removed += len(keys)
+
+			if !v.All().Next() {
+				delete(ms.outdated, sid)
+				ok = false
+			}
+		}
+		ms.outdatedMut.Unlock()
+
+		atomic.AddInt64(&ms.dataPointsCount, -int64(removed))
+		if ok || series.Count() > 0 {
+			continue
+		}
+
+		for _, label := range ms.removeSeries(series) {
+			ms.labelVs.Remove(label.Name, label.Value)
+		}
+	}
 
-	dataBuf := make([]byte, 0)
+	return nil
+}
 
-	// TOC 占位符 用于后面标记 dataBytes / metaBytes 长度
-	dataBuf = append(dataBuf, make([]byte, uint64Size*2)...)
-	meta := Metadata{MinTs: ms.minTs, MaxTs: ms.maxTs}
+func (ms *memorySegment) Marshal() ([]byte, []byte, error) {
+	startOffset := 0
 
-	// key: sid
-	// value: series entity
-	ms.segment.Range(func(key, value interface{}) bool {
-		sid := key.(string)
-		sids[sid] = uint32(size)
-		size++
+	header := segmentHeader{
+		version:         segmentFormatV4,
+		bytesCompressor: ms.opts.bytesCompressorType,
+		metaSerializer:  ms.opts.metaSerializerType,
+	}
+	dataBuf := header.Marshal()
+	shift := len(dataBuf) + segmentTOCSize
 
-		series := value.(*memorySeries)
-		meta.sidRelatedLabels = append(meta.sidRelatedLabels, series.labels)
+	// TOC 占位符 用于后面标记 dataBytes / indexBytes 长度
+	dataBuf = append(dataBuf, make([]byte, segmentTOCSize)...)
+	series := make([]indexSeries, 0)
 
+	// 按 ref 的顺序写入 在 disk segment 中的 sid 即为写入的顺序
+	for _, s := range ms.allSeries() {
 		ms.outdatedMut.Lock()
-		v, ok := ms.outdated[sid]
+		v, ok := ms.outdated[s.ref]
 		ms.outdatedMut.Unlock()
 
 		var dataBytes []byte
 		if ok {
-			dataBytes = ByteCompress(series.MergeOutdatedList(v).Bytes())
+			dataBytes = ms.opts.bytesCompressor.Compress(s.MergeOutdatedList(v).Bytes())
 		} else {
-			dataBytes = ByteCompress(series.Bytes())
+			dataBytes = ms.opts.bytesCompressor.Compress(s.Bytes())
 		}
 
 		dataBuf = append(dataBuf, dataBytes...)
+		dataBuf = appendChecksum(dataBuf, dataBytes)
 		endOffset := startOffset + len(dataBytes)
-		meta.Series = append(meta.Series, metaSeries{
-			Sid:         key.(string),
-			StartOffset: uint64(startOffset),
-			EndOffset:   uint64(endOffset),
-		})
-		startOffset = endOffset
-
-		return true
-	})
-
-	labelIdx := make([]seriesWithLabel, 0)
-
-	// key: Label.MarshalName()
-	// value: sids...
-	ms.indexMap.Range(func(key string, value *memorySidSet) {
-		l := make([]uint32, 0)
-		for _, s := range value.List() {
-			l = append(l, sids[s])
-		}
-
-		sort.Slice(l, func(i, j int) bool {
-			return l[i] < l[j]
+		series = append(series, indexSeries{
+			labels: s.labels,
+			start:  uint64(startOffset),
+			end:    uint64(endOffset),
 		})
-		labelIdx = append(labelIdx, seriesWithLabel{Name: key, Sids: l})
-	})
-	meta.Labels = labelIdx
-
-	metaBytes, err := MarshalMeta(meta)
-	if err != nil {
-		return nil, nil, err
+		startOffset = endOffset + checksumSize
 	}
-	metalen := len(metaBytes)
+
+	indexBytes := marshalIndex(series, segmentFormatV4)
+	indexLen := len(indexBytes)
 
 	desc := &Desc{
-		SeriesCount:     ms.seriesCount,
-		DataPointsCount: ms.dataPointsCount,
-		MaxTs:           ms.maxTs,
-		MinTs:           ms.minTs,
+		SeriesCount:     atomic.LoadInt64(&ms.seriesCount),
+		DataPointsCount: atomic.LoadInt64(&ms.dataPointsCount),
+		MaxTs:           ms.MaxTs(),
+		MinTs:           ms.MinTs(),
+		WalSeq:          ms.walSeq,
+		Seq:             ms.seq,
+		Parents:         ms.parents,
 	}
 
 	descBytes, _ := json.MarshalIndent(desc, "", "    ")
 
-	dataLen := len(dataBuf) - (uint64Size * 2)
-	dataBuf = append(dataBuf, metaBytes...)
+	dataLen := len(dataBuf) - shift
+	dataBuf = append(dataBuf, indexBytes...)
+	dataBuf = appendChecksum(dataBuf, indexBytes[indexLen-indexTOCSize:])
 
 	// TOC 写入
 	encf := newEncbuf()
-	encf.MarshalUint64(uint64(dataLen))
-	dataLenBs := encf.Bytes()
-	copy(dataBuf[:uint64Size], dataLenBs[:uint64Size])
-
-	encf.Reset()
-
-	encf.MarshalUint64(uint64(metalen))
-	metaLenBs := encf.Bytes()
-	copy(dataBuf[uint64Size:uint64Size*2], metaLenBs[:uint64Size])
+	encf.MarshalUint64(uint64(dataLen), uint64(indexLen))
+	copy(dataBuf[shift-segmentTOCSize:shift], encf.Bytes())
 
 	return dataBuf, descBytes, nil
 }
 
+// appendChecksum 在 buf 末尾追加 data 的 crc32 校验和
+func appendChecksum(buf, data []byte) []byte {
+	encf := newEncbuf()
+	encf.MarshalUint32(crc32.Checksum(data, castagnoliTable))
+	return append(buf, encf.Bytes()...)
+}
+
 func mkdir(d string) {
 	if _, err := os.Stat(d); !os.IsNotExist(err) {
 		return
@@ -271,38 +515,87 @@ func mkdir(d string) {
 	}
 }
 
-func writeToDisk(segment *memorySegment) error {
+const tmpSegmentSuffix = ".tmp"
+
+// syncDir 将文件夹的元数据变更（新建/重命名文件）刷到磁盘
+func syncDir(d string) error {
+	fd, err := os.Open(d)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return fd.Sync()
+}
+
+// segmentDirname 返回一个尚未被占用的 segment 文件夹
+// 同名文件夹已经存在时（如时间范围不变的 segment 被重写）追加序号
+func segmentDirname(dataPath string, minTs, maxTs int64) string {
+	dn := dirname(dataPath, minTs, maxTs)
+	for i := 1; isFileExist(dn); i++ {
+		dn = fmt.Sprintf("%s.%d", dirname(dataPath, minTs, maxTs), i)
+	}
+
+	return dn
+}
+
+// writeToDisk 先将 segment 写入临时文件夹 fsync 后再原子地 rename 成最终的文件夹 返回最终的文件夹路径
+// 保证进程崩溃或者机器掉电后磁盘上不会出现写了一半的 segment
+func writeToDisk(segment *memorySegment) (string, error) {
 	dataBytes, descBytes, err := segment.Marshal()
 	if err != nil {
-		return fmt.Errorf("failed to marshal segment: %s", err.Error())
+		return "", fmt.Errorf("failed to marshal segment: %s", err.Error())
 	}
 
-	writeFile := func(f string, data []byte) error {
-		if isFileExist(f) {
-			return fmt.Errorf("%s file is already exists", f)
-		}
+	dn := segmentDirname(segment.opts.dataPath, segment.MinTs(), segment.MaxTs())
 
-		fd, err := os.OpenFile(f, os.O_CREATE|os.O_WRONLY, os.ModePerm)
-		if err != nil {
-			return err
-		}
-		defer fd.Close()
+	// 清理上次失败残留的临时文件夹
+	tmp := dn + tmpSegmentSuffix
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	mkdir(tmp)
+
+	if err := writeFileSync(path.Join(tmp, "data"), dataBytes); err != nil {
+		return "", err
+	}
+
+	// 这里的 meta.json 只是描述了一些简单的信息 并非全局定义的 MetaData
+	if err := writeFileSync(path.Join(tmp, "meta.json"), descBytes); err != nil {
+		return "", err
+	}
+
+	return dn, commitSegmentDir(tmp, dn)
+}
+
+// writeFileSync 创建文件 f 并写入 data 写入完成后 fsync
+func writeFileSync(f string, data []byte) error {
+	if isFileExist(f) {
+		return fmt.Errorf("%s file is already exists", f)
+	}
+
+	fd, err := os.OpenFile(f, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
 
-		_, err = fd.Write(data)
+	if _, err = fd.Write(data); err != nil {
 		return err
 	}
 
-	dn := dirname(segment.MinTs(), segment.MaxTs())
-	mkdir(dn)
+	return fd.Sync()
+}
 
-	if err := writeFile(path.Join(dn, "data"), dataBytes); err != nil {
+// commitSegmentDir 将写入完成的临时文件夹 tmp fsync 后 rename 成 dn
+func commitSegmentDir(tmp, dn string) error {
+	if err := syncDir(tmp); err != nil {
 		return err
 	}
 
-	// 这里的 meta.json 只是描述了一些简单的信息 并非全局定义的 MetaData
-	if err := writeFile(path.Join(dn, "meta.json"), descBytes); err != nil {
+	if err := os.Rename(tmp, dn); err != nil {
 		return err
 	}
 
-	return nil
+	return syncDir(path.Dir(dn))
 }
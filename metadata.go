@@ -1,6 +1,7 @@
 package mandodb
 
 import (
+	"fmt"
 	"sort"
 )
 
@@ -37,14 +38,34 @@ type MetaSerializer interface {
 	Unmarshal([]byte, *Metadata) error
 }
 
-// MarshalMeta 负责序列化 Meta 数据
-func MarshalMeta(meta Metadata) ([]byte, error) {
-	return globalOpts.metaSerializer.Marshal(meta)
+// newMetaSerializer 根据类型创建对应的序列化器
+func newMetaSerializer(t MetaSerializerType) (MetaSerializer, error) {
+	switch t {
+	case BinaryMetaSerializer:
+		return newBinaryMetaSerializer(), nil
+	}
+
+	return nil, fmt.Errorf("unknown meta serializer type: %d", t)
 }
 
-// UnmarshalMeta 负责反序列化 Meta 数据
-func UnmarshalMeta(data []byte, meta *Metadata) error {
-	return globalOpts.metaSerializer.Unmarshal(data, meta)
+// MarshalMeta 负责序列化并压缩 Meta 数据
+func MarshalMeta(serializer MetaSerializer, compressor BytesCompressor, meta Metadata) ([]byte, error) {
+	data, err := serializer.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return compressor.Compress(data), nil
+}
+
+// UnmarshalMeta 负责解压缩并反序列化 Meta 数据
+func UnmarshalMeta(serializer MetaSerializer, compressor BytesCompressor, data []byte, meta *Metadata) error {
+	data, err := compressor.Decompress(data)
+	if err != nil {
+		return ErrInvalidSize
+	}
+
+	return serializer.Unmarshal(data, meta)
 }
 
 const (
@@ -101,15 +122,10 @@ func (s *binaryMetaSerializer) Marshal(meta Metadata) ([]byte, error) {
 	encf.MarshalUint64(uint64(meta.MaxTs))
 	encf.MarshalString(magic)
 
-	return ByteCompress(encf.Bytes()), nil
+	return encf.Bytes(), nil
 }
 
 func (s *binaryMetaSerializer) Unmarshal(data []byte, meta *Metadata) error {
-	data, err := ByteDecompress(data)
-	if err != nil {
-		return ErrInvalidSize
-	}
-
 	if len(data) < len(magic) {
 		return ErrInvalidSize
 	}
@@ -0,0 +1,123 @@
+package mandodb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/chenjiandongx/logger"
+
+	"github.com/chenjiandongx/mandodb/pkg/opentsdb"
+)
+
+// ServeOpenTSDB 接受 ln 上的 OpenTSDB telnet 连接并写入 ln 被关闭后返回
+// 支持 put 以及 version 命令 put 失败时会将错误回复给客户端
+func (tsdb *TSDB) ServeOpenTSDB(ln net.Listener) error {
+	return tsdb.serveLines(ln, "opentsdb", func(line string) ([]*Row, string) {
+		fields := strings.SplitN(line, " ", 2)
+		switch fields[0] {
+		case "put":
+			var args string
+			if len(fields) == 2 {
+				args = fields[1]
+			}
+
+			dp, err := opentsdb.ParsePut(args)
+			if err != nil {
+				return nil, fmt.Sprintf("put: illegal argument: %v", err)
+			}
+			return []*Row{tsdb.openTSDBPointToRow(dp)}, ""
+
+		case "version":
+			return nil, "mandodb"
+		}
+
+		return nil, fmt.Sprintf("unknown command: %s", fields[0])
+	})
+}
+
+type openTSDBPutError struct {
+	DataPoint opentsdb.DataPoint `json:"datapoint"`
+	Error     string             `json:"error"`
+}
+
+type openTSDBPutResponse struct {
+	Success int                `json:"success"`
+	Failed  int                `json:"failed"`
+	Errors  []openTSDBPutError `json:"errors"`
+}
+
+// OpenTSDBPutHandler 返回接收 OpenTSDB /api/put 请求的 http.Handler
+// 请求体为单个数据点或者数据点数组 支持 gzip 压缩
+// * 204: 写入成功
+// * 400: 请求体无法解析或者存在不合法的数据点 其余的数据点仍然会被写入 响应体中包含每个数据点的错误
+// * 413: 请求体超过 WithMaxRequestBodySize 设置的上限
+// * 503: 写入队列已满 客户端应该稍后重试
+func (tsdb *TSDB) OpenTSDBPutHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := tsdb.readGzipBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), badRequestCode(err))
+			return
+		}
+
+		dps, err := opentsdb.DecodeJSON(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode datapoints: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		resp := &openTSDBPutResponse{Errors: make([]openTSDBPutError, 0)}
+		rows := make([]*Row, 0, len(dps))
+		for _, dp := range dps {
+			if err := dp.Validate(); err != nil {
+				resp.Errors = append(resp.Errors, openTSDBPutError{DataPoint: dp, Error: err.Error()})
+				continue
+			}
+			rows = append(rows, tsdb.openTSDBPointToRow(dp))
+		}
+
+		if len(rows) > 0 {
+			if err := tsdb.InsertRows(rows); err != nil {
+				code := http.StatusInternalServerError
+				if errors.Is(err, ErrWriteOverloaded) {
+					code = http.StatusServiceUnavailable
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+		}
+
+		if len(resp.Errors) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		resp.Success, resp.Failed = len(rows), len(resp.Errors)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logger.Errorf("failed to write opentsdb response: %v", err)
+		}
+	})
+}
+
+// openTSDBPointToRow 将 opentsdb.DataPoint 转换为 Row 时间戳会转换为当前配置的精度
+func (tsdb *TSDB) openTSDBPointToRow(dp opentsdb.DataPoint) *Row {
+	labels := make(LabelSet, 0, len(dp.Tags))
+	for k, v := range dp.Tags {
+		labels = append(labels, Label{Name: k, Value: v})
+	}
+
+	return &Row{
+		Metric: dp.Metric,
+		Labels: labels,
+		Point: Point{
+			Ts:    tsdb.opts.precision.FromMilliseconds(dp.Milliseconds()),
+			Value: float64(dp.Value),
+		},
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The code in this file was largely written by Damian Gryski as part of
+// https://github.com/dgryski/go-tsz and published under the license below.
+// It was modified to accommodate reading from byte slices without modifying
+// the underlying bytes, which would panic when reading from mmap'd
+// read-only byte slices.
+
+// Copyright (c) 2015,2016 Damian Gryski <damian@gryski.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// 本文件移植自 github.com/prometheus/prometheus/tsdb/chunkenc/xor.go
+// 改动: Appender 合并进 XORChunk 样本数由调用方传入 NewIterator 不再写入 chunk 头部 注释改为中文
+
+package chunkenc
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// XORChunk 使用 Gorilla 差值算法压缩 (int64, float64) 数据点
+// 时间戳使用 delta-of-delta 编码 数值使用 XOR 编码 位布局与 Prometheus 的 XOR chunk 保持一致
+//
+// * 第一个点: 时间戳 varint | 数值 64 bits
+// * 第二个点: 时间戳差值 uvarint | 数值 XOR
+// * 之后的点: 时间戳 delta-of-delta | 数值 XOR
+//
+// delta-of-delta 编码
+// * '0': dod == 0
+// * '10': 14 bits
+// * '110': 17 bits
+// * '1110': 20 bits
+// * '1111': 64 bits
+type XORChunk struct {
+	b   bstream
+	num int
+
+	t      int64
+	v      float64
+	tDelta uint64
+
+	leading  uint8
+	trailing uint8
+}
+
+// NewXORChunk 生成一个空的 XORChunk
+func NewXORChunk() *XORChunk {
+	return &XORChunk{leading: 0xff}
+}
+
+// NumSamples 返回数据点数量
+func (c *XORChunk) NumSamples() int {
+	return c.num
+}
+
+// Bytes 返回编码后的数据流 不包含数据点数量
+func (c *XORChunk) Bytes() []byte {
+	return c.b.bytes()
+}
+
+// Append 追加数据点 时间戳需要单调递增
+func (c *XORChunk) Append(t int64, v float64) {
+	var tDelta uint64
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	switch c.num {
+	case 0:
+		for _, b := range buf[:binary.PutVarint(buf, t)] {
+			c.b.writeByte(b)
+		}
+		c.b.writeBits(math.Float64bits(v), 64)
+
+	case 1:
+		tDelta = uint64(t - c.t)
+		for _, b := range buf[:binary.PutUvarint(buf, tDelta)] {
+			c.b.writeByte(b)
+		}
+		c.writeVDelta(v)
+
+	default:
+		tDelta = uint64(t - c.t)
+		dod := int64(tDelta - c.tDelta)
+
+		switch {
+		case dod == 0:
+			c.b.writeBit(false)
+		case bitRange(dod, 14):
+			c.b.writeBits(0b10, 2)
+			c.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.b.writeBits(0b110, 3)
+			c.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.b.writeBits(0b1110, 4)
+			c.b.writeBits(uint64(dod), 20)
+		default:
+			c.b.writeBits(0b1111, 4)
+			c.b.writeBits(uint64(dod), 64)
+		}
+		c.writeVDelta(v)
+	}
+
+	c.t = t
+	c.v = v
+	c.tDelta = tDelta
+	c.num++
+}
+
+// bitRange 判断 x 是否可以使用 nbits 位表示
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+func (c *XORChunk) writeVDelta(v float64) {
+	vDelta := math.Float64bits(v) ^ math.Float64bits(c.v)
+
+	if vDelta == 0 {
+		c.b.writeBit(false)
+		return
+	}
+	c.b.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(vDelta))
+	trailing := uint8(bits.TrailingZeros64(vDelta))
+
+	// 只有 5 bits 用于存储 leading
+	if leading >= 32 {
+		leading = 31
+	}
+
+	// 沿用上一个值的 leading/trailing
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		c.b.writeBit(false)
+		c.b.writeBits(vDelta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+
+	c.leading, c.trailing = leading, trailing
+
+	c.b.writeBit(true)
+	c.b.writeBits(uint64(leading), 5)
+
+	// 有效位为 64 时会溢出成 0 读取的时候需要还原
+	sigbits := 64 - leading - trailing
+	c.b.writeBits(uint64(sigbits), 6)
+	c.b.writeBits(vDelta>>trailing, int(sigbits))
+}
+
+// Iterator 返回数据点迭代器 迭代的是当前数据的快照
+func (c *XORChunk) Iterator() *Iterator {
+	b := make([]byte, len(c.b.stream))
+	copy(b, c.b.stream)
+
+	return NewIterator(b, c.num)
+}
+
+// Iterator 数据点迭代器
+type Iterator struct {
+	br       *bstreamReader
+	numTotal int
+	numRead  int
+
+	t      int64
+	v      float64
+	tDelta uint64
+
+	leading  uint8
+	trailing uint8
+
+	err error
+}
+
+// NewIterator 从数据流 b 中迭代 n 个数据点
+func NewIterator(b []byte, n int) *Iterator {
+	return &Iterator{br: newBReader(b), numTotal: n}
+}
+
+// At 返回当前数据点
+func (it *Iterator) At() (int64, float64) {
+	return it.t, it.v
+}
+
+// Err 返回迭代过程中的错误
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Next 推进迭代器
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.numRead == it.numTotal {
+		return false
+	}
+
+	switch it.numRead {
+	case 0:
+		t, err := binary.ReadVarint(it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		v, err := it.br.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.t = t
+		it.v = math.Float64frombits(v)
+
+	case 1:
+		tDelta, err := binary.ReadUvarint(it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.tDelta = tDelta
+		it.t += int64(tDelta)
+		if !it.readValue() {
+			return false
+		}
+
+	default:
+		var d byte
+		for i := 0; i < 4; i++ {
+			d <<= 1
+			bit, err := it.br.readBit()
+			if err != nil {
+				it.err = err
+				return false
+			}
+			if !bit {
+				break
+			}
+			d |= 1
+		}
+
+		var sz uint8
+		var dod int64
+		switch d {
+		case 0b0:
+		case 0b10:
+			sz = 14
+		case 0b110:
+			sz = 17
+		case 0b1110:
+			sz = 20
+		case 0b1111:
+			b, err := it.br.readBits(64)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			dod = int64(b)
+		}
+
+		if sz != 0 {
+			b, err := it.br.readBits(int(sz))
+			if err != nil {
+				it.err = err
+				return false
+			}
+
+			// 还原负数
+			if b > (1 << (sz - 1)) {
+				b -= 1 << sz
+			}
+			dod = int64(b)
+		}
+
+		it.tDelta = uint64(int64(it.tDelta) + dod)
+		it.t += int64(it.tDelta)
+		if !it.readValue() {
+			return false
+		}
+	}
+
+	it.numRead++
+	return true
+}
+
+func (it *Iterator) readValue() bool {
+	bit, err := it.br.readBit()
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	// 与上一个值相同
+	if !bit {
+		return true
+	}
+
+	bit, err = it.br.readBit()
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	if bit {
+		leading, err := it.br.readBits(5)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		sigbits, err := it.br.readBits(6)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if sigbits == 0 {
+			sigbits = 64
+		}
+
+		it.leading = uint8(leading)
+		it.trailing = 64 - it.leading - uint8(sigbits)
+	}
+
+	sigbits := 64 - int(it.leading) - int(it.trailing)
+	b, err := it.br.readBits(sigbits)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	vbits := math.Float64bits(it.v)
+	vbits ^= b << it.trailing
+	it.v = math.Float64frombits(vbits)
+	return true
+}
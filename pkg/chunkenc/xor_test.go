@@ -0,0 +1,67 @@
+package chunkenc
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sample struct {
+	t int64
+	v float64
+}
+
+func TestXORChunk(t *testing.T) {
+	samples := make([]sample, 0)
+
+	ts := int64(1600000000000) // 毫秒时间戳
+	v := 100.0
+	for i := 0; i < 2000; i++ {
+		switch {
+		case i%100 == 0:
+			ts += 1 << 40 // 超过 20 bits 的 delta-of-delta
+		case i%10 == 0:
+			ts += rand.Int63n(100000)
+		default:
+			ts += 15000
+		}
+
+		if i%3 == 0 {
+			v = rand.Float64() * 1000
+		}
+		samples = append(samples, sample{t: ts, v: v})
+	}
+	samples = append(samples, sample{t: ts + 1, v: math.MaxFloat64}, sample{t: ts + 2, v: -1})
+
+	c := NewXORChunk()
+	for _, s := range samples {
+		c.Append(s.t, s.v)
+	}
+	assert.Equal(t, len(samples), c.NumSamples())
+
+	it := NewIterator(c.Bytes(), c.NumSamples())
+	idx := 0
+	for it.Next() {
+		ts, v := it.At()
+		assert.Equal(t, samples[idx].t, ts)
+		assert.Equal(t, samples[idx].v, v)
+		idx++
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, len(samples), idx)
+}
+
+func TestXORChunk_Truncated(t *testing.T) {
+	c := NewXORChunk()
+	for i := 0; i < 10; i++ {
+		c.Append(int64(i*1000), float64(i))
+	}
+
+	b := c.Bytes()
+	it := NewIterator(b[:len(b)/2], c.NumSamples())
+	for it.Next() {
+	}
+	assert.Equal(t, ErrEndOfStream, it.Err())
+}
@@ -0,0 +1,258 @@
+// Package expfmt 实现了 Prometheus text exposition format 以及 OpenMetrics 文本格式的解析
+// 格式参见 https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+//	metric_name[{label="value",...}] value [timestamp]
+package expfmt
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Format 文本格式 两者的主要区别在于时间戳单位以及结尾的 # EOF
+type Format int
+
+const (
+	// FormatText Prometheus text format 0.0.4 时间戳单位为毫秒
+	FormatText Format = iota
+
+	// FormatOpenMetrics OpenMetrics 1.0 时间戳单位为秒(可以带小数) 以 # EOF 结尾
+	FormatOpenMetrics
+)
+
+// AcceptHeader 抓取时使用的 Accept 请求头 优先使用 OpenMetrics
+const AcceptHeader = "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+// FormatFromContentType 根据响应的 Content-Type 判断文本格式 无法识别时按照 FormatText 处理
+func FormatFromContentType(ct string) Format {
+	if strings.HasPrefix(strings.TrimSpace(ct), "application/openmetrics-text") {
+		return FormatOpenMetrics
+	}
+	return FormatText
+}
+
+// Label 样本的标签
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample 一行样本
+type Sample struct {
+	Metric string
+	Labels []Label
+	Value  float64
+
+	// Timestamp 单位为毫秒 HasTimestamp 为 false 时表示没有指定时间戳
+	Timestamp    int64
+	HasTimestamp bool
+}
+
+// ParseError 记录出错的行号(从 1 开始)以及原因
+type ParseError struct {
+	Line int
+	Err  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at line %d: %s", e.Line, e.Err)
+}
+
+// Parse 逐行解析 b 空行以及 # 开头的注释行(HELP、TYPE 等)会被忽略
+// 与 Prometheus 的抓取行为一致 任何一行出错都会导致整体失败
+func Parse(b []byte, format Format) ([]Sample, error) {
+	samples := make([]Sample, 0)
+
+	var eof bool
+	for n, line := range bytes.Split(b, []byte("\n")) {
+		s := strings.TrimSpace(string(line))
+		if s == "" {
+			continue
+		}
+
+		if eof {
+			return nil, &ParseError{Line: n + 1, Err: "unexpected data after # EOF"}
+		}
+
+		if s[0] == '#' {
+			if format == FormatOpenMetrics && s == "# EOF" {
+				eof = true
+			}
+			continue
+		}
+
+		sample, err := ParseLine(s, format)
+		if err != nil {
+			return nil, &ParseError{Line: n + 1, Err: err.Error()}
+		}
+		samples = append(samples, sample)
+	}
+
+	if format == FormatOpenMetrics && !eof {
+		return nil, fmt.Errorf("missing # EOF")
+	}
+
+	return samples, nil
+}
+
+// ParseLine 解析单行样本 OpenMetrics 中的 exemplar 会被忽略
+func ParseLine(s string, format Format) (Sample, error) {
+	var sample Sample
+
+	i := 0
+	for i < len(s) && isNameChar(s[i], i == 0, true) {
+		i++
+	}
+	if i == 0 {
+		return sample, fmt.Errorf("invalid metric name in %q", s)
+	}
+	sample.Metric = s[:i]
+
+	if i < len(s) && s[i] == '{' {
+		labels, n, err := parseLabels(s[i:])
+		if err != nil {
+			return sample, err
+		}
+		sample.Labels = labels
+		i += n
+	}
+
+	// OpenMetrics 的 exemplar 以 " # " 开头 紧跟在样本之后
+	rest := s[i:]
+	if format == FormatOpenMetrics {
+		if idx := strings.Index(rest, " # "); idx >= 0 {
+			rest = rest[:idx]
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return sample, fmt.Errorf("invalid sample %q", s)
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample, fmt.Errorf("invalid value %q", fields[0])
+	}
+	sample.Value = value
+
+	if len(fields) == 2 {
+		ts, err := parseTimestamp(fields[1], format)
+		if err != nil {
+			return sample, err
+		}
+		sample.Timestamp = ts
+		sample.HasTimestamp = true
+	}
+
+	return sample, nil
+}
+
+// parseLabels 解析 {label="value",...} 返回标签以及消耗的字节数
+func parseLabels(s string) ([]Label, int, error) {
+	labels := make([]Label, 0)
+
+	i := 1
+	for {
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("unterminated labels in %q", s)
+		}
+		if s[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		start := i
+		for i < len(s) && isNameChar(s[i], i == start, false) {
+			i++
+		}
+		if i == start || i >= len(s) || s[i] != '=' {
+			return nil, 0, fmt.Errorf("invalid label name in %q", s)
+		}
+		name := s[start:i]
+
+		i++
+		if i >= len(s) || s[i] != '"' {
+			return nil, 0, fmt.Errorf("label %s value must be quoted", name)
+		}
+
+		value, n, err := unquote(s[i:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("label %s: %v", name, err)
+		}
+		labels = append(labels, Label{Name: name, Value: value})
+
+		i += n
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i < len(s) && s[i] == ',' {
+			i++
+		}
+	}
+}
+
+// unquote 解析以 " 开头的标签值 支持 \\ \" \n 转义 返回值以及消耗的字节数
+func unquote(s string) (string, int, error) {
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return sb.String(), i + 1, nil
+
+		case '\\':
+			i++
+			if i >= len(s) {
+				return "", 0, fmt.Errorf("unterminated escape")
+			}
+
+			switch s[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case '\\', '"':
+				sb.WriteByte(s[i])
+			default:
+				return "", 0, fmt.Errorf("invalid escape \\%c", s[i])
+			}
+
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+
+	return "", 0, fmt.Errorf("unterminated quoted value")
+}
+
+func parseTimestamp(s string, format Format) (int64, error) {
+	if format == FormatOpenMetrics {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		return int64(math.Round(f * 1000)), nil
+	}
+
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return ts, nil
+}
+
+// isNameChar 指标名称允许 [a-zA-Z_:][a-zA-Z0-9_:]* 标签名称不允许 :
+func isNameChar(c byte, first, colon bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		return true
+	case c == ':':
+		return colon
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
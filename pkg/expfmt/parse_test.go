@@ -0,0 +1,89 @@
+package expfmt
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLine(t *testing.T) {
+	cases := []struct {
+		input    string
+		format   Format
+		expected Sample
+	}{
+		{
+			input:    `http_requests_total{method="post",code="200"} 1027 1395066363000`,
+			format:   FormatText,
+			expected: Sample{Metric: "http_requests_total", Labels: []Label{{Name: "method", Value: "post"}, {Name: "code", Value: "200"}}, Value: 1027, Timestamp: 1395066363000, HasTimestamp: true},
+		},
+		{
+			input:    `msdos_file_access_time_seconds{path="C:\\DIR\\FILE.TXT",error="Cannot find file:\n\"FILE.TXT\"",} 1.458255915e9`,
+			format:   FormatText,
+			expected: Sample{Metric: "msdos_file_access_time_seconds", Labels: []Label{{Name: "path", Value: `C:\DIR\FILE.TXT`}, {Name: "error", Value: "Cannot find file:\n\"FILE.TXT\""}}, Value: 1.458255915e9},
+		},
+		{
+			input:    `metric_without_labels +Inf`,
+			format:   FormatText,
+			expected: Sample{Metric: "metric_without_labels", Value: math.Inf(1)},
+		},
+		{
+			input:    `foo_total{a="b"} 17 1520879607.789 # {trace_id="oHg5SJYRHA0"} 9.8 1520879607.789`,
+			format:   FormatOpenMetrics,
+			expected: Sample{Metric: "foo_total", Labels: []Label{{Name: "a", Value: "b"}}, Value: 17, Timestamp: 1520879607789, HasTimestamp: true},
+		},
+	}
+
+	for _, c := range cases {
+		sample, err := ParseLine(c.input, c.format)
+		assert.NoError(t, err, c.input)
+		assert.Equal(t, c.expected, sample, c.input)
+	}
+}
+
+func TestParseLine_Errors(t *testing.T) {
+	cases := []string{
+		`{a="b"} 1`,
+		`1metric 1`,
+		`metric{a="b" 1`,
+		`metric{a=b} 1`,
+		`metric{a="b\x"} 1`,
+		`metric{1a="b"} 1`,
+		`metric`,
+		`metric abc`,
+		`metric 1 abc`,
+		`metric 1 2 3`,
+	}
+
+	for _, c := range cases {
+		_, err := ParseLine(c, FormatText)
+		assert.Error(t, err, c)
+	}
+}
+
+func TestParse(t *testing.T) {
+	text := "# HELP up Whether the target is up.\n# TYPE up gauge\nup 1\n\nnode_load1 0.5\n"
+	samples, err := Parse([]byte(text), FormatText)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(samples))
+
+	_, err = Parse([]byte("up 1\nbroken\n"), FormatText)
+	assert.Equal(t, &ParseError{Line: 2, Err: `invalid sample "broken"`}, err)
+
+	samples, err = Parse([]byte("# TYPE up gauge\nup 1\n# EOF\n"), FormatOpenMetrics)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(samples))
+
+	_, err = Parse([]byte("up 1\n"), FormatOpenMetrics)
+	assert.Error(t, err)
+
+	_, err = Parse([]byte("up 1\n# EOF\nup 2\n"), FormatOpenMetrics)
+	assert.Error(t, err)
+}
+
+func TestFormatFromContentType(t *testing.T) {
+	assert.Equal(t, FormatOpenMetrics, FormatFromContentType("application/openmetrics-text; version=1.0.0; charset=utf-8"))
+	assert.Equal(t, FormatText, FormatFromContentType("text/plain; version=0.0.4"))
+	assert.Equal(t, FormatText, FormatFromContentType(""))
+}
@@ -0,0 +1,229 @@
+// Package graphite 实现了 Graphite plaintext 协议的解析 以及将点分路径拆分为指标名称和标签的模板规则
+//
+//	<path>[;tag=value...] <value> [timestamp]
+package graphite
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tag 数据点的标签
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Metric 一行 Graphite plaintext 解析后的数据点
+type Metric struct {
+	Name  string
+	Tags  []Tag // 按 Key 排序
+	Value float64
+
+	// Timestamp 单位为秒 HasTimestamp 为 false 时表示没有指定时间戳(缺失或者为 -1)
+	Timestamp    int64
+	HasTimestamp bool
+}
+
+// template 模板规则 格式为 [filter] pattern [tag=value,...]
+//
+// * filter: 以 . 分隔的过滤规则 * 匹配任意一段 没有 filter 的模板匹配所有路径
+// * pattern: 以 . 分隔 每一段对应路径中相同位置的一段
+//   - metric: 作为指标名称的一部分 多段之间使用 . 连接
+//   - metric*: 剩余的所有段都作为指标名称
+//   - 空: 忽略该段
+//   - 其他: 作为标签名称 该段的值即为标签值
+//
+// * tags: 额外附加的标签
+type template struct {
+	filter []string
+	parts  []string
+	tags   []Tag
+}
+
+func parseTemplate(s string) (*template, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid template %q", s)
+	}
+
+	t := &template{}
+	if len(fields) == 3 || (len(fields) == 2 && !strings.Contains(fields[1], "=")) {
+		t.filter = strings.Split(fields[0], ".")
+		fields = fields[1:]
+	}
+
+	t.parts = strings.Split(fields[0], ".")
+	var hasMetric bool
+	for i, part := range t.parts {
+		switch part {
+		case "metric":
+			hasMetric = true
+		case "metric*":
+			if i != len(t.parts)-1 {
+				return nil, fmt.Errorf("metric* must be the last part of template %q", s)
+			}
+			hasMetric = true
+		}
+	}
+
+	if !hasMetric {
+		return nil, fmt.Errorf("template %q has no metric part", s)
+	}
+
+	if len(fields) == 2 {
+		for _, kv := range strings.Split(fields[1], ",") {
+			pair := strings.SplitN(kv, "=", 2)
+			if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+				return nil, fmt.Errorf("invalid tag %q of template %q", kv, s)
+			}
+			t.tags = append(t.tags, Tag{Key: pair[0], Value: pair[1]})
+		}
+	}
+
+	return t, nil
+}
+
+// match 判断路径是否满足 filter 没有 filter 时总是满足
+func (t *template) match(nodes []string) bool {
+	if len(t.filter) == 0 {
+		return true
+	}
+
+	if len(nodes) < len(t.filter) {
+		return false
+	}
+
+	for i, f := range t.filter {
+		if f != "*" && f != nodes[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply 根据模板将路径拆分为指标名称和标签
+func (t *template) apply(nodes []string) (string, []Tag) {
+	names := make([]string, 0)
+	tags := make([]Tag, 0, len(t.tags))
+	tags = append(tags, t.tags...)
+
+	for i, part := range t.parts {
+		if i >= len(nodes) {
+			break
+		}
+
+		switch part {
+		case "":
+		case "metric":
+			names = append(names, nodes[i])
+		case "metric*":
+			names = append(names, nodes[i:]...)
+		default:
+			tags = append(tags, Tag{Key: part, Value: nodes[i]})
+		}
+	}
+
+	return strings.Join(names, "."), tags
+}
+
+// Parser 使用模板规则解析 Graphite plaintext 按顺序使用第一个匹配的模板
+// 没有任何模板匹配时整个路径作为指标名称 如 cpu.busy
+type Parser struct {
+	templates []*template
+}
+
+// NewParser 解析模板规则 如 "servers.* .host.metric*"、"*.app env.metric* dc=bj"
+func NewParser(templates []string) (*Parser, error) {
+	p := &Parser{}
+	for _, s := range templates {
+		t, err := parseTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		p.templates = append(p.templates, t)
+	}
+
+	return p, nil
+}
+
+// Parse 解析一行 Graphite plaintext
+func (p *Parser) Parse(line string) (Metric, error) {
+	var metric Metric
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return metric, fmt.Errorf("invalid line %q", line)
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return metric, fmt.Errorf("invalid value %q", fields[1])
+	}
+	metric.Value = value
+
+	if len(fields) == 3 {
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+			return metric, fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+
+		if ts != -1 {
+			metric.Timestamp = int64(ts)
+			metric.HasTimestamp = true
+		}
+	}
+
+	// 兼容 Graphite 1.1 的 tagged series 如 cpu.busy;host=vm1
+	segments := strings.Split(fields[0], ";")
+	path := segments[0]
+	if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+		return metric, fmt.Errorf("invalid path %q", fields[0])
+	}
+
+	nodes := strings.Split(path, ".")
+	metric.Name = path
+	for _, t := range p.templates {
+		if t.match(nodes) {
+			metric.Name, metric.Tags = t.apply(nodes)
+			break
+		}
+	}
+
+	if metric.Name == "" {
+		return metric, fmt.Errorf("no metric name in path %q", path)
+	}
+
+	for _, kv := range segments[1:] {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return metric, fmt.Errorf("invalid tag %q", kv)
+		}
+		metric.Tags = append(metric.Tags, Tag{Key: pair[0], Value: pair[1]})
+	}
+
+	metric.Tags = dedupTags(metric.Tags)
+	return metric, nil
+}
+
+// dedupTags 按 Key 排序 相同 Key 时后出现的值覆盖之前的值
+func dedupTags(tags []Tag) []Tag {
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].Key < tags[j].Key
+	})
+
+	ret := tags[:0]
+	for _, tag := range tags {
+		if len(ret) > 0 && ret[len(ret)-1].Key == tag.Key {
+			ret[len(ret)-1] = tag
+			continue
+		}
+		ret = append(ret, tag)
+	}
+
+	return ret
+}
@@ -0,0 +1,74 @@
+package graphite
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParser_Parse(t *testing.T) {
+	p, err := NewParser([]string{
+		"servers.* .host.metric*",
+		"*.app env..metric* region=bj,dc=a",
+	})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		input    string
+		expected Metric
+	}{
+		{
+			input:    "cpu.busy 12.5 1600000000",
+			expected: Metric{Name: "cpu.busy", Value: 12.5, Timestamp: 1600000000, HasTimestamp: true},
+		},
+		{
+			input: "servers.vm1.cpu.load.1m 0.5 1600000000",
+			expected: Metric{
+				Name:         "cpu.load.1m",
+				Tags:         []Tag{{Key: "host", Value: "vm1"}},
+				Value:        0.5,
+				Timestamp:    1600000000,
+				HasTimestamp: true,
+			},
+		},
+		{
+			input: "prod.app.http.requests;dc=b 3 -1",
+			expected: Metric{
+				Name:  "http.requests",
+				Tags:  []Tag{{Key: "dc", Value: "b"}, {Key: "env", Value: "prod"}, {Key: "region", Value: "bj"}},
+				Value: 3,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		metric, err := p.Parse(c.input)
+		assert.NoError(t, err, c.input)
+		assert.Equal(t, c.expected, metric, c.input)
+	}
+
+	for _, line := range []string{
+		"cpu.busy",
+		"cpu.busy abc 1600000000",
+		"cpu.busy 1 abc",
+		"cpu..busy 1 1600000000",
+		"cpu.busy;host 1 1600000000",
+		"servers.vm1 1 1600000000",
+	} {
+		_, err := p.Parse(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestNewParser_Errors(t *testing.T) {
+	for _, template := range []string{
+		"",
+		"host.env",
+		"metric*.host",
+		"a b c d",
+		"*.app env.metric dc",
+	} {
+		_, err := NewParser([]string{template})
+		assert.Error(t, err, template)
+	}
+}
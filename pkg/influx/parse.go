@@ -0,0 +1,256 @@
+// Package influx 实现了 InfluxDB line protocol 的解析
+// 格式参见 https://docs.influxdata.com/influxdb/v1.8/write_protocols/line_protocol_reference/
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tag 数据点的标签
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field 数据点的字段 整数、无符号整数以及布尔值都会转换成 float64
+type Field struct {
+	Key   string
+	Value float64
+}
+
+// Point 一行 line protocol 解析后的数据点
+// 字符串类型的 field 无法表示为 float64 解析时会被忽略 ParseLine 返回的 Fields 可能为空
+type Point struct {
+	Measurement string
+	Tags        []Tag
+	Fields      []Field
+
+	// Timestamp 单位由写入时指定的精度决定 HasTimestamp 为 false 时表示没有指定时间戳
+	Timestamp    int64
+	HasTimestamp bool
+
+	// Line 数据点所在的行号(从 1 开始) 只有 Parse 会设置
+	Line int
+}
+
+// UnixNano 将 unit 精度的 Timestamp 转换为纳秒时间戳 超出 int64 纳秒能表示的范围时返回错误
+func (p Point) UnixNano(unit time.Duration) (int64, error) {
+	n := int64(unit)
+	if n > 1 && (p.Timestamp > math.MaxInt64/n || p.Timestamp < math.MinInt64/n) {
+		return 0, fmt.Errorf("timestamp %d out of range for precision %v", p.Timestamp, unit)
+	}
+
+	return p.Timestamp * n, nil
+}
+
+// ParseError 记录出错的行号(从 1 开始)以及原因
+type ParseError struct {
+	Line int
+	Err  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at line %d: %s", e.Line, e.Err)
+}
+
+// Parse 逐行解析 b 空行以及 # 开头的注释行会被忽略 没有任何数值类型 field 的行视为错误
+// 出错的行不会中断解析 返回所有解析成功的数据点以及每一行的错误
+func Parse(b []byte) ([]Point, []*ParseError) {
+	points := make([]Point, 0)
+	errs := make([]*ParseError, 0)
+
+	for n, line := range bytes.Split(b, []byte("\n")) {
+		s := strings.TrimSpace(string(line))
+		if s == "" || s[0] == '#' {
+			continue
+		}
+
+		point, err := ParseLine(s)
+		if err == nil && len(point.Fields) == 0 {
+			err = fmt.Errorf("no numeric fields")
+		}
+
+		if err != nil {
+			errs = append(errs, &ParseError{Line: n + 1, Err: err.Error()})
+			continue
+		}
+		point.Line = n + 1
+		points = append(points, point)
+	}
+
+	return points, errs
+}
+
+// ParseLine 解析单行 line protocol
+func ParseLine(s string) (Point, error) {
+	var point Point
+
+	measurement, i := scan(s, 0, ", ")
+	if measurement == "" {
+		return point, fmt.Errorf("missing measurement")
+	}
+	point.Measurement = measurement
+
+	// tags
+	for i < len(s) && s[i] == ',' {
+		var key, value string
+		key, i = scan(s, i+1, ",= ")
+		if i >= len(s) || s[i] != '=' || key == "" {
+			return point, fmt.Errorf("missing tag key")
+		}
+
+		value, i = scan(s, i+1, ",= ")
+		if value == "" {
+			return point, fmt.Errorf("missing tag value of %q", key)
+		}
+		point.Tags = append(point.Tags, Tag{Key: key, Value: value})
+	}
+
+	i = skipSpaces(s, i)
+	if i >= len(s) {
+		return point, fmt.Errorf("missing fields")
+	}
+
+	// fields
+	for {
+		var key string
+		key, i = scan(s, i, ",= ")
+		if i >= len(s) || s[i] != '=' || key == "" {
+			return point, fmt.Errorf("missing field key")
+		}
+
+		i++
+		if i < len(s) && s[i] == '"' {
+			end := scanQuoted(s, i+1)
+			if end < 0 {
+				return point, fmt.Errorf("unterminated string value of field %q", key)
+			}
+			i = end + 1
+		} else {
+			var raw string
+			raw, i = scan(s, i, ", ")
+			value, err := parseFieldValue(raw)
+			if err != nil {
+				return point, fmt.Errorf("invalid value of field %q: %v", key, err)
+			}
+			point.Fields = append(point.Fields, Field{Key: key, Value: value})
+		}
+
+		if i >= len(s) || s[i] != ',' {
+			break
+		}
+		i++
+	}
+
+	i = skipSpaces(s, i)
+	if i >= len(s) {
+		return point, nil
+	}
+
+	ts, err := strconv.ParseInt(s[i:], 10, 64)
+	if err != nil {
+		return point, fmt.Errorf("invalid timestamp %q", s[i:])
+	}
+	point.Timestamp = ts
+	point.HasTimestamp = true
+
+	return point, nil
+}
+
+// scan 从 i 开始读取直到遇到未转义的 stops 中的字符 返回反转义后的内容以及停止的位置
+func scan(s string, i int, stops string) (string, int) {
+	var sb strings.Builder
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && (s[i+1] == '\\' || strings.IndexByte(stops, s[i+1]) >= 0) {
+			i++
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		sb.WriteByte(c)
+	}
+
+	return sb.String(), i
+}
+
+// scanQuoted 返回从 i 开始第一个未转义的双引号的位置 不存在时返回 -1
+func scanQuoted(s string, i int) int {
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+
+	return -1
+}
+
+func skipSpaces(s string, i int) int {
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	return i
+}
+
+// parseFieldValue 解析非字符串类型的 field 值
+// * 整数: 1i
+// * 无符号整数: 1u
+// * 布尔值: t、T、true、True、TRUE、f、F、false、False、FALSE
+// * 浮点数: 1、1.0、1e3
+func parseFieldValue(s string) (float64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty value")
+	}
+
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+
+	switch s[len(s)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
+
+// ParsePrecision 解析写入请求的时间戳精度 返回每个单位对应的时间跨度
+// 可选 ns(默认)、u、ms、s、m、h
+func ParsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+
+	return 0, fmt.Errorf("unknown precision %q", s)
+}
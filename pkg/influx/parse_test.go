@@ -0,0 +1,113 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLine(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected Point
+	}{
+		{
+			input: `cpu,host=server01,region=us-west usage_idle=98.5,usage_user=1i 1600000000000000000`,
+			expected: Point{
+				Measurement:  "cpu",
+				Tags:         []Tag{{Key: "host", Value: "server01"}, {Key: "region", Value: "us-west"}},
+				Fields:       []Field{{Key: "usage_idle", Value: 98.5}, {Key: "usage_user", Value: 1}},
+				Timestamp:    1600000000000000000,
+				HasTimestamp: true,
+			},
+		},
+		{
+			input: `mem free=1024u,ok=true,err=F`,
+			expected: Point{
+				Measurement: "mem",
+				Fields:      []Field{{Key: "free", Value: 1024}, {Key: "ok", Value: 1}, {Key: "err", Value: 0}},
+			},
+		},
+		{
+			input: `disk\ io,path=/var\,log,dev\=x=sda reads=1e3,msg="a \"quoted\", value" 1`,
+			expected: Point{
+				Measurement:  "disk io",
+				Tags:         []Tag{{Key: "path", Value: "/var,log"}, {Key: "dev=x", Value: "sda"}},
+				Fields:       []Field{{Key: "reads", Value: 1000}},
+				Timestamp:    1,
+				HasTimestamp: true,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		point, err := ParseLine(c.input)
+		assert.NoError(t, err, c.input)
+		assert.Equal(t, c.expected, point, c.input)
+	}
+}
+
+func TestParseLine_Errors(t *testing.T) {
+	cases := []string{
+		`,host=a value=1`,
+		`cpu,host value=1`,
+		`cpu,host= value=1`,
+		`cpu`,
+		`cpu value`,
+		`cpu value=abc`,
+		`cpu value=1i2`,
+		`cpu msg="unterminated`,
+		`cpu value=1 abc`,
+	}
+
+	for _, c := range cases {
+		_, err := ParseLine(c)
+		assert.Error(t, err, c)
+	}
+}
+
+func TestParse(t *testing.T) {
+	points, errs := Parse([]byte("# comment\ncpu value=1 1\n\ncpu value=x 2\nlog msg=\"only string\"\r\ncpu value=3 3\n"))
+
+	assert.Equal(t, 2, len(points))
+	assert.Equal(t, int64(3), points[1].Timestamp)
+	assert.Equal(t, 6, points[1].Line)
+
+	assert.Equal(t, 2, len(errs))
+	assert.Equal(t, 4, errs[0].Line)
+	assert.Equal(t, 5, errs[1].Line)
+	assert.Equal(t, "no numeric fields", errs[1].Err)
+}
+
+func TestParsePrecision(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"":   time.Nanosecond,
+		"u":  time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"h":  time.Hour,
+	} {
+		d, err := ParsePrecision(s)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, d)
+	}
+
+	_, err := ParsePrecision("d")
+	assert.Error(t, err)
+}
+
+func TestPoint_UnixNano(t *testing.T) {
+	ns, err := Point{Timestamp: 1600000000}.UnixNano(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1600000000000000000), ns)
+
+	ns, err = Point{Timestamp: -1600000000}.UnixNano(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1600000000000000000), ns)
+
+	_, err = Point{Timestamp: 99999999999999999}.UnixNano(time.Second)
+	assert.Error(t, err)
+	_, err = Point{Timestamp: -3000000}.UnixNano(time.Hour)
+	assert.Error(t, err)
+}
@@ -0,0 +1,118 @@
+// Package opentsdb 实现了 OpenTSDB telnet put 以及 HTTP /api/put 写入格式的解析
+//
+//	put <metric> <timestamp> <value> <tagk1=tagv1 ...>
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxSecondTimestamp 超过 10 位的时间戳视为毫秒
+const maxSecondTimestamp = 9999999999
+
+// Value 数据点的值 JSON 中可以是数值也可以是字符串
+type Value float64
+
+func (v *Value) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %s", b)
+	}
+
+	*v = Value(f)
+	return nil
+}
+
+// DataPoint OpenTSDB 的数据点 Timestamp 为秒或者毫秒
+type DataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     Value             `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// Milliseconds 返回毫秒时间戳
+func (dp DataPoint) Milliseconds() int64 {
+	if dp.Timestamp > maxSecondTimestamp {
+		return dp.Timestamp
+	}
+	return dp.Timestamp * 1000
+}
+
+// Validate 校验数据点是否合法
+func (dp DataPoint) Validate() error {
+	if dp.Metric == "" {
+		return fmt.Errorf("missing metric")
+	}
+
+	if dp.Timestamp <= 0 {
+		return fmt.Errorf("invalid timestamp %d", dp.Timestamp)
+	}
+
+	for k, v := range dp.Tags {
+		if k == "" || v == "" {
+			return fmt.Errorf("invalid tag %s=%s", k, v)
+		}
+	}
+
+	return nil
+}
+
+// ParsePut 解析 telnet 的 put 命令 不包括开头的 put
+func ParsePut(args string) (DataPoint, error) {
+	var dp DataPoint
+
+	fields := strings.Fields(args)
+	if len(fields) < 3 {
+		return dp, fmt.Errorf("not enough arguments (need at least 3, got %d)", len(fields))
+	}
+
+	dp.Metric = fields[0]
+
+	ts, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return dp, fmt.Errorf("invalid timestamp %q", fields[1])
+	}
+	dp.Timestamp = ts
+
+	value, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return dp, fmt.Errorf("invalid value %q", fields[2])
+	}
+	dp.Value = Value(value)
+
+	dp.Tags = make(map[string]string, len(fields)-3)
+	for _, kv := range fields[3:] {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return dp, fmt.Errorf("invalid tag %q", kv)
+		}
+		dp.Tags[pair[0]] = pair[1]
+	}
+
+	return dp, dp.Validate()
+}
+
+// DecodeJSON 解析 /api/put 的请求体 可以是单个数据点也可以是数据点数组
+func DecodeJSON(b []byte) ([]DataPoint, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '{' {
+		var dp DataPoint
+		if err := json.Unmarshal(b, &dp); err != nil {
+			return nil, err
+		}
+		return []DataPoint{dp}, nil
+	}
+
+	var dps []DataPoint
+	if err := json.Unmarshal(b, &dps); err != nil {
+		return nil, err
+	}
+
+	return dps, nil
+}
@@ -0,0 +1,53 @@
+package opentsdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePut(t *testing.T) {
+	dp, err := ParsePut("sys.cpu.user 1600000000 42.5 host=web01 cpu=0")
+	assert.NoError(t, err)
+	assert.Equal(t, DataPoint{
+		Metric:    "sys.cpu.user",
+		Timestamp: 1600000000,
+		Value:     42.5,
+		Tags:      map[string]string{"host": "web01", "cpu": "0"},
+	}, dp)
+	assert.Equal(t, int64(1600000000000), dp.Milliseconds())
+
+	dp, err = ParsePut("sys.cpu.user 1600000000123 1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1600000000123), dp.Milliseconds())
+
+	for _, args := range []string{
+		"sys.cpu.user 1600000000",
+		"sys.cpu.user abc 1",
+		"sys.cpu.user 1600000000 abc",
+		"sys.cpu.user 1600000000 1 host",
+		"sys.cpu.user 1600000000 1 host=",
+		"sys.cpu.user -1 1",
+	} {
+		_, err := ParsePut(args)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	dps, err := DecodeJSON([]byte(`{"metric": "sys.cpu.nice", "timestamp": 1600000000, "value": 18, "tags": {"host": "web01"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dps))
+	assert.Equal(t, Value(18), dps[0].Value)
+
+	dps, err = DecodeJSON([]byte(` [{"metric": "a", "timestamp": 1, "value": "1.5"}, {"metric": "b", "timestamp": 2, "value": 2}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(dps))
+	assert.Equal(t, Value(1.5), dps[0].Value)
+
+	_, err = DecodeJSON([]byte(`{"metric": "a", "timestamp": 1, "value": "x"}`))
+	assert.Error(t, err)
+
+	_, err = DecodeJSON([]byte(`not json`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,93 @@
+package prompb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/http"
+)
+
+// 流式 remote_read 响应中每一帧的布局
+// │ size(uvarint) │ crc32 castagnoli(big-endian uint32) │ message(size bytes) │
+
+const maxFrameSize = 50 * 1024 * 1024
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrChecksumMismatch = errors.New("prompb: chunked frame checksum mismatch")
+	ErrFrameTooLarge    = errors.New("prompb: chunked frame too large")
+)
+
+// ChunkedWriter 按帧写入 ChunkedReadResponse 每一帧写入后都会 flush 给客户端
+type ChunkedWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func NewChunkedWriter(w io.Writer, flusher http.Flusher) *ChunkedWriter {
+	return &ChunkedWriter{w: w, flusher: flusher}
+}
+
+func (w *ChunkedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var buf [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(buf[:], uint64(len(b)))
+	binary.BigEndian.PutUint32(buf[n:], crc32.Checksum(b, castagnoliTable))
+
+	if _, err := w.w.Write(buf[:n+4]); err != nil {
+		return 0, err
+	}
+
+	written, err := w.w.Write(b)
+	if err != nil {
+		return written, err
+	}
+
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return written, nil
+}
+
+// ChunkedReader 读取 ChunkedWriter 写入的帧
+type ChunkedReader struct {
+	r *bufio.Reader
+}
+
+func NewChunkedReader(r io.Reader) *ChunkedReader {
+	return &ChunkedReader{r: bufio.NewReader(r)}
+}
+
+// Next 返回下一帧的数据 读取完毕时返回 io.EOF
+func (r *ChunkedReader) Next() ([]byte, error) {
+	size, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	var crc [4]byte
+	if _, err := io.ReadFull(r.r, crc[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(crc[:]) != crc32.Checksum(b, castagnoliTable) {
+		return nil, ErrChecksumMismatch
+	}
+
+	return b, nil
+}
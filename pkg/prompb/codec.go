@@ -0,0 +1,187 @@
+package prompb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// 只实现了 remote 协议用到的 protobuf wire type
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var (
+	ErrInvalidLength = errors.New("prompb: invalid length")
+	ErrUnknownWire   = errors.New("prompb: unknown wire type")
+)
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) Bytes() []byte {
+	return e.buf
+}
+
+func (e *encoder) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *encoder) key(field, wire int) {
+	e.uvarint(uint64(field)<<3 | uint64(wire))
+}
+
+func (e *encoder) Varint(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	e.key(field, wireVarint)
+	e.uvarint(uint64(v))
+}
+
+func (e *encoder) Double(field int, v float64) {
+	bits := math.Float64bits(v)
+	if bits == 0 {
+		return
+	}
+	e.key(field, wireFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], bits)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) String(field int, s string) {
+	if s == "" {
+		return
+	}
+	e.key(field, wireBytes)
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) Message(field int, b []byte) {
+	e.key(field, wireBytes)
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) RawBytes(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e.Message(field, b)
+}
+
+// decoder 按顺序遍历 message 中的字段
+type decoder struct {
+	buf []byte
+	pos int
+
+	field int
+	wire  int
+	value uint64 // varint / fixed 类型的字段值
+	bytes []byte // bytes 类型的字段值
+}
+
+func newDecoder(b []byte) *decoder {
+	return &decoder{buf: b}
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf[d.pos:])
+	if n <= 0 {
+		return 0, ErrInvalidLength
+	}
+	d.pos += n
+	return v, nil
+}
+
+// Next 读取下一个字段 没有更多字段时返回 false
+func (d *decoder) Next() (bool, error) {
+	if d.pos >= len(d.buf) {
+		return false, nil
+	}
+
+	key, err := d.uvarint()
+	if err != nil {
+		return false, err
+	}
+	d.field, d.wire = int(key>>3), int(key&7)
+	d.value, d.bytes = 0, nil
+
+	switch d.wire {
+	case wireVarint:
+		if d.value, err = d.uvarint(); err != nil {
+			return false, err
+		}
+	case wireFixed64:
+		if d.pos+8 > len(d.buf) {
+			return false, ErrInvalidLength
+		}
+		d.value = binary.LittleEndian.Uint64(d.buf[d.pos:])
+		d.pos += 8
+	case wireFixed32:
+		if d.pos+4 > len(d.buf) {
+			return false, ErrInvalidLength
+		}
+		d.value = uint64(binary.LittleEndian.Uint32(d.buf[d.pos:]))
+		d.pos += 4
+	case wireBytes:
+		n, err := d.uvarint()
+		if err != nil {
+			return false, err
+		}
+		if n > uint64(len(d.buf)-d.pos) {
+			return false, ErrInvalidLength
+		}
+		d.bytes = d.buf[d.pos : d.pos+int(n)]
+		d.pos += int(n)
+	default:
+		return false, ErrUnknownWire
+	}
+
+	return true, nil
+}
+
+func (d *decoder) Int64() int64 {
+	return int64(d.value)
+}
+
+func (d *decoder) Double() float64 {
+	return math.Float64frombits(d.value)
+}
+
+func (d *decoder) String() string {
+	return string(d.bytes)
+}
+
+func (d *decoder) Bytes() []byte {
+	return d.bytes
+}
+
+// Varints 读取 repeated 的 varint 字段 兼容 packed 和非 packed 两种编码
+func (d *decoder) Varints() ([]int64, error) {
+	if d.wire == wireVarint {
+		return []int64{int64(d.value)}, nil
+	}
+
+	ret := make([]int64, 0)
+	b := d.bytes
+	for len(b) > 0 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, ErrInvalidLength
+		}
+		ret = append(ret, int64(v))
+		b = b[n:]
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,350 @@
+package prompb
+
+// MatchType 对应 prometheus.LabelMatcher.Type
+type MatchType int32
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+// LabelMatcher 对应 prometheus.LabelMatcher
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+func (m *LabelMatcher) Marshal() []byte {
+	e := &encoder{}
+	e.Varint(1, int64(m.Type))
+	e.String(2, m.Name)
+	e.String(3, m.Value)
+	return e.Bytes()
+}
+
+func (m *LabelMatcher) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		switch d.field {
+		case 1:
+			m.Type = MatchType(d.Int64())
+		case 2:
+			m.Name = d.String()
+		case 3:
+			m.Value = d.String()
+		}
+	}
+}
+
+// Query 对应 prometheus.Query 时间戳单位为毫秒 ReadHints 会被忽略
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []LabelMatcher
+}
+
+func (m *Query) Marshal() []byte {
+	e := &encoder{}
+	e.Varint(1, m.StartTimestampMs)
+	e.Varint(2, m.EndTimestampMs)
+	for i := range m.Matchers {
+		e.Message(3, m.Matchers[i].Marshal())
+	}
+	return e.Bytes()
+}
+
+func (m *Query) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		switch d.field {
+		case 1:
+			m.StartTimestampMs = d.Int64()
+		case 2:
+			m.EndTimestampMs = d.Int64()
+		case 3:
+			var matcher LabelMatcher
+			if err := matcher.Unmarshal(d.Bytes()); err != nil {
+				return err
+			}
+			m.Matchers = append(m.Matchers, matcher)
+		}
+	}
+}
+
+// ReadResponseType 对应 prometheus.ReadRequest.ResponseType
+type ReadResponseType int32
+
+const (
+	ReadSamples ReadResponseType = iota
+	ReadStreamedXORChunks
+)
+
+// ReadRequest 对应 prometheus.ReadRequest
+type ReadRequest struct {
+	Queries               []Query
+	AcceptedResponseTypes []ReadResponseType
+}
+
+func (m *ReadRequest) Marshal() []byte {
+	e := &encoder{}
+	for i := range m.Queries {
+		e.Message(1, m.Queries[i].Marshal())
+	}
+
+	packed := &encoder{}
+	for _, t := range m.AcceptedResponseTypes {
+		packed.uvarint(uint64(t))
+	}
+	e.RawBytes(2, packed.Bytes())
+	return e.Bytes()
+}
+
+func (m *ReadRequest) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		switch d.field {
+		case 1:
+			var query Query
+			if err := query.Unmarshal(d.Bytes()); err != nil {
+				return err
+			}
+			m.Queries = append(m.Queries, query)
+		case 2:
+			types, err := d.Varints()
+			if err != nil {
+				return err
+			}
+			for _, t := range types {
+				m.AcceptedResponseTypes = append(m.AcceptedResponseTypes, ReadResponseType(t))
+			}
+		}
+	}
+}
+
+// QueryResult 对应 prometheus.QueryResult
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+func (m *QueryResult) Marshal() []byte {
+	e := &encoder{}
+	for i := range m.Timeseries {
+		e.Message(1, m.Timeseries[i].Marshal())
+	}
+	return e.Bytes()
+}
+
+func (m *QueryResult) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		if d.field == 1 {
+			var ts TimeSeries
+			if err := ts.Unmarshal(d.Bytes()); err != nil {
+				return err
+			}
+			m.Timeseries = append(m.Timeseries, ts)
+		}
+	}
+}
+
+// ReadResponse 对应 prometheus.ReadResponse 与 ReadRequest.Queries 一一对应
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+func (m *ReadResponse) Marshal() []byte {
+	e := &encoder{}
+	for i := range m.Results {
+		e.Message(1, m.Results[i].Marshal())
+	}
+	return e.Bytes()
+}
+
+func (m *ReadResponse) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		if d.field == 1 {
+			var result QueryResult
+			if err := result.Unmarshal(d.Bytes()); err != nil {
+				return err
+			}
+			m.Results = append(m.Results, result)
+		}
+	}
+}
+
+// ChunkEncoding 对应 prometheus.Chunk.Encoding
+type ChunkEncoding int32
+
+const (
+	ChunkUnknown ChunkEncoding = iota
+	ChunkXOR
+)
+
+// Chunk 对应 prometheus.Chunk 时间戳单位为毫秒
+type Chunk struct {
+	MinTimeMs int64
+	MaxTimeMs int64
+	Type      ChunkEncoding
+	Data      []byte
+}
+
+func (m *Chunk) Marshal() []byte {
+	e := &encoder{}
+	e.Varint(1, m.MinTimeMs)
+	e.Varint(2, m.MaxTimeMs)
+	e.Varint(3, int64(m.Type))
+	e.RawBytes(4, m.Data)
+	return e.Bytes()
+}
+
+func (m *Chunk) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		switch d.field {
+		case 1:
+			m.MinTimeMs = d.Int64()
+		case 2:
+			m.MaxTimeMs = d.Int64()
+		case 3:
+			m.Type = ChunkEncoding(d.Int64())
+		case 4:
+			m.Data = append([]byte(nil), d.Bytes()...)
+		}
+	}
+}
+
+// ChunkedSeries 对应 prometheus.ChunkedSeries
+type ChunkedSeries struct {
+	Labels []Label
+	Chunks []Chunk
+}
+
+func (m *ChunkedSeries) Marshal() []byte {
+	e := &encoder{}
+	for i := range m.Labels {
+		e.Message(1, m.Labels[i].Marshal())
+	}
+	for i := range m.Chunks {
+		e.Message(2, m.Chunks[i].Marshal())
+	}
+	return e.Bytes()
+}
+
+func (m *ChunkedSeries) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		switch d.field {
+		case 1:
+			var label Label
+			if err := label.Unmarshal(d.Bytes()); err != nil {
+				return err
+			}
+			m.Labels = append(m.Labels, label)
+		case 2:
+			var chunk Chunk
+			if err := chunk.Unmarshal(d.Bytes()); err != nil {
+				return err
+			}
+			m.Chunks = append(m.Chunks, chunk)
+		}
+	}
+}
+
+// ChunkedReadResponse 对应 prometheus.ChunkedReadResponse
+type ChunkedReadResponse struct {
+	ChunkedSeries []ChunkedSeries
+	QueryIndex    int64
+}
+
+func (m *ChunkedReadResponse) Marshal() []byte {
+	e := &encoder{}
+	for i := range m.ChunkedSeries {
+		e.Message(1, m.ChunkedSeries[i].Marshal())
+	}
+	e.Varint(2, m.QueryIndex)
+	return e.Bytes()
+}
+
+func (m *ChunkedReadResponse) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		switch d.field {
+		case 1:
+			var series ChunkedSeries
+			if err := series.Unmarshal(d.Bytes()); err != nil {
+				return err
+			}
+			m.ChunkedSeries = append(m.ChunkedSeries, series)
+		case 2:
+			m.QueryIndex = d.Int64()
+		}
+	}
+}
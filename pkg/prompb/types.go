@@ -0,0 +1,148 @@
+// Package prompb 实现了 Prometheus remote 协议中所使用的 protobuf 消息
+// 字段编号与 prometheus/prompb 保持一致 未使用的字段在解码时会被忽略
+package prompb
+
+// Label 对应 prometheus.Label
+type Label struct {
+	Name  string
+	Value string
+}
+
+func (m *Label) Marshal() []byte {
+	e := &encoder{}
+	e.String(1, m.Name)
+	e.String(2, m.Value)
+	return e.Bytes()
+}
+
+func (m *Label) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		switch d.field {
+		case 1:
+			m.Name = d.String()
+		case 2:
+			m.Value = d.String()
+		}
+	}
+}
+
+// Sample 对应 prometheus.Sample 时间戳单位为毫秒
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+func (m *Sample) Marshal() []byte {
+	e := &encoder{}
+	e.Double(1, m.Value)
+	e.Varint(2, m.Timestamp)
+	return e.Bytes()
+}
+
+func (m *Sample) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		switch d.field {
+		case 1:
+			m.Value = d.Double()
+		case 2:
+			m.Timestamp = d.Int64()
+		}
+	}
+}
+
+// TimeSeries 对应 prometheus.TimeSeries
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+func (m *TimeSeries) Marshal() []byte {
+	e := &encoder{}
+	for i := range m.Labels {
+		e.Message(1, m.Labels[i].Marshal())
+	}
+	for i := range m.Samples {
+		e.Message(2, m.Samples[i].Marshal())
+	}
+	return e.Bytes()
+}
+
+func (m *TimeSeries) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		switch d.field {
+		case 1:
+			var label Label
+			if err := label.Unmarshal(d.Bytes()); err != nil {
+				return err
+			}
+			m.Labels = append(m.Labels, label)
+		case 2:
+			var sample Sample
+			if err := sample.Unmarshal(d.Bytes()); err != nil {
+				return err
+			}
+			m.Samples = append(m.Samples, sample)
+		}
+	}
+}
+
+// WriteRequest 对应 prometheus.WriteRequest
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+func (m *WriteRequest) Marshal() []byte {
+	e := &encoder{}
+	for i := range m.Timeseries {
+		e.Message(1, m.Timeseries[i].Marshal())
+	}
+	return e.Bytes()
+}
+
+func (m *WriteRequest) Unmarshal(b []byte) error {
+	d := newDecoder(b)
+	for {
+		ok, err := d.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		if d.field == 1 {
+			var ts TimeSeries
+			if err := ts.Unmarshal(d.Bytes()); err != nil {
+				return err
+			}
+			m.Timeseries = append(m.Timeseries, ts)
+		}
+	}
+}
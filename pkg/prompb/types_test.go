@@ -0,0 +1,32 @@
+package prompb
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteRequest_Marshal(t *testing.T) {
+	req := &WriteRequest{Timeseries: []TimeSeries{
+		{
+			Labels:  []Label{{Name: "__name__", Value: "cpu_busy"}, {Name: "node", Value: "vm1"}},
+			Samples: []Sample{{Value: 1.5, Timestamp: 1600000000000}, {Value: math.Inf(-1), Timestamp: -1}},
+		},
+		{
+			Labels:  []Label{{Name: "__name__", Value: "up"}},
+			Samples: []Sample{{Value: 0, Timestamp: 0}},
+		},
+	}}
+
+	got := &WriteRequest{}
+	assert.NoError(t, got.Unmarshal(req.Marshal()))
+	assert.Equal(t, req, got)
+}
+
+func TestWriteRequest_UnmarshalInvalid(t *testing.T) {
+	b := (&WriteRequest{Timeseries: []TimeSeries{{Labels: []Label{{Name: "a", Value: "b"}}}}}).Marshal()
+
+	got := &WriteRequest{}
+	assert.Equal(t, ErrInvalidLength, got.Unmarshal(b[:len(b)-1]))
+}
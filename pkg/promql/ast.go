@@ -0,0 +1,240 @@
+// Package promql 实现了 PromQL 的一个子集的语法解析
+// 支持 selector、range vector、rate/irate/increase、sum/avg/min/max/count/topk 聚合以及四则运算
+package promql
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValueType 表达式的求值结果类型
+type ValueType string
+
+const (
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+)
+
+// MatchType 匹配器类型
+type MatchType int8
+
+const (
+	MatchEqual     MatchType = iota // =
+	MatchNotEqual                   // !=
+	MatchRegexp                     // =~
+	MatchNotRegexp                  // !~
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return "="
+}
+
+// Matcher 表示 selector 中的一个 label 匹配器
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+func (m Matcher) String() string {
+	return m.Name + m.Type.String() + strconv.Quote(m.Value)
+}
+
+// Expr 语法树节点
+type Expr interface {
+	Type() ValueType
+	String() string
+}
+
+// NumberLiteral 数值常量 如 1、2.5、1e3
+type NumberLiteral struct {
+	Val float64
+}
+
+func (e *NumberLiteral) Type() ValueType { return ValueTypeScalar }
+
+func (e *NumberLiteral) String() string {
+	return strconv.FormatFloat(e.Val, 'g', -1, 64)
+}
+
+// VectorSelector 即时向量选择器 如 http_requests_total{code="200"}
+// metric 名称会被转换成 __name__ 匹配器
+type VectorSelector struct {
+	Name     string
+	Matchers []Matcher
+}
+
+func (e *VectorSelector) Type() ValueType { return ValueTypeVector }
+
+func (e *VectorSelector) String() string {
+	ms := make([]string, 0, len(e.Matchers))
+	for _, m := range e.Matchers {
+		if m.Name == metricName && e.Name != "" {
+			continue
+		}
+		ms = append(ms, m.String())
+	}
+
+	if len(ms) == 0 {
+		return e.Name
+	}
+	return e.Name + "{" + strings.Join(ms, ",") + "}"
+}
+
+// MatrixSelector 区间向量选择器 如 http_requests_total[5m]
+type MatrixSelector struct {
+	*VectorSelector
+	Range time.Duration
+}
+
+func (e *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+
+func (e *MatrixSelector) String() string {
+	return e.VectorSelector.String() + "[" + formatDuration(e.Range) + "]"
+}
+
+// Call 函数调用 如 rate(x[5m])
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+func (e *Call) Type() ValueType { return ValueTypeVector }
+
+func (e *Call) String() string {
+	args := make([]string, 0, len(e.Args))
+	for _, arg := range e.Args {
+		args = append(args, arg.String())
+	}
+	return e.Func + "(" + strings.Join(args, ", ") + ")"
+}
+
+// AggregateExpr 聚合表达式 如 sum by (job) (x)、topk(3, x)
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr // topk 的 k
+	Grouping []string
+	Without  bool
+}
+
+func (e *AggregateExpr) Type() ValueType { return ValueTypeVector }
+
+func (e *AggregateExpr) String() string {
+	s := e.Op
+	if e.Without {
+		s += " without (" + strings.Join(e.Grouping, ", ") + ")"
+	} else if len(e.Grouping) > 0 {
+		s += " by (" + strings.Join(e.Grouping, ", ") + ")"
+	}
+
+	if e.Param != nil {
+		return s + " (" + e.Param.String() + ", " + e.Expr.String() + ")"
+	}
+	return s + " (" + e.Expr.String() + ")"
+}
+
+// BinaryExpr 四则运算表达式 两侧均为向量时按照去掉 __name__ 后的 label 一一匹配
+type BinaryExpr struct {
+	Op  string
+	LHS Expr
+	RHS Expr
+}
+
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == ValueTypeScalar && e.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+func (e *BinaryExpr) String() string {
+	return e.LHS.String() + " " + e.Op + " " + e.RHS.String()
+}
+
+// UnaryExpr 一元运算表达式 如 -x
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+}
+
+func (e *UnaryExpr) Type() ValueType { return e.Expr.Type() }
+
+func (e *UnaryExpr) String() string {
+	return e.Op + e.Expr.String()
+}
+
+// ParenExpr 括号表达式
+type ParenExpr struct {
+	Expr Expr
+}
+
+func (e *ParenExpr) Type() ValueType { return e.Expr.Type() }
+
+func (e *ParenExpr) String() string {
+	return "(" + e.Expr.String() + ")"
+}
+
+// Inspect 深度优先遍历语法树
+func Inspect(expr Expr, f func(Expr)) {
+	f(expr)
+
+	switch e := expr.(type) {
+	case *MatrixSelector:
+		Inspect(e.VectorSelector, f)
+	case *Call:
+		for _, arg := range e.Args {
+			Inspect(arg, f)
+		}
+	case *AggregateExpr:
+		if e.Param != nil {
+			Inspect(e.Param, f)
+		}
+		Inspect(e.Expr, f)
+	case *BinaryExpr:
+		Inspect(e.LHS, f)
+		Inspect(e.RHS, f)
+	case *UnaryExpr:
+		Inspect(e.Expr, f)
+	case *ParenExpr:
+		Inspect(e.Expr, f)
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	units := []struct {
+		unit string
+		d    time.Duration
+	}{
+		{"y", 365 * 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+	}
+
+	if d == 0 {
+		return "0s"
+	}
+
+	var s string
+	for _, u := range units {
+		if d >= u.d {
+			s += strconv.FormatInt(int64(d/u.d), 10) + u.unit
+			d %= u.d
+		}
+	}
+	return s
+}
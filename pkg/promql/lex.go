@@ -0,0 +1,199 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokIdent
+	tokNumber
+	tokDuration
+	tokString
+
+	tokLeftParen
+	tokRightParen
+	tokLeftBrace
+	tokRightBrace
+	tokLeftBracket
+	tokRightBracket
+	tokComma
+
+	tokEQL   // =
+	tokNEQ   // !=
+	tokEQLRE // =~
+	tokNEQRE // !~
+
+	tokADD // +
+	tokSUB // -
+	tokMUL // *
+	tokDIV // /
+	tokMOD // %
+	tokPOW // ^
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	if t.typ == tokEOF {
+		return "EOF"
+	}
+	return strconv.Quote(t.val)
+}
+
+var operators = map[string]tokenType{
+	"(": tokLeftParen, ")": tokRightParen,
+	"{": tokLeftBrace, "}": tokRightBrace,
+	"[": tokLeftBracket, "]": tokRightBracket,
+	",": tokComma,
+	"=": tokEQL, "!=": tokNEQ, "=~": tokEQLRE, "!~": tokNEQRE,
+	"+": tokADD, "-": tokSUB, "*": tokMUL, "/": tokDIV, "%": tokMOD, "^": tokPOW,
+}
+
+func isAlpha(r byte) bool {
+	return r == '_' || r == ':' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+func isDigit(r byte) bool {
+	return '0' <= r && r <= '9'
+}
+
+// isIdentChar 标识符中允许出现 '.' 以兼容 cpu.busy 这类 metric 名称
+func isIdentChar(r byte) bool {
+	return isAlpha(r) || isDigit(r) || r == '.'
+}
+
+func isDurationUnit(r byte) bool {
+	return strings.IndexByte("smhdwy", r) >= 0
+}
+
+// lex 将表达式切分成 token 列表 最后一个 token 固定为 tokEOF
+func lex(input string) ([]token, error) {
+	tokens := make([]token, 0)
+	pos := 0
+	for pos < len(input) {
+		c := input[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+
+		case c == '#': // 注释
+			for pos < len(input) && input[pos] != '\n' {
+				pos++
+			}
+
+		case isAlpha(c):
+			start := pos
+			for pos < len(input) && isIdentChar(input[pos]) {
+				pos++
+			}
+			tokens = append(tokens, token{typ: tokIdent, val: input[start:pos], pos: start})
+
+		case isDigit(c) || (c == '.' && pos+1 < len(input) && isDigit(input[pos+1])):
+			tok, err := lexNumberOrDuration(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			pos += len(tok.val)
+
+		case c == '"' || c == '\'' || c == '`':
+			tok, err := lexString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			pos += len(tok.val)
+
+			val, err := unquote(tok.val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s at position %d: %v", tok.val, tok.pos, err)
+			}
+			tok.val = val
+			tokens = append(tokens, tok)
+
+		default:
+			if pos+1 < len(input) {
+				if typ, ok := operators[input[pos:pos+2]]; ok {
+					tokens = append(tokens, token{typ: typ, val: input[pos : pos+2], pos: pos})
+					pos += 2
+					continue
+				}
+			}
+
+			typ, ok := operators[input[pos:pos+1]]
+			if !ok {
+				r, _ := utf8.DecodeRuneInString(input[pos:])
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, pos)
+			}
+			tokens = append(tokens, token{typ: typ, val: input[pos : pos+1], pos: pos})
+			pos++
+		}
+	}
+
+	return append(tokens, token{typ: tokEOF, pos: len(input)}), nil
+}
+
+// lexNumberOrDuration 数字后面紧跟时间单位的视为 duration 如 5m、1h30m
+func lexNumberOrDuration(input string, start int) (token, error) {
+	pos := start
+	for pos < len(input) && isDigit(input[pos]) {
+		pos++
+	}
+
+	if pos < len(input) && isDurationUnit(input[pos]) {
+		for pos < len(input) && (isDigit(input[pos]) || isDurationUnit(input[pos])) {
+			pos++
+		}
+		return token{typ: tokDuration, val: input[start:pos], pos: start}, nil
+	}
+
+	for pos < len(input) && (isIdentChar(input[pos]) || ((input[pos] == '+' || input[pos] == '-') && (input[pos-1] == 'e' || input[pos-1] == 'E'))) {
+		pos++
+	}
+
+	val := input[start:pos]
+	if _, err := strconv.ParseFloat(val, 64); err != nil {
+		return token{}, fmt.Errorf("invalid number %q at position %d", val, start)
+	}
+	return token{typ: tokNumber, val: val, pos: start}, nil
+}
+
+func lexString(input string, start int) (token, error) {
+	quote := input[start]
+	pos := start + 1
+	for pos < len(input) {
+		switch input[pos] {
+		case '\\':
+			if quote != '`' {
+				pos++
+			}
+		case quote:
+			return token{typ: tokString, val: input[start : pos+1], pos: start}, nil
+		}
+		pos++
+	}
+
+	return token{}, fmt.Errorf("unterminated string at position %d", start)
+}
+
+func unquote(s string) (string, error) {
+	switch s[0] {
+	case '`':
+		return s[1 : len(s)-1], nil
+	case '\'':
+		// 转换成双引号字符串后再处理转义字符
+		inner := strings.ReplaceAll(s[1:len(s)-1], `"`, `\"`)
+		inner = strings.ReplaceAll(inner, `\'`, `'`)
+		return strconv.Unquote(`"` + inner + `"`)
+	}
+	return strconv.Unquote(s)
+}
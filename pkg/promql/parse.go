@@ -0,0 +1,478 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const metricName = "__name__"
+
+// Aggregators 支持的聚合操作
+var Aggregators = map[string]bool{
+	"sum": true, "avg": true, "min": true, "max": true, "count": true, "topk": true,
+}
+
+// Functions 支持的函数 所有函数的参数都是一个区间向量
+var Functions = map[string]bool{
+	"rate": true, "irate": true, "increase": true,
+}
+
+// 二元运算符优先级 数值越大优先级越高
+var binaryPrecedence = map[tokenType]int{
+	tokADD: 1, tokSUB: 1,
+	tokMUL: 2, tokDIV: 2, tokMOD: 2,
+	tokPOW: 3,
+}
+
+// ParseError 表达式解析错误
+type ParseError struct {
+	Pos int
+	Err string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at position %d: %s", e.Pos, e.Err)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// ParseExpr 解析 PromQL 表达式
+func ParseExpr(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, &ParseError{Err: err.Error()}
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.typ != tokEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok)
+	}
+
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.typ != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return &ParseError{Pos: tok.pos, Err: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(typ tokenType, context string) (token, error) {
+	tok := p.next()
+	if tok.typ != typ {
+		return tok, p.errorf(tok, "unexpected %s in %s", tok, context)
+	}
+	return tok, nil
+}
+
+// parseExpr 使用优先级爬升的方式解析二元表达式 '^' 为右结合
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		prec, ok := binaryPrecedence[tok.typ]
+		if !ok || prec <= minPrec {
+			return lhs, nil
+		}
+		p.next()
+
+		nextPrec := prec
+		if tok.typ == tokPOW {
+			nextPrec = prec - 1
+		}
+
+		rhs, err := p.parseExpr(nextPrec)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, operand := range []Expr{lhs, rhs} {
+			if operand.Type() != ValueTypeScalar && operand.Type() != ValueTypeVector {
+				return nil, p.errorf(tok, "binary expression must contain only scalar and instant vector types")
+			}
+		}
+
+		lhs = &BinaryExpr{Op: tok.val, LHS: lhs, RHS: rhs}
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	tok := p.peek()
+	if tok.typ != tokADD && tok.typ != tokSUB {
+		return p.parsePrimary()
+	}
+	p.next()
+
+	// 一元运算符的优先级低于 '^' 即 -2^2 = -(2^2)
+	expr, err := p.parseExpr(binaryPrecedence[tokMUL])
+	if err != nil {
+		return nil, err
+	}
+
+	if expr.Type() != ValueTypeScalar && expr.Type() != ValueTypeVector {
+		return nil, p.errorf(tok, "unary expression only allowed on expressions of type scalar or instant vector")
+	}
+
+	if tok.typ == tokADD {
+		return expr, nil
+	}
+
+	// 常量直接取反
+	if num, ok := expr.(*NumberLiteral); ok {
+		num.Val = -num.Val
+		return num, nil
+	}
+	return &UnaryExpr{Op: tok.val, Expr: expr}, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.peek()
+	switch tok.typ {
+	case tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(tok.val, 64)
+		if err != nil {
+			return nil, p.errorf(tok, "invalid number %s", tok)
+		}
+		return &NumberLiteral{Val: v}, nil
+
+	case tokLeftParen:
+		p.next()
+		expr, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRightParen, "paren expression"); err != nil {
+			return nil, err
+		}
+		return p.parseRange(&ParenExpr{Expr: expr})
+
+	case tokLeftBrace:
+		return p.parseSelector("")
+
+	case tokIdent:
+		p.next()
+		switch tok.val {
+		case "Inf", "inf":
+			return &NumberLiteral{Val: math.Inf(1)}, nil
+		case "NaN", "nan":
+			return &NumberLiteral{Val: math.NaN()}, nil
+		}
+
+		next := p.peek()
+		if Aggregators[tok.val] && (next.typ == tokLeftParen || (next.typ == tokIdent && (next.val == "by" || next.val == "without"))) {
+			return p.parseAggregate(tok)
+		}
+
+		if next.typ == tokLeftParen {
+			return p.parseCall(tok)
+		}
+
+		return p.parseSelector(tok.val)
+	}
+
+	return nil, p.errorf(tok, "unexpected %s", tok)
+}
+
+// parseRange 解析紧跟在 selector 后面的 [duration]
+func (p *parser) parseRange(expr Expr) (Expr, error) {
+	if p.peek().typ != tokLeftBracket {
+		return expr, nil
+	}
+
+	tok := p.next()
+	vs, ok := expr.(*VectorSelector)
+	if !ok {
+		return nil, p.errorf(tok, "ranges only allowed for vector selectors")
+	}
+
+	durTok, err := p.expect(tokDuration, "range")
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := ParseDuration(durTok.val)
+	if err != nil {
+		return nil, p.errorf(durTok, "%v", err)
+	}
+
+	if _, err := p.expect(tokRightBracket, "range"); err != nil {
+		return nil, err
+	}
+
+	return &MatrixSelector{VectorSelector: vs, Range: d}, nil
+}
+
+func (p *parser) parseSelector(name string) (Expr, error) {
+	vs := &VectorSelector{Name: name}
+	if name != "" {
+		vs.Matchers = append(vs.Matchers, Matcher{Type: MatchEqual, Name: metricName, Value: name})
+	}
+
+	if p.peek().typ == tokLeftBrace {
+		p.next()
+		for p.peek().typ != tokRightBrace {
+			m, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			vs.Matchers = append(vs.Matchers, m)
+
+			if p.peek().typ != tokComma {
+				break
+			}
+			p.next()
+		}
+
+		if _, err := p.expect(tokRightBrace, "label matching"); err != nil {
+			return nil, err
+		}
+	}
+
+	// 与 Prometheus 一致 至少需要一个不匹配空值的匹配器 避免选中所有的 series
+	var nonEmpty bool
+	for _, m := range vs.Matchers {
+		if (m.Type == MatchEqual && m.Value != "") || m.Type == MatchNotEqual && m.Value == "" {
+			nonEmpty = true
+		}
+		if m.Type == MatchRegexp || m.Type == MatchNotRegexp {
+			if _, err := compileAnchored(m.Value); err != nil {
+				return nil, p.errorf(p.peek(), "invalid regular expression %q: %v", m.Value, err)
+			}
+			if !matchesEmpty(m) {
+				nonEmpty = true
+			}
+		}
+	}
+	if !nonEmpty {
+		return nil, p.errorf(p.peek(), "vector selector must contain at least one non-empty matcher")
+	}
+
+	return p.parseRange(vs)
+}
+
+func (p *parser) parseMatcher() (Matcher, error) {
+	nameTok, err := p.expect(tokIdent, "label matching")
+	if err != nil {
+		return Matcher{}, err
+	}
+
+	var m Matcher
+	opTok := p.next()
+	switch opTok.typ {
+	case tokEQL:
+		m.Type = MatchEqual
+	case tokNEQ:
+		m.Type = MatchNotEqual
+	case tokEQLRE:
+		m.Type = MatchRegexp
+	case tokNEQRE:
+		m.Type = MatchNotRegexp
+	default:
+		return Matcher{}, p.errorf(opTok, "unexpected %s in label matching, expected label matching operator", opTok)
+	}
+
+	valTok, err := p.expect(tokString, "label matching")
+	if err != nil {
+		return Matcher{}, err
+	}
+
+	m.Name, m.Value = nameTok.val, valTok.val
+	return m, nil
+}
+
+func (p *parser) parseCall(fn token) (Expr, error) {
+	if !Functions[fn.val] {
+		return nil, p.errorf(fn, "unknown function with name %q", fn.val)
+	}
+
+	p.next() // '('
+	arg, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if arg.Type() != ValueTypeMatrix {
+		return nil, p.errorf(fn, "expected type range vector in call to function %q, got %s", fn.val, arg.Type())
+	}
+
+	if _, err := p.expect(tokRightParen, "function call"); err != nil {
+		return nil, err
+	}
+
+	return &Call{Func: fn.val, Args: []Expr{arg}}, nil
+}
+
+// parseAggregate 解析聚合表达式 by/without 子句可以位于参数之前或者之后
+func (p *parser) parseAggregate(op token) (Expr, error) {
+	agg := &AggregateExpr{Op: op.val}
+
+	modifier := false
+	if p.peek().typ == tokIdent {
+		if err := p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+		modifier = true
+	}
+
+	if _, err := p.expect(tokLeftParen, "aggregation"); err != nil {
+		return nil, err
+	}
+
+	if op.val == "topk" {
+		param, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if param.Type() != ValueTypeScalar {
+			return nil, p.errorf(op, "expected type scalar in aggregation parameter, got %s", param.Type())
+		}
+		agg.Param = param
+
+		if _, err := p.expect(tokComma, "aggregation"); err != nil {
+			return nil, err
+		}
+	}
+
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if expr.Type() != ValueTypeVector {
+		return nil, p.errorf(op, "expected type instant vector in aggregation expression, got %s", expr.Type())
+	}
+	agg.Expr = expr
+
+	if _, err := p.expect(tokRightParen, "aggregation"); err != nil {
+		return nil, err
+	}
+
+	if !modifier {
+		if tok := p.peek(); tok.typ == tokIdent && (tok.val == "by" || tok.val == "without") {
+			if err := p.parseGrouping(agg); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return agg, nil
+}
+
+func (p *parser) parseGrouping(agg *AggregateExpr) error {
+	tok := p.next()
+	switch tok.val {
+	case "by":
+	case "without":
+		agg.Without = true
+	default:
+		return p.errorf(tok, "unexpected %s in aggregation", tok)
+	}
+
+	if _, err := p.expect(tokLeftParen, "grouping"); err != nil {
+		return err
+	}
+
+	agg.Grouping = make([]string, 0)
+	for p.peek().typ != tokRightParen {
+		label, err := p.expect(tokIdent, "grouping")
+		if err != nil {
+			return err
+		}
+		agg.Grouping = append(agg.Grouping, label.val)
+
+		if p.peek().typ != tokComma {
+			break
+		}
+		p.next()
+	}
+
+	_, err := p.expect(tokRightParen, "grouping")
+	return err
+}
+
+func compileAnchored(v string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + v + ")$")
+}
+
+// matchesEmpty 判断正则匹配器能否匹配空值
+func matchesEmpty(m Matcher) bool {
+	re, err := compileAnchored(m.Value)
+	if err != nil {
+		return false
+	}
+	return re.MatchString("") != (m.Type == MatchNotRegexp)
+}
+
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+// ParseDuration 解析 PromQL 中的时间跨度 如 5m、1h30m、1d
+func ParseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	orig := s
+	for s != "" {
+		i := 0
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+		s = s[i:]
+
+		j := 0
+		for j < len(s) && !isDigit(s[j]) {
+			j++
+		}
+
+		unit, ok := durationUnits[s[:j]]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+		s = s[j:]
+
+		d += time.Duration(n) * unit
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be greater than 0: %q", orig)
+	}
+	return d, nil
+}
@@ -0,0 +1,81 @@
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExpr(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{input: `cpu.busy`, expected: `cpu.busy`},
+		{input: `up{job="node", env!='dev', host=~"web-.*"}`, expected: `up{job="node",env!="dev",host=~"web-.*"}`},
+		{input: `{__name__="up"}`, expected: `{__name__="up"}`},
+		{input: `rate(http_requests_total[5m])`, expected: `rate(http_requests_total[5m])`},
+		{input: `increase(x[1h30m])`, expected: `increase(x[1h30m])`},
+		{input: `sum by (job) (rate(x[1m]))`, expected: `sum by (job) (rate(x[1m]))`},
+		{input: `sum(rate(x[1m])) without (instance)`, expected: `sum without (instance) (rate(x[1m]))`},
+		{input: `topk(3, x)`, expected: `topk (3, x)`},
+		{input: `1 + 2 * 3`, expected: `1 + 2 * 3`},
+		{input: `-2 ^ 2`, expected: `-2 ^ 2`},
+		{input: `(a + b) / c`, expected: `(a + b) / c`},
+		{input: `a - -1`, expected: `a - -1`},
+	}
+
+	for _, c := range cases {
+		expr, err := ParseExpr(c.input)
+		assert.NoError(t, err, c.input)
+		if err == nil {
+			assert.Equal(t, c.expected, expr.String(), c.input)
+		}
+	}
+}
+
+func TestParseExpr_Precedence(t *testing.T) {
+	expr, err := ParseExpr(`1 + 2 * 3 ^ 2 ^ 2`)
+	assert.NoError(t, err)
+
+	add := expr.(*BinaryExpr)
+	assert.Equal(t, "+", add.Op)
+	mul := add.RHS.(*BinaryExpr)
+	assert.Equal(t, "*", mul.Op)
+	pow := mul.RHS.(*BinaryExpr)
+	assert.Equal(t, "^", pow.Op)
+	assert.Equal(t, "^", pow.RHS.(*BinaryExpr).Op) // 右结合
+
+	expr, err = ParseExpr(`-2 ^ 2`)
+	assert.NoError(t, err)
+	assert.Equal(t, "-", expr.(*UnaryExpr).Op)
+
+	expr, err = ParseExpr(`x[5m]`)
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, expr.(*MatrixSelector).Range)
+	assert.Equal(t, []Matcher{{Type: MatchEqual, Name: "__name__", Value: "x"}}, expr.(*MatrixSelector).Matchers)
+}
+
+func TestParseExpr_Errors(t *testing.T) {
+	inputs := []string{
+		``,
+		`rate(x)`,
+		`foo(x[5m])`,
+		`sum(x[5m])`,
+		`x[5m] + 1`,
+		`{job=~".*"}`,
+		`x{job="a"`,
+		`x{job=~"("}`,
+		`topk(x, y)`,
+		`(x)[5m]`,
+		`x[5]`,
+		`1 +`,
+		`"unterminated`,
+	}
+
+	for _, input := range inputs {
+		_, err := ParseExpr(input)
+		assert.Error(t, err, input)
+	}
+}
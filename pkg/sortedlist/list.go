@@ -65,11 +65,16 @@ func (a *aVLTree) Add(k int64, v interface{}) {
 }
 
 func (a *aVLTree) Remove(k int64) bool {
-	if a.tree.search(k) {
-		a.tree.delete(k)
-		return true
+	if a.tree.h == -2 || !a.tree.search(k) {
+		return false
 	}
-	return false
+
+	// 删除节点后根节点可能发生变化
+	a.tree = a.tree.delete(k)
+	if a.tree == nil {
+		a.tree = &avlNode{h: -2}
+	}
+	return true
 }
 
 func (a *aVLTree) All() Iter {
@@ -118,7 +123,7 @@ func insert(k int64, v interface{}, t *avlNode) *avlNode {
 		t.value = v
 	}
 	// 维持树平衡
-	t = t.keepBalance(k)
+	t = t.keepBalance()
 	t.h = max(t.left.height(), t.right.height()) + 1
 	return t
 }
@@ -172,7 +177,7 @@ func (t *avlNode) delete(k int64) *avlNode {
 
 	if t != nil {
 		t.h = max(t.left.height(), t.right.height()) + 1
-		t = t.keepBalance(k)
+		t = t.keepBalance()
 	}
 	return t
 }
@@ -255,10 +260,11 @@ func (t *avlNode) rlRotate() *avlNode {
 	return t.rrRotate()
 }
 
-func (t *avlNode) keepBalance(k int64) *avlNode {
+func (t *avlNode) keepBalance() *avlNode {
 	// 左子树失衡
 	if t.left.height()-t.right.height() == 2 {
-		if k-t.left.key < 0 {
+		// 使用子树高度而非 key 判断失衡类型 删除节点时同样适用
+		if t.left.left.height() >= t.left.right.height() {
 			// 当插入的节点在失衡节点的左子树的左子树中，直接右旋
 			t = t.llRotate()
 		} else {
@@ -266,7 +272,7 @@ func (t *avlNode) keepBalance(k int64) *avlNode {
 			t = t.lrRotate()
 		}
 	} else if t.right.height()-t.left.height() == 2 {
-		if t.right.right.height() > t.right.left.height() {
+		if t.right.right.height() >= t.right.left.height() {
 			// 当插入的节点在失衡节点的右子树的右子树中，直接左旋
 			t = t.rrRotate()
 		} else {
@@ -300,6 +306,11 @@ func appendValue(values []interface{}, lower, upper int64, t *avlNode) []interfa
 
 func (t *avlNode) values(lower, upper int64) Iter {
 	it := &iter{data: []interface{}{nil}}
+
+	// 空树只有一个占位节点
+	if t != nil && t.h == -2 {
+		return it
+	}
 	it.data = appendValue(it.data, lower, upper, t)
 
 	return it
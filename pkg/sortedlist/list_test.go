@@ -42,3 +42,54 @@ func TestAVLTree(t *testing.T) {
 		idx += 1
 	}
 }
+
+// checkBalance 校验 AVL 树的平衡性以及节点高度 返回子树高度
+func checkBalance(t *testing.T, n *avlNode) int {
+	if n == nil {
+		return -1
+	}
+
+	lh, rh := checkBalance(t, n.left), checkBalance(t, n.right)
+	assert.LessOrEqual(t, lh-rh, 1, "node %d", n.key)
+	assert.LessOrEqual(t, rh-lh, 1, "node %d", n.key)
+	assert.Equal(t, max(lh, rh)+1, n.h, "node %d", n.key)
+	return n.h
+}
+
+func TestAVLTree_Remove(t *testing.T) {
+	tree := NewTree()
+	for i := 0; i < 1000; i++ {
+		tree.Add(int64(i), i)
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		assert.True(t, tree.Remove(int64(i)))
+	}
+	assert.False(t, tree.Remove(0))
+	checkBalance(t, tree.(*aVLTree).tree)
+
+	// 删除根节点后根节点会发生变化
+	root := tree.(*aVLTree).tree.key
+	assert.True(t, tree.Remove(root))
+	assert.NotEqual(t, root, tree.(*aVLTree).tree.key)
+	checkBalance(t, tree.(*aVLTree).tree)
+	tree.Add(root, int(root))
+
+	iter := tree.All()
+	expected := 1
+	for iter.Next() {
+		assert.Equal(t, expected, iter.Value().(int))
+		expected += 2
+	}
+	assert.Equal(t, 1001, expected)
+
+	for i := 1; i < 1000; i += 2 {
+		assert.True(t, tree.Remove(int64(i)))
+	}
+	assert.False(t, tree.All().Next())
+
+	tree.Add(1, "a")
+	iter = tree.All()
+	assert.True(t, iter.Next())
+	assert.Equal(t, "a", iter.Value().(string))
+}
@@ -0,0 +1,563 @@
+package mandodb
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dgryski/go-tsz"
+
+	"github.com/chenjiandongx/mandodb/pkg/chunkenc"
+)
+
+// 惰性查询接口
+//
+// Querier.Select 返回的 SeriesSet 按 LabelSet 升序逐条返回 series
+// 数据点只有在调用 Series.Iterator 后才会从 chunk 中逐个解码 不会一次性物化整个查询结果
+// 同一个 series 在多个 segment 中的数据会按时间顺序归并
+
+// SeriesIterator 数据点迭代器
+type SeriesIterator interface {
+	Next() bool
+	At() Point
+	Err() error
+}
+
+// Series 单条时序数据
+type Series interface {
+	Labels() LabelSet
+	Iterator() SeriesIterator
+}
+
+// SeriesSet series 迭代器 按 LabelSet 升序返回
+type SeriesSet interface {
+	Next() bool
+	At() Series
+	Err() error
+}
+
+var (
+	// ErrTooManySeries 查询涉及的 series 数量超出 WithMaxQuerySeries 的限制
+	ErrTooManySeries = errors.New("query touched too many series")
+
+	// ErrTooManySamples 查询读取的数据点数量超出 WithMaxQuerySamples 的限制
+	ErrTooManySamples = errors.New("query touched too many samples")
+)
+
+// QueryLimitErr 表示查询超出了资源限制 Err 为 ErrTooManySeries 或者 ErrTooManySamples
+type QueryLimitErr struct {
+	Limit int64
+	Err   error
+}
+
+func (e *QueryLimitErr) Error() string {
+	return fmt.Sprintf("%v (limit: %d)", e.Err, e.Limit)
+}
+
+func (e *QueryLimitErr) Unwrap() error {
+	return e.Err
+}
+
+// Querier 持有 [start, end] 区间内的 segment 引用 使用完毕后需要调用 Close
+type Querier struct {
+	ctx        context.Context
+	segs       []Segment
+	start, end int64
+	release    func([]Segment)
+
+	maxSeries  int64
+	maxSamples int64
+}
+
+// Querier 返回 [start, end] 区间的 Querier
+func (tsdb *TSDB) Querier(start, end int64) *Querier {
+	return tsdb.QuerierContext(context.Background(), start, end)
+}
+
+// QuerierContext 与 Querier 相同 ctx 被取消后 SeriesSet 会停止迭代并返回 ctx.Err()
+func (tsdb *TSDB) QuerierContext(ctx context.Context, start, end int64) *Querier {
+	return &Querier{
+		ctx:        ctx,
+		segs:       tsdb.segs.Get(start, end),
+		start:      start,
+		end:        end,
+		release:    tsdb.segs.Release,
+		maxSeries:  tsdb.opts.maxQuerySeries,
+		maxSamples: tsdb.opts.maxQuerySamples,
+	}
+}
+
+// Select 返回满足 lms 的 SeriesSet
+func (q *Querier) Select(lms LabelMatcherSet) SeriesSet {
+	if err := lms.validate(); err != nil {
+		return errSeriesSet{err: err}
+	}
+
+	sets := make([]SeriesSet, 0, len(q.segs))
+	for _, segment := range q.segs {
+		if err := q.ctx.Err(); err != nil {
+			return errSeriesSet{err: err}
+		}
+
+		segment, err := segment.Load()
+		if err != nil {
+			return errSeriesSet{err: err}
+		}
+
+		sets = append(sets, segment.Select(lms, q.start, q.end))
+	}
+
+	var ss SeriesSet
+	if len(sets) == 1 {
+		ss = sets[0]
+	} else {
+		ss = newMergedSeriesSet(sets...)
+	}
+
+	return &limitSeriesSet{SeriesSet: ss, ctx: q.ctx, maxSeries: q.maxSeries, maxSamples: q.maxSamples}
+}
+
+// Close 释放 segment 引用 之后不能再使用 Select 返回的 SeriesSet
+func (q *Querier) Close() {
+	q.release(q.segs)
+	q.segs = nil
+}
+
+// collectPoints 将迭代器中的数据点全部读取出来
+func collectPoints(it SeriesIterator) ([]Point, error) {
+	points := make([]Point, 0)
+	for it.Next() {
+		points = append(points, it.At())
+	}
+
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+
+	return points, nil
+}
+
+// limitSeriesSet 每次迭代 series 前检查 ctx 并统计 series 以及数据点的数量
+type limitSeriesSet struct {
+	SeriesSet
+	ctx context.Context
+	err error
+
+	maxSeries, maxSamples int64
+	series, samples       int64
+}
+
+func (s *limitSeriesSet) Next() bool {
+	if s.err != nil {
+		return false
+	}
+
+	if err := s.ctx.Err(); err != nil {
+		s.err = err
+		return false
+	}
+
+	if !s.SeriesSet.Next() {
+		return false
+	}
+
+	s.series++
+	if s.maxSeries > 0 && s.series > s.maxSeries {
+		s.err = &QueryLimitErr{Limit: s.maxSeries, Err: ErrTooManySeries}
+		return false
+	}
+
+	return true
+}
+
+func (s *limitSeriesSet) At() Series {
+	return &limitSeries{Series: s.SeriesSet.At(), set: s}
+}
+
+func (s *limitSeriesSet) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.SeriesSet.Err()
+}
+
+type limitSeries struct {
+	Series
+	set *limitSeriesSet
+}
+
+func (s *limitSeries) Iterator() SeriesIterator {
+	return &limitIterator{SeriesIterator: s.Series.Iterator(), set: s.set}
+}
+
+// limitIterator 数据点数量在同一个查询的所有 series 之间累计
+type limitIterator struct {
+	SeriesIterator
+	set *limitSeriesSet
+	err error
+}
+
+func (it *limitIterator) Next() bool {
+	if it.err != nil || !it.SeriesIterator.Next() {
+		return false
+	}
+
+	it.set.samples++
+	if max := it.set.maxSamples; max > 0 && it.set.samples > max {
+		it.err = &QueryLimitErr{Limit: max, Err: ErrTooManySamples}
+		return false
+	}
+
+	return true
+}
+
+func (it *limitIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.SeriesIterator.Err()
+}
+
+type errSeriesSet struct {
+	err error
+}
+
+func (s errSeriesSet) Next() bool { return false }
+func (s errSeriesSet) At() Series { return nil }
+func (s errSeriesSet) Err() error { return s.err }
+
+type errSeriesIterator struct {
+	err error
+}
+
+func (it errSeriesIterator) Next() bool { return false }
+func (it errSeriesIterator) At() Point  { return Point{} }
+func (it errSeriesIterator) Err() error { return it.err }
+
+// listSeriesSet 遍历已经按 LabelSet 排序的 series 列表
+type listSeriesSet struct {
+	series []Series
+	idx    int
+}
+
+func newListSeriesSet(series []Series) *listSeriesSet {
+	sort.Slice(series, func(i, j int) bool {
+		return compareLabels(series[i].Labels(), series[j].Labels()) < 0
+	})
+	return &listSeriesSet{series: series, idx: -1}
+}
+
+func (s *listSeriesSet) Next() bool {
+	s.idx++
+	return s.idx < len(s.series)
+}
+
+func (s *listSeriesSet) At() Series { return s.series[s.idx] }
+func (s *listSeriesSet) Err() error { return nil }
+
+// listSeriesIterator 遍历已经按时间排序的数据点
+type listSeriesIterator struct {
+	points []Point
+	idx    int
+}
+
+func newListSeriesIterator(points []Point) *listSeriesIterator {
+	return &listSeriesIterator{points: points, idx: -1}
+}
+
+func (it *listSeriesIterator) Next() bool {
+	it.idx++
+	return it.idx < len(it.points)
+}
+
+func (it *listSeriesIterator) At() Point  { return it.points[it.idx] }
+func (it *listSeriesIterator) Err() error { return nil }
+
+// xorSeriesIterator 解码 XOR chunk 并返回 [start, end] 范围内的数据点
+type xorSeriesIterator struct {
+	it         *chunkenc.Iterator
+	start, end int64
+	cur        Point
+
+	// wrap 用于包装解码错误 比如标记 diskSegment 已经损坏
+	wrap func(error) error
+}
+
+func (it *xorSeriesIterator) Next() bool {
+	for it.it.Next() {
+		ts, val := it.it.At()
+		if ts > it.end {
+			return false
+		}
+
+		if ts >= it.start {
+			it.cur = Point{Ts: ts, Value: val}
+			return true
+		}
+	}
+
+	return false
+}
+
+func (it *xorSeriesIterator) At() Point { return it.cur }
+
+func (it *xorSeriesIterator) Err() error {
+	if it.it.Err() == nil || it.wrap == nil {
+		return it.it.Err()
+	}
+	return it.wrap(it.it.Err())
+}
+
+// tszSeriesIterator 解码旧版本使用 go-tsz 编码的 chunk
+type tszSeriesIterator struct {
+	it         *tsz.Iter
+	start, end int64
+	cur        Point
+}
+
+func (it *tszSeriesIterator) Next() bool {
+	for it.it.Next() {
+		ts, val := it.it.Values()
+		if int64(ts) > it.end {
+			return false
+		}
+
+		if int64(ts) >= it.start {
+			it.cur = Point{Ts: int64(ts), Value: val}
+			return true
+		}
+	}
+
+	return false
+}
+
+func (it *tszSeriesIterator) At() Point  { return it.cur }
+func (it *tszSeriesIterator) Err() error { return it.it.Err() }
+
+// tombstoneIterator 过滤掉落在 tombstones 区间内的数据点
+type tombstoneIterator struct {
+	SeriesIterator
+	ivs intervals
+}
+
+func (it *tombstoneIterator) Next() bool {
+	for it.SeriesIterator.Next() {
+		if !it.ivs.contains(it.At().Ts) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mergedIterator 按时间顺序归并多个迭代器 时间戳相同的数据点只返回最后一个迭代器中的数据点
+// 调用方需要保证迭代器按照写入顺序排列 即以最后写入的数据点为准
+type mergedIterator struct {
+	its  iteratorHeap
+	cur  SeriesIterator
+	init []SeriesIterator
+	err  error
+}
+
+func newMergedIterator(its ...SeriesIterator) *mergedIterator {
+	return &mergedIterator{init: its}
+}
+
+func (it *mergedIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.init != nil {
+		for i, sit := range it.init {
+			it.push(i, sit)
+		}
+		it.init = nil
+	} else if it.cur != nil {
+		it.push(it.its.popped, it.cur)
+	}
+
+	if it.err != nil || len(it.its.items) == 0 {
+		it.cur = nil
+		return false
+	}
+
+	item := heap.Pop(&it.its).(iteratorItem)
+
+	// 时间戳相同时 heap 按迭代器顺序弹出 跳过除最后一个以外的数据点
+	for len(it.its.items) > 0 && it.its.items[0].it.At().Ts == item.it.At().Ts {
+		it.push(item.idx, item.it)
+		if it.err != nil {
+			it.cur = nil
+			return false
+		}
+		item = heap.Pop(&it.its).(iteratorItem)
+	}
+
+	it.its.popped = item.idx
+	it.cur = item.it
+	return true
+}
+
+func (it *mergedIterator) push(idx int, sit SeriesIterator) {
+	if sit.Next() {
+		heap.Push(&it.its, iteratorItem{idx: idx, it: sit})
+		return
+	}
+
+	if sit.Err() != nil {
+		it.err = sit.Err()
+	}
+}
+
+func (it *mergedIterator) At() Point  { return it.cur.At() }
+func (it *mergedIterator) Err() error { return it.err }
+
+type iteratorItem struct {
+	idx int
+	it  SeriesIterator
+}
+
+type iteratorHeap struct {
+	items  []iteratorItem
+	popped int
+}
+
+func (h *iteratorHeap) Len() int { return len(h.items) }
+
+func (h *iteratorHeap) Less(i, j int) bool {
+	a, b := h.items[i].it.At().Ts, h.items[j].it.At().Ts
+	if a == b {
+		return h.items[i].idx < h.items[j].idx
+	}
+	return a < b
+}
+
+func (h *iteratorHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *iteratorHeap) Push(x interface{}) { h.items = append(h.items, x.(iteratorItem)) }
+
+func (h *iteratorHeap) Pop() interface{} {
+	n := len(h.items)
+	x := h.items[n-1]
+	h.items = h.items[:n-1]
+	return x
+}
+
+// mergedSeries 同一个 series 在多个 segment 中的数据
+type mergedSeries struct {
+	labels LabelSet
+	series []Series
+}
+
+func (s *mergedSeries) Labels() LabelSet { return s.labels }
+
+func (s *mergedSeries) Iterator() SeriesIterator {
+	its := make([]SeriesIterator, 0, len(s.series))
+	for _, series := range s.series {
+		its = append(its, series.Iterator())
+	}
+	return newMergedIterator(its...)
+}
+
+// mergedSeriesSet 按 LabelSet 顺序归并多个 SeriesSet LabelSet 相同的 series 会被合并成一个
+type mergedSeriesSet struct {
+	sets []SeriesSet
+	h    seriesSetHeap
+	cur  Series
+	done []int
+	init bool
+	err  error
+}
+
+func newMergedSeriesSet(sets ...SeriesSet) *mergedSeriesSet {
+	return &mergedSeriesSet{sets: sets, h: seriesSetHeap{sets: sets}}
+}
+
+func (s *mergedSeriesSet) Next() bool {
+	if s.err != nil {
+		return false
+	}
+
+	if !s.init {
+		for i := range s.sets {
+			s.push(i)
+		}
+		s.init = true
+	} else {
+		for _, i := range s.done {
+			s.push(i)
+		}
+	}
+	s.done = s.done[:0]
+
+	if s.err != nil || s.h.Len() == 0 {
+		return false
+	}
+
+	first := heap.Pop(&s.h).(int)
+	s.done = append(s.done, first)
+	labels := s.sets[first].At().Labels()
+	series := []Series{s.sets[first].At()}
+
+	for s.h.Len() > 0 && compareLabels(s.sets[s.h.idx[0]].At().Labels(), labels) == 0 {
+		i := heap.Pop(&s.h).(int)
+		s.done = append(s.done, i)
+		series = append(series, s.sets[i].At())
+	}
+
+	if len(series) == 1 {
+		s.cur = series[0]
+	} else {
+		// 归并时按 segment 的顺序排列 保证时间戳相同的数据点顺序稳定
+		sort.Ints(s.done)
+		for j, i := range s.done {
+			series[j] = s.sets[i].At()
+		}
+		s.cur = &mergedSeries{labels: labels, series: series}
+	}
+
+	return true
+}
+
+func (s *mergedSeriesSet) push(i int) {
+	if s.sets[i].Next() {
+		heap.Push(&s.h, i)
+		return
+	}
+
+	if s.sets[i].Err() != nil {
+		s.err = s.sets[i].Err()
+	}
+}
+
+func (s *mergedSeriesSet) At() Series { return s.cur }
+func (s *mergedSeriesSet) Err() error { return s.err }
+
+type seriesSetHeap struct {
+	sets []SeriesSet
+	idx  []int
+}
+
+func (h *seriesSetHeap) Len() int { return len(h.idx) }
+
+func (h *seriesSetHeap) Less(i, j int) bool {
+	c := compareLabels(h.sets[h.idx[i]].At().Labels(), h.sets[h.idx[j]].At().Labels())
+	if c == 0 {
+		return h.idx[i] < h.idx[j]
+	}
+	return c < 0
+}
+
+func (h *seriesSetHeap) Swap(i, j int) { h.idx[i], h.idx[j] = h.idx[j], h.idx[i] }
+
+func (h *seriesSetHeap) Push(x interface{}) { h.idx = append(h.idx, x.(int)) }
+
+func (h *seriesSetHeap) Pop() interface{} {
+	n := len(h.idx)
+	x := h.idx[n-1]
+	h.idx = h.idx[:n-1]
+	return x
+}
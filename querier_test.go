@@ -0,0 +1,150 @@
+package mandodb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergedIterator(t *testing.T) {
+	it := newMergedIterator(
+		newListSeriesIterator([]Point{{Ts: 1, Value: 1}, {Ts: 4, Value: 4}, {Ts: 6, Value: 6}}),
+		newListSeriesIterator(nil),
+		newListSeriesIterator([]Point{{Ts: 2, Value: 2}, {Ts: 4, Value: 40}, {Ts: 5, Value: 5}}),
+	)
+
+	// 时间戳相同时以靠后的迭代器为准
+	points, err := collectPoints(it)
+	assert.NoError(t, err)
+	assert.Equal(t, []Point{
+		{Ts: 1, Value: 1}, {Ts: 2, Value: 2}, {Ts: 4, Value: 40},
+		{Ts: 5, Value: 5}, {Ts: 6, Value: 6},
+	}, points)
+
+	errIt := errors.New("broken chunk")
+	_, err = collectPoints(newMergedIterator(newListSeriesIterator([]Point{{Ts: 1}}), errSeriesIterator{err: errIt}))
+	assert.Equal(t, errIt, err)
+}
+
+func TestMergedSeriesSet(t *testing.T) {
+	series := func(value string, points ...Point) Series {
+		return &mergedSeries{
+			labels: LabelSet{{Name: "node", Value: value}},
+			series: []Series{&memSeries{series: &memorySeries{tszStore: &tszStore{}}, outdated: points}},
+		}
+	}
+
+	ss := newMergedSeriesSet(
+		newListSeriesSet([]Series{series("b", Point{Ts: 3}), series("a", Point{Ts: 1})}),
+		newListSeriesSet([]Series{series("c", Point{Ts: 1}), series("a", Point{Ts: 2})}),
+	)
+
+	var labels []string
+	var counts []int
+	for ss.Next() {
+		points, err := collectPoints(ss.At().Iterator())
+		assert.NoError(t, err)
+		labels = append(labels, ss.At().Labels()[0].Value)
+		counts = append(counts, len(points))
+	}
+
+	assert.NoError(t, ss.Err())
+	assert.Equal(t, []string{"a", "b", "c"}, labels)
+	assert.Equal(t, []int{2, 1, 1}, counts)
+}
+
+func TestTSDB_Querier(t *testing.T) {
+	tmpdir := "/tmp/tsdb-querier"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+	defer store.Close()
+
+	var start int64 = 1600000000
+	var now = start
+	for i := 0; i < 480; i++ { // 8h
+		for n := 2; n >= 0; n-- {
+			_ = store.InsertRows(genPoints(now, n, 0))
+		}
+		now += 60
+	}
+	time.Sleep(time.Millisecond * 100)
+	store.wg.Wait()
+	assert.True(t, len(store.segs.All()) > 1)
+
+	q := store.Querier(start, now)
+	ss := q.Select(LabelMatcherSet{{Name: "node", Value: "vm.*", Type: MatchRegexp}}.AddMetricName("cpu.busy"))
+
+	var nodes []string
+	for ss.Next() {
+		series := ss.At()
+		nodes = append(nodes, series.Labels().Map()["node"])
+
+		it := series.Iterator()
+		var count int
+		ts := start
+		for it.Next() {
+			assert.Equal(t, ts, it.At().Ts)
+			ts += 60
+			count++
+		}
+		assert.NoError(t, it.Err())
+		assert.Equal(t, 480, count)
+	}
+	assert.NoError(t, ss.Err())
+	assert.Equal(t, []string{"vm0", "vm1", "vm2"}, nodes)
+
+	q.Close()
+	assert.Nil(t, q.segs)
+}
+
+func TestTSDB_QueryLimits(t *testing.T) {
+	tmpdir := "/tmp/tsdb-query-limits"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir), WithMaxQuerySeries(2), WithMaxQuerySamples(100))
+	defer store.Close()
+
+	var start int64 = 1600000000
+	for i := 0; i < 60; i++ {
+		for n := 0; n < 3; n++ {
+			_ = store.InsertRows(genPoints(start+int64(i)*60, n, 0))
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	_, err := store.QueryRange("cpu.busy", nil, start, start+600)
+	var limitErr *QueryLimitErr
+	assert.True(t, errors.As(err, &limitErr))
+	assert.True(t, errors.Is(err, ErrTooManySeries))
+	assert.Equal(t, int64(2), limitErr.Limit)
+
+	_, err = store.QuerySeries(LabelMatcherSet{{Name: "node", Value: "vm.*", Type: MatchRegexp}}, start, start+3600)
+	assert.True(t, errors.Is(err, ErrTooManySeries))
+
+	_, err = store.QueryRange("cpu.busy", LabelMatcherSet{{Name: "node", Value: "vm0|vm1", Type: MatchRegexp}}, start, start+3600)
+	assert.True(t, errors.Is(err, ErrTooManySamples))
+
+	ret, err := store.QueryRange("cpu.busy", LabelMatcherSet{{Name: "node", Value: "vm0|vm1", Type: MatchRegexp}}, start, start+1200)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(ret))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = store.QueryRangeContext(ctx, "cpu.busy", LabelMatcherSet{{Name: "node", Value: "vm0"}}, start, start+3600)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = store.QuerySeriesContext(ctx, LabelMatcherSet{{Name: "node", Value: "vm0"}}, start, start+3600)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = store.QueryLabelValuesContext(ctx, "node", start, start+3600)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = store.QueryContext(ctx, `cpu.busy{node="vm0"}`, start+600)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,375 @@
+package mandodb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/chenjiandongx/logger"
+	"github.com/golang/snappy"
+
+	"github.com/chenjiandongx/mandodb/pkg/chunkenc"
+	"github.com/chenjiandongx/mandodb/pkg/prompb"
+)
+
+// ErrRequestTooLarge 请求体超过 WithMaxRequestBodySize 设置的上限
+var ErrRequestTooLarge = errors.New("request body too large")
+
+// badRequestCode 请求体超过上限时返回 413 其余错误返回 400
+func badRequestCode(err error) int {
+	if errors.Is(err, ErrRequestTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// limitedReader 读取超过 n 字节后返回 ErrRequestTooLarge
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+// limitReader limit <= 0 表示不限制
+func limitReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, n: limit}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// 已经读满上限 再读取一个字节确认是否还有剩余数据
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, ErrRequestTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// readRequestBody 读取请求体 超过 maxRequestBodySize 时返回 ErrRequestTooLarge
+func (tsdb *TSDB) readRequestBody(r *http.Request) ([]byte, error) {
+	return ioutil.ReadAll(limitReader(r.Body, tsdb.opts.maxRequestBodySize))
+}
+
+// decodeSnappyBody 解压 snappy 压缩的请求体 解压后的长度同样受 maxRequestBodySize 限制
+func (tsdb *TSDB) decodeSnappyBody(r *http.Request) ([]byte, error) {
+	compressed, err := tsdb.readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode snappy payload: %v", err)
+	}
+	if limit := tsdb.opts.maxRequestBodySize; limit > 0 && int64(n) > limit {
+		return nil, ErrRequestTooLarge
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode snappy payload: %v", err)
+	}
+	return data, nil
+}
+
+// RemoteWriteHandler 返回接收 Prometheus remote_write 请求的 http.Handler
+// 请求体为 snappy 压缩后的 prompb.WriteRequest
+// * 204: 写入成功
+// * 400: 请求体无法解析
+// * 413: 请求体超过 WithMaxRequestBodySize 设置的上限
+// * 503: 写入队列已满 客户端应该稍后重试
+func (tsdb *TSDB) RemoteWriteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := tsdb.decodeWriteRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), badRequestCode(err))
+			return
+		}
+
+		rows, err := tsdb.timeSeriesToRows(req.Timeseries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(rows) > 0 {
+			if err := tsdb.InsertRows(rows); err != nil {
+				code := http.StatusInternalServerError
+				if errors.Is(err, ErrWriteOverloaded) {
+					code = http.StatusServiceUnavailable
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (tsdb *TSDB) decodeWriteRequest(r *http.Request) (*prompb.WriteRequest, error) {
+	data, err := tsdb.decodeSnappyBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &prompb.WriteRequest{}
+	if err := req.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal write request: %v", err)
+	}
+
+	return req, nil
+}
+
+// timeSeriesToRows 将 prompb.TimeSeries 转换为 Row __name__ 对应 Row.Metric
+// 时间戳会从毫秒转换为当前配置的精度 值为空的标签会被忽略
+func (tsdb *TSDB) timeSeriesToRows(series []prompb.TimeSeries) ([]*Row, error) {
+	rows := make([]*Row, 0)
+	for _, ts := range series {
+		var metric string
+		labels := make(LabelSet, 0, len(ts.Labels))
+		for _, label := range ts.Labels {
+			if label.Name == metricName {
+				metric = label.Value
+				continue
+			}
+
+			if label.Value == "" {
+				continue
+			}
+			labels = append(labels, Label{Name: label.Name, Value: label.Value})
+		}
+
+		if metric == "" {
+			return nil, fmt.Errorf("series %v has no metric name", ts.Labels)
+		}
+
+		// 每行数据在写入的时候都会追加 metricName 这里限制容量避免共享底层数组
+		labels = labels[:len(labels):len(labels)]
+		for _, sample := range ts.Samples {
+			rows = append(rows, &Row{
+				Metric: metric,
+				Labels: labels,
+				Point: Point{
+					Ts:    tsdb.opts.precision.FromMilliseconds(sample.Timestamp),
+					Value: sample.Value,
+				},
+			})
+		}
+	}
+
+	return rows, nil
+}
+
+// RemoteReadHandler 返回响应 Prometheus remote_read 请求的 http.Handler
+// 客户端声明支持 STREAMED_XOR_CHUNKS 时使用流式响应 否则返回 snappy 压缩后的 prompb.ReadResponse
+func (tsdb *TSDB) RemoteReadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := tsdb.decodeReadRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), badRequestCode(err))
+			return
+		}
+
+		queries := make([]*remoteReadQuery, 0, len(req.Queries))
+		for _, q := range req.Queries {
+			query, err := tsdb.newRemoteReadQuery(q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			queries = append(queries, query)
+		}
+
+		for _, t := range req.AcceptedResponseTypes {
+			if t == prompb.ReadStreamedXORChunks {
+				tsdb.streamReadResponse(r.Context(), w, queries)
+				return
+			}
+		}
+
+		tsdb.sampledReadResponse(r.Context(), w, queries)
+	})
+}
+
+func (tsdb *TSDB) decodeReadRequest(r *http.Request) (*prompb.ReadRequest, error) {
+	data, err := tsdb.decodeSnappyBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &prompb.ReadRequest{}
+	if err := req.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal read request: %v", err)
+	}
+
+	return req, nil
+}
+
+var remoteMatchTypes = map[prompb.MatchType]MatchType{
+	prompb.MatchEqual:     MatchEqual,
+	prompb.MatchNotEqual:  MatchNotEqual,
+	prompb.MatchRegexp:    MatchRegexp,
+	prompb.MatchNotRegexp: MatchNotRegexp,
+}
+
+// remoteReadQuery 由 prompb.Query 转换而来
+type remoteReadQuery struct {
+	lms   LabelMatcherSet
+	start int64
+	end   int64
+}
+
+func (tsdb *TSDB) newRemoteReadQuery(q prompb.Query) (*remoteReadQuery, error) {
+	precision := tsdb.opts.precision
+
+	// 精度降低时 start 需要向上取整 避免返回早于 start 的数据点
+	start := precision.FromMilliseconds(q.StartTimestampMs)
+	if precision.ToMilliseconds(start) < q.StartTimestampMs {
+		start++
+	}
+
+	query := &remoteReadQuery{start: start, end: precision.FromMilliseconds(q.EndTimestampMs)}
+	for _, m := range q.Matchers {
+		t, ok := remoteMatchTypes[m.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown matcher type %d", m.Type)
+		}
+
+		if t == MatchRegexp || t == MatchNotRegexp {
+			if _, err := newFastRegexMatcher(m.Value); err != nil {
+				return nil, fmt.Errorf("invalid regexp %q: %v", m.Value, err)
+			}
+		}
+
+		query.lms = append(query.lms, LabelMatcher{Name: m.Name, Value: m.Value, Type: t})
+	}
+
+	return query, nil
+}
+
+func (tsdb *TSDB) execRemoteReadQuery(ctx context.Context, q *remoteReadQuery) ([]MetricRet, error) {
+	return tsdb.queryRange(ctx, q.lms.filter(), q.start, q.end)
+}
+
+func toPromLabels(labels LabelSet) []prompb.Label {
+	ret := make([]prompb.Label, 0, len(labels))
+	for _, label := range labels {
+		ret = append(ret, prompb.Label{Name: label.Name, Value: label.Value})
+	}
+
+	return ret
+}
+
+func (tsdb *TSDB) sampledReadResponse(ctx context.Context, w http.ResponseWriter, queries []*remoteReadQuery) {
+	resp := &prompb.ReadResponse{}
+	for _, q := range queries {
+		ret, err := tsdb.execRemoteReadQuery(ctx, q)
+		if err != nil {
+			http.Error(w, err.Error(), queryError(err).code())
+			return
+		}
+
+		result := prompb.QueryResult{}
+		for _, r := range ret {
+			ts := prompb.TimeSeries{Labels: toPromLabels(r.Labels)}
+			for _, p := range r.Points {
+				ts.Samples = append(ts.Samples, prompb.Sample{
+					Timestamp: tsdb.opts.precision.ToMilliseconds(p.Ts),
+					Value:     p.Value,
+				})
+			}
+			result.Timeseries = append(result.Timeseries, ts)
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	if _, err := w.Write(snappy.Encode(nil, resp.Marshal())); err != nil {
+		logger.Errorf("failed to write remote read response: %v", err)
+	}
+}
+
+// remoteReadChunkSamples 流式响应中每个 chunk 最多包含的数据点数量 与 Prometheus 保持一致
+const remoteReadChunkSamples = 120
+
+// streamReadResponse 以 ChunkedReadResponse 帧的形式逐个 series 返回 XOR chunk
+func (tsdb *TSDB) streamReadResponse(ctx context.Context, w http.ResponseWriter, queries []*remoteReadQuery) {
+	w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+	flusher, _ := w.(http.Flusher)
+	cw := prompb.NewChunkedWriter(w, flusher)
+
+	var written bool
+	for idx, q := range queries {
+		ret, err := tsdb.execRemoteReadQuery(ctx, q)
+		if err != nil {
+			// 响应头已经发出后只能中断响应
+			if !written {
+				http.Error(w, err.Error(), queryError(err).code())
+			}
+			logger.Errorf("failed to execute remote read query: %v", err)
+			return
+		}
+
+		for _, r := range ret {
+			resp := &prompb.ChunkedReadResponse{
+				ChunkedSeries: []prompb.ChunkedSeries{{
+					Labels: toPromLabels(r.Labels),
+					Chunks: tsdb.encodeRemoteChunks(r.Points),
+				}},
+				QueryIndex: int64(idx),
+			}
+
+			if _, err := cw.Write(resp.Marshal()); err != nil {
+				logger.Errorf("failed to write remote read response: %v", err)
+				return
+			}
+			written = true
+		}
+	}
+}
+
+// encodeRemoteChunks 将数据点编码成 Prometheus 格式的 XOR chunk
+// 数据格式为 数据点数量(big-endian uint16) | XOR 数据流 时间戳单位为毫秒
+func (tsdb *TSDB) encodeRemoteChunks(points []Point) []prompb.Chunk {
+	chunks := make([]prompb.Chunk, 0, len(points)/remoteReadChunkSamples+1)
+	for i := 0; i < len(points); i += remoteReadChunkSamples {
+		j := i + remoteReadChunkSamples
+		if j > len(points) {
+			j = len(points)
+		}
+
+		c := chunkenc.NewXORChunk()
+		for _, p := range points[i:j] {
+			c.Append(tsdb.opts.precision.ToMilliseconds(p.Ts), p.Value)
+		}
+
+		data := make([]byte, 2, 2+len(c.Bytes()))
+		binary.BigEndian.PutUint16(data, uint16(c.NumSamples()))
+
+		chunks = append(chunks, prompb.Chunk{
+			MinTimeMs: tsdb.opts.precision.ToMilliseconds(points[i].Ts),
+			MaxTimeMs: tsdb.opts.precision.ToMilliseconds(points[j-1].Ts),
+			Type:      prompb.ChunkXOR,
+			Data:      append(data, c.Bytes()...),
+		})
+	}
+
+	return chunks
+}
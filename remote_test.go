@@ -0,0 +1,263 @@
+package mandodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/chenjiandongx/mandodb/pkg/chunkenc"
+	"github.com/chenjiandongx/mandodb/pkg/prompb"
+)
+
+func postWriteRequest(h http.Handler, req *prompb.WriteRequest) *httptest.ResponseRecorder {
+	body := snappy.Encode(nil, req.Marshal())
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestRemoteWriteHandler(t *testing.T) {
+	tmpdir := "/tmp/tsdb-remote-write"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir), WithTimestampPrecision(PrecisionMillisecond))
+	defer store.Close()
+
+	var start int64 = 1600000000000
+	req := &prompb.WriteRequest{}
+	for _, node := range []string{"vm1", "vm2"} {
+		ts := prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "cpu_busy"},
+				{Name: "node", Value: node},
+				{Name: "empty", Value: ""},
+			},
+		}
+		for i := 0; i < 10; i++ {
+			ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: start + int64(i*15000), Value: float64(i)})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+
+	w := postWriteRequest(store.RemoteWriteHandler(), req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	time.Sleep(time.Millisecond * 20)
+
+	ret, err := store.QueryRange("cpu_busy", LabelMatcherSet{{Name: "node", Value: "vm2"}}, start, start+150000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, LabelSet{{Name: "__name__", Value: "cpu_busy"}, {Name: "node", Value: "vm2"}}, ret[0].Labels)
+	assert.Equal(t, 10, len(ret[0].Points))
+	assert.Equal(t, start+15000, ret[0].Points[1].Ts)
+	assert.Equal(t, float64(1), ret[0].Points[1].Value)
+}
+
+func TestRemoteWriteHandler_BadRequest(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true))
+	defer store.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader([]byte("not snappy")))
+	w := httptest.NewRecorder()
+	store.RemoteWriteHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "node", Value: "vm1"}},
+		Samples: []prompb.Sample{{Timestamp: 1, Value: 1}},
+	}}}
+	assert.Equal(t, http.StatusBadRequest, postWriteRequest(store.RemoteWriteHandler(), req).Code)
+}
+
+func TestRemoteWriteHandler_Overloaded(t *testing.T) {
+	// 没有消费者的写入队列 写入必然超时
+	store := &TSDB{opts: newDefaultOptions(), q: make(chan *writeBatch)}
+	store.opts.writeTimeout = time.Millisecond
+
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "cpu_busy"}},
+		Samples: []prompb.Sample{{Timestamp: 1, Value: 1}},
+	}}}
+	assert.Equal(t, http.StatusServiceUnavailable, postWriteRequest(store.RemoteWriteHandler(), req).Code)
+}
+
+func TestRemoteWriteHandler_TooLarge(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true), WithMaxRequestBodySize(1024))
+	defer store.Close()
+
+	// 压缩前超过上限
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(make([]byte, 2048)))
+	w := httptest.NewRecorder()
+	store.RemoteWriteHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// 压缩后未超过上限 但解压后超过上限
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: string(bytes.Repeat([]byte("a"), 4096))}},
+		Samples: []prompb.Sample{{Timestamp: 1, Value: 1}},
+	}}}
+	assert.Less(t, len(snappy.Encode(nil, req.Marshal())), 1024)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, postWriteRequest(store.RemoteWriteHandler(), req).Code)
+}
+
+func postReadRequest(h http.Handler, req *prompb.ReadRequest) *httptest.ResponseRecorder {
+	body := snappy.Encode(nil, req.Marshal())
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// genRemoteReadStore 写入 cpu.busy/mem.busy 在 vm1/vm2 上的数据 每 15s 一个点 值为点的序号
+func genRemoteReadStore(tmpdir string) *TSDB {
+	store := OpenTSDB(WithDataPath(tmpdir))
+
+	var start int64 = 1600000000
+	for i := 0; i < 300; i++ {
+		rows := make([]*Row, 0)
+		for _, metric := range []string{"cpu.busy", "mem.busy"} {
+			for _, node := range []string{"vm1", "vm2"} {
+				rows = append(rows, &Row{
+					Metric: metric,
+					Labels: LabelSet{{Name: "node", Value: node}},
+					Point:  Point{Ts: start + int64(i*15), Value: float64(i)},
+				})
+			}
+		}
+		_ = store.InsertRows(rows)
+	}
+	time.Sleep(time.Millisecond * 20)
+	return store
+}
+
+func TestRemoteReadHandler_Samples(t *testing.T) {
+	tmpdir := "/tmp/tsdb-remote-read"
+	defer os.RemoveAll(tmpdir)
+
+	store := genRemoteReadStore(tmpdir)
+	defer store.Close()
+
+	var start int64 = 1600000000000
+	req := &prompb.ReadRequest{Queries: []prompb.Query{
+		{
+			StartTimestampMs: start,
+			EndTimestampMs:   start + 15000*9,
+			Matchers: []prompb.LabelMatcher{
+				{Type: prompb.MatchEqual, Name: "__name__", Value: "cpu.busy"},
+				{Type: prompb.MatchNotEqual, Name: "node", Value: "vm1"},
+			},
+		},
+		{
+			StartTimestampMs: start + 500,
+			EndTimestampMs:   start + 15000,
+			Matchers: []prompb.LabelMatcher{
+				{Type: prompb.MatchNotRegexp, Name: "__name__", Value: "cpu.*"},
+			},
+		},
+	}}
+
+	w := postReadRequest(store.RemoteReadHandler(), req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "snappy", w.Header().Get("Content-Encoding"))
+
+	data, err := snappy.Decode(nil, w.Body.Bytes())
+	assert.NoError(t, err)
+
+	resp := &prompb.ReadResponse{}
+	assert.NoError(t, resp.Unmarshal(data))
+	assert.Equal(t, 2, len(resp.Results))
+
+	assert.Equal(t, 1, len(resp.Results[0].Timeseries))
+	ts := resp.Results[0].Timeseries[0]
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "cpu.busy"}, {Name: "node", Value: "vm2"}}, ts.Labels)
+	assert.Equal(t, 10, len(ts.Samples))
+	assert.Equal(t, start+15000, ts.Samples[1].Timestamp)
+
+	// start 向上取整到秒 只剩下 start + 15s 一个点
+	assert.Equal(t, 2, len(resp.Results[1].Timeseries))
+	for _, ts := range resp.Results[1].Timeseries {
+		assert.Equal(t, "mem.busy", ts.Labels[0].Value)
+		assert.Equal(t, []prompb.Sample{{Timestamp: start + 15000, Value: 1}}, ts.Samples)
+	}
+}
+
+func TestRemoteReadHandler_Streamed(t *testing.T) {
+	tmpdir := "/tmp/tsdb-remote-read-streamed"
+	defer os.RemoveAll(tmpdir)
+
+	store := genRemoteReadStore(tmpdir)
+	defer store.Close()
+
+	var start int64 = 1600000000000
+	req := &prompb.ReadRequest{
+		Queries: []prompb.Query{{
+			StartTimestampMs: start,
+			EndTimestampMs:   start + 15000*299,
+			Matchers: []prompb.LabelMatcher{
+				{Type: prompb.MatchRegexp, Name: "__name__", Value: "mem.*"},
+				{Type: prompb.MatchEqual, Name: "node", Value: "vm1"},
+			},
+		}},
+		AcceptedResponseTypes: []prompb.ReadResponseType{prompb.ReadStreamedXORChunks},
+	}
+
+	w := postReadRequest(store.RemoteReadHandler(), req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "prometheus.ChunkedReadResponse")
+
+	reader := prompb.NewChunkedReader(w.Body)
+	frames := 0
+	for {
+		b, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		frames++
+
+		resp := &prompb.ChunkedReadResponse{}
+		assert.NoError(t, resp.Unmarshal(b))
+		assert.Equal(t, 1, len(resp.ChunkedSeries))
+
+		series := resp.ChunkedSeries[0]
+		assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "mem.busy"}, {Name: "node", Value: "vm1"}}, series.Labels)
+		assert.Equal(t, 3, len(series.Chunks))
+
+		var n int
+		for _, chunk := range series.Chunks {
+			assert.Equal(t, prompb.ChunkXOR, chunk.Type)
+			it := chunkenc.NewIterator(chunk.Data[2:], int(binary.BigEndian.Uint16(chunk.Data)))
+			for it.Next() {
+				ts, _ := it.At()
+				assert.Equal(t, start+int64(n*15000), ts)
+				n++
+			}
+			assert.NoError(t, it.Err())
+		}
+		assert.Equal(t, 300, n)
+	}
+	assert.Equal(t, 1, frames)
+}
+
+func TestRemoteReadHandler_BadRequest(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true))
+	defer store.Close()
+
+	req := &prompb.ReadRequest{Queries: []prompb.Query{{
+		Matchers: []prompb.LabelMatcher{{Type: prompb.MatchRegexp, Name: "node", Value: "("}},
+	}}}
+	w := postReadRequest(store.RemoteReadHandler(), req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.Contains(t, string(body), "invalid regexp")
+}
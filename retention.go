@@ -0,0 +1,99 @@
+package mandodb
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/chenjiandongx/logger"
+)
+
+// DiskUsage 描述持久化数据的磁盘空间使用情况
+type DiskUsage struct {
+	SegmentCount int   `json:"segmentCount"`
+	SegmentBytes int64 `json:"segmentBytes"`
+	WALBytes     int64 `json:"walBytes"`
+
+	// MaxBytes 为 WithMaxDiskBytes 设置的上限 0 表示不限制
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+// DiskUsage 返回当前的磁盘空间使用情况 只有 SegmentBytes 会计入 MaxBytes
+func (tsdb *TSDB) DiskUsage() DiskUsage {
+	usage := DiskUsage{MaxBytes: tsdb.opts.maxDiskBytes}
+	for _, ds := range tsdb.diskSegments() {
+		usage.SegmentCount++
+		usage.SegmentBytes += ds.Size()
+	}
+
+	if tsdb.wal != nil {
+		usage.WALBytes = dirSize(filepath.Join(tsdb.opts.dataPath, walDirname))
+	}
+
+	return usage
+}
+
+func (tsdb *TSDB) diskSegments() []*diskSegment {
+	disks := make([]*diskSegment, 0)
+	for _, segment := range tsdb.segs.All() {
+		if ds, ok := segment.(*diskSegment); ok {
+			disks = append(disks, ds)
+		}
+	}
+
+	return disks
+}
+
+func (tsdb *TSDB) notifyFlushed() {
+	select {
+	case tsdb.flushed <- struct{}{}:
+	default:
+	}
+}
+
+// enforceDiskQuota 持久化数据超出 maxDiskBytes 时从最旧的 diskSegment 开始删除
+func (tsdb *TSDB) enforceDiskQuota() {
+	if tsdb.opts.maxDiskBytes <= 0 {
+		return
+	}
+
+	tsdb.compactMut.Lock()
+	defer tsdb.compactMut.Unlock()
+
+	disks := tsdb.diskSegments()
+
+	var total int64
+	for _, ds := range disks {
+		total += ds.Size()
+	}
+
+	for _, ds := range disks {
+		if total <= tsdb.opts.maxDiskBytes {
+			return
+		}
+
+		if err := tsdb.segs.Remove(ds); err != nil {
+			logger.Errorf("failed to remove segment %s: %v", ds.dir, err)
+			continue
+		}
+
+		total -= ds.Size()
+		logger.Warnf("disk usage exceeds %d bytes, remove segment %s", tsdb.opts.maxDiskBytes, ds.dir)
+	}
+}
+
+// dirSize 返回文件夹下所有文件的大小之和 segment 和 wal 文件夹下都没有子文件夹
+func dirSize(dir string) int64 {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, file := range files {
+		if !file.IsDir() {
+			size += file.Size()
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,75 @@
+package mandodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTSDB_MaxDiskBytes(t *testing.T) {
+	tmpdir := "/tmp/tsdb-retention"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir), WithCompactionLevels())
+
+	var start int64 = 1600000000
+	var now = start
+	for i := 0; i < 480; i++ { // 8h
+		_ = store.InsertRows(genPoints(now, 0, 0))
+		now += 60
+	}
+	time.Sleep(time.Millisecond * 100)
+	store.wg.Wait()
+
+	usage := store.DiskUsage()
+	assert.Equal(t, 3, usage.SegmentCount)
+	assert.True(t, usage.SegmentBytes > 0)
+	assert.True(t, usage.WALBytes > 0)
+	assert.Equal(t, int64(0), usage.MaxBytes)
+
+	oldest := store.diskSegments()[0]
+	store.Close()
+
+	// 超出限制后只删除最旧的 segment
+	store = OpenTSDB(WithDataPath(tmpdir), WithCompactionLevels(), WithMaxDiskBytes(usage.SegmentBytes-1))
+	defer store.Close()
+	store.enforceDiskQuota()
+
+	usage = store.DiskUsage()
+	assert.Equal(t, 3, usage.SegmentCount) // Close 时 head 也被持久化了
+	assert.True(t, usage.SegmentBytes <= usage.MaxBytes)
+	assert.False(t, isFileExist(oldest.dir))
+
+	ret, err := store.QueryRange("cpu.busy", nil, start, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.True(t, ret[0].Points[0].Ts > oldest.MaxTs())
+}
+
+func TestTSDB_RemoveExpired(t *testing.T) {
+	tmpdir := "/tmp/tsdb-expired"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir), WithCompactionLevels(), WithRetention(time.Hour))
+	defer store.Close()
+
+	var start int64 = 1600000000
+	for _, ts := range []int64{start, start + 7260, start + 7320} {
+		_, err := store.InsertRowsSync(context.Background(), genPoints(ts, 0, 0))
+		assert.NoError(t, err)
+	}
+
+	// 模拟 segment 仍在持久化中 memorySegment 不会被删除
+	flushing := newMemorySegment(store.opts)
+	flushing.InsertRows(genPoints(start+60, 1, 0))
+	store.segs.Add(flushing)
+	store.wg.Wait()
+
+	store.removeExpired(start + 7320 + 3600*24)
+	segs := store.segs.All()
+	assert.Equal(t, 1, len(segs))
+	assert.True(t, segs[0] == flushing)
+}
@@ -0,0 +1,366 @@
+package mandodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash"
+	"github.com/chenjiandongx/logger"
+	"gopkg.in/yaml.v2"
+
+	"github.com/chenjiandongx/mandodb/pkg/expfmt"
+)
+
+const (
+	defaultScrapeInterval = time.Minute
+	defaultScrapeTimeout  = 10 * time.Second
+	defaultMetricsPath    = "/metrics"
+	defaultScheme         = "http"
+
+	jobLabel      = "job"
+	instanceLabel = "instance"
+
+	// exportedLabelPrefix 样本自带的 job、instance 标签与目标标签冲突时添加的前缀
+	exportedLabelPrefix = "exported_"
+)
+
+// ScrapeConfig 抓取配置 为 Prometheus 配置文件的子集
+//
+//	global:
+//	  scrape_interval: 15s
+//	scrape_configs:
+//	  - job_name: node
+//	    static_configs:
+//	      - targets: ["localhost:9100"]
+//	        labels: {env: prod}
+type ScrapeConfig struct {
+	Global        ScrapeGlobalConfig `yaml:"global"`
+	ScrapeConfigs []*ScrapeJobConfig `yaml:"scrape_configs"`
+}
+
+// ScrapeGlobalConfig 各个 job 默认使用的抓取间隔以及超时时间
+type ScrapeGlobalConfig struct {
+	ScrapeInterval time.Duration `yaml:"scrape_interval"`
+	ScrapeTimeout  time.Duration `yaml:"scrape_timeout"`
+}
+
+// ScrapeJobConfig 单个 job 的抓取配置 为空的字段使用 global 或者默认值
+type ScrapeJobConfig struct {
+	JobName        string          `yaml:"job_name"`
+	ScrapeInterval time.Duration   `yaml:"scrape_interval"`
+	ScrapeTimeout  time.Duration   `yaml:"scrape_timeout"`
+	MetricsPath    string          `yaml:"metrics_path"`
+	Scheme         string          `yaml:"scheme"`
+	StaticConfigs  []*StaticConfig `yaml:"static_configs"`
+}
+
+// StaticConfig 一组静态目标 Labels 会附加到这组目标的所有样本上
+type StaticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// LoadScrapeConfigFile 读取并解析 YAML 格式的抓取配置文件
+func LoadScrapeConfigFile(path string) (*ScrapeConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseScrapeConfig(b)
+}
+
+// ParseScrapeConfig 解析 YAML 格式的抓取配置 填充默认值并校验
+func ParseScrapeConfig(b []byte) (*ScrapeConfig, error) {
+	cfg := &ScrapeConfig{}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse scrape config: %w", err)
+	}
+
+	if cfg.Global.ScrapeInterval <= 0 {
+		cfg.Global.ScrapeInterval = defaultScrapeInterval
+	}
+	if cfg.Global.ScrapeTimeout <= 0 {
+		cfg.Global.ScrapeTimeout = defaultScrapeTimeout
+	}
+
+	jobs := make(map[string]struct{})
+	for _, job := range cfg.ScrapeConfigs {
+		if job == nil || job.JobName == "" {
+			return nil, fmt.Errorf("job_name is required")
+		}
+		if _, ok := jobs[job.JobName]; ok {
+			return nil, fmt.Errorf("duplicated job_name %q", job.JobName)
+		}
+		jobs[job.JobName] = struct{}{}
+
+		if err := job.validate(cfg.Global); err != nil {
+			return nil, fmt.Errorf("job %q: %w", job.JobName, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+func (job *ScrapeJobConfig) validate(global ScrapeGlobalConfig) error {
+	if job.ScrapeInterval <= 0 {
+		job.ScrapeInterval = global.ScrapeInterval
+	}
+
+	// 没有显式指定超时时间时不超过抓取间隔
+	if job.ScrapeTimeout <= 0 {
+		job.ScrapeTimeout = global.ScrapeTimeout
+		if job.ScrapeTimeout > job.ScrapeInterval {
+			job.ScrapeTimeout = job.ScrapeInterval
+		}
+	}
+	if job.ScrapeTimeout > job.ScrapeInterval {
+		return fmt.Errorf("scrape_timeout %v is greater than scrape_interval %v", job.ScrapeTimeout, job.ScrapeInterval)
+	}
+
+	if job.MetricsPath == "" {
+		job.MetricsPath = defaultMetricsPath
+	}
+	if !strings.HasPrefix(job.MetricsPath, "/") {
+		return fmt.Errorf("metrics_path %q must start with /", job.MetricsPath)
+	}
+
+	if job.Scheme == "" {
+		job.Scheme = defaultScheme
+	}
+	if job.Scheme != "http" && job.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", job.Scheme)
+	}
+
+	for _, sc := range job.StaticConfigs {
+		if sc == nil {
+			continue
+		}
+
+		for _, target := range sc.Targets {
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				return fmt.Errorf("invalid target %q: %w", target, err)
+			}
+		}
+
+		for name := range sc.Labels {
+			if name == "" || name == metricName {
+				return fmt.Errorf("invalid label name %q", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// scrapeTarget 单个抓取目标 labels 包括 job、instance 以及静态标签 按名称排序
+type scrapeTarget struct {
+	url      string
+	labels   LabelSet
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// ScrapeManager 周期性地抓取目标的 Prometheus exposition format 并写入 TSDB
+// 每次抓取除了样本以外还会写入 up、scrape_duration_seconds 以及 scrape_samples_scraped 三个指标
+type ScrapeManager struct {
+	tsdb    *TSDB
+	client  *http.Client
+	targets []*scrapeTarget
+}
+
+// NewScrapeManager 根据抓取配置创建 ScrapeManager cfg 需要是 ParseScrapeConfig 返回的配置
+func (tsdb *TSDB) NewScrapeManager(cfg *ScrapeConfig) *ScrapeManager {
+	m := &ScrapeManager{tsdb: tsdb, client: &http.Client{}}
+
+	for _, job := range cfg.ScrapeConfigs {
+		for _, sc := range job.StaticConfigs {
+			if sc == nil {
+				continue
+			}
+
+			for _, target := range sc.Targets {
+				labels := map[string]string{jobLabel: job.JobName, instanceLabel: target}
+				for k, v := range sc.Labels {
+					labels[k] = v
+				}
+
+				ls := make(LabelSet, 0, len(labels))
+				for k, v := range labels {
+					ls = append(ls, Label{Name: k, Value: v})
+				}
+				ls.Sorted()
+
+				m.targets = append(m.targets, &scrapeTarget{
+					url:      fmt.Sprintf("%s://%s%s", job.Scheme, target, job.MetricsPath),
+					labels:   ls,
+					interval: job.ScrapeInterval,
+					timeout:  job.ScrapeTimeout,
+				})
+			}
+		}
+	}
+
+	return m
+}
+
+// Run 为每个目标启动一个抓取循环 ctx 结束或者 TSDB 关闭后等待所有循环退出再返回
+func (m *ScrapeManager) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-m.tsdb.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, t := range m.targets {
+		wg.Add(1)
+		go func(t *scrapeTarget) {
+			defer wg.Done()
+			m.scrapeLoop(ctx, t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// scrapeLoop 按照目标 url 的 hash 错开首次抓取的时间 避免所有目标同时抓取
+func (m *ScrapeManager) scrapeLoop(ctx context.Context, t *scrapeTarget) {
+	offset := time.Duration(xxhash.Sum64String(t.url) % uint64(t.interval))
+	timer := time.NewTimer(offset)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return
+	case <-timer.C:
+	}
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		rows := m.scrape(ctx, t, time.Now())
+
+		// 退出时中断的抓取不应该记录为 up=0
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := m.tsdb.InsertRows(rows); err != nil {
+			logger.Errorf("failed to insert scraped rows of %s: %v", t.url, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrape 抓取一次目标 返回样本以及 up 等指标对应的 rows
+// 抓取失败时只返回 up=0 等指标 没有时间戳的样本使用抓取开始的时间
+func (m *ScrapeManager) scrape(ctx context.Context, t *scrapeTarget, start time.Time) []*Row {
+	ts := m.tsdb.opts.precision.Timestamp(start)
+
+	samples, err := m.fetch(ctx, t)
+	duration := time.Since(start)
+
+	up := 1.0
+	if err != nil {
+		logger.Warnf("failed to scrape %s: %v", t.url, err)
+		up = 0
+	}
+
+	rows := make([]*Row, 0, len(samples)+3)
+	for _, sample := range samples {
+		sampleTs := ts
+		if sample.HasTimestamp {
+			sampleTs = m.tsdb.opts.precision.FromMilliseconds(sample.Timestamp)
+		}
+
+		rows = append(rows, &Row{
+			Metric: sample.Metric,
+			Labels: t.sampleLabels(sample.Labels),
+			Point:  Point{Ts: sampleTs, Value: sample.Value},
+		})
+	}
+
+	for _, report := range []struct {
+		metric string
+		value  float64
+	}{
+		{metric: "up", value: up},
+		{metric: "scrape_duration_seconds", value: duration.Seconds()},
+		{metric: "scrape_samples_scraped", value: float64(len(samples))},
+	} {
+		labels := make(LabelSet, len(t.labels))
+		copy(labels, t.labels)
+
+		rows = append(rows, &Row{
+			Metric: report.metric,
+			Labels: labels,
+			Point:  Point{Ts: ts, Value: report.value},
+		})
+	}
+
+	return rows
+}
+
+// sampleLabels 合并样本标签和目标标签 冲突时目标标签优先 样本标签重命名为 exported_<name>
+func (t *scrapeTarget) sampleLabels(labels []expfmt.Label) LabelSet {
+	ls := make(LabelSet, 0, len(labels)+len(t.labels))
+	for _, label := range labels {
+		name := label.Name
+		if t.labels.Has(name) {
+			name = exportedLabelPrefix + name
+		}
+		ls = append(ls, Label{Name: name, Value: label.Value})
+	}
+
+	ls = append(ls, t.labels...)
+	sort.Stable(ls)
+	return ls
+}
+
+func (m *ScrapeManager) fetch(ctx context.Context, t *scrapeTarget) ([]expfmt.Sample, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", expfmt.AcceptHeader)
+	req.Header.Set("User-Agent", "mandodb")
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(t.timeout.Seconds(), 'f', -1, 64))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return expfmt.Parse(b, expfmt.FormatFromContentType(resp.Header.Get("Content-Type")))
+}
@@ -0,0 +1,166 @@
+package mandodb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScrapeConfig(t *testing.T) {
+	cfg, err := ParseScrapeConfig([]byte(`
+global:
+  scrape_interval: 15s
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["localhost:9100", "localhost:9101"]
+        labels: {env: prod}
+  - job_name: app
+    scrape_interval: 5s
+    metrics_path: /stats
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(cfg.ScrapeConfigs))
+
+	node := cfg.ScrapeConfigs[0]
+	assert.Equal(t, 15*time.Second, node.ScrapeInterval)
+	assert.Equal(t, 10*time.Second, node.ScrapeTimeout)
+	assert.Equal(t, "/metrics", node.MetricsPath)
+	assert.Equal(t, "http", node.Scheme)
+
+	// 超时时间默认不超过抓取间隔
+	assert.Equal(t, 5*time.Second, cfg.ScrapeConfigs[1].ScrapeTimeout)
+
+	for _, s := range []string{
+		"scrape_configs:\n  - static_configs: []\n",
+		"scrape_configs:\n  - job_name: a\n  - job_name: a\n",
+		"scrape_configs:\n  - job_name: a\n    scrape_interval: 1s\n    scrape_timeout: 2s\n",
+		"scrape_configs:\n  - job_name: a\n    scheme: ftp\n",
+		"scrape_configs:\n  - job_name: a\n    static_configs:\n      - targets: [localhost]\n",
+		"scrape_configs:\n  - job_name: a\n    unknown: 1\n",
+	} {
+		_, err := ParseScrapeConfig([]byte(s))
+		assert.Error(t, err, s)
+	}
+}
+
+func newTestScrapeManager(t *testing.T, store *TSDB, interval string, targets ...string) *ScrapeManager {
+	cfg, err := ParseScrapeConfig([]byte(fmt.Sprintf(`
+scrape_configs:
+  - job_name: test
+    scrape_interval: %s
+    static_configs:
+      - targets: ["%s"]
+        labels: {env: prod}
+`, interval, strings.Join(targets, `", "`))))
+	assert.NoError(t, err)
+
+	return store.NewScrapeManager(cfg)
+}
+
+func TestScrapeManager_Scrape(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true), WithTimestampPrecision(PrecisionMillisecond))
+	defer store.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/metrics", r.URL.Path)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintln(w, "# TYPE http_requests_total counter")
+		fmt.Fprintln(w, `http_requests_total{code="200",job="exporter"} 10`)
+		fmt.Fprintln(w, `http_requests_total{code="500"} 1 1600000000000`)
+	}))
+	defer srv.Close()
+
+	instance := strings.TrimPrefix(srv.URL, "http://")
+	m := newTestScrapeManager(t, store, "1s", instance)
+	assert.Equal(t, 1, len(m.targets))
+
+	now := time.Unix(1600000015, 0)
+	rows := m.scrape(context.Background(), m.targets[0], now)
+	assert.Equal(t, 5, len(rows))
+
+	assert.Equal(t, "http_requests_total", rows[0].Metric)
+	assert.Equal(t, LabelSet{
+		{Name: "code", Value: "200"},
+		{Name: "env", Value: "prod"},
+		{Name: "exported_job", Value: "exporter"},
+		{Name: "instance", Value: instance},
+		{Name: "job", Value: "test"},
+	}, rows[0].Labels)
+	assert.Equal(t, Point{Ts: 1600000015000, Value: 10}, rows[0].Point)
+	assert.Equal(t, Point{Ts: 1600000000000, Value: 1}, rows[1].Point)
+
+	assert.Equal(t, "up", rows[2].Metric)
+	assert.Equal(t, float64(1), rows[2].Point.Value)
+	assert.Equal(t, "scrape_duration_seconds", rows[3].Metric)
+	assert.Equal(t, "scrape_samples_scraped", rows[4].Metric)
+	assert.Equal(t, float64(2), rows[4].Point.Value)
+}
+
+func TestScrapeManager_ScrapeFailed(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true))
+	defer store.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("broken") != "" {
+			fmt.Fprintln(w, "broken")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	m := newTestScrapeManager(t, store, "1s", strings.TrimPrefix(srv.URL, "http://"))
+	target := m.targets[0]
+
+	for _, url := range []string{target.url, target.url + "?broken=1"} {
+		target.url = url
+		rows := m.scrape(context.Background(), target, time.Now())
+		assert.Equal(t, 3, len(rows))
+		assert.Equal(t, "up", rows[0].Metric)
+		assert.Equal(t, float64(0), rows[0].Point.Value)
+	}
+}
+
+func TestScrapeManager_Run(t *testing.T) {
+	store := OpenTSDB(WithOnlyMemoryMode(true))
+	defer store.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0")
+		fmt.Fprintln(w, "node_load1 0.5")
+		fmt.Fprintln(w, "# EOF")
+	}))
+	defer srv.Close()
+
+	m := newTestScrapeManager(t, store, "50ms", strings.TrimPrefix(srv.URL, "http://"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+
+	start := time.Now().Unix()
+	var ret []MetricRet
+	for i := 0; i < 100 && len(ret) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+		ret, _ = store.QueryRange("up", nil, start-1, start+60)
+	}
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, float64(1), ret[0].Points[0].Value)
+
+	ret, err := store.QueryRange("node_load1", LabelMatcherSet{{Name: "job", Value: "test"}}, start-1, start+60)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+
+	cancel()
+	<-done
+}
@@ -1,10 +1,10 @@
 package mandodb
 
 import (
+	"math"
 	"os"
+	"sort"
 	"sync"
-
-	"github.com/chenjiandongx/mandodb/pkg/sortedlist"
 )
 
 type SegmentType string
@@ -15,17 +15,20 @@ const (
 )
 
 type Segment interface {
-	InsertRows(row []*Row)
-	QueryRange(lms LabelMatcherSet, start, end int64) ([]MetricRet, error)
+	InsertRows(rows []*Row) InsertResult
+	Select(lms LabelMatcherSet, start, end int64) SeriesSet
 	QuerySeries(lms LabelMatcherSet) ([]LabelSet, error)
-	QueryLabelValues(label string) []string
+	QueryLabelNames(lms LabelMatcherSet) ([]string, error)
+	QueryLabelValues(label string, lms LabelMatcherSet) ([]string, error)
+	DeleteSeries(lms LabelMatcherSet, start, end int64) error
 	MinTs() int64
 	MaxTs() int64
+	Seq() int64
 	Frozen() bool
 	Close() error
 	Cleanup() error
 	Type() SegmentType
-	Load() Segment
+	Load() (Segment, error)
 }
 
 type Desc struct {
@@ -33,33 +36,57 @@ type Desc struct {
 	DataPointsCount int64 `json:"dataPointsCount"`
 	MaxTs           int64 `json:"maxTs"`
 	MinTs           int64 `json:"minTs"`
+	WalSeq          int   `json:"walSeq"`
+
+	// Seq 写入顺序 越大表示数据越新 时间区间重叠的 segment 中时间戳相同的数据点以 Seq 大的为准
+	// 旧版本写入的 segment 没有该字段 视为 0
+	Seq int64 `json:"seq,omitempty"`
+
+	// Parents 记录 compaction 合并前的 segment 文件夹名称
+	Parents []string `json:"parents,omitempty"`
 }
 
+// segmentList 除了 head 以外的 segment 按 MinTs 排序
+// 乱序写入的 segment 时间区间会与其他 segment 重叠 MinTs 也可能相同 所以不能以 MinTs 作为 key
 type segmentList struct {
 	mut  sync.Mutex
 	head Segment
-	lst  sortedlist.List
+	segs []Segment
+
+	// ooo 接收落在已经持久化的时间区间内的数据点 与 head 一起持久化 为空时表示还没有数据
+	ooo Segment
+
+	// maxTs 已经停止写入的 segment 的最大时间戳 不大于该值的数据点会写入 ooo
+	maxTs int64
 }
 
-func newSegmentList() *segmentList {
-	return &segmentList{head: newMemorySegment(), lst: sortedlist.NewTree()}
+func newSegmentList(opts *tsdbOptions) *segmentList {
+	return &segmentList{head: newMemorySegment(opts), maxTs: math.MinInt64}
 }
 
+// Get 返回时间区间与 [start, end] 存在交集的 segment 按 Seq 排序 依次是 ooo 和 head
+// 返回的磁盘 segment 会增加引用计数 使用完毕后需要调用 Release 否则 segment 无法被关闭
 func (sl *segmentList) Get(start, end int64) []Segment {
 	sl.mut.Lock()
 	defer sl.mut.Unlock()
 
 	segs := make([]Segment, 0)
-
-	iter := sl.lst.All()
-
-	for iter.Next() {
-		seg := iter.Value().(Segment)
+	for _, seg := range sl.segs {
 		if sl.Choose(seg, start, end) {
+			acquire(seg)
 			segs = append(segs, seg)
 		}
 	}
 
+	// 查询时时间戳相同的数据点以靠后的 segment 为准
+	sort.SliceStable(segs, func(i, j int) bool {
+		return segs[i].Seq() < segs[j].Seq()
+	})
+
+	if sl.ooo != nil && sl.Choose(sl.ooo, start, end) {
+		segs = append(segs, sl.ooo)
+	}
+
 	// 头部永远是最新的 所以放最后
 	if sl.Choose(sl.head, start, end) {
 		segs = append(segs, sl.head)
@@ -68,59 +95,149 @@ func (sl *segmentList) Get(start, end int64) []Segment {
 	return segs
 }
 
-func (sl *segmentList) Choose(seg Segment, start, end int64) bool {
-	if seg.MinTs() < start && seg.MaxTs() > start {
-		return true
+// Release 释放 Get 返回的 segment 引用
+func (sl *segmentList) Release(segs []Segment) {
+	for _, seg := range segs {
+		release(seg)
 	}
+}
 
-	if seg.MinTs() > start && seg.MaxTs() < end {
-		return true
-	}
+// All 返回除 head 以及 ooo 以外的所有 segment 快照 不增加引用计数
+func (sl *segmentList) All() []Segment {
+	sl.mut.Lock()
+	defer sl.mut.Unlock()
+
+	segs := make([]Segment, len(sl.segs))
+	copy(segs, sl.segs)
+	return segs
+}
+
+func (sl *segmentList) Choose(seg Segment, start, end int64) bool {
+	// 时间区间存在交集即可
+	return seg.MinTs() <= end && seg.MaxTs() >= start
+}
+
+// MaxTs 返回已经停止写入的 segment 的最大时间戳 没有时返回 math.MinInt64
+func (sl *segmentList) MaxTs() int64 {
+	sl.mut.Lock()
+	defer sl.mut.Unlock()
+
+	return sl.maxTs
+}
 
-	if seg.MinTs() < end && seg.MaxTs() > end {
-		return true
+// OutOfOrder 返回 ooo 不存在时使用 newSegment 创建
+func (sl *segmentList) OutOfOrder(newSegment func() Segment) Segment {
+	sl.mut.Lock()
+	defer sl.mut.Unlock()
+
+	if sl.ooo == nil {
+		sl.ooo = newSegment()
 	}
+	return sl.ooo
+}
 
-	return false
+// PendingOutOfOrder 返回当前的 ooo 不存在时返回 nil
+func (sl *segmentList) PendingOutOfOrder() Segment {
+	sl.mut.Lock()
+	defer sl.mut.Unlock()
+
+	return sl.ooo
 }
 
-func (sl *segmentList) Add(segment Segment) {
+// TakeOutOfOrder 取出 ooo 之后的数据会写入新的 ooo
+func (sl *segmentList) TakeOutOfOrder() Segment {
 	sl.mut.Lock()
 	defer sl.mut.Unlock()
 
-	sl.lst.Add(segment.MinTs(), segment)
+	ooo := sl.ooo
+	sl.ooo = nil
+	return ooo
 }
 
-func (sl *segmentList) Remove(segment Segment) error {
+func (sl *segmentList) Add(segment Segment) {
 	sl.mut.Lock()
 	defer sl.mut.Unlock()
 
-	if err := segment.Close(); err != nil {
-		return err
+	sl.add(segment)
+}
+
+func (sl *segmentList) add(segment Segment) {
+	idx := sort.Search(len(sl.segs), func(i int) bool {
+		return sl.segs[i].MinTs() > segment.MinTs()
+	})
+
+	sl.segs = append(sl.segs, nil)
+	copy(sl.segs[idx+1:], sl.segs[idx:])
+	sl.segs[idx] = segment
+
+	if segment.MaxTs() > sl.maxTs {
+		sl.maxTs = segment.MaxTs()
 	}
+}
 
-	if err := segment.Cleanup(); err != nil {
-		return err
+func (sl *segmentList) remove(segment Segment) {
+	for i, seg := range sl.segs {
+		if seg == segment {
+			sl.segs = append(sl.segs[:i], sl.segs[i+1:]...)
+			return
+		}
 	}
+}
 
-	sl.lst.Remove(segment.MinTs())
-	return nil
+func (sl *segmentList) Remove(segment Segment) error {
+	sl.mut.Lock()
+	sl.remove(segment)
+	sl.mut.Unlock()
+
+	return drop(segment)
 }
 
 func (sl *segmentList) Replace(pre, nxt Segment) error {
+	return sl.Swap([]Segment{pre}, nxt)
+}
+
+// Swap 原子地使用 nxt 替换 pres 中的所有 segment 替换后正在进行的查询不受影响
+func (sl *segmentList) Swap(pres []Segment, nxt Segment) error {
 	sl.mut.Lock()
-	defer sl.mut.Unlock()
+	for _, pre := range pres {
+		sl.remove(pre)
+	}
+	sl.add(nxt)
+	sl.mut.Unlock()
 
-	if err := pre.Close(); err != nil {
-		return err
+	for _, pre := range pres {
+		if err := drop(pre); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func acquire(seg Segment) {
+	if ds, ok := seg.(*diskSegment); ok {
+		ds.wg.Add(1)
+	}
+}
+
+func release(seg Segment) {
+	if ds, ok := seg.(*diskSegment); ok {
+		ds.wg.Done()
+	}
+}
+
+// drop 关闭并清理已经从列表中移除的 segment
+// 内存 segment 的数据此时已经持久化 交给 GC 回收即可
+func drop(seg Segment) error {
+	if seg.Type() != DiskSegmentType {
+		return nil
 	}
 
-	if err := pre.Cleanup(); err != nil {
+	if err := seg.Close(); err != nil {
 		return err
 	}
 
-	sl.lst.Add(pre.MinTs(), nxt)
-	return nil
+	return seg.Cleanup()
 }
 
 const metricName = "__name__"
@@ -6,13 +6,12 @@ import (
 	"sync"
 	"sync/atomic"
 
-	"github.com/dgryski/go-tsz"
-
+	"github.com/chenjiandongx/mandodb/pkg/chunkenc"
 	"github.com/chenjiandongx/mandodb/pkg/sortedlist"
 )
 
 type tszStore struct {
-	block *tsz.Series
+	block *chunkenc.XORChunk
 	lock  sync.Mutex
 	maxTs int64
 	count int64
@@ -29,10 +28,10 @@ func (store *tszStore) Append(point *Point) *Point {
 
 	// 懒加载的方式初始化
 	if store.count <= 0 {
-		store.block = tsz.New(uint32(point.Ts))
+		store.block = chunkenc.NewXORChunk()
 	}
 
-	store.block.Push(uint32(point.Ts), point.Value)
+	store.block.Append(point.Ts, point.Value)
 	store.maxTs = point.Ts
 
 	store.count++
@@ -42,33 +41,88 @@ func (store *tszStore) Append(point *Point) *Point {
 func (store *tszStore) Get(start, end int64) []Point {
 	points := make([]Point, 0)
 
-	it := store.block.Iter()
+	it := store.Iterator(start, end)
 	for it.Next() {
-		ts, val := it.Values()
-		if ts > uint32(end) {
-			break
-		}
-
-		if ts >= uint32(start) {
-			points = append(points, Point{Ts: int64(ts), Value: val})
-		}
+		points = append(points, it.At())
 	}
 
 	return points
 }
 
+// Iterator 返回 [start, end] 范围内的数据点迭代器 迭代的是当前数据的快照
+func (store *tszStore) Iterator(start, end int64) SeriesIterator {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.block == nil {
+		return newListSeriesIterator(nil)
+	}
+
+	return &xorSeriesIterator{it: store.block.Iterator(), start: start, end: end}
+}
+
 func (store *tszStore) All() []Point {
 	return store.Get(math.MinInt64, math.MaxInt64)
 }
 
+func (store *tszStore) MaxTs() int64 {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.maxTs
+}
+
 func (store *tszStore) Count() int {
 	return int(atomic.LoadInt64(&store.count))
 }
 
+// Bytes 返回 chunk 数据 格式为 数据点数量(uint32) | XOR 数据流
 func (store *tszStore) Bytes() []byte {
-	return store.block.Bytes()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.block == nil {
+		return nil
+	}
+
+	encf := newEncbuf()
+	encf.MarshalUint32(uint32(store.block.NumSamples()))
+	return append(encf.Bytes(), store.block.Bytes()...)
 }
 
+// Delete 删除 [start, end] 范围内的数据点 返回被删除的数据点数量
+// XOR chunk 不支持原地删除 所以需要使用剩余的数据点重新编码 maxTs 更新为剩余数据点的最大时间戳
+func (store *tszStore) Delete(start, end int64) int {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.block == nil {
+		return 0
+	}
+
+	var maxTs int64 = math.MinInt64
+	block := chunkenc.NewXORChunk()
+	it := store.block.Iterator()
+	for it.Next() {
+		ts, val := it.At()
+		if ts < start || ts > end {
+			block.Append(ts, val)
+			maxTs = ts
+		}
+	}
+
+	removed := store.block.NumSamples() - block.NumSamples()
+	if removed == 0 {
+		return 0
+	}
+
+	store.block = block
+	store.maxTs = maxTs
+	atomic.StoreInt64(&store.count, int64(block.NumSamples()))
+	return removed
+}
+
+// MergeOutdatedList 合并 chunk 以及乱序写入的数据点 时间戳相同时以 lst 中的数据点为准
 func (store *tszStore) MergeOutdatedList(lst sortedlist.List) *tszStore {
 	if lst == nil {
 		return store
@@ -82,11 +136,14 @@ func (store *tszStore) MergeOutdatedList(lst sortedlist.List) *tszStore {
 		tmp = append(tmp, Point{Ts: dp.Ts, Value: dp.Value})
 	}
 
-	sort.Slice(tmp, func(i, j int) bool {
+	sort.SliceStable(tmp, func(i, j int) bool {
 		return tmp[i].Ts < tmp[j].Ts
 	})
 
 	for i := 0; i < len(tmp); i++ {
+		if i+1 < len(tmp) && tmp[i+1].Ts == tmp[i].Ts {
+			continue
+		}
 		news.Append(&tmp[i])
 	}
 
@@ -94,10 +151,12 @@ func (store *tszStore) MergeOutdatedList(lst sortedlist.List) *tszStore {
 }
 
 type memorySeries struct {
+	ref    uint32
+	hash   uint64
 	labels LabelSet
 	*tszStore
 }
 
-func newSeries(row *Row) *memorySeries {
-	return &memorySeries{labels: row.Labels, tszStore: &tszStore{}}
+func newSeries(row *Row, ref uint32, hash uint64) *memorySeries {
+	return &memorySeries{ref: ref, hash: hash, labels: row.Labels, tszStore: &tszStore{}}
 }
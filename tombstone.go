@@ -0,0 +1,162 @@
+package mandodb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// tombstones 记录 diskSegment 中已经被删除的数据区间 查询时会过滤掉这些数据点
+// 磁盘上以 JSON 的形式保存在 segment 文件夹下的 tombstones 文件中 在下一次 compaction 时数据才会被真正删除
+//
+// [{"sid": 0, "intervals": [{"start": 1600000000, "end": 1600000600}]}]
+
+const tombstonesFilename = "tombstones"
+
+// interval 表示闭区间 [Start, End]
+type interval struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type intervals []interval
+
+// add 添加一个区间 重叠或者相邻的区间会被合并
+func (ivs intervals) add(n interval) intervals {
+	ret := make(intervals, 0, len(ivs)+1)
+	for _, iv := range ivs {
+		if iv.End+1 < n.Start || n.End+1 < iv.Start {
+			ret = append(ret, iv)
+			continue
+		}
+
+		if iv.Start < n.Start {
+			n.Start = iv.Start
+		}
+		if iv.End > n.End {
+			n.End = iv.End
+		}
+	}
+
+	ret = append(ret, n)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Start < ret[j].Start
+	})
+
+	return ret
+}
+
+// contains 判断 ts 是否落在某个区间内
+func (ivs intervals) contains(ts int64) bool {
+	for _, iv := range ivs {
+		if iv.Start <= ts && ts <= iv.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+// covers 判断 [start, end] 是否被某个区间完全覆盖
+func (ivs intervals) covers(start, end int64) bool {
+	for _, iv := range ivs {
+		if iv.Start <= start && end <= iv.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filter 返回不在任何区间内的数据点
+func (ivs intervals) filter(points []Point) []Point {
+	if len(ivs) == 0 {
+		return points
+	}
+
+	ret := points[:0]
+	for _, p := range points {
+		if !ivs.contains(p.Ts) {
+			ret = append(ret, p)
+		}
+	}
+
+	return ret
+}
+
+type tombstoneEntry struct {
+	Sid       uint32    `json:"sid"`
+	Intervals intervals `json:"intervals"`
+}
+
+func readTombstones(dir string) (map[uint32]intervals, error) {
+	ret := make(map[uint32]intervals)
+
+	f := path.Join(dir, tombstonesFilename)
+	if !isFileExist(f) {
+		return ret, nil
+	}
+
+	bs, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []tombstoneEntry
+	if err := json.Unmarshal(bs, &entries); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		ret[entry.Sid] = entry.Intervals
+	}
+
+	return ret, nil
+}
+
+// writeTombstones 先写入临时文件 fsync 后再原子地 rename 成 tombstones 文件
+func writeTombstones(dir string, tombstones map[uint32]intervals) error {
+	entries := make([]tombstoneEntry, 0, len(tombstones))
+	for sid, ivs := range tombstones {
+		entries = append(entries, tombstoneEntry{Sid: sid, Intervals: ivs})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Sid < entries[j].Sid
+	})
+
+	bs, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	f := path.Join(dir, tombstonesFilename)
+	tmp := f + tmpSegmentSuffix
+
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fd.Write(bs); err != nil {
+		fd.Close()
+		return err
+	}
+
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+
+	if err := fd.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, f); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
@@ -13,6 +14,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cespare/xxhash"
@@ -22,41 +24,67 @@ import (
 )
 
 type tsdbOptions struct {
-	metaSerializer    MetaSerializer
-	bytesCompressor   BytesCompressor
-	retention         time.Duration
-	segmentDuration   time.Duration
-	writeTimeout      time.Duration
-	onlyMemoryMode    bool
-	enableOutdated    bool
-	maxRowsPerSegment int64
-	dataPath          string
-	loggerConfig      *logger.Options
-}
-
-var globalOpts = &tsdbOptions{
-	metaSerializer:    newBinaryMetaSerializer(),
-	bytesCompressor:   newNoopBytesCompressor(),
-	segmentDuration:   2 * time.Hour,
-	retention:         7 * 24 * time.Hour, // 7d
-	writeTimeout:      30 * time.Second,
-	onlyMemoryMode:    false,
-	enableOutdated:    true,
-	maxRowsPerSegment: 19960412,
-	dataPath:          ".",
-	loggerConfig:      nil,
+	metaSerializerType  MetaSerializerType
+	metaSerializer      MetaSerializer
+	bytesCompressorType BytesCompressorType
+	bytesCompressor     BytesCompressor
+	retention           time.Duration
+	precision           TimestampPrecision
+	segmentDuration     time.Duration
+	writeTimeout        time.Duration
+	onlyMemoryMode      bool
+	enableOutdated      bool
+	outOfOrderWindow    time.Duration
+	duplicatePolicy     DuplicatePolicy
+	enableWAL           bool
+	maxRowsPerSegment   int64
+	dataPath            string
+	compactionLevels    []time.Duration
+	maxDiskBytes        int64
+	maxQuerySeries      int64
+	maxQuerySamples     int64
+	maxRequestBodySize  int64
+	maxLineSize         int64
+	loggerConfig        *logger.Options
+}
+
+func newDefaultOptions() *tsdbOptions {
+	return &tsdbOptions{
+		metaSerializerType:  BinaryMetaSerializer,
+		metaSerializer:      newBinaryMetaSerializer(),
+		bytesCompressorType: NoopBytesCompressor,
+		bytesCompressor:     newNoopBytesCompressor(),
+		segmentDuration:     2 * time.Hour,
+		retention:           7 * 24 * time.Hour, // 7d
+		precision:           PrecisionSecond,
+		writeTimeout:        30 * time.Second,
+		onlyMemoryMode:      false,
+		enableOutdated:      true,
+		duplicatePolicy:     DuplicateLastWriteWins,
+		enableWAL:           true,
+		maxRowsPerSegment:   19960412,
+		dataPath:            ".",
+		compactionLevels:    []time.Duration{12 * time.Hour, 48 * time.Hour},
+		maxRequestBodySize:  32 * 1024 * 1024, // 32MB
+		maxLineSize:         64 * 1024,        // 64KB
+		loggerConfig:        nil,
+	}
 }
 
 type Option func(c *tsdbOptions)
 
 // WithMetaSerializerType 设置 Metadata 数据的序列化类型
 // 目前只提供了 BinaryMetaSerializer
+// version 3 开始 Segment 不再写入 Metadata 仅用于读取旧版本的 Segment
 func WithMetaSerializerType(t MetaSerializerType) Option {
 	return func(c *tsdbOptions) {
-		switch t {
-		default: // binary
-			c.metaSerializer = newBinaryMetaSerializer()
+		serializer, err := newMetaSerializer(t)
+		if err != nil { // binary
+			t, serializer = BinaryMetaSerializer, newBinaryMetaSerializer()
 		}
+
+		c.metaSerializerType = t
+		c.metaSerializer = serializer
 	}
 }
 
@@ -65,16 +93,16 @@ func WithMetaSerializerType(t MetaSerializerType) Option {
 // * 不压缩: NoopBytesCompressor（默认）
 // * ZSTD: ZstdBytesCompressor
 // * Snappy: SnappyBytesCompressor
+// 每个 Segment 都会记录写入时所使用的压缩算法 所以切换算法后旧数据仍然可读
 func WithMetaBytesCompressorType(t BytesCompressorType) Option {
 	return func(c *tsdbOptions) {
-		switch t {
-		case ZstdBytesCompressor:
-			c.bytesCompressor = newZstdBytesCompressor()
-		case SnappyBytesCompressor:
-			c.bytesCompressor = newSnappyBytesCompressor()
-		default: // noop
-			c.bytesCompressor = newNoopBytesCompressor()
+		compressor, err := newBytesCompressor(t)
+		if err != nil { // noop
+			t, compressor = NoopBytesCompressor, newNoopBytesCompressor()
 		}
+
+		c.bytesCompressorType = t
+		c.bytesCompressor = compressor
 	}
 }
 
@@ -87,6 +115,7 @@ func WithOnlyMemoryMode(memoryMode bool) Option {
 }
 
 // WithEnabledOutdated 设置是否支持乱序写入 此特性会增加资源开销 但会提升数据完整性
+// 关闭时时间戳不大于 series 最新时间戳的数据点 以及落在已经持久化的时间区间内的数据点都会被拒绝写入
 // 默认为 true
 func WithEnabledOutdated(outdated bool) Option {
 	return func(c *tsdbOptions) {
@@ -94,6 +123,44 @@ func WithEnabledOutdated(outdated bool) Option {
 	}
 }
 
+// WithOutOfOrderWindow 设置乱序写入的时间窗口 早于已写入的最新时间戳 d 以上的数据点会被拒绝写入
+// 默认为 0 表示不限制
+func WithOutOfOrderWindow(d time.Duration) Option {
+	return func(c *tsdbOptions) {
+		c.outOfOrderWindow = d
+	}
+}
+
+// DuplicatePolicy 同一个 series 写入时间戳相同的数据点时的处理策略
+type DuplicatePolicy int8
+
+const (
+	// DuplicateLastWriteWins 保留最后写入的数据点
+	DuplicateLastWriteWins DuplicatePolicy = iota
+
+	// DuplicateFirstWriteWins 保留最先写入的数据点 之后写入的数据点会被忽略
+	DuplicateFirstWriteWins
+
+	// DuplicateReject 拒绝写入 InsertRowsSync 会返回 RejectDuplicate
+	DuplicateReject
+)
+
+// WithDuplicatePolicy 设置时间戳重复的数据点的处理策略
+// 默认为 DuplicateLastWriteWins
+func WithDuplicatePolicy(p DuplicatePolicy) Option {
+	return func(c *tsdbOptions) {
+		c.duplicatePolicy = p
+	}
+}
+
+// WithEnabledWAL 设置是否开启 WAL 开启后进程异常退出时 head 中的数据可以通过 WAL 恢复
+// 默认为 true（OnlyMemoryMode 下不生效）
+func WithEnabledWAL(enabled bool) Option {
+	return func(c *tsdbOptions) {
+		c.enableWAL = enabled
+	}
+}
+
 // WithMaxRowsPerSegment 设置单 Segment 最大允许存储的点数
 // 默认为 19960412（夹杂私货 🐶）
 func WithMaxRowsPerSegment(n int64) Option {
@@ -118,6 +185,62 @@ func WithRetention(t time.Duration) Option {
 	}
 }
 
+// WithTimestampPrecision 设置写入数据点的时间戳精度 Segment 时间跨度、数据保留时长等均以此为单位计算
+// 默认为 PrecisionSecond
+func WithTimestampPrecision(p TimestampPrecision) Option {
+	return func(c *tsdbOptions) {
+		c.precision = p
+	}
+}
+
+// WithCompactionLevels 设置 Segment 合并的时间跨度 相邻的 Segment 会被逐级合并成更大的 Segment
+// 默认为 12h, 48h 不设置任何层级时则关闭合并 但存在 tombstones 的 Segment 仍然会被重写
+func WithCompactionLevels(levels ...time.Duration) Option {
+	return func(c *tsdbOptions) {
+		c.compactionLevels = levels
+	}
+}
+
+// WithMaxDiskBytes 设置持久化数据最多允许占用的磁盘空间 超出后会从最旧的 Segment 开始删除
+// 默认为 0 即不限制
+func WithMaxDiskBytes(n int64) Option {
+	return func(c *tsdbOptions) {
+		c.maxDiskBytes = n
+	}
+}
+
+// WithMaxQuerySeries 设置单次查询最多允许涉及的 series 数量 超出后查询返回 ErrTooManySeries
+// 默认为 0 即不限制
+func WithMaxQuerySeries(n int64) Option {
+	return func(c *tsdbOptions) {
+		c.maxQuerySeries = n
+	}
+}
+
+// WithMaxQuerySamples 设置单次查询最多允许读取的数据点数量 超出后查询返回 ErrTooManySamples
+// 默认为 0 即不限制
+func WithMaxQuerySamples(n int64) Option {
+	return func(c *tsdbOptions) {
+		c.maxQuerySamples = n
+	}
+}
+
+// WithMaxRequestBodySize 设置 HTTP 请求体(解压后)允许的最大字节数 超出后返回 413
+// 默认为 32MB 0 表示不限制
+func WithMaxRequestBodySize(n int64) Option {
+	return func(c *tsdbOptions) {
+		c.maxRequestBodySize = n
+	}
+}
+
+// WithMaxLineSize 设置 Graphite/OpenTSDB TCP 监听器单行数据允许的最大字节数 超出后回复错误并关闭连接
+// 默认为 64KB 0 表示不限制
+func WithMaxLineSize(n int64) Option {
+	return func(c *tsdbOptions) {
+		c.maxLineSize = n
+	}
+}
+
 // WithWriteTimeout 设置写入超时阈值
 // 默认为 30s
 func WithWriteTimeout(t time.Duration) Option {
@@ -141,7 +264,60 @@ const (
 	defaultQSize = 128
 )
 
-// Point 表示一个数据点 (ts, value) 二元组
+// TimestampPrecision 时间戳精度
+type TimestampPrecision uint8
+
+const (
+	PrecisionSecond TimestampPrecision = iota
+	PrecisionMillisecond
+	PrecisionNanosecond
+)
+
+// Duration 将 d 转换为当前精度下的时间跨度
+func (p TimestampPrecision) Duration(d time.Duration) int64 {
+	switch p {
+	case PrecisionMillisecond:
+		return int64(d / time.Millisecond)
+	case PrecisionNanosecond:
+		return int64(d)
+	}
+	return int64(d / time.Second)
+}
+
+// Timestamp 将 t 转换为当前精度下的时间戳
+func (p TimestampPrecision) Timestamp(t time.Time) int64 {
+	switch p {
+	case PrecisionMillisecond:
+		return t.UnixNano() / int64(time.Millisecond)
+	case PrecisionNanosecond:
+		return t.UnixNano()
+	}
+	return t.Unix()
+}
+
+// FromMilliseconds 将毫秒时间戳转换为当前精度下的时间戳
+func (p TimestampPrecision) FromMilliseconds(ms int64) int64 {
+	switch p {
+	case PrecisionMillisecond:
+		return ms
+	case PrecisionNanosecond:
+		return ms * int64(time.Millisecond)
+	}
+	return ms / 1000
+}
+
+// ToMilliseconds 将当前精度下的时间戳转换为毫秒时间戳
+func (p TimestampPrecision) ToMilliseconds(ts int64) int64 {
+	switch p {
+	case PrecisionMillisecond:
+		return ts
+	case PrecisionNanosecond:
+		return ts / int64(time.Millisecond)
+	}
+	return ts * 1000
+}
+
+// Point 表示一个数据点 (ts, value) 二元组 Ts 的单位由 WithTimestampPrecision 决定
 type Point struct {
 	Ts    int64
 	Value float64
@@ -151,8 +327,8 @@ func joinSeparator(a, b interface{}) string {
 	return fmt.Sprintf("%v%s%v", a, separator, b)
 }
 
-func dirname(a, b int64) string {
-	return path.Join(globalOpts.dataPath, fmt.Sprintf("seg-%d-%d", a, b))
+func dirname(dataPath string, a, b int64) string {
+	return path.Join(dataPath, fmt.Sprintf("seg-%d-%d", a, b))
 }
 
 // Row 一行时序数据 包括数据点和标签组合
@@ -162,20 +338,96 @@ type Row struct {
 	Point  Point
 }
 
+// RejectReason Row 被拒绝写入的原因
+type RejectReason string
+
+const (
+	RejectEmptyMetric RejectReason = "empty metric name"
+	RejectOutOfOrder  RejectReason = "out of order sample"
+	RejectOutOfWindow RejectReason = "sample is older than out of order window"
+	RejectDuplicate   RejectReason = "duplicate sample timestamp"
+	RejectOversized   RejectReason = "metric, label or label count exceeds 65535"
+)
+
+// maxRowFieldSize WAL 以及 segment 元数据中 metric、label 名称和值的长度以及 label 数量都使用 uint16 编码
+const maxRowFieldSize = math.MaxUint16
+
+// oversized 判断 row 是否超出 maxRowFieldSize 的限制 超出限制的 row 编码后会被截断
+func (r *Row) oversized() bool {
+	// 写入时会追加 metricName
+	if len(r.Metric) > maxRowFieldSize || len(r.Labels)+1 > maxRowFieldSize {
+		return true
+	}
+
+	for _, label := range r.Labels {
+		if len(label.Name) > maxRowFieldSize || len(label.Value) > maxRowFieldSize {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RejectedRow 被拒绝写入的 Row Index 为其在写入的 rows 中的下标
+type RejectedRow struct {
+	Index  int
+	Row    *Row
+	Reason RejectReason
+}
+
+// InsertResult InsertRowsSync 的写入结果
+// Ignored 为 DuplicateFirstWriteWins 下被忽略的重复数据点数量 不计入 Inserted 也不计入 Rejected
+type InsertResult struct {
+	Inserted int
+	Ignored  int
+	Rejected []RejectedRow
+}
+
 // ID 使用 hash 计算 Series 的唯一标识
 func (r Row) ID() string {
 	return joinSeparator(xxhash.Sum64([]byte(r.Metric)), r.Labels.Hash())
 }
 
 type TSDB struct {
+	opts *tsdbOptions
 	segs *segmentList
 	mut  sync.Mutex
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	q  chan []*Row
+	q  chan *writeBatch
 	wg sync.WaitGroup
+
+	// ingestWg 等待写入协程退出 Close 需要在所有写入完成后才能持久化 head
+	ingestWg sync.WaitGroup
+
+	// closeMut 保护 closed 以及向 q 发送数据 Close 持有写锁关闭 q 之后不会再有新的 batch 进入 q
+	closeMut sync.RWMutex
+	closed   bool
+
+	// writeMut 写入 head 以及 ooo 期间持有读锁 持久化前获取写锁以等待已经拿到旧 head 的写入完成
+	writeMut sync.RWMutex
+
+	// walPending 正在持久化的 segment 对应的 WAL 序号 walFlushed 已经持久化但还不能删除的 WAL 序号
+	// 持久化的完成顺序不确定 WAL 只能删除到最小的未持久化序号之前
+	walMut     sync.Mutex
+	walPending []int
+	walFlushed []int
+
+	// flushed 有新的 segment 持久化完成时通知检查磁盘空间
+	flushed chan struct{}
+
+	wal *wal
+
+	// maxTs 已经写入的最大时间戳 用于计算乱序写入的时间窗口
+	maxTs int64
+
+	// seq 最近一次分配的 segment 写入顺序 见 Desc.Seq
+	seq int64
+
+	// compactMut 保证 compaction 和过期清理等删除 segment 的操作串行执行
+	compactMut sync.Mutex
 }
 
 var timerPool sync.Pool
@@ -202,143 +454,536 @@ func putTimer(t *time.Timer) {
 	timerPool.Put(t)
 }
 
+var (
+	// ErrWriteOverloaded 写入队列在 WriteTimeout 内一直处于满载状态
+	ErrWriteOverloaded = errors.New("failed to insert rows to database, write overloaded")
+
+	// ErrClosed TSDB 已经关闭
+	ErrClosed = errors.New("database is closed")
+)
+
+// writeBatch 写入队列中的一批数据 done 不为空时表示调用方在等待写入结果
+type writeBatch struct {
+	rows   []*Row
+	result InsertResult
+	err    error
+	done   chan struct{}
+}
+
+// InsertRows 将 rows 放入写入队列后立即返回 被拒绝写入的 rows 只会记录日志
+// 返回 nil 的 rows 在 Close 之前一定会被写入 TSDB 关闭后返回 ErrClosed
 func (tsdb *TSDB) InsertRows(rows []*Row) error {
-	timer := getTimer(globalOpts.writeTimeout)
+	return tsdb.enqueue(context.Background(), &writeBatch{rows: rows})
+}
+
+// enqueue 将 batch 放入写入队列 队列在 WriteTimeout 内一直满载时返回 ErrWriteOverloaded
+func (tsdb *TSDB) enqueue(ctx context.Context, batch *writeBatch) error {
+	tsdb.closeMut.RLock()
+	defer tsdb.closeMut.RUnlock()
+
+	if tsdb.closed {
+		return ErrClosed
+	}
+
+	timer := getTimer(tsdb.opts.writeTimeout)
+	defer putTimer(timer)
+
 	select {
-	case tsdb.q <- rows:
-		putTimer(timer)
+	case tsdb.q <- batch:
+		return nil
 	case <-timer.C:
-		putTimer(timer)
-		return errors.New("failed to insert rows to database, write overloaded")
+		return ErrWriteOverloaded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// InsertRowsSync 等待 rows 写入 head 并且 WAL 刷盘后返回 结果中包含被拒绝写入的 rows 以及原因
+// TSDB 关闭后返回 ErrClosed ctx 结束时返回 ctx.Err() 此时 rows 可能已经写入也可能没有写入
+func (tsdb *TSDB) InsertRowsSync(ctx context.Context, rows []*Row) (*InsertResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return &InsertResult{}, nil
 	}
 
-	return nil
+	batch := &writeBatch{rows: rows, done: make(chan struct{})}
+	if err := tsdb.enqueue(ctx, batch); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-tsdb.ctx.Done():
+		return nil, ErrClosed
+	}
+
+	if batch.err != nil {
+		return nil, batch.err
+	}
+	return &batch.result, nil
 }
 
 func (tsdb *TSDB) ingestRows(ctx context.Context) {
+	defer tsdb.ingestWg.Done()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 
-		case rs := <-tsdb.q:
-			head, err := tsdb.getHeadPartition()
-			if err != nil {
-				logger.Errorf("failed to get head partition: %v", head)
+		case batch, ok := <-tsdb.q:
+			if !ok {
+				return
+			}
+
+			batch.result, batch.err = tsdb.applyRows(batch.rows, batch.done != nil)
+			if batch.done != nil {
+				close(batch.done)
+				continue
+			}
+
+			if batch.err != nil {
+				logger.Errorf("failed to insert rows: %v", batch.err)
 				continue
 			}
-			head.InsertRows(rs)
+
+			if rejected := batch.result.Rejected; len(rejected) > 0 {
+				logger.Warnf("rejected %d rows, first: %s %s: %s",
+					len(rejected), rejected[0].Row.Metric, rejected[0].Row.Labels, rejected[0].Reason)
+			}
 		}
 	}
 }
 
-func (tsdb *TSDB) getHeadPartition() (Segment, error) {
+// applyRows 将 rows 写入 head 以及 ooo sync 为 true 时会在返回前将 WAL 刷盘
+// 超出编码长度限制的 rows 在写入 WAL 之前就会被拒绝
+func (tsdb *TSDB) applyRows(rows []*Row, sync bool) (InsertResult, error) {
+	var oversized []RejectedRow
+	accepted, idx := make([]*Row, 0, len(rows)), make([]int, 0, len(rows))
+	for i, row := range rows {
+		if row.oversized() {
+			oversized = append(oversized, RejectedRow{Index: i, Row: row, Reason: RejectOversized})
+			continue
+		}
+		accepted = append(accepted, row)
+		idx = append(idx, i)
+	}
+
+	if len(accepted) == 0 {
+		return InsertResult{Rejected: oversized}, nil
+	}
+
+	head, err := tsdb.getHeadPartition(accepted)
+	if err != nil {
+		return InsertResult{}, fmt.Errorf("failed to get head partition: %w", err)
+	}
+
+	result := tsdb.insertRows(head, accepted)
+	tsdb.writeMut.RUnlock()
+
+	if len(oversized) > 0 {
+		for i := range result.Rejected {
+			result.Rejected[i].Index = idx[result.Rejected[i].Index]
+		}
+		result.Rejected = append(result.Rejected, oversized...)
+		sort.Slice(result.Rejected, func(i, j int) bool {
+			return result.Rejected[i].Index < result.Rejected[j].Index
+		})
+	}
+
+	if sync && tsdb.wal != nil {
+		if err := tsdb.wal.Sync(); err != nil {
+			return result, fmt.Errorf("failed to sync wal: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// insertRows 早于乱序时间窗口的数据点会被拒绝
+// 落在已经停止写入的 segment 时间区间内的数据点写入 ooo 避免 head 的时间区间被拉大 其余的数据点写入 head
+func (tsdb *TSDB) insertRows(head Segment, rows []*Row) InsertResult {
+	boundary := tsdb.segs.MaxTs()
+	window := tsdb.opts.precision.Duration(tsdb.opts.outOfOrderWindow)
+
+	// ooo 自身可以判断重复 但已经持久化的数据点需要查询才能知道
+	var existing map[string]map[int64]float64
+	if tsdb.opts.enableOutdated && tsdb.opts.duplicatePolicy != DuplicateLastWriteWins {
+		existing = tsdb.existingSamples(rows, boundary)
+	}
+
+	var result InsertResult
+	reject := func(idx int, row *Row, reason RejectReason) {
+		result.Rejected = append(result.Rejected, RejectedRow{Index: idx, Row: row, Reason: reason})
+	}
+
+	maxTs := atomic.LoadInt64(&tsdb.maxTs)
+	headRows, headIdx := make([]*Row, 0, len(rows)), make([]int, 0, len(rows))
+	var oooRows []*Row
+	var oooIdx []int
+
+	for i, row := range rows {
+		ts := row.Point.Ts
+		switch {
+		case row.Metric == "":
+			reject(i, row, RejectEmptyMetric)
+
+		case window > 0 && maxTs != math.MinInt64 && ts < maxTs-window:
+			reject(i, row, RejectOutOfWindow)
+
+		case ts <= boundary && !tsdb.opts.enableOutdated:
+			reject(i, row, RejectOutOfOrder)
+
+		case ts <= boundary:
+			if _, ok := existing[rowLabels(row).String()][ts]; ok {
+				if tsdb.opts.duplicatePolicy == DuplicateReject {
+					reject(i, row, RejectDuplicate)
+				} else {
+					result.Ignored++
+				}
+				continue
+			}
+			oooRows = append(oooRows, row)
+			oooIdx = append(oooIdx, i)
+
+		default:
+			headRows = append(headRows, row)
+			headIdx = append(headIdx, i)
+			if ts > maxTs {
+				maxTs = ts
+			}
+		}
+	}
+
+	merge := func(ret InsertResult, idx []int) {
+		result.Ignored += ret.Ignored
+		for _, r := range ret.Rejected {
+			r.Index = idx[r.Index]
+			result.Rejected = append(result.Rejected, r)
+		}
+	}
+
+	merge(head.InsertRows(headRows), headIdx)
+	if len(oooRows) > 0 {
+		ooo := tsdb.segs.OutOfOrder(func() Segment { return newMemorySegment(tsdb.opts) })
+		merge(ooo.InsertRows(oooRows), oooIdx)
+	}
+
+	for {
+		cur := atomic.LoadInt64(&tsdb.maxTs)
+		if maxTs <= cur || atomic.CompareAndSwapInt64(&tsdb.maxTs, cur, maxTs) {
+			break
+		}
+	}
+
+	sort.Slice(result.Rejected, func(i, j int) bool {
+		return result.Rejected[i].Index < result.Rejected[j].Index
+	})
+
+	result.Inserted = len(rows) - len(result.Rejected) - result.Ignored
+	return result
+}
+
+// rowLabels 返回包括 metricName 在内并且排好序的 LabelSet 不修改 row
+func rowLabels(row *Row) LabelSet {
+	labels := make(LabelSet, len(row.Labels))
+	copy(labels, row.Labels)
+	labels = labels.AddMetricName(row.Metric)
+	labels.Sorted()
+	return labels
+}
+
+// existingSamples 查询 rows 中时间戳不大于 boundary 的数据点在已有数据中是否存在
+// 每个 series 只查询一次 返回以 LabelSet.String() 为 key 的已存在的数据点 时间戳对应当前可见的值
+func (tsdb *TSDB) existingSamples(rows []*Row, boundary int64) map[string]map[int64]float64 {
+	type pending struct {
+		labels       LabelSet
+		minTs, maxTs int64
+	}
+
+	var minTs, maxTs int64 = math.MaxInt64, math.MinInt64
+	series := make(map[string]*pending)
+	for _, row := range rows {
+		ts := row.Point.Ts
+		if row.Metric == "" || ts > boundary {
+			continue
+		}
+
+		labels := rowLabels(row)
+		key := labels.String()
+		p, ok := series[key]
+		if !ok {
+			p = &pending{labels: labels, minTs: ts, maxTs: ts}
+			series[key] = p
+		}
+		if ts < p.minTs {
+			p.minTs = ts
+		}
+		if ts > p.maxTs {
+			p.maxTs = ts
+		}
+
+		if ts < minTs {
+			minTs = ts
+		}
+		if ts > maxTs {
+			maxTs = ts
+		}
+	}
+
+	if len(series) == 0 {
+		return nil
+	}
+
+	q := &Querier{ctx: context.Background(), segs: tsdb.segs.Get(minTs, maxTs), release: tsdb.segs.Release}
+	defer q.Close()
+
+	ret := make(map[string]map[int64]float64, len(series))
+	for key, p := range series {
+		lms := make(LabelMatcherSet, 0, len(p.labels))
+		for _, label := range p.labels {
+			lms = append(lms, LabelMatcher{Name: label.Name, Value: label.Value})
+		}
+
+		// 复用同一批 segment 每个 series 只读取自己的时间区间
+		q.start, q.end = p.minTs, p.maxTs
+		set := q.Select(lms)
+		for set.Next() {
+			if compareLabels(set.At().Labels(), p.labels) != 0 {
+				continue
+			}
+
+			samples := make(map[int64]float64)
+			it := set.At().Iterator()
+			for it.Next() {
+				samples[it.At().Ts] = it.At().Value
+			}
+			ret[key] = samples
+		}
+	}
+
+	return ret
+}
+
+// nextSeq 分配 segment 的写入顺序
+func (tsdb *TSDB) nextSeq() int64 {
+	return atomic.AddInt64(&tsdb.seq, 1)
+}
+
+// getHeadPartition 返回当前可写入的 head 如果开启了 WAL 则会在返回前先记录 rows
+// 成功返回时持有 writeMut 的读锁 调用方写入完成后需要释放
+func (tsdb *TSDB) getHeadPartition(rows []*Row) (Segment, error) {
 	tsdb.mut.Lock()
 	defer tsdb.mut.Unlock()
 
 	if tsdb.segs.head.Frozen() {
-		head := tsdb.segs.head
+		head := tsdb.segs.head.(*memorySegment)
+		head.seq = tsdb.nextSeq()
+
+		// ooo 与 head 共用 WAL 序号 两者都持久化以后才能删除对应的 WAL
+		flushing := []*memorySegment{head}
+		if ooo := tsdb.segs.TakeOutOfOrder(); ooo != nil {
+			flushing = append(flushing, ooo.(*memorySegment))
+		}
 
+		if tsdb.wal != nil {
+			seq, err := tsdb.wal.Cut()
+			if err != nil {
+				return nil, err
+			}
+			for _, ms := range flushing {
+				ms.walSeq = seq
+			}
+			tsdb.addPendingWAL(seq)
+		}
+
+		for _, ms := range flushing[1:] {
+			ms.seq = head.seq
+			tsdb.segs.Add(ms)
+		}
+		tsdb.segs.Add(head)
+
+		tsdb.wg.Add(1)
 		go func() {
-			tsdb.wg.Add(1)
 			defer tsdb.wg.Done()
 
-			tsdb.segs.Add(head)
-
-			t0 := time.Now()
-			dn := dirname(head.MinTs(), head.MaxTs())
+			// 等待已经拿到旧 head 或者 ooo 的写入完成
+			tsdb.writeMut.Lock()
+			tsdb.writeMut.Unlock()
 
-			if err := writeToDisk(head.(*memorySegment)); err != nil {
-				logger.Errorf("failed to flush data to disk, %v", err)
-				return
+			for _, ms := range flushing {
+				if err := tsdb.flushSegment(ms); err != nil {
+					logger.Errorf("failed to flush data to disk, %v", err)
+					return
+				}
 			}
+			tsdb.notifyFlushed()
 
-			fname := path.Join(dn, "data")
-			mf, err := mmap.OpenMmapFile(fname)
-			if err != nil {
-				logger.Errorf("failed to make a mmap file %s, %v", fname, err)
-				return
+			// 数据已经持久化 对应的 WAL 可以删除了
+			if tsdb.wal != nil {
+				tsdb.truncateWAL(head.walSeq)
 			}
-
-			tsdb.segs.Replace(head, newDiskSegment(mf, dn, head.MinTs(), head.MaxTs()))
-			logger.Infof("write file %s take: %v", fname, time.Since(t0))
 		}()
 
-		tsdb.segs.head = newMemorySegment()
+		tsdb.segs.head = newMemorySegment(tsdb.opts)
 	}
 
+	if tsdb.wal != nil {
+		if err := tsdb.wal.Log(rows); err != nil {
+			return nil, err
+		}
+	}
+
+	tsdb.writeMut.RLock()
 	return tsdb.segs.head, nil
 }
 
+// addPendingWAL 记录正在持久化的 segment 对应的 WAL 序号 序号按照 Cut 的顺序递增
+func (tsdb *TSDB) addPendingWAL(seq int) {
+	tsdb.walMut.Lock()
+	defer tsdb.walMut.Unlock()
+
+	tsdb.walPending = append(tsdb.walPending, seq)
+}
+
+// truncateWAL 标记 seq 对应的 segment 已经持久化 并删除所有更早的 segment 都已经持久化的 WAL
+// 持久化失败的 segment 不会调用 truncateWAL 其 WAL 会一直保留到下次启动时回放
+func (tsdb *TSDB) truncateWAL(seq int) {
+	tsdb.walMut.Lock()
+	defer tsdb.walMut.Unlock()
+
+	for i, s := range tsdb.walPending {
+		if s == seq {
+			tsdb.walPending = append(tsdb.walPending[:i], tsdb.walPending[i+1:]...)
+			break
+		}
+	}
+	tsdb.walFlushed = append(tsdb.walFlushed, seq)
+	sort.Ints(tsdb.walFlushed)
+
+	truncated := 0
+	for _, s := range tsdb.walFlushed {
+		if len(tsdb.walPending) > 0 && s > tsdb.walPending[0] {
+			break
+		}
+		truncated++
+	}
+	if truncated == 0 {
+		return
+	}
+
+	if err := tsdb.wal.Truncate(tsdb.walFlushed[truncated-1]); err != nil {
+		logger.Errorf("failed to truncate wal: %v", err)
+		return
+	}
+	tsdb.walFlushed = tsdb.walFlushed[truncated:]
+}
+
+// flushSegment 将已经停止写入的 ms 持久化并替换为对应的磁盘 segment
+func (tsdb *TSDB) flushSegment(ms *memorySegment) error {
+	t0 := time.Now()
+	dn, err := writeToDisk(ms)
+	if err != nil {
+		return err
+	}
+
+	fname := path.Join(dn, "data")
+	mf, err := mmap.OpenMmapFile(fname)
+	if err != nil {
+		return fmt.Errorf("failed to make a mmap file %s, %v", fname, err)
+	}
+
+	diskseg := newDiskSegment(mf, dn, ms.MinTs(), ms.MaxTs(), tsdb.opts).(*diskSegment)
+	diskseg.walSeq = ms.walSeq
+	diskseg.seq = ms.seq
+	if err := tsdb.segs.Replace(ms, diskseg); err != nil {
+		logger.Errorf("failed to replace segment: %v", err)
+	}
+	logger.Infof("write file %s take: %v", fname, time.Since(t0))
+
+	return nil
+}
+
 type MetricRet struct {
 	Labels LabelSet
 	Points []Point
 }
 
 func (tsdb *TSDB) QueryRange(metric string, lms LabelMatcherSet, start, end int64) ([]MetricRet, error) {
-	lms = lms.AddMetricName(metric)
+	return tsdb.QueryRangeContext(context.Background(), metric, lms, start, end)
+}
+
+// QueryRangeContext 与 QueryRange 相同 ctx 被取消时查询会提前返回 ctx.Err()
+func (tsdb *TSDB) QueryRangeContext(ctx context.Context, metric string, lms LabelMatcherSet, start, end int64) ([]MetricRet, error) {
+	return tsdb.queryRange(ctx, lms.AddMetricName(metric), start, end)
+}
+
+// queryRange 查询所有满足 lms 的时序数据 不要求指定 metric
+// 结果按 LabelSet 升序排列
+func (tsdb *TSDB) queryRange(ctx context.Context, lms LabelMatcherSet, start, end int64) ([]MetricRet, error) {
+	q := tsdb.QuerierContext(ctx, start, end)
+	defer q.Close()
 
-	tmp := make([]MetricRet, 0)
-	for _, segment := range tsdb.segs.Get(start, end) {
-		segment = segment.Load()
-		data, err := segment.QueryRange(lms, start, end)
+	ss := q.Select(lms)
+	ret := make([]MetricRet, 0)
+	for ss.Next() {
+		series := ss.At()
+
+		points, err := collectPoints(series.Iterator())
 		if err != nil {
 			return nil, err
 		}
 
-		tmp = append(tmp, data...)
+		ret = append(ret, MetricRet{Labels: series.Labels(), Points: points})
+	}
+
+	if ss.Err() != nil {
+		return nil, ss.Err()
 	}
 
-	return tsdb.mergeQueryRangeResult(tmp...), nil
+	return ret, nil
 }
 
-func (tsdb *TSDB) mergeQueryRangeResult(ret ...MetricRet) []MetricRet {
-	metrics := make(map[uint64]*MetricRet)
-	for _, r := range ret {
-		h := r.Labels.Hash()
-		v, ok := metrics[h]
-		if !ok {
-			metrics[h] = &MetricRet{
-				Labels: r.Labels,
-				Points: r.Points,
-			}
-			continue
-		}
+func (tsdb *TSDB) QuerySeries(lms LabelMatcherSet, start, end int64) ([]map[string]string, error) {
+	return tsdb.QuerySeriesContext(context.Background(), lms, start, end)
+}
 
-		v.Points = append(v.Points, r.Points...)
+// QuerySeriesContext 与 QuerySeries 相同 每个 segment 查询前都会检查 ctx 是否已经被取消
+func (tsdb *TSDB) QuerySeriesContext(ctx context.Context, lms LabelMatcherSet, start, end int64) ([]map[string]string, error) {
+	if err := lms.validate(); err != nil {
+		return nil, err
 	}
 
-	items := make([]MetricRet, 0, len(metrics))
-	for _, v := range metrics {
-		sort.Slice(v.Points, func(i, j int) bool {
-			return v.Points[i].Ts < v.Points[j].Ts
-		})
+	segs := tsdb.segs.Get(start, end)
+	defer tsdb.segs.Release(segs)
 
-		items = append(items, *v)
-	}
+	lbs := make(map[uint64]LabelSet)
+	for _, segment := range segs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-	return items
-}
+		segment, err := segment.Load()
+		if err != nil {
+			return nil, err
+		}
 
-func (tsdb *TSDB) QuerySeries(lms LabelMatcherSet, start, end int64) ([]map[string]string, error) {
-	tmp := make([]LabelSet, 0)
-	for _, segment := range tsdb.segs.Get(start, end) {
-		segment = segment.Load()
 		data, err := segment.QuerySeries(lms)
 		if err != nil {
 			return nil, err
 		}
 
-		tmp = append(tmp, data...)
-	}
-
-	return tsdb.mergeQuerySeriesResult(tmp...), nil
-}
+		for _, r := range data {
+			lbs[r.Hash()] = r
+		}
 
-func (tsdb *TSDB) mergeQuerySeriesResult(ret ...LabelSet) []map[string]string {
-	lbs := make(map[uint64]LabelSet)
-	for _, r := range ret {
-		lbs[r.Hash()] = r
+		if max := tsdb.opts.maxQuerySeries; max > 0 && int64(len(lbs)) > max {
+			return nil, &QueryLimitErr{Limit: max, Err: ErrTooManySeries}
+		}
 	}
 
 	items := make([]map[string]string, 0)
@@ -346,14 +991,66 @@ func (tsdb *TSDB) mergeQuerySeriesResult(ret ...LabelSet) []map[string]string {
 		items = append(items, lb.Map())
 	}
 
-	return items
+	return items, nil
+}
+
+// QueryLabelNames 查询满足 lms 的 series 中出现过的所有 label 名称 lms 为空时返回全部 label 名称
+func (tsdb *TSDB) QueryLabelNames(lms LabelMatcherSet, start, end int64) []string {
+	ret, _ := tsdb.QueryLabelNamesContext(context.Background(), lms, start, end)
+	return ret
+}
+
+// QueryLabelNamesContext 与 QueryLabelNames 相同 每个 segment 查询前都会检查 ctx 是否已经被取消
+func (tsdb *TSDB) QueryLabelNamesContext(ctx context.Context, lms LabelMatcherSet, start, end int64) ([]string, error) {
+	lms = lms.filter()
+	if err := lms.validate(); err != nil {
+		return nil, err
+	}
+
+	return tsdb.queryLabels(ctx, start, end, func(segment Segment) ([]string, error) {
+		return segment.QueryLabelNames(lms)
+	})
+}
+
+// QueryLabelValues 查询 label 的所有值 指定 lms 时只返回满足 lms 的 series 中的值
+func (tsdb *TSDB) QueryLabelValues(label string, start, end int64, lms ...LabelMatcher) []string {
+	ret, _ := tsdb.QueryLabelValuesContext(context.Background(), label, start, end, lms...)
+	return ret
+}
+
+// QueryLabelValuesContext 与 QueryLabelValues 相同 每个 segment 查询前都会检查 ctx 是否已经被取消
+func (tsdb *TSDB) QueryLabelValuesContext(ctx context.Context, label string, start, end int64, lms ...LabelMatcher) ([]string, error) {
+	matchers := LabelMatcherSet(lms).filter()
+	if err := matchers.validate(); err != nil {
+		return nil, err
+	}
+
+	return tsdb.queryLabels(ctx, start, end, func(segment Segment) ([]string, error) {
+		return segment.QueryLabelValues(label, matchers)
+	})
 }
 
-func (tsdb *TSDB) QueryLabelValues(label string, start, end int64) []string {
+// queryLabels 合并 [start, end] 区间内每个 segment 的查询结果 去重后升序返回
+func (tsdb *TSDB) queryLabels(ctx context.Context, start, end int64, f func(segment Segment) ([]string, error)) ([]string, error) {
+	segs := tsdb.segs.Get(start, end)
+	defer tsdb.segs.Release(segs)
+
 	tmp := make(map[string]struct{})
-	for _, segment := range tsdb.segs.Get(start, end) {
-		segment = segment.Load()
-		values := segment.QueryLabelValues(label)
+	for _, segment := range segs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		segment, err := segment.Load()
+		if err != nil {
+			logger.Errorf("failed to load segment: %v", err)
+			continue
+		}
+
+		values, err := f(segment)
+		if err != nil {
+			return nil, err
+		}
 		for i := 0; i < len(values); i++ {
 			tmp[values[i]] = struct{}{}
 		}
@@ -366,48 +1063,204 @@ func (tsdb *TSDB) QueryLabelValues(label string, start, end int64) []string {
 
 	sort.Strings(ret)
 
-	return ret
+	return ret, nil
 }
 
-func (tsdb *TSDB) Close() {
+// ErrEmptyMatchers 删除数据时必须指定至少一个匹配器
+var ErrEmptyMatchers = errors.New("at least one label matcher is required")
+
+// DeleteSeries 删除满足 lms 的 series 在 [start, end] 区间内的数据点
+// head 中的数据会被立即删除 diskSegment 则记录 tombstones 查询时会过滤掉被删除的数据
+// 被删除的数据会在下一次 compaction 重写 segment 时被真正清理
+func (tsdb *TSDB) DeleteSeries(lms LabelMatcherSet, start, end int64) error {
+	lms = lms.filter()
+	if len(lms) == 0 {
+		return ErrEmptyMatchers
+	}
+	if err := lms.validate(); err != nil {
+		return err
+	}
+	for _, lm := range lms {
+		if len(lm.Name) > maxRowFieldSize || len(lm.Value) > maxRowFieldSize {
+			return fmt.Errorf("%w %s: exceeds %d bytes", ErrInvalidMatcher, lm.Name, maxRowFieldSize)
+		}
+	}
+
+	tsdb.compactMut.Lock()
+	defer tsdb.compactMut.Unlock()
+
+	tsdb.mut.Lock()
+	defer tsdb.mut.Unlock()
+
+	// 等待正在持久化的 head 完成 此后除了 head 和 ooo 之外都是 diskSegment
 	tsdb.wg.Wait()
+
+	if tsdb.wal != nil {
+		if err := tsdb.wal.LogDeletion(walDeletion{lms: lms, start: start, end: end}); err != nil {
+			return err
+		}
+	}
+
+	segs := tsdb.segs.Get(start, end)
+	defer tsdb.segs.Release(segs)
+
+	for _, segment := range segs {
+		segment, err := segment.Load()
+		if err != nil {
+			return err
+		}
+
+		if err := segment.DeleteSeries(lms, start, end); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tsdb *TSDB) Close() {
+	// 先拒绝新的写入 再将队列中已经接收的 batch 全部写完 此后 head 和 ooo 不会再有新的写入
+	tsdb.closeMut.Lock()
+	if tsdb.closed {
+		tsdb.closeMut.Unlock()
+		return
+	}
+	tsdb.closed = true
+	close(tsdb.q)
+	tsdb.closeMut.Unlock()
+
+	tsdb.ingestWg.Wait()
 	tsdb.cancel()
+	tsdb.wg.Wait()
+
+	tsdb.compactMut.Lock()
+	defer tsdb.compactMut.Unlock()
+
+	for _, segment := range tsdb.segs.All() {
+		segment.Close()
+	}
+
+	head := tsdb.segs.head.(*memorySegment)
+	head.seq = tsdb.nextSeq()
+
+	flushing := []*memorySegment{head}
+	if ooo := tsdb.segs.TakeOutOfOrder(); ooo != nil {
+		ooo.(*memorySegment).seq = head.seq
+		flushing = append(flushing, ooo.(*memorySegment))
+	}
+
+	if tsdb.wal == nil {
+		for _, ms := range flushing {
+			ms.Close()
+		}
+		return
+	}
 
-	it := tsdb.segs.lst.All()
-	for it.Next() {
-		it.Value().(Segment).Close()
+	// 切换 WAL 失败时无法确定 head 对应的 WAL 序号 持久化后不删除任何 WAL 下次启动时回放会跳过已经持久化的数据
+	seq, cutErr := tsdb.wal.Cut()
+	if cutErr != nil {
+		logger.Errorf("failed to cut wal: %v", cutErr)
+	} else {
+		tsdb.addPendingWAL(seq)
 	}
 
-	tsdb.segs.head.Close()
+	// head 或者 ooo 持久化失败时保留 WAL 下次启动的时候回放
+	flushed := cutErr == nil
+	for _, ms := range flushing {
+		if cutErr == nil {
+			ms.walSeq = seq
+		}
+		if err := ms.Close(); err != nil {
+			logger.Errorf("failed to flush head to disk: %v", err)
+			flushed = false
+		}
+	}
+
+	if flushed {
+		tsdb.truncateWAL(seq)
+	}
+
+	if err := tsdb.wal.Close(); err != nil {
+		logger.Errorf("failed to close wal: %v", err)
+	}
 }
 
+// removeExpires 定期删除过期的 segment 并在 segment 持久化后检查磁盘空间是否超出限制
 func (tsdb *TSDB) removeExpires() {
+	tsdb.enforceDiskQuota()
+
 	tick := time.Tick(5 * time.Minute)
 	for {
 		select {
 		case <-tsdb.ctx.Done():
 			return
+		case <-tsdb.flushed:
+			tsdb.enforceDiskQuota()
 		case <-tick:
-			now := time.Now().Unix()
+			tsdb.removeExpired(tsdb.opts.precision.Timestamp(time.Now()))
+			tsdb.enforceDiskQuota()
+		}
+	}
+}
 
-			var removed []Segment
-			it := tsdb.segs.lst.All()
-			for it.Next() {
-				if now-it.Value().(Segment).MaxTs() > int64(globalOpts.retention.Seconds()) {
-					removed = append(removed, it.Value().(Segment))
-				}
-			}
+// removeExpired 删除超出保存时长的 diskSegment
+// 正在持久化的 memorySegment 会在持久化完成后被替换 此时删除会被 Replace 重新加回 留到下一轮处理
+func (tsdb *TSDB) removeExpired(now int64) {
+	tsdb.compactMut.Lock()
+	defer tsdb.compactMut.Unlock()
 
-			for _, r := range removed {
-				tsdb.segs.Remove(r)
+	for _, ds := range tsdb.diskSegments() {
+		if now-ds.MaxTs() > tsdb.opts.precision.Duration(tsdb.opts.retention) {
+			if err := tsdb.segs.Remove(ds); err != nil {
+				logger.Errorf("failed to remove expired segment: %v", err)
 			}
 		}
 	}
 }
 
+// openDiskSegment 打开一个持久化的 Segment 文件夹
+// 缺少 data 或者 meta.json 以及 data 文件长度与 TOC 描述不一致的 Segment 都会被拒绝加载
+func openDiskSegment(dir string, opts *tsdbOptions) (*diskSegment, *Desc, error) {
+	dataFile := filepath.Join(dir, "data")
+	descFile := filepath.Join(dir, "meta.json")
+
+	if !isFileExist(dataFile) || !isFileExist(descFile) {
+		return nil, nil, fmt.Errorf("segment %s is incomplete", dir)
+	}
+
+	bs, err := ioutil.ReadFile(descFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read file: %s, err: %v", descFile, err)
+	}
+
+	desc := &Desc{}
+	if err := json.Unmarshal(bs, desc); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal desc file: %v", err)
+	}
+
+	mf, err := mmap.OpenMmapFile(dataFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open mmap file %s, err: %v", dataFile, err)
+	}
+
+	diskseg := newDiskSegment(mf, dir, desc.MinTs, desc.MaxTs, opts).(*diskSegment)
+	if _, _, err := diskseg.readTOC(); err != nil {
+		mf.Close()
+		return nil, nil, err
+	}
+	diskseg.walSeq = desc.WalSeq
+	diskseg.seq = desc.Seq
+
+	return diskseg, desc, nil
+}
+
+// loadFiles 加载所有持久化的 Segment
 func (tsdb *TSDB) loadFiles() {
-	mkdir(globalOpts.dataPath)
-	err := filepath.Walk(globalOpts.dataPath, func(path string, info os.FileInfo, err error) error {
+	disksegs := make([]*diskSegment, 0)
+	parents := make(map[string]struct{})
+
+	mkdir(tsdb.opts.dataPath)
+	err := filepath.Walk(tsdb.opts.dataPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("failed to read the dir: %s, err: %v", path, err)
 		}
@@ -416,71 +1269,155 @@ func (tsdb *TSDB) loadFiles() {
 			return nil
 		}
 
-		files, err := ioutil.ReadDir(filepath.Join(globalOpts.dataPath, info.Name()))
+		// 写入过程中崩溃残留的临时文件夹
+		if strings.HasSuffix(info.Name(), tmpSegmentSuffix) {
+			logger.Warnf("remove incomplete segment dir %s", path)
+			if err := os.RemoveAll(path); err != nil {
+				logger.Errorf("failed to remove dir %s: %v", path, err)
+			}
+			return filepath.SkipDir
+		}
+
+		diskseg, desc, err := openDiskSegment(path, tsdb.opts)
 		if err != nil {
-			return fmt.Errorf("failed to load data storage, err: %v", err)
+			logger.Errorf("failed to load segment, skipped: %v", err)
+			return filepath.SkipDir
 		}
 
-		diskseg := &diskSegment{}
+		for _, parent := range desc.Parents {
+			parents[parent] = struct{}{}
+		}
 
-		for _, file := range files {
-			fn := filepath.Join(globalOpts.dataPath, info.Name(), file.Name())
+		disksegs = append(disksegs, diskseg)
+		return filepath.SkipDir
+	})
 
-			if file.Name() == "data" {
-				mf, err := mmap.OpenMmapFile(fn)
-				if err != nil {
-					return fmt.Errorf("failed to open mmap file %s, err: %v", fn, err)
-				}
+	if err != nil {
+		logger.Error(err)
+	}
 
-				diskseg.dataFd = mf
-				diskseg.dataFilename = fn
-				diskseg.labelVs = newLabelValueSet()
+	for _, diskseg := range disksegs {
+		// compaction 完成后尚未来得及删除的 segment
+		if _, ok := parents[filepath.Base(diskseg.dir)]; ok {
+			logger.Warnf("remove compacted segment dir %s", diskseg.dir)
+			if err := drop(diskseg); err != nil {
+				logger.Errorf("failed to remove dir %s: %v", diskseg.dir, err)
 			}
+			continue
+		}
 
-			if file.Name() == "meta.json" {
-				bs, err := ioutil.ReadFile(fn)
-				if err != nil {
-					return fmt.Errorf("failed to read file: %s, err: %v", fn, err)
-				}
+		tsdb.segs.Add(diskseg)
+	}
+}
 
-				desc := Desc{}
-				if err := json.Unmarshal(bs, &desc); err != nil {
-					return fmt.Errorf("failed to unmarshal desc file: %v", err)
-				}
+// replayWAL 打开 WAL 并将剩余的数据全部回放到 head 中
+// 持久化的完成顺序不确定 磁盘上最大的 WalSeq 之前仍可能有未持久化的 WAL 所以不能根据 WalSeq 跳过
+// 剩余的 WAL 中已经持久化的数据在回放时跳过(见 replayRows) 回放的 WAL 在 head 持久化后删除
+func (tsdb *TSDB) replayWAL() error {
+	w, err := openWAL(filepath.Join(tsdb.opts.dataPath, walDirname))
+	if err != nil {
+		return err
+	}
 
-				diskseg.minTs = desc.MinTs
-				diskseg.maxTs = desc.MaxTs
-			}
+	t0 := time.Now()
+	var count, skipped int
+	err = w.Replay(0, func(rows []*Row) {
+		skipped += tsdb.replayRows(rows)
+		count += len(rows)
+	}, func(d walDeletion) {
+		if err := tsdb.segs.head.DeleteSeries(d.lms, d.start, d.end); err != nil {
+			logger.Errorf("failed to replay deletion: %v", err)
 		}
 
-		tsdb.segs.Add(diskseg)
-		return nil
+		if tsdb.segs.ooo != nil {
+			if err := tsdb.segs.ooo.DeleteSeries(d.lms, d.start, d.end); err != nil {
+				logger.Errorf("failed to replay deletion: %v", err)
+			}
+		}
 	})
-
 	if err != nil {
-		logger.Error(err)
+		w.Close()
+		return err
+	}
+
+	tsdb.wal = w
+	logger.Infof("replay %d rows from wal, skip %d persisted rows, take: %v", count, skipped, time.Since(t0))
+	return nil
+}
+
+// replayRows 将 WAL 中的 rows 写入 head 以及 ooo 返回被跳过的 rows 数量
+// 剩余的 WAL 中可能包含已经持久化的数据 与当前可见的数据点完全相同的 row 再次写入不会改变查询结果
+// 直接跳过 避免这部分数据写入 ooo 后再次持久化成重复的 segment
+func (tsdb *TSDB) replayRows(rows []*Row) int {
+	existing := tsdb.existingSamples(rows, tsdb.segs.MaxTs())
+
+	var skipped int
+	pending := make([]*Row, 0, len(rows))
+	for _, row := range rows {
+		key := rowLabels(row).String()
+		samples, ok := existing[key]
+		if !ok {
+			pending = append(pending, row)
+			continue
+		}
+
+		ts, value := row.Point.Ts, row.Point.Value
+		if v, ok := samples[ts]; ok && math.Float64bits(v) == math.Float64bits(value) {
+			skipped++
+			continue
+		}
+
+		// 同一批中时间戳相同的 row 需要与前面将要写入的值比较
+		samples[ts] = value
+		pending = append(pending, row)
 	}
+
+	tsdb.insertRows(tsdb.segs.head, pending)
+	return skipped
 }
 
+// OpenTSDB 打开一个 TSDB 实例 每个实例的配置相互独立
+// 同一进程中可以同时打开多个使用不同 DataPath 的实例
 func OpenTSDB(opts ...Option) *TSDB {
+	options := newDefaultOptions()
 	for _, opt := range opts {
-		opt(globalOpts)
+		opt(options)
 	}
 
 	tsdb := &TSDB{
-		segs: newSegmentList(),
-		q:    make(chan []*Row, defaultQSize),
+		opts:    options,
+		segs:    newSegmentList(options),
+		q:       make(chan *writeBatch, defaultQSize),
+		flushed: make(chan struct{}, 1),
 	}
 
 	tsdb.loadFiles()
+	for _, segment := range tsdb.segs.All() {
+		if segment.Seq() > tsdb.seq {
+			tsdb.seq = segment.Seq()
+		}
+	}
+
+	// 回放时不以已经持久化的数据计算乱序时间窗口 避免更早的未持久化数据被拒绝
+	tsdb.maxTs = math.MinInt64
+	if options.enableWAL && !options.onlyMemoryMode {
+		if err := tsdb.replayWAL(); err != nil {
+			logger.Errorf("failed to replay wal: %v", err)
+		}
+	}
+	if maxTs := tsdb.segs.MaxTs(); maxTs > tsdb.maxTs {
+		tsdb.maxTs = maxTs
+	}
 
 	worker := runtime.GOMAXPROCS(-1)
 	tsdb.ctx, tsdb.cancel = context.WithCancel(context.Background())
 
+	tsdb.ingestWg.Add(worker)
 	for i := 0; i < worker; i++ {
 		go tsdb.ingestRows(tsdb.ctx)
 	}
 	go tsdb.removeExpires()
+	go tsdb.compactLoop()
 
 	return tsdb
 }
@@ -1,8 +1,14 @@
 package mandodb
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -112,7 +118,7 @@ func TestTSDB_QuerySeries(t *testing.T) {
 	time.Sleep(time.Millisecond * 20)
 
 	ret, err := store.QuerySeries(LabelMatcherSet{
-		{Name: "__name__", Value: "disk.*", IsRegx: true},
+		{Name: "__name__", Value: "disk.*", Type: MatchRegexp},
 		{Name: "node", Value: "vm1"},
 		{Name: "dc", Value: "0"},
 	}, start, start+120)
@@ -145,3 +151,648 @@ func TestTSDB_QueryLabelValues(t *testing.T) {
 	ret := store.QueryLabelValues("node", start, start+120)
 	assert.Equal(t, ret, []string{"vm0", "vm1", "vm2"})
 }
+
+func TestTSDB_QueryLabelNames(t *testing.T) {
+	tmpdir := "/tmp/tsdb-label-names"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+	defer store.Close()
+
+	var start int64 = 1600000000
+	var now = start
+	for i := 0; i < 180; i++ { // 3h 前 2h 的数据会被持久化
+		for n := 0; n < 3; n++ {
+			_ = store.InsertRows(genPoints(now, n, n))
+		}
+		now += 60
+	}
+	_ = store.InsertRows([]*Row{{
+		Metric: "up",
+		Labels: LabelSet{{Name: "node", Value: "vm0"}, {Name: "job", Value: "node"}},
+		Point:  Point{Ts: now, Value: 1},
+	}})
+	time.Sleep(time.Millisecond * 100)
+	store.wg.Wait()
+	assert.True(t, len(store.segs.All()) > 0)
+
+	assert.Equal(t, []string{"__name__", "dc", "job", "node"}, store.QueryLabelNames(nil, start, now))
+	assert.Equal(t, []string{"__name__", "dc", "node"}, store.QueryLabelNames(nil, start, start+600))
+	assert.Equal(t, []string{"__name__", "job", "node"}, store.QueryLabelNames(LabelMatcherSet{{Name: "job", Value: "node"}}, start, now))
+	assert.Equal(t, []string{}, store.QueryLabelNames(LabelMatcherSet{{Name: "job", Value: "node"}}, start, start+600))
+
+	assert.Equal(t, []string{"vm0", "vm1", "vm2"}, store.QueryLabelValues("node", start, now))
+	assert.Equal(t, []string{"vm1"}, store.QueryLabelValues("node", start, start+600, LabelMatcher{Name: "dc", Value: "1"}))
+	assert.Equal(t, []string{"vm0", "vm2"}, store.QueryLabelValues("node", start, now, LabelMatcher{Name: "dc", Value: "1", Type: MatchNotEqual}))
+	assert.Equal(t, []string{"node"}, store.QueryLabelValues("job", start, now, LabelMatcher{Name: "node", Value: "vm0"}))
+}
+
+func TestTSDB_LoadFiles(t *testing.T) {
+	tmpdir := "/tmp/tsdb4"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+	var start int64 = 1600000000
+	for i := 0; i < 10; i++ {
+		_ = store.InsertRows(genPoints(start+int64(i*60), 0, 0))
+	}
+	time.Sleep(time.Millisecond * 20)
+	store.Close()
+
+	// 写入过程中崩溃残留的临时文件夹
+	tmpSeg := filepath.Join(tmpdir, "seg-1-2"+tmpSegmentSuffix)
+	assert.NoError(t, os.MkdirAll(tmpSeg, os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tmpSeg, "data"), []byte("partial"), os.ModePerm))
+
+	// 缺少 meta.json 的 Segment
+	brokenSeg := filepath.Join(tmpdir, "seg-3-4")
+	assert.NoError(t, os.MkdirAll(brokenSeg, os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(brokenSeg, "data"), []byte("partial"), os.ModePerm))
+
+	store = OpenTSDB(WithDataPath(tmpdir))
+	defer store.Close()
+
+	assert.False(t, isFileExist(tmpSeg))
+	assert.Equal(t, 1, len(store.segs.All()))
+
+	ret, err := store.QueryRange("cpu.busy", nil, start, start+600)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, 10, len(ret[0].Points))
+}
+
+func TestTSDB_Corruption(t *testing.T) {
+	tmpdir := "/tmp/tsdb5"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+	var start int64 = 1600000000
+	for i := 0; i < 10; i++ {
+		_ = store.InsertRows(genPoints(start+int64(i*60), 0, 0))
+	}
+	time.Sleep(time.Millisecond * 20)
+	store.Close()
+
+	dirs, err := filepath.Glob(filepath.Join(tmpdir, "seg-*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dirs))
+
+	fname := filepath.Join(dirs[0], "data")
+	data, err := ioutil.ReadFile(fname)
+	assert.NoError(t, err)
+	assert.Equal(t, segmentFormatV4, readSegmentHeader(data).version)
+
+	// 翻转 Index TOC 中的一个字节 加载时就能发现
+	broken := append([]byte(nil), data...)
+	broken[len(broken)-checksumSize-1] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(fname, broken, os.ModePerm))
+
+	store = OpenTSDB(WithDataPath(tmpdir))
+
+	_, err = store.QueryRange("cpu.busy", nil, start, start+600)
+	var cerr *CorruptionErr
+	assert.True(t, errors.As(err, &cerr))
+	assert.Equal(t, ErrChecksumMismatch, cerr.Err)
+	store.Close()
+
+	// 翻转 Index TOC 之前的一个字节 加载时不会校验 compaction 读取整个 segment 之前会发现
+	broken = append(broken[:0], data...)
+	broken[len(broken)-checksumSize-indexTOCSize-1] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(fname, broken, os.ModePerm))
+
+	store = OpenTSDB(WithDataPath(tmpdir))
+	defer store.Close()
+
+	ds := store.segs.All()[0].(*diskSegment)
+	_, err = ds.Load()
+	assert.NoError(t, err)
+
+	err = store.compactSegments([]*diskSegment{ds})
+	assert.True(t, errors.As(err, &cerr))
+	assert.Equal(t, ErrChecksumMismatch, cerr.Err)
+	assert.Equal(t, 1, len(store.segs.All()))
+}
+
+func TestTSDB_MixedCompressors(t *testing.T) {
+	tmpdir := "/tmp/tsdb6"
+	defer os.RemoveAll(tmpdir)
+
+	var start int64 = 1600000000
+	compressors := []BytesCompressorType{NoopBytesCompressor, ZstdBytesCompressor, SnappyBytesCompressor}
+	for idx, c := range compressors {
+		store := OpenTSDB(WithDataPath(tmpdir), WithMetaBytesCompressorType(c))
+		for i := 0; i < 10; i++ {
+			_ = store.InsertRows(genPoints(start+int64(idx*600+i*60), 0, 0))
+		}
+		time.Sleep(time.Millisecond * 20)
+		store.Close()
+	}
+
+	store := OpenTSDB(WithDataPath(tmpdir), WithMetaBytesCompressorType(ZstdBytesCompressor))
+	defer store.Close()
+
+	assert.Equal(t, len(compressors), len(store.segs.All()))
+
+	ret, err := store.QueryRange("cpu.busy", nil, start, start+1800)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, 30, len(ret[0].Points))
+}
+
+func TestTSDB_MillisecondPrecision(t *testing.T) {
+	tmpdir := "/tmp/tsdb7"
+	defer os.RemoveAll(tmpdir)
+
+	var start int64 = 1600000000000
+	store := OpenTSDB(WithDataPath(tmpdir), WithTimestampPrecision(PrecisionMillisecond))
+	for i := 0; i < 1000; i++ {
+		_ = store.InsertRows(genPoints(start+int64(i*250), 0, 0))
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	// 250s 的数据不会触发 2h 的 Segment 切分
+	assert.Equal(t, 0, len(store.segs.All()))
+	assert.False(t, store.segs.head.Frozen())
+	store.Close()
+
+	store = OpenTSDB(WithDataPath(tmpdir), WithTimestampPrecision(PrecisionMillisecond))
+	defer store.Close()
+
+	ret, err := store.QueryRange("cpu.busy", nil, start, start+250*999)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, 1000, len(ret[0].Points))
+	for i, p := range ret[0].Points {
+		assert.Equal(t, start+int64(i*250), p.Ts)
+	}
+}
+
+func TestTSDB_MultipleInstances(t *testing.T) {
+	dirs := []string{"/tmp/tsdb8-a", "/tmp/tsdb8-b"}
+	for _, dir := range dirs {
+		defer os.RemoveAll(dir)
+	}
+
+	var start int64 = 1600000000
+	a := OpenTSDB(WithDataPath(dirs[0]), WithMetaBytesCompressorType(ZstdBytesCompressor))
+	b := OpenTSDB(WithDataPath(dirs[1]), WithTimestampPrecision(PrecisionMillisecond))
+	assert.Equal(t, dirs[0], a.opts.dataPath)
+	assert.Equal(t, dirs[1], b.opts.dataPath)
+
+	for i := 0; i < 10; i++ {
+		_ = a.InsertRows(genPoints(start+int64(i*60), 0, 0))
+		_ = b.InsertRows(genPoints(start*1000+int64(i*60000), 0, 0))
+	}
+	time.Sleep(time.Millisecond * 20)
+	a.Close()
+	b.Close()
+
+	a = OpenTSDB(WithDataPath(dirs[0]))
+	defer a.Close()
+	b = OpenTSDB(WithDataPath(dirs[1]), WithTimestampPrecision(PrecisionMillisecond))
+	defer b.Close()
+
+	ret, err := a.QueryRange("cpu.busy", nil, start, start+600)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, 10, len(ret[0].Points))
+
+	ret, err = b.QueryRange("cpu.busy", nil, start*1000, start*1000+600000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, 10, len(ret[0].Points))
+}
+
+func TestTSDB_NegativeMatchers(t *testing.T) {
+	tmpdir := "/tmp/tsdb9"
+	defer os.RemoveAll(tmpdir)
+
+	var start int64 = 1600000000
+	series := []LabelSet{
+		{{Name: "env", Value: "dev"}, {Name: "host", Value: "test-1"}},
+		{{Name: "env", Value: "prod"}, {Name: "host", Value: "web-1"}},
+		{{Name: "host", Value: "web-2"}}, // 没有 env label
+	}
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+	for i := 0; i < 10; i++ {
+		rows := make([]*Row, 0)
+		for _, labels := range series {
+			rows = append(rows, &Row{Metric: "up", Labels: append(LabelSet{}, labels...), Point: Point{Ts: start + int64(i), Value: 1}})
+		}
+		_ = store.InsertRows(rows)
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	cases := []struct {
+		lms   LabelMatcherSet
+		hosts []string
+	}{
+		{lms: LabelMatcherSet{{Name: "env", Value: "dev", Type: MatchNotEqual}}, hosts: []string{"web-1", "web-2"}},
+		{lms: LabelMatcherSet{{Name: "host", Value: "test-.*", Type: MatchNotRegexp}}, hosts: []string{"web-1", "web-2"}},
+		{lms: LabelMatcherSet{{Name: "env", Value: "", Type: MatchEqual}}, hosts: []string{"web-2"}},
+		{lms: LabelMatcherSet{{Name: "env", Value: "", Type: MatchNotEqual}}, hosts: []string{"test-1", "web-1"}},
+		{lms: LabelMatcherSet{{Name: "env", Value: "p.*|", Type: MatchRegexp}}, hosts: []string{"web-1", "web-2"}},
+		{
+			lms: LabelMatcherSet{
+				{Name: "host", Value: "web-.*", Type: MatchRegexp},
+				{Name: "env", Value: "prod", Type: MatchNotEqual},
+			},
+			hosts: []string{"web-2"},
+		},
+	}
+
+	check := func() {
+		for _, c := range cases {
+			ret, err := store.QueryRange("up", c.lms, start, start+10)
+			assert.NoError(t, err)
+
+			hosts := make([]string, 0)
+			for _, r := range ret {
+				assert.Equal(t, 10, len(r.Points))
+				hosts = append(hosts, r.Labels.Map()["host"])
+			}
+			sort.Strings(hosts)
+			assert.Equal(t, c.hosts, hosts, "matchers: %v", c.lms)
+		}
+	}
+
+	check()
+	store.Close()
+
+	store = OpenTSDB(WithDataPath(tmpdir))
+	defer store.Close()
+	check()
+
+	// 非法的正则表达式返回错误 而不是按照字面值匹配
+	invalid := LabelMatcherSet{{Name: "host", Value: "web-(", Type: MatchRegexp}}
+	_, err := store.QueryRange("up", invalid, start, start+10)
+	assert.True(t, errors.Is(err, ErrInvalidMatcher))
+	_, err = store.QuerySeries(invalid, start, start+10)
+	assert.True(t, errors.Is(err, ErrInvalidMatcher))
+	_, err = store.QueryLabelValuesContext(context.Background(), "host", start, start+10, invalid...)
+	assert.True(t, errors.Is(err, ErrInvalidMatcher))
+	assert.True(t, errors.Is(store.DeleteSeries(invalid, start, start+10), ErrInvalidMatcher))
+}
+
+func TestTSDB_DeleteSeries(t *testing.T) {
+	tmpdir := "/tmp/tsdb10"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir), WithCompactionLevels())
+
+	var start int64 = 1600000000
+	var now = start
+	for i := 0; i < 180; i++ { // 3h 第一个 2h 的 segment 会被持久化
+		for n := 0; n < 2; n++ {
+			_ = store.InsertRows(genPoints(now, n, 0))
+		}
+		now += 60
+	}
+	time.Sleep(time.Millisecond * 100)
+	store.wg.Wait()
+	assert.Equal(t, 1, len(store.segs.All()))
+
+	assert.Equal(t, ErrEmptyMatchers, store.DeleteSeries(nil, start, now))
+	assert.NoError(t, store.DeleteSeries(LabelMatcherSet{{Name: "node", Value: "vm1"}}, start, now))
+	assert.NoError(t, store.DeleteSeries(LabelMatcherSet{{Name: "node", Value: "vm0"}}, start+600, start+8000))
+
+	check := func(store *TSDB) {
+		ret, err := store.QueryRange("cpu.busy", LabelMatcherSet{{Name: "node", Value: "vm1"}}, start, now)
+		assert.NoError(t, err)
+		for _, r := range ret {
+			assert.Equal(t, 0, len(r.Points))
+		}
+
+		ret, err = store.QueryRange("cpu.busy", LabelMatcherSet{{Name: "node", Value: "vm0"}}, start, now)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(ret))
+		assert.Equal(t, 180-124, len(ret[0].Points))
+		for _, p := range ret[0].Points {
+			assert.True(t, p.Ts < start+600 || p.Ts > start+8000, "ts: %d", p.Ts)
+		}
+
+		series, err := store.QuerySeries(LabelMatcherSet{{Name: "node", Value: "vm.*", Type: MatchRegexp}}, start, now)
+		assert.NoError(t, err)
+		assert.Equal(t, len(metrics), len(series))
+		assert.Equal(t, []string{"vm0"}, store.QueryLabelValues("node", start, now))
+	}
+
+	check(store)
+	ds := store.segs.All()[0].(*diskSegment)
+	assert.True(t, ds.hasTombstones())
+
+	// 模拟进程崩溃 磁盘上的 tombstones 以及 WAL 中的删除记录都能够被恢复
+	recovered := OpenTSDB(WithDataPath(tmpdir), WithCompactionLevels())
+	check(recovered)
+	recovered.cancel()
+	assert.NoError(t, recovered.wal.Close())
+	for _, segment := range recovered.segs.All() {
+		assert.NoError(t, segment.Close())
+	}
+
+	// compaction 时重写存在 tombstones 的 segment
+	assert.NoError(t, store.compact())
+	segs := store.segs.All()
+	assert.Equal(t, 1, len(segs))
+	assert.False(t, segs[0].(*diskSegment).hasTombstones())
+	assert.NotEqual(t, ds.dir, segs[0].(*diskSegment).dir)
+	check(store)
+
+	store.Close()
+
+	store = OpenTSDB(WithDataPath(tmpdir), WithCompactionLevels())
+	defer store.Close()
+	check(store)
+}
+
+func TestMemorySegment_DeleteSeries(t *testing.T) {
+	opts := newDefaultOptions()
+	opts.duplicatePolicy = DuplicateReject
+	ms := newMemorySegment(opts).(*memorySegment)
+
+	var start int64 = 1600000000
+	lms := LabelMatcherSet{{Name: "node", Value: "vm0"}}
+	for i := int64(0); i < 3; i++ {
+		assert.Empty(t, ms.InsertRows(genPoints(start+i*60, 0, 0)).Rejected)
+	}
+
+	// 删除后重新写入相同时间戳的数据点不应该被视为重复
+	assert.NoError(t, ms.DeleteSeries(lms, start+60, start+120))
+	assert.Empty(t, ms.InsertRows(genPoints(start+120, 0, 0)).Rejected)
+	assert.NoError(t, ms.DeleteSeries(lms, start, start+120))
+	assert.Empty(t, ms.InsertRows(genPoints(start, 0, 0)).Rejected)
+
+	// 并发写入的 series 以及 label 值不会被删除
+	var wg sync.WaitGroup
+	for n := 1; n <= 8; n++ {
+		wg.Add(2)
+		go func(n int) {
+			defer wg.Done()
+			for i := int64(0); i < 50; i++ {
+				ms.InsertRows(genPoints(start+i, n, 0))
+			}
+		}(n)
+		go func(n int) {
+			defer wg.Done()
+			for i := int64(0); i < 50; i++ {
+				_ = ms.DeleteSeries(LabelMatcherSet{{Name: "node", Value: "vm" + strconv.Itoa(n)}}, start, start+i)
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	for n := 1; n <= 8; n++ {
+		node := "vm" + strconv.Itoa(n)
+		series, err := ms.QuerySeries(LabelMatcherSet{{Name: "node", Value: node}})
+		assert.NoError(t, err)
+		if len(series) > 0 {
+			values, err := ms.QueryLabelValues("node", nil)
+			assert.NoError(t, err)
+			assert.Contains(t, values, node)
+		}
+	}
+}
+
+func TestMemorySegment_HashCollision(t *testing.T) {
+	ms := newMemorySegment(newDefaultOptions()).(*memorySegment)
+
+	row := func(node string) *Row {
+		labels := LabelSet{{Name: "node", Value: node}}.AddMetricName("cpu.busy")
+		labels.Sorted()
+		for _, label := range labels {
+			ms.labelVs.Set(label.Name, label.Value)
+		}
+		return &Row{Metric: "cpu.busy", Labels: labels}
+	}
+
+	// 模拟两个不同的 LabelSet 哈希值相同
+	a := ms.getOrCreateSeries(row("vm0"), 1)
+	b := ms.getOrCreateSeries(row("vm1"), 1)
+	assert.NotEqual(t, a.ref, b.ref)
+	assert.True(t, a == ms.getOrCreateSeries(row("vm0"), 1))
+	assert.Equal(t, int64(2), ms.seriesCount)
+
+	assert.Equal(t, []uint32{b.ref}, ms.indexMap.MatchSids(ms.labelVs, LabelMatcherSet{{Name: "node", Value: "vm1"}}))
+	assert.Equal(t, []uint32{a.ref, b.ref}, ms.indexMap.MatchSids(ms.labelVs, LabelMatcherSet{{Name: "node", Value: "vm2", Type: MatchNotEqual}}))
+
+	assert.Equal(t, []Label{{Name: "node", Value: "vm0"}}, ms.removeSeries(a))
+	assert.Nil(t, ms.getSeries(a.ref))
+	assert.True(t, b == ms.getOrCreateSeries(row("vm1"), 1))
+	assert.Equal(t, []*memorySeries{b}, ms.hashes[1])
+	assert.Equal(t, int64(1), ms.seriesCount)
+}
+
+func TestTSDB_InsertRowsSync(t *testing.T) {
+	tmpdir := "/tmp/tsdb-sync"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir), WithEnabledOutdated(false), WithDuplicatePolicy(DuplicateReject))
+
+	var start int64 = 1600000000
+	rows := genPoints(start+60, 1, 0)
+	rows = append(rows,
+		&Row{Metric: "", Point: Point{Ts: start, Value: 1}},
+		&Row{Metric: "cpu.busy", Labels: LabelSet{{Name: "node", Value: "vm1"}, {Name: "dc", Value: "0"}}, Point: Point{Ts: start + 60, Value: 2}},
+		&Row{Metric: "cpu.busy", Labels: LabelSet{{Name: "node", Value: "vm1"}, {Name: "dc", Value: "0"}}, Point: Point{Ts: start, Value: 3}},
+	)
+
+	ret, err := store.InsertRowsSync(context.Background(), rows)
+	assert.NoError(t, err)
+	assert.Equal(t, len(metrics), ret.Inserted)
+	assert.Equal(t, 3, len(ret.Rejected))
+
+	n := len(metrics)
+	assert.Equal(t, RejectedRow{Index: n, Row: rows[n], Reason: RejectEmptyMetric}, ret.Rejected[0])
+	assert.Equal(t, n+1, ret.Rejected[1].Index)
+	assert.Equal(t, RejectDuplicate, ret.Rejected[1].Reason)
+	assert.Equal(t, n+2, ret.Rejected[2].Index)
+	assert.Equal(t, RejectOutOfOrder, ret.Rejected[2].Reason)
+	assert.Equal(t, LabelSet{{Name: "dc", Value: "0"}, {Name: "node", Value: "vm1"}}, ret.Rejected[2].Row.Labels)
+
+	// 返回时数据已经可以查询 不需要等待写入队列
+	series, err := store.QueryRange("cpu.busy", LabelMatcherSet{{Name: "node", Value: "vm1"}}, start, start+600)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(series))
+	assert.Equal(t, []Point{{Ts: start + 60, Value: float64(start + 60)}}, series[0].Points)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.InsertRowsSync(ctx, genPoints(start+120, 1, 0))
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	// 模拟进程崩溃 已经确认的数据可以从 WAL 中恢复
+	store.cancel()
+	assert.NoError(t, store.wal.Close())
+
+	store = OpenTSDB(WithDataPath(tmpdir), WithEnabledOutdated(false), WithDuplicatePolicy(DuplicateReject))
+	defer store.Close()
+
+	series, err = store.QueryRange("cpu.busy", LabelMatcherSet{{Name: "node", Value: "vm1"}}, start, start+600)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(series))
+	assert.Equal(t, []Point{{Ts: start + 60, Value: float64(start + 60)}}, series[0].Points)
+}
+
+func TestTSDB_Close(t *testing.T) {
+	tmpdir := "/tmp/tsdb-close"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+
+	// InsertRows 返回 nil 的 rows 在 Close 之后都可以查询到
+	var start int64 = 1600000000
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, store.InsertRows(genPoints(start+int64(i), 0, 0)))
+	}
+	store.Close()
+	store.Close()
+
+	assert.Equal(t, ErrClosed, store.InsertRows(genPoints(start+100, 0, 0)))
+	_, err := store.InsertRowsSync(context.Background(), genPoints(start+100, 0, 0))
+	assert.Equal(t, ErrClosed, err)
+
+	store = OpenTSDB(WithDataPath(tmpdir))
+	defer store.Close()
+
+	series, err := store.QueryRange("cpu.busy", nil, start, start+100)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(series))
+	assert.Equal(t, 100, len(series[0].Points))
+}
+
+func TestTSDB_DuplicatePolicy(t *testing.T) {
+	var start int64 = 1600000000
+	row := func(ts int64, value float64) []*Row {
+		return []*Row{{Metric: "cpu.busy", Labels: LabelSet{{Name: "node", Value: "vm0"}}, Point: Point{Ts: ts, Value: value}}}
+	}
+
+	for _, tc := range []struct {
+		policy   DuplicatePolicy
+		value    float64
+		inserted int
+		ignored  int
+		rejected []RejectReason
+	}{
+		{policy: DuplicateLastWriteWins, value: 2, inserted: 1},
+		{policy: DuplicateFirstWriteWins, value: 1, ignored: 1},
+		{policy: DuplicateReject, value: 1, rejected: []RejectReason{RejectDuplicate}},
+	} {
+		tmpdir := "/tmp/tsdb-duplicate"
+		store := OpenTSDB(WithDataPath(tmpdir), WithDuplicatePolicy(tc.policy))
+
+		_, err := store.InsertRowsSync(context.Background(), row(start+60, 1))
+		assert.NoError(t, err)
+		_, err = store.InsertRowsSync(context.Background(), row(start, 0))
+		assert.NoError(t, err)
+
+		ret, err := store.InsertRowsSync(context.Background(), row(start+60, 2))
+		assert.NoError(t, err)
+
+		var reasons []RejectReason
+		for _, r := range ret.Rejected {
+			reasons = append(reasons, r.Reason)
+		}
+		assert.Equal(t, tc.rejected, reasons)
+		assert.Equal(t, tc.inserted, ret.Inserted)
+		assert.Equal(t, tc.ignored, ret.Ignored)
+
+		series, err := store.QueryRange("cpu.busy", nil, start, start+600)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(series))
+		assert.Equal(t, []Point{{Ts: start, Value: 0}, {Ts: start + 60, Value: tc.value}}, series[0].Points)
+
+		store.Close()
+		os.RemoveAll(tmpdir)
+	}
+}
+
+func TestTSDB_OutOfOrderWindow(t *testing.T) {
+	tmpdir := "/tmp/tsdb-window"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir), WithOutOfOrderWindow(time.Minute))
+	defer store.Close()
+
+	var start int64 = 1600000000
+	rows := genPoints(start+600, 0, 0)
+	rows = append(rows, genPoints(start+590, 0, 0)[0], genPoints(start+500, 0, 0)[0])
+
+	ret, err := store.InsertRowsSync(context.Background(), rows)
+	assert.NoError(t, err)
+	assert.Equal(t, len(metrics)+1, ret.Inserted)
+	assert.Equal(t, 1, len(ret.Rejected))
+	assert.Equal(t, len(metrics)+1, ret.Rejected[0].Index)
+	assert.Equal(t, RejectOutOfWindow, ret.Rejected[0].Reason)
+
+	series, err := store.QueryRange("cpu.busy", nil, start, start+600)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(series))
+	assert.Equal(t, []Point{{Ts: start + 590, Value: float64(start + 590)}, {Ts: start + 600, Value: float64(start + 600)}}, series[0].Points)
+}
+
+func TestTSDB_OutOfOrderBlock(t *testing.T) {
+	tmpdir := "/tmp/tsdb-ooo"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+
+	var start int64 = 1600000000
+	for _, ts := range []int64{start, start + 60, start + 7260, start + 7320} {
+		_, err := store.InsertRowsSync(context.Background(), genPoints(ts, 0, 0))
+		assert.NoError(t, err)
+	}
+	store.wg.Wait()
+	assert.Equal(t, start+7260, store.segs.MaxTs())
+
+	// 落在已经持久化的时间区间内的数据点写入 ooo 不会拉大 head 的时间区间
+	rows := genPoints(start+60, 0, 0)
+	for _, row := range rows {
+		row.Point.Value = 1
+	}
+	ret, err := store.InsertRowsSync(context.Background(), append(rows, genPoints(start+30, 0, 0)...))
+	assert.NoError(t, err)
+	assert.Equal(t, 2*len(metrics), ret.Inserted)
+	assert.Equal(t, start+7320, store.segs.head.MinTs())
+	assert.NotNil(t, store.segs.ooo)
+
+	expected := []Point{
+		{Ts: start, Value: float64(start)},
+		{Ts: start + 30, Value: float64(start + 30)},
+		{Ts: start + 60, Value: 1},
+		{Ts: start + 7260, Value: float64(start + 7260)},
+		{Ts: start + 7320, Value: float64(start + 7320)},
+	}
+
+	series, err := store.QueryRange("cpu.busy", nil, start, start+7320)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(series))
+	assert.Equal(t, expected, series[0].Points)
+
+	store.Close()
+
+	// ooo 持久化成独立的 segment 与原来的 segment MinTs 相同 重启后仍以较新的数据为准
+	store = OpenTSDB(WithDataPath(tmpdir), WithDuplicatePolicy(DuplicateReject))
+	assert.Equal(t, 3, len(store.segs.All()))
+
+	series, err = store.QueryRange("cpu.busy", nil, start, start+7320)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(series))
+	assert.Equal(t, expected, series[0].Points)
+
+	ret, err = store.InsertRowsSync(context.Background(), genPoints(start+60, 0, 0)[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret.Rejected))
+	assert.Equal(t, RejectDuplicate, ret.Rejected[0].Reason)
+	store.Close()
+
+	// 已经持久化的重复数据点在 FirstWriteWins 下被忽略 不计入写入数量
+	store = OpenTSDB(WithDataPath(tmpdir), WithDuplicatePolicy(DuplicateFirstWriteWins))
+	defer store.Close()
+
+	ret, err = store.InsertRowsSync(context.Background(), genPoints(start+60, 0, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, ret.Inserted)
+	assert.Equal(t, len(metrics), ret.Ignored)
+	assert.Empty(t, ret.Rejected)
+}
@@ -0,0 +1,447 @@
+package mandodb
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/chenjiandongx/logger"
+)
+
+// WAL 文件布局
+//
+// wal/
+// ├── 00000001
+// ├── 00000002
+// └── 00000003
+//
+// 每个文件由若干条 record 组成 一条 record 对应一次 InsertRows 的 Row 批次或者一次 DeleteSeries 操作
+// ┌────────────────┬────────────────┬──────────────────────┐
+// │ crc32 (uint32) │ size (uint32)  │ payload (size bytes) │
+// └────────────────┴────────────────┴──────────────────────┘
+//
+// payload 编码 长度以及数量都使用 uint16 超出 maxRowFieldSize 的 Row 在写入 WAL 之前就会被拒绝:
+// rowCount(uint32) | { metricLen(uint16) metric labelCount(uint16) { nameLen(uint16) name valueLen(uint16) value }... ts(uint64) value(uint64) }...
+//
+// DeleteSeries 的 payload 以 walDeletionMarker 开头 用于和 Row 批次区分:
+// marker(uint32) | matcherCount(uint16) | { type(uint8) nameLen(uint16) name valueLen(uint16) value }... | start(uint64) | end(uint64)
+
+const (
+	walDirname        = "wal"
+	walRecordHeadSize = uint32Size * 2
+	walSegmentSize    = 64 * 1024 * 1024 // 64MB
+
+	walDeletionMarker uint32 = math.MaxUint32
+)
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errWALCorrupted = errors.New("wal record corrupted")
+)
+
+// wal 负责记录所有写入 head memorySegment 的数据 用于进程异常退出后恢复
+type wal struct {
+	mut  sync.Mutex
+	dir  string
+	fd   *os.File
+	seq  int
+	size int64
+}
+
+func walFilename(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d", seq))
+}
+
+// openWAL 打开 wal 文件夹 新的写入总是落在一个新的文件中
+func openWAL(dir string) (*wal, error) {
+	mkdir(dir)
+
+	seqs, err := listWALSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{dir: dir}
+	if len(seqs) > 0 {
+		w.seq = seqs[len(seqs)-1]
+	}
+
+	if err := w.nextSegment(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func listWALSegments(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]int, 0, len(files))
+	for _, file := range files {
+		seq, err := strconv.Atoi(file.Name())
+		if err != nil || file.IsDir() {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+func (w *wal) nextSegment() error {
+	if w.fd != nil {
+		if err := w.fd.Sync(); err != nil {
+			return err
+		}
+		if err := w.fd.Close(); err != nil {
+			return err
+		}
+	}
+
+	w.seq++
+	fd, err := os.OpenFile(walFilename(w.dir, w.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.fd = fd
+	w.size = 0
+	return nil
+}
+
+// walDeletion 记录一次 DeleteSeries 操作 回放时需要按照顺序在 head 上重新执行
+type walDeletion struct {
+	lms   LabelMatcherSet
+	start int64
+	end   int64
+}
+
+// Log 将一批 Row 写入 wal 需要在数据写入 head 之前调用
+func (w *wal) Log(rows []*Row) error {
+	return w.logRecord(encodeWALRows(rows))
+}
+
+// LogDeletion 将一次 DeleteSeries 操作写入 wal
+func (w *wal) LogDeletion(d walDeletion) error {
+	return w.logRecord(encodeWALDeletion(d))
+}
+
+func (w *wal) logRecord(payload []byte) error {
+	encf := newEncbuf()
+	encf.MarshalUint32(crc32.Checksum(payload, castagnoliTable))
+	encf.MarshalUint32(uint32(len(payload)))
+	encf.MarshalBytes(payload)
+
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if w.size+int64(encf.Len()) > walSegmentSize && w.size > 0 {
+		if err := w.nextSegment(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.fd.Write(encf.Bytes())
+	w.size += int64(n)
+	return err
+}
+
+// Sync 将 wal 数据刷到磁盘
+func (w *wal) Sync() error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	return w.fd.Sync()
+}
+
+// Cut 关闭当前 wal 文件并切换到新文件 返回被关闭文件的序号
+// 序号小于等于该值的文件所记录的数据都属于当前 head
+func (w *wal) Cut() (int, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	seq := w.seq
+	if err := w.nextSegment(); err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+// Truncate 删除序号小于等于 seq 的 wal 文件 在对应 segment 持久化后调用
+func (w *wal) Truncate(seq int) error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	seqs, err := listWALSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range seqs {
+		if s > seq || s == w.seq {
+			continue
+		}
+
+		if err := os.Remove(walFilename(w.dir, s)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replay 按顺序回放序号大于 after 的 wal 文件 onDeletion 为 nil 时忽略删除操作
+// 文件末尾不完整或者校验失败的 record 会被丢弃（通常是写入过程中进程崩溃导致的）
+func (w *wal) Replay(after int, onRows func(rows []*Row), onDeletion func(d walDeletion)) error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	seqs, err := listWALSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range seqs {
+		if seq <= after || seq == w.seq {
+			continue
+		}
+
+		fname := walFilename(w.dir, seq)
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+
+		if err := replayWALSegment(data, onRows, onDeletion); err != nil {
+			logger.Warnf("wal file %s is corrupted, the remaining records are dropped: %v", fname, err)
+		}
+	}
+
+	return nil
+}
+
+func replayWALSegment(data []byte, onRows func(rows []*Row), onDeletion func(d walDeletion)) error {
+	decf := newDecbuf()
+
+	offset := 0
+	for offset < len(data) {
+		if len(data)-offset < walRecordHeadSize {
+			return errWALCorrupted
+		}
+
+		checksum := decf.UnmarshalUint32(data[offset : offset+uint32Size])
+		size := int(decf.UnmarshalUint32(data[offset+uint32Size : offset+walRecordHeadSize]))
+		offset += walRecordHeadSize
+
+		if len(data)-offset < size {
+			return errWALCorrupted
+		}
+
+		payload := data[offset : offset+size]
+		offset += size
+
+		if crc32.Checksum(payload, castagnoliTable) != checksum {
+			return errWALCorrupted
+		}
+
+		if len(payload) >= uint32Size && decf.UnmarshalUint32(payload[:uint32Size]) == walDeletionMarker {
+			d, err := decodeWALDeletion(payload)
+			if err != nil {
+				return err
+			}
+
+			if onDeletion != nil {
+				onDeletion(d)
+			}
+			continue
+		}
+
+		rows, err := decodeWALRows(payload)
+		if err != nil {
+			return err
+		}
+
+		onRows(rows)
+	}
+
+	return nil
+}
+
+// Close 关闭 wal 文件句柄
+func (w *wal) Close() error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if err := w.fd.Sync(); err != nil {
+		return err
+	}
+
+	return w.fd.Close()
+}
+
+func encodeWALRows(rows []*Row) []byte {
+	encf := newEncbuf()
+	encf.MarshalUint32(uint32(len(rows)))
+
+	for _, row := range rows {
+		encf.MarshalUint16(uint16(len(row.Metric)))
+		encf.MarshalString(row.Metric)
+
+		encf.MarshalUint16(uint16(len(row.Labels)))
+		for _, label := range row.Labels {
+			encf.MarshalUint16(uint16(len(label.Name)))
+			encf.MarshalString(label.Name)
+			encf.MarshalUint16(uint16(len(label.Value)))
+			encf.MarshalString(label.Value)
+		}
+
+		encf.MarshalUint64(uint64(row.Point.Ts), math.Float64bits(row.Point.Value))
+	}
+
+	return encf.Bytes()
+}
+
+func decodeWALRows(data []byte) ([]*Row, error) {
+	decf := newDecbuf()
+
+	offset := 0
+	readString := func() string {
+		if len(data)-offset < uint16Size {
+			offset = len(data) + 1
+			return ""
+		}
+		size := int(decf.UnmarshalUint16(data[offset : offset+uint16Size]))
+		offset += uint16Size
+
+		if len(data)-offset < size {
+			offset = len(data) + 1
+			return ""
+		}
+		s := string(data[offset : offset+size])
+		offset += size
+		return s
+	}
+
+	if len(data) < uint32Size {
+		return nil, errWALCorrupted
+	}
+	rowCnt := int(decf.UnmarshalUint32(data[:uint32Size]))
+	offset += uint32Size
+
+	rows := make([]*Row, 0, rowCnt)
+	for i := 0; i < rowCnt; i++ {
+		row := &Row{Metric: readString()}
+
+		if len(data)-offset < uint16Size {
+			return nil, errWALCorrupted
+		}
+		labelCnt := int(decf.UnmarshalUint16(data[offset : offset+uint16Size]))
+		offset += uint16Size
+
+		row.Labels = make(LabelSet, 0, labelCnt)
+		for j := 0; j < labelCnt; j++ {
+			row.Labels = append(row.Labels, Label{Name: readString(), Value: readString()})
+		}
+
+		if len(data)-offset < uint64Size*2 {
+			return nil, errWALCorrupted
+		}
+		row.Point.Ts = int64(decf.UnmarshalUint64(data[offset : offset+uint64Size]))
+		offset += uint64Size
+		row.Point.Value = math.Float64frombits(decf.UnmarshalUint64(data[offset : offset+uint64Size]))
+		offset += uint64Size
+
+		rows = append(rows, row)
+	}
+
+	return rows, decf.Err()
+}
+
+func encodeWALDeletion(d walDeletion) []byte {
+	encf := newEncbuf()
+	encf.MarshalUint32(walDeletionMarker)
+
+	encf.MarshalUint16(uint16(len(d.lms)))
+	for _, lm := range d.lms {
+		encf.MarshalUint8(uint8(lm.Type))
+		encf.MarshalUint16(uint16(len(lm.Name)))
+		encf.MarshalString(lm.Name)
+		encf.MarshalUint16(uint16(len(lm.Value)))
+		encf.MarshalString(lm.Value)
+	}
+
+	encf.MarshalUint64(uint64(d.start), uint64(d.end))
+	return encf.Bytes()
+}
+
+func decodeWALDeletion(data []byte) (walDeletion, error) {
+	decf := newDecbuf()
+
+	var d walDeletion
+	offset := uint32Size
+	readUint16 := func() (int, bool) {
+		if len(data)-offset < uint16Size {
+			return 0, false
+		}
+		n := int(decf.UnmarshalUint16(data[offset : offset+uint16Size]))
+		offset += uint16Size
+		return n, true
+	}
+
+	readString := func() (string, bool) {
+		size, ok := readUint16()
+		if !ok || len(data)-offset < size {
+			return "", false
+		}
+		s := string(data[offset : offset+size])
+		offset += size
+		return s, true
+	}
+
+	cnt, ok := readUint16()
+	if !ok {
+		return d, errWALCorrupted
+	}
+
+	d.lms = make(LabelMatcherSet, 0, cnt)
+	for i := 0; i < cnt; i++ {
+		if len(data)-offset < 1 {
+			return d, errWALCorrupted
+		}
+		t := MatchType(data[offset])
+		offset++
+
+		name, ok := readString()
+		if !ok {
+			return d, errWALCorrupted
+		}
+		value, ok := readString()
+		if !ok {
+			return d, errWALCorrupted
+		}
+
+		d.lms = append(d.lms, LabelMatcher{Name: name, Value: value, Type: t})
+	}
+
+	if len(data)-offset < uint64Size*2 {
+		return d, errWALCorrupted
+	}
+	d.start = int64(decf.UnmarshalUint64(data[offset : offset+uint64Size]))
+	offset += uint64Size
+	d.end = int64(decf.UnmarshalUint64(data[offset : offset+uint64Size]))
+
+	return d, decf.Err()
+}
@@ -0,0 +1,205 @@
+package mandodb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_Replay(t *testing.T) {
+	tmpdir := "/tmp/tsdb-wal1"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+
+	var start int64 = 1600000000
+	for i := 0; i < 10; i++ {
+		_ = store.InsertRows(genPoints(start+int64(i*60), 1, 0))
+	}
+	// 乱序写入的数据点
+	_ = store.InsertRows(genPoints(start+30, 1, 0))
+
+	time.Sleep(time.Millisecond * 20)
+
+	// 模拟进程崩溃 head 中的数据没有持久化
+	store.cancel()
+	assert.NoError(t, store.wal.Close())
+
+	store = OpenTSDB(WithDataPath(tmpdir))
+	defer store.Close()
+
+	ret, err := store.QueryRange("cpu.busy", LabelMatcherSet{{Name: "node", Value: "vm1"}}, start, start+600)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, 11, len(ret[0].Points))
+}
+
+func TestWAL_CorruptedTail(t *testing.T) {
+	tmpdir := "/tmp/tsdb-wal2"
+	defer os.RemoveAll(tmpdir)
+
+	w, err := openWAL(tmpdir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.Log(genPoints(1600000000, 0, 0)))
+	assert.NoError(t, w.Log(genPoints(1600000060, 0, 0)))
+	assert.NoError(t, w.Close())
+
+	// 截断最后一条 record 模拟写入过程中崩溃
+	fname := walFilename(tmpdir, w.seq)
+	info, err := os.Stat(fname)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(fname, info.Size()-3))
+
+	w, err = openWAL(tmpdir)
+	assert.NoError(t, err)
+	defer w.Close()
+
+	var batches int
+	assert.NoError(t, w.Replay(0, func(rows []*Row) {
+		batches++
+		assert.Equal(t, len(metrics), len(rows))
+		assert.Equal(t, "vm0", rows[0].Labels[0].Value)
+	}, nil))
+	assert.Equal(t, 1, batches)
+
+	files, err := filepath.Glob(filepath.Join(tmpdir, "*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+}
+
+func TestWAL_OversizedRows(t *testing.T) {
+	tmpdir := "/tmp/tsdb-wal3"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+
+	var start int64 = 1600000000
+	long := strings.Repeat("x", maxRowFieldSize+1)
+	rows := []*Row{
+		{Metric: long, Point: Point{Ts: start, Value: 1}},
+		{Metric: "up", Labels: LabelSet{{Name: "job", Value: long}}, Point: Point{Ts: start, Value: 1}},
+		{Metric: "up", Labels: LabelSet{{Name: "job", Value: "api"}}, Point: Point{Ts: start, Value: 1}},
+	}
+
+	ret, err := store.InsertRowsSync(context.Background(), rows)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ret.Inserted)
+	assert.Equal(t, 2, len(ret.Rejected))
+	for i, r := range ret.Rejected {
+		assert.Equal(t, i, r.Index)
+		assert.Equal(t, RejectOversized, r.Reason)
+	}
+
+	// 超出长度限制的 rows 不会写入 WAL 回放后只有合法的数据
+	store.cancel()
+	assert.NoError(t, store.wal.Close())
+
+	store = OpenTSDB(WithDataPath(tmpdir))
+	defer store.Close()
+
+	series, err := store.QuerySeries(nil, start, start)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"__name__": "up", "job": "api"}}, series)
+}
+
+func TestWAL_TruncatePending(t *testing.T) {
+	tmpdir := "/tmp/tsdb-wal4"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+
+	var start int64 = 1600000000
+	_, err := store.InsertRowsSync(context.Background(), genPoints(start, 0, 0))
+	assert.NoError(t, err)
+	seq1, err := store.wal.Cut()
+	assert.NoError(t, err)
+	store.addPendingWAL(seq1)
+
+	_, err = store.InsertRowsSync(context.Background(), genPoints(start+60, 0, 0))
+	assert.NoError(t, err)
+	seq2, err := store.wal.Cut()
+	assert.NoError(t, err)
+	store.addPendingWAL(seq2)
+
+	// 较新的 segment 先持久化完成 更早的 WAL 仍然需要保留
+	store.truncateWAL(seq2)
+	seqs, err := listWALSegments(store.wal.dir)
+	assert.NoError(t, err)
+	assert.Contains(t, seqs, seq1)
+	assert.Contains(t, seqs, seq2)
+
+	// 磁盘上存在 WalSeq 更大的 segment 时 回放也不能跳过更早的 WAL
+	ms := newMemorySegment(store.opts).(*memorySegment)
+	ms.InsertRows(genPoints(start+60, 0, 0))
+	ms.walSeq = seq2
+	_, err = writeToDisk(ms)
+	assert.NoError(t, err)
+
+	store.cancel()
+	store.ingestWg.Wait()
+	assert.NoError(t, store.wal.Close())
+
+	store = OpenTSDB(WithDataPath(tmpdir))
+
+	// 只有没有持久化的数据点会写入 ooo
+	assert.Equal(t, int64(len(metrics)), store.segs.ooo.(*memorySegment).dataPointsCount)
+
+	ret, err := store.QueryRange("cpu.busy", LabelMatcherSet{{Name: "node", Value: "vm0"}}, start, start+60)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, []Point{{Ts: start, Value: float64(start)}, {Ts: start + 60, Value: float64(start + 60)}}, ret[0].Points)
+
+	store.Close()
+
+	// 所有数据都持久化后 WAL 被清理
+	seqs, err = listWALSegments(filepath.Join(tmpdir, walDirname))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(seqs))
+}
+
+func TestWAL_ReplayPersisted(t *testing.T) {
+	tmpdir := "/tmp/tsdb-wal5"
+	defer os.RemoveAll(tmpdir)
+
+	store := OpenTSDB(WithDataPath(tmpdir))
+
+	var start int64 = 1600000000
+	ms := newMemorySegment(store.opts).(*memorySegment)
+	for _, ts := range []int64{start, start + 60} {
+		_, err := store.InsertRowsSync(context.Background(), genPoints(ts, 0, 0))
+		assert.NoError(t, err)
+		ms.InsertRows(genPoints(ts, 0, 0))
+	}
+
+	// 模拟数据已经持久化但还没来得及删除 WAL 时进程崩溃
+	seq, err := store.wal.Cut()
+	assert.NoError(t, err)
+	ms.walSeq = seq
+	_, err = writeToDisk(ms)
+	assert.NoError(t, err)
+
+	store.cancel()
+	store.ingestWg.Wait()
+	assert.NoError(t, store.wal.Close())
+
+	store = OpenTSDB(WithDataPath(tmpdir))
+	assert.Nil(t, store.segs.ooo)
+
+	ret, err := store.QueryRange("cpu.busy", LabelMatcherSet{{Name: "node", Value: "vm0"}}, start, start+60)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, []Point{{Ts: start, Value: float64(start)}, {Ts: start + 60, Value: float64(start + 60)}}, ret[0].Points)
+
+	store.Close()
+
+	// 已经持久化的数据不会再次持久化成新的 segment
+	dirs, err := filepath.Glob(filepath.Join(tmpdir, "seg-*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dirs))
+}